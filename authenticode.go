@@ -0,0 +1,619 @@
+package main
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"unicode/utf16"
+)
+
+// Authenticode object identifiers
+var (
+	oidSpcIndirectDataContent = asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 311, 2, 1, 4}
+	oidSpcStatementType       = asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 311, 2, 1, 11}
+	oidSpcSpOpusInfo          = asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 311, 2, 1, 12}
+	oidSpcPEImageData         = asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 311, 2, 1, 15}
+	oidSpcIndividualCodeSign  = asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 311, 2, 1, 21}
+	oidNestedSignature        = asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 311, 2, 4, 1}
+)
+
+// spcAttributeTypeAndValue is the SpcAttributeTypeAndOptionalValue structure
+type spcAttributeTypeAndValue struct {
+	Type  asn1.ObjectIdentifier
+	Value asn1.RawValue `asn1:"optional"`
+}
+
+// spcDigestInfo is the DigestInfo embedded in SpcIndirectDataContent
+type spcDigestInfo struct {
+	DigestAlgorithm pkix.AlgorithmIdentifier
+	Digest          []byte
+}
+
+// spcIndirectDataContent is the content signed by an Authenticode signature
+type spcIndirectDataContent struct {
+	Data          spcAttributeTypeAndValue
+	MessageDigest spcDigestInfo
+}
+
+// spcSpOpusInfo carries the optional program name and URL of a signature
+type spcSpOpusInfo struct {
+	ProgramName asn1.RawValue `asn1:"optional,explicit,tag:0"`
+	MoreInfo    asn1.RawValue `asn1:"optional,explicit,tag:1"`
+}
+
+// spcPEImageDataDER returns the SpcPeImageData value used by signtool:
+// empty flags and a file link holding the "<<<Obsolete>>>" string
+func spcPEImageDataDER() []byte {
+	obsolete := utf16.Encode([]rune("<<<Obsolete>>>"))
+	bmp := make([]byte, 0, len(obsolete)*2)
+	for _, r := range obsolete {
+		bmp = append(bmp, byte(r>>8), byte(r))
+	}
+
+	// SpcString unicode [0] IMPLICIT BMPString
+	spcString, _ := asn1.Marshal(asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 0, Bytes: bmp})
+	// SpcLink file [2] EXPLICIT SpcString
+	spcLink, _ := asn1.Marshal(asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 2, IsCompound: true, Bytes: spcString})
+	// SpcPeImageData file [0] EXPLICIT SpcLink
+	file, _ := asn1.Marshal(asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 0, IsCompound: true, Bytes: spcLink})
+	flags, _ := asn1.Marshal(asn1.BitString{})
+
+	der, _ := asn1.Marshal(asn1.RawValue{Class: asn1.ClassUniversal, Tag: asn1.TagSequence, IsCompound: true, Bytes: append(flags, file...)})
+	return der
+}
+
+// createAuthenticodeSignature builds the PKCS#7 SignedData for a PE image digest
+func createAuthenticodeSignature(cert *Certificate, imageDigest []byte, hash crypto.Hash) ([]byte, error) {
+	digestAlg, err := digestAlgorithmID(hash)
+	if err != nil {
+		return nil, err
+	}
+
+	content := spcIndirectDataContent{
+		Data: spcAttributeTypeAndValue{
+			Type:  oidSpcPEImageData,
+			Value: asn1.RawValue{FullBytes: spcPEImageDataDER()},
+		},
+		MessageDigest: spcDigestInfo{
+			DigestAlgorithm: digestAlg,
+			Digest:          imageDigest,
+		},
+	}
+	contentDER, err := asn1.Marshal(content)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode SpcIndirectDataContent: %w", err)
+	}
+
+	// Authenticode hashes the content octets without the outer SEQUENCE header
+	var contentValue asn1.RawValue
+	if _, err := asn1.Unmarshal(contentDER, &contentValue); err != nil {
+		return nil, fmt.Errorf("failed to decode SpcIndirectDataContent: %w", err)
+	}
+	h := hash.New()
+	h.Write(contentValue.Bytes)
+
+	statementType, err := newCMSAttribute(oidSpcStatementType, []asn1.ObjectIdentifier{oidSpcIndividualCodeSign})
+	if err != nil {
+		return nil, err
+	}
+	opusInfo, err := newCMSAttribute(oidSpcSpOpusInfo, spcSpOpusInfo{})
+	if err != nil {
+		return nil, err
+	}
+
+	return createSignedData(cert, cmsSignOptions{
+		ContentType:      oidSpcIndirectDataContent,
+		Content:          contentDER,
+		MessageDigest:    h.Sum(nil),
+		Hash:             hash,
+		SignedAttributes: []cmsAttribute{statementType, opusInfo},
+	})
+}
+
+// signPEFile embeds Authenticode signatures into a PE file, one per
+// requested digest, either replacing or nesting under existing signatures
+func signPEFile(filename string, cert *Certificate, opts *signOptions) error {
+	info, err := os.Stat(filename)
+	if err != nil {
+		return fmt.Errorf("failed to stat file: %w", err)
+	}
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return fmt.Errorf("failed to read file: %w", err)
+	}
+
+	img, err := parsePEImage(data)
+	if err != nil {
+		return fmt.Errorf("failed to parse PE file: %w", err)
+	}
+
+	// The digest never covers the certificate table, so existing signatures
+	// can stay in place while we compute ours
+	var entries []winCertificate
+	var sigs []*signedData
+	signatureIndex := 0
+	if opts.Append && img.hasCertificateTable() {
+		if entries, err = img.certificates(); err != nil {
+			return fmt.Errorf("failed to parse certificate table: %w", err)
+		}
+		signatureIndex = len(entries)
+		for i, entry := range entries {
+			if entry.CertificateType == winCertTypePKCSSignedData {
+				existing, err := splitNestedSignatures(entry.Certificate)
+				if err != nil {
+					return fmt.Errorf("failed to parse existing signature: %w", err)
+				}
+				// Our own earlier signatures are replaced, not nested again
+				for _, sd := range existing {
+					if signer, err := signedDataSigner(sd); err != nil || !signer.Equal(cert.Cert) {
+						sigs = append(sigs, sd)
+					}
+				}
+				signatureIndex = i
+				break
+			}
+		}
+	}
+
+	seen := make(map[crypto.Hash]bool)
+	for _, requested := range opts.Digests {
+		// Ed25519 keys sign with SHA-512 whatever digest is requested
+		hash := cmsDigestFor(cert.Cert.PublicKey, requested)
+		if seen[hash] {
+			continue
+		}
+		seen[hash] = true
+
+		der, err := createAuthenticodeSignature(cert, img.authenticodeDigest(hash), hash)
+		if err != nil {
+			return fmt.Errorf("failed to create Authenticode signature: %w", err)
+		}
+		sd, err := parseSignedData(der)
+		if err != nil {
+			return err
+		}
+		if opts.TimestampURL != "" {
+			if err := addTimestamp(sd, opts.TimestampURL); err != nil {
+				return fmt.Errorf("failed to time-stamp signature: %w", err)
+			}
+		}
+		sigs = append(sigs, sd)
+	}
+
+	signature, err := joinNestedSignatures(sigs)
+	if err != nil {
+		return fmt.Errorf("failed to encode signatures: %w", err)
+	}
+	entry := winCertificate{
+		Revision:        winCertRevision2_0,
+		CertificateType: winCertTypePKCSSignedData,
+		Certificate:     signature,
+	}
+	if signatureIndex < len(entries) {
+		entries[signatureIndex] = entry
+	} else {
+		entries = append(entries, entry)
+	}
+
+	if err := os.WriteFile(filename, img.withCertificates(entries), info.Mode().Perm()); err != nil {
+		return fmt.Errorf("failed to write signed file: %w", err)
+	}
+
+	return nil
+}
+
+// isPEFile reports whether the named file is a PE image
+func isPEFile(filename string) bool {
+	return classifyFile(filename).Kind == fileKindPE
+}
+
+// verifyPEFile verifies the embedded Authenticode signature of a PE file
+func verifyPEFile(filename string) (*SignatureStatus, error) {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read file: %w", err)
+	}
+
+	img, err := parsePEImage(data)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse PE file: %w", err)
+	}
+	if !img.hasCertificateTable() {
+		return &SignatureStatus{Status: StatusNotSigned}, nil
+	}
+
+	certs, err := img.certificates()
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse certificate table: %w", err)
+	}
+	for _, entry := range certs {
+		if entry.CertificateType != winCertTypePKCSSignedData {
+			continue
+		}
+		status, err := verifyAuthenticodeSignature(img, entry.Certificate)
+		if err != nil {
+			return nil, err
+		}
+		if err := verifyNestedSignatures(img, entry.Certificate, status); err != nil {
+			return nil, err
+		}
+		return status, nil
+	}
+
+	return &SignatureStatus{Status: StatusNotSigned}, nil
+}
+
+// verifyNestedSignatures verifies the signatures nested in a primary one
+// into status.Nested. A nested signature that is broken, rather than just
+// untrusted, makes the file's status that of the broken signature
+func verifyNestedSignatures(img *peImage, der []byte, status *SignatureStatus) error {
+	sigs, err := splitNestedSignatures(der)
+	if err != nil {
+		return fmt.Errorf("failed to decode nested signatures: %w", err)
+	}
+	for _, sd := range sigs[1:] {
+		nestedDER, err := marshalSignedData(*sd)
+		if err != nil {
+			return err
+		}
+		nested, err := verifyAuthenticodeSignature(img, nestedDER)
+		if err != nil {
+			return fmt.Errorf("failed to verify nested signature: %w", err)
+		}
+		status.Nested = append(status.Nested, nested)
+
+		if isBrokenStatus(nested.Status) && !isBrokenStatus(status.Status) {
+			status.Status = nested.Status
+		}
+	}
+	return nil
+}
+
+// isBrokenStatus reports whether a signature status means the file or the
+// signature was changed after signing
+func isBrokenStatus(status string) bool {
+	return status == StatusHashMismatch || status == StatusBadSignature
+}
+
+// verifyAuthenticodeSignature checks a PKCS#7 Authenticode signature against a PE image
+func verifyAuthenticodeSignature(img *peImage, der []byte) (*SignatureStatus, error) {
+	sd, err := parseSignedData(der)
+	if err != nil {
+		return nil, err
+	}
+	if !sd.ContentInfo.ContentType.Equal(oidSpcIndirectDataContent) {
+		return nil, fmt.Errorf("signature content is not SpcIndirectDataContent")
+	}
+	if len(sd.SignerInfos) != 1 {
+		return nil, fmt.Errorf("expected one signer, found %d", len(sd.SignerInfos))
+	}
+	si := &sd.SignerInfos[0]
+
+	certs, err := x509.ParseCertificates(sd.Certificates.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse signature certificates: %w", err)
+	}
+	signer, err := findSignerCertificate(certs, si.IssuerAndSerialNumber)
+	if err != nil {
+		return nil, err
+	}
+
+	status := &SignatureStatus{
+		SignerCertificate: signer.Subject.CommonName,
+		SignerFingerprint: certificateFingerprint(signer),
+		SignerExpires:     signer.NotAfter,
+		IsSelfSigned:      isSelfSignedCertificate(signer),
+	}
+
+	// The encapsulated content is the SpcIndirectDataContent SEQUENCE
+	var contentValue asn1.RawValue
+	if _, err := asn1.Unmarshal(sd.ContentInfo.Content.Bytes, &contentValue); err != nil {
+		return nil, fmt.Errorf("failed to decode signed content: %w", err)
+	}
+	var content spcIndirectDataContent
+	if _, err := asn1.Unmarshal(contentValue.FullBytes, &content); err != nil {
+		return nil, fmt.Errorf("failed to decode SpcIndirectDataContent: %w", err)
+	}
+
+	imageHash, err := hashFromAlgorithmID(content.MessageDigest.DigestAlgorithm)
+	if err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(img.authenticodeDigest(imageHash), content.MessageDigest.Digest) {
+		status.Status = StatusHashMismatch
+		return status, nil
+	}
+
+	signerHash, err := hashFromAlgorithmID(si.DigestAlgorithm)
+	if err != nil {
+		return nil, err
+	}
+	h := signerHash.New()
+	h.Write(contentValue.Bytes)
+
+	if err := verifySignerInfo(si, signer, h.Sum(nil)); err != nil {
+		if errors.Is(err, errMessageDigestMismatch) || errors.Is(err, errBadSignature) {
+			status.Status = StatusBadSignature
+			return status, nil
+		}
+		return nil, err
+	}
+
+	applySignerTrust(status, si, signer, certs)
+	return status, nil
+}
+
+// splitNestedSignatures decodes a signature and every signature nested in
+// its unsigned attributes, returning them outermost first with the nesting removed
+func splitNestedSignatures(der []byte) ([]*signedData, error) {
+	sd, err := parseSignedData(der)
+	if err != nil {
+		return nil, err
+	}
+	if len(sd.SignerInfos) != 1 {
+		return nil, fmt.Errorf("expected one signer, found %d", len(sd.SignerInfos))
+	}
+
+	si := &sd.SignerInfos[0]
+	attrs, err := parseAttributes(si.UnauthenticatedAttributes)
+	if err != nil {
+		return nil, err
+	}
+
+	var nested [][]byte
+	var kept []cmsAttribute
+	for _, attr := range attrs {
+		if !attr.Type.Equal(oidNestedSignature) {
+			kept = append(kept, attr)
+			continue
+		}
+		rest := attr.Values.Bytes
+		for len(rest) > 0 {
+			var value asn1.RawValue
+			if rest, err = asn1.Unmarshal(rest, &value); err != nil {
+				return nil, fmt.Errorf("failed to decode nested signature: %w", err)
+			}
+			nested = append(nested, value.FullBytes)
+		}
+	}
+	if err := setUnsignedAttributes(si, kept); err != nil {
+		return nil, err
+	}
+
+	sigs := []*signedData{sd}
+	for _, nestedDER := range nested {
+		inner, err := splitNestedSignatures(nestedDER)
+		if err != nil {
+			return nil, err
+		}
+		sigs = append(sigs, inner...)
+	}
+	return sigs, nil
+}
+
+// joinNestedSignatures encodes the first signature with all others nested
+// in its unsigned attributes
+func joinNestedSignatures(sigs []*signedData) ([]byte, error) {
+	primary := sigs[0]
+	if len(sigs) > 1 {
+		var nested [][]byte
+		for _, sd := range sigs[1:] {
+			der, err := marshalSignedData(*sd)
+			if err != nil {
+				return nil, err
+			}
+			nested = append(nested, der)
+		}
+		sort.Slice(nested, func(i, j int) bool {
+			return bytes.Compare(nested[i], nested[j]) < 0
+		})
+
+		si := &primary.SignerInfos[0]
+		attrs, err := parseAttributes(si.UnauthenticatedAttributes)
+		if err != nil {
+			return nil, err
+		}
+		attrs = append(attrs, cmsAttribute{
+			Type:   oidNestedSignature,
+			Values: asn1.RawValue{Class: asn1.ClassUniversal, Tag: asn1.TagSet, IsCompound: true, Bytes: bytes.Join(nested, nil)},
+		})
+		if err := setUnsignedAttributes(si, attrs); err != nil {
+			return nil, err
+		}
+	}
+	return marshalSignedData(*primary)
+}
+
+// signedDataSigner returns the certificate that produced a single-signer SignedData
+func signedDataSigner(sd *signedData) (*x509.Certificate, error) {
+	if len(sd.SignerInfos) != 1 {
+		return nil, fmt.Errorf("expected one signer, found %d", len(sd.SignerInfos))
+	}
+	certs, err := x509.ParseCertificates(sd.Certificates.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse signature certificates: %w", err)
+	}
+	return findSignerCertificate(certs, sd.SignerInfos[0].IssuerAndSerialNumber)
+}
+
+// verifyOwnPESignatures verifies the Authenticode signatures of a PE file
+// made with cert, nested ones included, keyed by the digest they sign with.
+// Signatures that can't be decoded are not ours and are left out
+func verifyOwnPESignatures(filename string, cert *x509.Certificate) (map[crypto.Hash]*SignatureStatus, error) {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read file: %w", err)
+	}
+	img, err := parsePEImage(data)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse PE file: %w", err)
+	}
+
+	own := make(map[crypto.Hash]*SignatureStatus)
+	if !img.hasCertificateTable() {
+		return own, nil
+	}
+	entries, err := img.certificates()
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse certificate table: %w", err)
+	}
+
+	fingerprint := certificateFingerprint(cert)
+	for _, entry := range entries {
+		if entry.CertificateType != winCertTypePKCSSignedData {
+			continue
+		}
+		sigs, err := splitNestedSignatures(entry.Certificate)
+		if err != nil {
+			continue
+		}
+		for _, sd := range sigs {
+			signer, err := signedDataSigner(sd)
+			if err != nil || certificateFingerprint(signer) != fingerprint {
+				continue
+			}
+			hash, err := hashFromAlgorithmID(sd.SignerInfos[0].DigestAlgorithm)
+			if err != nil {
+				return nil, err
+			}
+			der, err := marshalSignedData(*sd)
+			if err != nil {
+				return nil, err
+			}
+			status, err := verifyAuthenticodeSignature(img, der)
+			if err != nil {
+				return nil, err
+			}
+			// A valid signature for a digest wins over a broken one
+			if existing, ok := own[hash]; !ok || existing.Status != StatusValid {
+				own[hash] = status
+			}
+		}
+	}
+	return own, nil
+}
+
+// removeOwnPESignatures strips the Authenticode signatures made with ownCerts
+// from a PE file, keeping any other signatures; with dryRun it only reports
+// whether there are any
+func removeOwnPESignatures(filename string, ownCerts []*x509.Certificate, dryRun bool) (bool, error) {
+	info, err := os.Stat(filename)
+	if err != nil {
+		return false, fmt.Errorf("failed to stat file: %w", err)
+	}
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return false, fmt.Errorf("failed to read file: %w", err)
+	}
+
+	img, err := parsePEImage(data)
+	if err != nil {
+		return false, fmt.Errorf("failed to parse PE file: %w", err)
+	}
+	if !img.hasCertificateTable() {
+		return false, nil
+	}
+
+	entries, err := img.certificates()
+	if err != nil {
+		return false, fmt.Errorf("failed to parse certificate table: %w", err)
+	}
+
+	removed := false
+	var kept []winCertificate
+
+	for _, entry := range entries {
+		if entry.CertificateType != winCertTypePKCSSignedData {
+			kept = append(kept, entry)
+			continue
+		}
+
+		// Signatures we can't decode, such as BER encoded or multi-signer
+		// ones, were not made by this tool and are kept as they are
+		sigs, err := splitNestedSignatures(entry.Certificate)
+		if err != nil {
+			kept = append(kept, entry)
+			continue
+		}
+
+		var foreign []*signedData
+		for _, sd := range sigs {
+			signer, err := signedDataSigner(sd)
+			if err != nil || !isOwnCertificate(signer, ownCerts) {
+				foreign = append(foreign, sd)
+			}
+		}
+
+		switch {
+		case len(foreign) == len(sigs):
+			// Nothing of ours in this entry, keep its original encoding
+			kept = append(kept, entry)
+		case len(foreign) == 0:
+			removed = true
+		default:
+			der, err := joinNestedSignatures(foreign)
+			if err != nil {
+				return false, fmt.Errorf("failed to rebuild remaining signatures: %w", err)
+			}
+			entry.Certificate = der
+			kept = append(kept, entry)
+			removed = true
+		}
+	}
+
+	if !removed || dryRun {
+		return removed, nil
+	}
+
+	if err := os.WriteFile(filename, img.withCertificates(kept), info.Mode().Perm()); err != nil {
+		return false, fmt.Errorf("failed to write file: %w", err)
+	}
+	return true, nil
+}
+
+// foreignPESigner returns the subject of a signature in a PE file not made
+// with ownCerts, nested ones included, or "" when every signature is ours.
+// Signatures that can't be decoded are not ours
+func foreignPESigner(filename string, ownCerts []*x509.Certificate) (string, error) {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return "", fmt.Errorf("failed to read file: %w", err)
+	}
+	img, err := parsePEImage(data)
+	if err != nil {
+		return "", fmt.Errorf("failed to parse PE file: %w", err)
+	}
+	if !img.hasCertificateTable() {
+		return "", nil
+	}
+	entries, err := img.certificates()
+	if err != nil {
+		return "", fmt.Errorf("failed to parse certificate table: %w", err)
+	}
+
+	for _, entry := range entries {
+		if entry.CertificateType != winCertTypePKCSSignedData {
+			continue
+		}
+		sigs, err := splitNestedSignatures(entry.Certificate)
+		if err != nil {
+			return "an unknown signer", nil
+		}
+		for _, sd := range sigs {
+			signer, err := signedDataSigner(sd)
+			if err != nil {
+				return "an unknown signer", nil
+			}
+			if !isOwnCertificate(signer, ownCerts) {
+				return signer.Subject.CommonName, nil
+			}
+		}
+	}
+	return "", nil
+}
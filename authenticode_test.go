@@ -0,0 +1,500 @@
+package main
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/binary"
+	"io"
+	"math/big"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newTestCertificate creates an in-memory code signing certificate
+func newTestCertificate(t *testing.T, subjectName string) *Certificate {
+	t.Helper()
+
+	privateKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("Failed to generate key: %v", err)
+	}
+	return newTestCertificateWithKey(t, subjectName, privateKey)
+}
+
+func newTestCertificateWithKey(t *testing.T, subjectName string, privateKey crypto.Signer) *Certificate {
+	t.Helper()
+
+	template := x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		Subject:               pkix.Name{CommonName: subjectName},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().AddDate(1, 0, 0),
+		KeyUsage:              x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageCodeSigning},
+		BasicConstraintsValid: true,
+	}
+	certDER, err := x509.CreateCertificate(rand.Reader, &template, &template, privateKey.Public(), privateKey)
+	if err != nil {
+		t.Fatalf("Failed to create certificate: %v", err)
+	}
+	cert, err := x509.ParseCertificate(certDER)
+	if err != nil {
+		t.Fatalf("Failed to parse certificate: %v", err)
+	}
+	return &Certificate{Subject: subjectName, Cert: cert, PrivateKey: privateKey}
+}
+
+// buildTestPE returns a minimal PE32+ image with a single section
+func buildTestPE() []byte {
+	const (
+		peOffset      = 0x40
+		optHeaderSize = 240
+		headersSize   = 0x200
+		sectionSize   = 0x200
+	)
+	data := make([]byte, headersSize+sectionSize+3) // odd length exercises padding
+
+	data[0], data[1] = 'M', 'Z'
+	binary.LittleEndian.PutUint32(data[0x3c:], peOffset)
+	copy(data[peOffset:], "PE\x00\x00")
+
+	coff := peOffset + 4
+	binary.LittleEndian.PutUint16(data[coff:], 0x8664)           // Machine
+	binary.LittleEndian.PutUint16(data[coff+2:], 1)              // NumberOfSections
+	binary.LittleEndian.PutUint16(data[coff+16:], optHeaderSize) // SizeOfOptionalHeader
+	binary.LittleEndian.PutUint16(data[coff+18:], 0x0022)        // Characteristics
+
+	opt := coff + 20
+	binary.LittleEndian.PutUint16(data[opt:], peMagicPE32Plus)
+	binary.LittleEndian.PutUint32(data[opt+60:], headersSize) // SizeOfHeaders
+	binary.LittleEndian.PutUint32(data[opt+108:], 16)         // NumberOfRvaAndSizes
+
+	section := opt + optHeaderSize
+	copy(data[section:], ".text")
+	binary.LittleEndian.PutUint32(data[section+16:], sectionSize) // SizeOfRawData
+	binary.LittleEndian.PutUint32(data[section+20:], headersSize) // PointerToRawData
+
+	for i := headersSize; i < len(data); i++ {
+		data[i] = byte(i)
+	}
+	return data
+}
+
+func TestSignPEFileEmbedsSignature(t *testing.T) {
+	cert := newTestCertificate(t, "LocalSign-Test")
+	filename := filepath.Join(t.TempDir(), "test.exe")
+	original := buildTestPE()
+	if err := os.WriteFile(filename, original, 0755); err != nil {
+		t.Fatalf("Failed to write test PE: %v", err)
+	}
+
+	if !isPEFile(filename) {
+		t.Fatal("Test image should be detected as a PE file")
+	}
+	if err := signFile(filename, cert, defaultSignOptions()); err != nil {
+		t.Fatalf("Failed to sign PE file: %v", err)
+	}
+	if _, err := os.Stat(filename + ".sig"); !os.IsNotExist(err) {
+		t.Error("Signing a PE file should not create a .sig sidecar")
+	}
+
+	signed, err := os.ReadFile(filename)
+	if err != nil {
+		t.Fatalf("Failed to read signed file: %v", err)
+	}
+	img, err := parsePEImage(signed)
+	if err != nil {
+		t.Fatalf("Failed to parse signed file: %v", err)
+	}
+	if !img.hasCertificateTable() || img.certTableOffset%8 != 0 {
+		t.Fatalf("Signed file should have an aligned certificate table, got offset %d", img.certTableOffset)
+	}
+	if !bytes.Equal(signed[:img.checksumOffset], original[:img.checksumOffset]) {
+		t.Error("Signing should not change the headers before the checksum")
+	}
+	if got := binary.LittleEndian.Uint32(signed[img.checksumOffset:]); got != peChecksum(signed, img.checksumOffset) {
+		t.Errorf("Checksum %#x does not match recomputed value", got)
+	}
+
+	certs, err := img.certificates()
+	if err != nil || len(certs) != 1 {
+		t.Fatalf("Expected one WIN_CERTIFICATE entry, got %d (%v)", len(certs), err)
+	}
+	if certs[0].Revision != winCertRevision2_0 || certs[0].CertificateType != winCertTypePKCSSignedData {
+		t.Errorf("Unexpected WIN_CERTIFICATE header: %+v", certs[0])
+	}
+
+	sd, err := parseSignedData(certs[0].Certificate)
+	if err != nil {
+		t.Fatalf("Failed to parse embedded SignedData: %v", err)
+	}
+	if !sd.ContentInfo.ContentType.Equal(oidSpcIndirectDataContent) {
+		t.Errorf("Expected SpcIndirectDataContent, got %v", sd.ContentInfo.ContentType)
+	}
+
+	// Re-signing replaces the signature instead of accumulating entries
+	if err := signFile(filename, cert, defaultSignOptions()); err != nil {
+		t.Fatalf("Failed to re-sign PE file: %v", err)
+	}
+	resigned, _ := os.ReadFile(filename)
+	img, err = parsePEImage(resigned)
+	if err != nil {
+		t.Fatalf("Failed to parse re-signed file: %v", err)
+	}
+	if certs, _ := img.certificates(); len(certs) != 1 {
+		t.Errorf("Expected one WIN_CERTIFICATE entry after re-signing, got %d", len(certs))
+	}
+	if !bytes.Equal(img.authenticodeDigest(crypto.SHA256), mustParsePE(t, signed).authenticodeDigest(crypto.SHA256)) {
+		t.Error("Re-signing should not change the Authenticode digest")
+	}
+}
+
+func mustParsePE(t *testing.T, data []byte) *peImage {
+	t.Helper()
+	img, err := parsePEImage(data)
+	if err != nil {
+		t.Fatalf("Failed to parse PE image: %v", err)
+	}
+	return img
+}
+
+// signTestPE writes a minimal PE image to a temporary file and signs it
+func signTestPE(t *testing.T, cert *Certificate) string {
+	t.Helper()
+	filename := filepath.Join(t.TempDir(), "test.exe")
+	if err := os.WriteFile(filename, buildTestPE(), 0755); err != nil {
+		t.Fatalf("Failed to write test PE: %v", err)
+	}
+	if err := signFile(filename, cert, defaultSignOptions()); err != nil {
+		t.Fatalf("Failed to sign PE file: %v", err)
+	}
+	return filename
+}
+
+// trustTestCertificate makes chain verification trust the given certificate
+// for the duration of the test
+func trustTestCertificate(t *testing.T, cert *Certificate) {
+	t.Helper()
+	roots := x509.NewCertPool()
+	roots.AddCert(cert.Cert)
+	signatureVerifyRoots = roots
+	t.Cleanup(func() { signatureVerifyRoots = nil })
+}
+
+func TestVerifyPEFileStatus(t *testing.T) {
+	cert := newTestCertificate(t, "LocalSign-Test")
+
+	unsigned := filepath.Join(t.TempDir(), "unsigned.exe")
+	if err := os.WriteFile(unsigned, buildTestPE(), 0755); err != nil {
+		t.Fatalf("Failed to write test PE: %v", err)
+	}
+	if status, err := getFileSignatureStatus(unsigned, nil); err != nil || status.Status != StatusNotSigned {
+		t.Errorf("Expected NotSigned for unsigned file, got %+v (%v)", status, err)
+	}
+
+	filename := signTestPE(t, cert)
+	status, err := getFileSignatureStatus(filename, nil)
+	if err != nil {
+		t.Fatalf("Failed to get status: %v", err)
+	}
+	if status.Status != StatusUntrustedRoot {
+		t.Errorf("Expected UntrustedRoot without a trusted root, got %s", status.Status)
+	}
+	if status.SignerCertificate != "LocalSign-Test" || !status.IsSelfSigned {
+		t.Errorf("Unexpected signer details: %+v", status)
+	}
+
+	trustTestCertificate(t, cert)
+	if status, _ := getFileSignatureStatus(filename, nil); status.Status != StatusValid {
+		t.Errorf("Expected Valid with trusted root, got %s", status.Status)
+	}
+
+	// Tampering with the image must be detected
+	data, _ := os.ReadFile(filename)
+	data[0x210] ^= 0xff
+	os.WriteFile(filename, data, 0755)
+	if status, _ := getFileSignatureStatus(filename, nil); status.Status != StatusHashMismatch {
+		t.Errorf("Expected HashMismatch for modified image, got %s", status.Status)
+	}
+
+	// Tampering with the signature value must be detected
+	filename = signTestPE(t, cert)
+	data, _ = os.ReadFile(filename)
+	img := mustParsePE(t, data)
+	data[img.certTableOffset+img.certTableSize-16] ^= 0xff
+	os.WriteFile(filename, data, 0755)
+	if status, _ := getFileSignatureStatus(filename, nil); status.Status != StatusBadSignature {
+		t.Errorf("Expected BadSignature for modified signature, got %s", status.Status)
+	}
+}
+
+func TestVerifyPEFileExpired(t *testing.T) {
+	cert := newTestCertificate(t, "LocalSign-Expired")
+	filename := signTestPE(t, cert)
+	trustTestCertificate(t, cert)
+
+	data, _ := os.ReadFile(filename)
+	img := mustParsePE(t, data)
+	certs, _ := img.certificates()
+	status, err := verifyAuthenticodeSignature(img, certs[0].Certificate)
+	if err != nil {
+		t.Fatalf("Failed to verify signature: %v", err)
+	}
+	if status.Status != StatusValid {
+		t.Fatalf("Expected Valid, got %s", status.Status)
+	}
+
+	if got := verifyCertificateTrust(cert.Cert, nil, cert.Cert.NotAfter.Add(time.Hour), x509.ExtKeyUsageCodeSigning); got != StatusExpired {
+		t.Errorf("Expected Expired after NotAfter, got %s", got)
+	}
+}
+
+// peSignatureDER returns the first WIN_CERTIFICATE payload of a signed PE file
+func peSignatureDER(t *testing.T, filename string) []byte {
+	t.Helper()
+	data, _ := os.ReadFile(filename)
+	certs, err := mustParsePE(t, data).certificates()
+	if err != nil || len(certs) == 0 {
+		t.Fatalf("Expected a certificate table in %s (%v)", filename, err)
+	}
+	return certs[0].Certificate
+}
+
+func TestClearRemovesOwnSignatureOnly(t *testing.T) {
+	t.Setenv("HOME", t.TempDir())
+	own := newTestCertificate(t, "LocalSign-Test")
+	saveCertificateFiles(io.Discard, own.Subject, own.Cert, own.PrivateKey)
+	vendor := newTestCertificate(t, "Vendor Inc")
+
+	// Our own signature is removed entirely
+	filename := signTestPE(t, own)
+	removed, err := removeSelfSignedSignature(filename, getOwnCertificates())
+	if err != nil || !removed {
+		t.Fatalf("Expected own signature to be removed, got %v (%v)", removed, err)
+	}
+	data, _ := os.ReadFile(filename)
+	img := mustParsePE(t, data)
+	if img.hasCertificateTable() || binary.LittleEndian.Uint64(data[img.securityDirOffset:]) != 0 {
+		t.Error("Clearing should zero the security data directory")
+	}
+	if len(data) != len(buildTestPE())+paddingFor(len(buildTestPE()), 8) {
+		t.Errorf("Clearing should truncate the certificate table, file is %d bytes", len(data))
+	}
+	if got := binary.LittleEndian.Uint32(data[img.checksumOffset:]); got != peChecksum(data, img.checksumOffset) {
+		t.Errorf("Checksum %#x does not match recomputed value", got)
+	}
+
+	// Vendor signatures are left untouched
+	filename = signTestPE(t, vendor)
+	before, _ := os.ReadFile(filename)
+	if removed, err := removeSelfSignedSignature(filename, getOwnCertificates()); err != nil || removed {
+		t.Errorf("Vendor signature should not be removed, got %v (%v)", removed, err)
+	}
+	if after, _ := os.ReadFile(filename); !bytes.Equal(before, after) {
+		t.Error("File with only a vendor signature should not be modified")
+	}
+
+	// Entries that can't be decoded are kept, while ours is removed
+	mixed := signTestPE(t, own)
+	undecodable := winCertificate{Revision: winCertRevision2_0, CertificateType: winCertTypePKCSSignedData, Certificate: []byte{0x30, 0x80, 0x06, 0x01, 0x2a, 0x00, 0x00, 0x00}}
+	data, _ = os.ReadFile(mixed)
+	mixedImg := mustParsePE(t, data)
+	entries, _ := mixedImg.certificates()
+	os.WriteFile(mixed, mixedImg.withCertificates(append(entries, undecodable)), 0755)
+	if removed, err := removeSelfSignedSignature(mixed, getOwnCertificates()); err != nil || !removed {
+		t.Fatalf("Expected own signature to be removed next to an undecodable one, got %v (%v)", removed, err)
+	}
+	data, _ = os.ReadFile(mixed)
+	if entries, err := mustParsePE(t, data).certificates(); err != nil || len(entries) != 1 || !bytes.Equal(entries[0].Certificate, undecodable.Certificate) {
+		t.Errorf("Expected the undecodable entry to be kept unchanged, got %d entries (%v)", len(entries), err)
+	}
+
+	// So are signatures from another copy of the tool, despite the name
+	other := newTestCertificate(t, "LocalSign-SelfSigned")
+	if removed, err := removeSelfSignedSignature(signTestPE(t, other), getOwnCertificates()); err != nil || removed {
+		t.Errorf("Another machine's signature should not be removed, got %v (%v)", removed, err)
+	}
+
+	// A vendor signature nested under ours is promoted to the primary signature
+	vendorSigs, err := splitNestedSignatures(peSignatureDER(t, filename))
+	if err != nil {
+		t.Fatalf("Failed to parse vendor signature: %v", err)
+	}
+	filename = signTestPE(t, own)
+	ownSigs, err := splitNestedSignatures(peSignatureDER(t, filename))
+	if err != nil {
+		t.Fatalf("Failed to parse own signature: %v", err)
+	}
+	nested, err := joinNestedSignatures(append(ownSigs, vendorSigs...))
+	if err != nil {
+		t.Fatalf("Failed to nest signatures: %v", err)
+	}
+	data, _ = os.ReadFile(filename)
+	data = mustParsePE(t, data).withCertificates([]winCertificate{{
+		Revision:        winCertRevision2_0,
+		CertificateType: winCertTypePKCSSignedData,
+		Certificate:     nested,
+	}})
+	os.WriteFile(filename, data, 0755)
+
+	if removed, err := removeSelfSignedSignature(filename, getOwnCertificates()); err != nil || !removed {
+		t.Fatalf("Expected nested own signature to be removed, got %v (%v)", removed, err)
+	}
+	sigs, err := splitNestedSignatures(peSignatureDER(t, filename))
+	if err != nil || len(sigs) != 1 {
+		t.Fatalf("Expected only the vendor signature to remain, got %d (%v)", len(sigs), err)
+	}
+	trustTestCertificate(t, vendor)
+	status, err := getFileSignatureStatus(filename, nil)
+	if err != nil || status.Status != StatusValid || status.SignerCertificate != "Vendor Inc" {
+		t.Errorf("Remaining vendor signature should verify, got %+v (%v)", status, err)
+	}
+}
+
+func TestSignPEFileDualAndAppend(t *testing.T) {
+	own := newTestCertificate(t, "LocalSign-Test")
+	vendor := newTestCertificate(t, "Vendor Inc")
+	trustTestCertificate(t, vendor)
+
+	// Dual signing nests the SHA-256 signature under the SHA-1 one
+	filename := signTestPE(t, own)
+	if err := signFile(filename, own, &signOptions{Digests: []crypto.Hash{crypto.SHA1, crypto.SHA256}}); err != nil {
+		t.Fatalf("Failed to dual-sign: %v", err)
+	}
+	sigs, err := splitNestedSignatures(peSignatureDER(t, filename))
+	if err != nil || len(sigs) != 2 {
+		t.Fatalf("Expected two signatures, got %d (%v)", len(sigs), err)
+	}
+	for i, want := range []crypto.Hash{crypto.SHA1, crypto.SHA256} {
+		if got, _ := hashFromAlgorithmID(sigs[i].SignerInfos[0].DigestAlgorithm); got != want {
+			t.Errorf("Signature %d: expected %v, got %v", i, want, got)
+		}
+	}
+
+	// Appending keeps the vendor signature as the primary one
+	filename = signTestPE(t, vendor)
+	if err := signFile(filename, own, &signOptions{Append: true, Digests: []crypto.Hash{crypto.SHA256}}); err != nil {
+		t.Fatalf("Failed to append signature: %v", err)
+	}
+	sigs, err = splitNestedSignatures(peSignatureDER(t, filename))
+	if err != nil || len(sigs) != 2 {
+		t.Fatalf("Expected two signatures after appending, got %d (%v)", len(sigs), err)
+	}
+	if signer, _ := signedDataSigner(sigs[1]); signer == nil || signer.Subject.CommonName != "LocalSign-Test" {
+		t.Error("Appended signature should be nested under the vendor signature")
+	}
+	status, err := getFileSignatureStatus(filename, nil)
+	if err != nil || status.Status != StatusValid || status.SignerCertificate != "Vendor Inc" {
+		t.Errorf("Vendor signature should still verify after appending, got %+v (%v)", status, err)
+	}
+	if len(status.Nested) != 1 || status.Nested[0].SignerCertificate != "LocalSign-Test" || status.Nested[0].Status != StatusUntrustedRoot {
+		t.Errorf("Expected the untrusted nested signature to be reported, got %+v", status.Nested)
+	}
+
+	// A broken nested signature fails the file
+	sigs[1].SignerInfos[0].EncryptedDigest[0] ^= 0xff
+	der, err := joinNestedSignatures(sigs)
+	if err != nil {
+		t.Fatalf("Failed to rebuild signatures: %v", err)
+	}
+	data, _ := os.ReadFile(filename)
+	img := mustParsePE(t, data)
+	os.WriteFile(filename, img.withCertificates([]winCertificate{{Revision: winCertRevision2_0, CertificateType: winCertTypePKCSSignedData, Certificate: der}}), 0755)
+	status, err = getFileSignatureStatus(filename, nil)
+	if err != nil || status.Status != StatusBadSignature || status.SignerCertificate != "Vendor Inc" {
+		t.Errorf("Expected the broken nested signature to fail the file, got %+v (%v)", status, err)
+	}
+
+	if _, err := parseDigestList("sha256,md5"); err == nil {
+		t.Error("Unsupported digest algorithms should be rejected")
+	}
+}
+
+func TestPlanSigning(t *testing.T) {
+	t.Setenv("HOME", t.TempDir())
+	cert := newTestCertificate(t, "LocalSign-Test")
+	other := newTestCertificate(t, "LocalSign-Other")
+	trustTestCertificate(t, cert)
+
+	unsigned := filepath.Join(t.TempDir(), "unsigned.exe")
+	os.WriteFile(unsigned, buildTestPE(), 0755)
+	signed := signTestPE(t, cert)
+
+	opts := defaultSignOptions()
+	force := &signOptions{Digests: opts.Digests, Force: true}
+	replace := &signOptions{Digests: opts.Digests, Replace: true}
+	appendOpts := &signOptions{Digests: opts.Digests, Append: true}
+	timestamped := &signOptions{Digests: opts.Digests, TimestampURL: "http://tsa.invalid"}
+
+	tests := []struct {
+		name     string
+		file     string
+		cert     *Certificate
+		opts     *signOptions
+		decision string
+	}{
+		{"unsigned", unsigned, cert, opts, signDecisionSign},
+		{"signed", signed, cert, opts, signDecisionSkip},
+		{"other signer", signed, other, opts, signDecisionSkip},
+		{"other signer, appending", signed, other, appendOpts, signDecisionSign},
+		{"other signer, forced", signed, other, force, signDecisionResign},
+		{"force", signed, cert, force, signDecisionResign},
+		{"replace", signed, cert, replace, signDecisionReplace},
+		{"no time-stamp", signed, cert, timestamped, signDecisionSign},
+	}
+	for _, tt := range tests {
+		if plan := planSigning(tt.file, tt.cert, tt.opts, nil); plan.Decision != tt.decision {
+			t.Errorf("%s: got %s (%s), want %s", tt.name, plan.Decision, plan.Reason, tt.decision)
+		}
+	}
+
+	data, _ := os.ReadFile(signed)
+	data[0x210] ^= 0xff // inside .text
+	os.WriteFile(signed, data, 0755)
+	if plan := planSigning(signed, cert, opts, nil); plan.Decision != signDecisionSign {
+		t.Errorf("Expected a modified file to be signed again, got %s (%s)", plan.Decision, plan.Reason)
+	}
+
+	// Another signer's signature is not replaced, and not cached as ours
+	if plan := planSigning(signed, other, opts, nil); !plan.Foreign || !strings.Contains(plan.Reason, "LocalSign-Test") {
+		t.Errorf("Expected the other signature to be kept, got %+v", plan)
+	}
+
+	// A signature nested under another signer's counts, and appending again
+	// replaces it rather than nesting another one
+	vendorSigned := signTestPE(t, other)
+	for i := 0; i < 2; i++ {
+		if err := signFile(vendorSigned, cert, appendOpts); err != nil {
+			t.Fatalf("Failed to append signature: %v", err)
+		}
+	}
+	if plan := planSigning(vendorSigned, cert, appendOpts, nil); plan.Decision != signDecisionSkip {
+		t.Errorf("Expected an appended signature to be found, got %s (%s)", plan.Decision, plan.Reason)
+	}
+	data, _ = os.ReadFile(vendorSigned)
+	img, _ := parsePEImage(data)
+	entries, _ := img.certificates()
+	if sigs, err := splitNestedSignatures(entries[0].Certificate); err != nil || len(sigs) != 2 {
+		t.Errorf("Expected the vendor signature and one of ours, got %d (%v)", len(sigs), err)
+	}
+
+	// Every requested digest needs a signature
+	both := &signOptions{Digests: []crypto.Hash{crypto.SHA1, crypto.SHA256}}
+	sha256Only := signTestPE(t, cert)
+	if plan := planSigning(sha256Only, cert, both, nil); plan.Decision != signDecisionSign {
+		t.Errorf("Expected a missing SHA-1 signature to be added, got %s (%s)", plan.Decision, plan.Reason)
+	}
+	if err := signFile(sha256Only, cert, both); err != nil {
+		t.Fatalf("Failed to sign with both digests: %v", err)
+	}
+	if plan := planSigning(sha256Only, cert, both, nil); plan.Decision != signDecisionSkip {
+		t.Errorf("Expected both digests to be found, got %s (%s)", plan.Decision, plan.Reason)
+	}
+}
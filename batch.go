@@ -0,0 +1,68 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"sync"
+)
+
+// processFiles runs process on files with up to jobs of them in flight at
+// once. Each file's output is written to w, and its result returned, in the
+// order of files as soon as every earlier file is done, so the output does not
+// depend on which worker finishes first
+func processFiles(w io.Writer, files []string, jobs int, process func(file string) (fileResult, string)) []fileResult {
+	if jobs > len(files) {
+		jobs = len(files)
+	}
+	if jobs < 1 {
+		jobs = 1
+	}
+
+	type outcome struct {
+		result fileResult
+		output string
+	}
+	outcomes := make([]chan outcome, len(files))
+	for i := range outcomes {
+		outcomes[i] = make(chan outcome, 1)
+	}
+
+	next := make(chan int)
+	var wg sync.WaitGroup
+	for worker := 0; worker < jobs; worker++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range next {
+				result, output := process(files[i])
+				outcomes[i] <- outcome{result, output}
+			}
+		}()
+	}
+	go func() {
+		for i := range files {
+			next <- i
+		}
+		close(next)
+	}()
+
+	results := make([]fileResult, len(files))
+	for i, done := range outcomes {
+		o := <-done
+		fmt.Fprint(w, o.output)
+		results[i] = o.result
+	}
+	wg.Wait()
+	return results
+}
+
+// countStatus returns how many results have the given status
+func countStatus(results []fileResult, status string) int {
+	count := 0
+	for _, result := range results {
+		if result.Status == status {
+			count++
+		}
+	}
+	return count
+}
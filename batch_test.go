@@ -0,0 +1,89 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestProcessFilesOrderAndBound(t *testing.T) {
+	var files []string
+	for i := 0; i < 50; i++ {
+		files = append(files, fmt.Sprintf("file%02d", i))
+	}
+
+	var running, peak int32
+	var out strings.Builder
+	results := processFiles(&out, files, 4, func(file string) (fileResult, string) {
+		n := atomic.AddInt32(&running, 1)
+		for {
+			p := atomic.LoadInt32(&peak)
+			if n <= p || atomic.CompareAndSwapInt32(&peak, p, n) {
+				break
+			}
+		}
+		// Later files finish first, so completion order is not file order
+		var i int
+		fmt.Sscanf(file, "file%d", &i)
+		time.Sleep(time.Duration(50-i) * 50 * time.Microsecond)
+		atomic.AddInt32(&running, -1)
+		return fileResult{Path: file, Status: "done"}, file + "\n"
+	})
+
+	if peak > 4 {
+		t.Errorf("Expected at most 4 files in flight, saw %d", peak)
+	}
+	if len(results) != len(files) {
+		t.Fatalf("Expected %d results, got %d", len(files), len(results))
+	}
+	for i, result := range results {
+		if result.Path != files[i] {
+			t.Fatalf("Result %d is %s, expected %s", i, result.Path, files[i])
+		}
+	}
+	if out.String() != strings.Join(files, "\n")+"\n" {
+		t.Errorf("Expected the output of each file in file order, got %q", out.String())
+	}
+}
+
+func TestParallelSignAndVerify(t *testing.T) {
+	cert := newTestCertificate(t, "LocalSign-Test")
+	opts := defaultSignOptions()
+
+	dir := t.TempDir()
+	var files []string
+	for i := 0; i < 16; i++ {
+		file := filepath.Join(dir, fmt.Sprintf("data%02d.txt", i))
+		os.WriteFile(file, []byte(fmt.Sprintf("payload %d\n", i)), 0644)
+		files = append(files, file)
+	}
+
+	// The one certificate and key are shared by every worker
+	signed := processFiles(io.Discard, files, 8, func(file string) (fileResult, string) {
+		if err := signDetachedFile(file, cert, opts); err != nil {
+			return errorFileResult(file, "sign", err), ""
+		}
+		return fileResult{Path: file, Action: "sign", Status: resultSigned}, ""
+	})
+	if n := countStatus(signed, resultSigned); n != len(files) {
+		t.Fatalf("Expected every file signed, got %d: %+v", n, signed)
+	}
+
+	verified := processFiles(io.Discard, files, 8, func(file string) (fileResult, string) {
+		status, err := verifyDetachedFile(file)
+		if err != nil {
+			return errorFileResult(file, "status", err), ""
+		}
+		return newFileResult(file, "status", status), ""
+	})
+	for _, result := range verified {
+		if result.Error != "" || result.Signer != "LocalSign-Test" {
+			t.Errorf("Unexpected status for %s: %+v", result.Path, result)
+		}
+	}
+}
@@ -0,0 +1,351 @@
+package main
+
+import (
+	"crypto"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// cacheFileName is the digest cache file in the tool's data directory
+const cacheFileName = "cache.json"
+
+// cacheVersion is bumped whenever cached results are no longer comparable
+const cacheVersion = 2
+
+// cacheRacyWindow is how close to the time it was recorded a file may have
+// been modified before its size and modification time stop being trusted,
+// as a change within the same timestamp tick would go unnoticed
+const cacheRacyWindow = 2 * time.Second
+
+// statusCacheContext keys the results of --status
+const statusCacheContext = "status"
+
+// fileStamp is what the file system says about a file without reading it
+type fileStamp struct {
+	Size    int64  `json:"size"`
+	ModTime int64  `json:"mtime"`
+	Inode   uint64 `json:"inode,omitempty"`
+}
+
+// cacheEntry is what is known about one file: its stamp, digest and the
+// stamp of its detached signature when it was last processed, and the
+// results it was processed with, keyed by context
+type cacheEntry struct {
+	fileStamp
+	Digest   string                 `json:"sha256"`
+	Sidecar  fileStamp              `json:"sidecar"`
+	Recorded int64                  `json:"recorded"`
+	Results  map[string]cacheResult `json:"results"`
+}
+
+// cacheResult is a cached signature status
+type cacheResult struct {
+	Status      string    `json:"status"`
+	Signer      string    `json:"signer,omitempty"`
+	Fingerprint string    `json:"fingerprint,omitempty"`
+	SelfSigned  bool      `json:"self_signed,omitempty"`
+	TimestampBy string    `json:"timestamp_signer,omitempty"`
+	Timestamp   time.Time `json:"timestamp,omitempty"`
+	// Expires is when the result stops holding, zero if never
+	Expires time.Time `json:"expires,omitempty"`
+}
+
+// digestCache remembers which files were already signed or verified, so
+// unchanged files are not hashed again. A nil cache is disabled: lookups
+// miss and stores do nothing
+type digestCache struct {
+	path  string
+	mu    sync.Mutex
+	files map[string]*cacheEntry
+	dirty bool
+}
+
+// cacheFile is the on-disk form of the cache
+type cacheFile struct {
+	Version int                    `json:"version"`
+	Files   map[string]*cacheEntry `json:"files"`
+}
+
+// getCachePath returns the path of the digest cache file
+func getCachePath() (string, error) {
+	dataDir, err := getDataDirectory()
+	if err != nil {
+		return "", fmt.Errorf("failed to locate data directory: %w", err)
+	}
+	return filepath.Join(dataDir, cacheFileName), nil
+}
+
+// openDigestCache loads the digest cache, or returns nil, after a warning to
+// w, when it cannot be used
+func openDigestCache(w io.Writer) *digestCache {
+	path, err := getCachePath()
+	if err != nil {
+		fmt.Fprintf(w, "Warning: Not using the digest cache: %v\n", err)
+		return nil
+	}
+	cache, err := loadDigestCache(path)
+	if err != nil {
+		fmt.Fprintf(w, "Warning: Not using the digest cache: %v\n", err)
+		return nil
+	}
+	return cache
+}
+
+// loadDigestCache reads the cache at path; a missing, unreadable or outdated
+// cache file starts an empty cache
+func loadDigestCache(path string) (*digestCache, error) {
+	cache := &digestCache{path: path, files: make(map[string]*cacheEntry)}
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return cache, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read cache: %w", err)
+	}
+
+	var stored cacheFile
+	if err := json.Unmarshal(data, &stored); err != nil || stored.Version != cacheVersion {
+		// Rebuilt from scratch, as it is only a cache
+		cache.dirty = true
+		return cache, nil
+	}
+	if stored.Files != nil {
+		cache.files = stored.Files
+	}
+	return cache, nil
+}
+
+// save writes the cache back if it changed, replacing the file atomically
+func (c *digestCache) save() error {
+	if c == nil {
+		return nil
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.dirty {
+		return nil
+	}
+
+	data, err := json.Marshal(cacheFile{Version: cacheVersion, Files: c.files})
+	if err != nil {
+		return fmt.Errorf("failed to encode cache: %w", err)
+	}
+	if err := os.MkdirAll(filepath.Dir(c.path), 0700); err != nil {
+		return fmt.Errorf("failed to create cache directory: %w", err)
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(c.path), ".cache-*.json")
+	if err != nil {
+		return fmt.Errorf("failed to write cache: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to write cache: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("failed to write cache: %w", err)
+	}
+	if err := os.Rename(tmp.Name(), c.path); err != nil {
+		return fmt.Errorf("failed to write cache: %w", err)
+	}
+	c.dirty = false
+	return nil
+}
+
+// signCacheContext keys the results of signing with cert and opts, so a
+// change of certificate or options signs files again
+func signCacheContext(cert *Certificate, opts *signOptions) string {
+	var digests []string
+	for _, hash := range opts.Digests {
+		digests = append(digests, hash.String())
+	}
+	return fmt.Sprintf("sign:%s:%s:timestamp=%t:append=%t", certificateFingerprint(cert.Cert),
+		strings.Join(digests, ","), opts.TimestampURL != "", opts.Append)
+}
+
+// statFile returns the stamp of a file, or the zero stamp if it is missing
+func statFile(filename string) (fileStamp, error) {
+	info, err := os.Stat(filename)
+	if os.IsNotExist(err) {
+		return fileStamp{}, nil
+	}
+	if err != nil {
+		return fileStamp{}, err
+	}
+	return fileStamp{Size: info.Size(), ModTime: info.ModTime().UnixNano(), Inode: fileInode(info)}, nil
+}
+
+// fileDigest returns the hex SHA-256 of a file
+func fileDigest(filename string) (string, error) {
+	digest, err := hashFile(filename, crypto.SHA256)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(digest), nil
+}
+
+// cacheKey returns the absolute path a file is cached under
+func cacheKey(filename string) string {
+	if abs, err := filepath.Abs(filename); err == nil {
+		return abs
+	}
+	return filename
+}
+
+// lookup returns the status cached for a file in context, if the file and
+// its detached signature are unchanged since it was recorded. A file whose
+// size is unchanged but whose stamp is not, e.g. after a checkout, is hashed
+// and still hits the cache if its content is the same
+func (c *digestCache) lookup(filename, context string) (*SignatureStatus, bool) {
+	if c == nil {
+		return nil, false
+	}
+	key := cacheKey(filename)
+	stamp, err := statFile(filename)
+	if err != nil || stamp.Size == 0 && stamp.ModTime == 0 {
+		return nil, false
+	}
+	sidecar, err := statFile(filename + detachedSignatureExt)
+	if err != nil {
+		return nil, false
+	}
+
+	c.mu.Lock()
+	entry, ok := c.files[key]
+	var result cacheResult
+	if ok {
+		result, ok = entry.Results[context]
+	}
+	var digest string
+	racy := false
+	if ok {
+		digest = entry.Digest
+		racy = entry.ModTime >= entry.Recorded-int64(cacheRacyWindow)
+		ok = entry.Sidecar == sidecar && stamp.Size == entry.Size
+	}
+	stampMatches := ok && stamp == entry.fileStamp
+	c.mu.Unlock()
+
+	if !ok || !result.Expires.IsZero() && time.Now().After(result.Expires) {
+		return nil, false
+	}
+	if !stampMatches || racy {
+		current, err := fileDigest(filename)
+		if err != nil || current != digest {
+			return nil, false
+		}
+		// The content is known to be unchanged as of now
+		c.mu.Lock()
+		entry.fileStamp = stamp
+		entry.Recorded = time.Now().UnixNano()
+		c.dirty = true
+		c.mu.Unlock()
+	}
+
+	return &SignatureStatus{
+		Status:               result.Status,
+		SignerCertificate:    result.Signer,
+		SignerFingerprint:    result.Fingerprint,
+		IsSelfSigned:         result.SelfSigned,
+		TimestampCertificate: result.TimestampBy,
+		TimestampTime:        result.Timestamp,
+	}, true
+}
+
+// store records the status of a file in context. Results recorded for
+// other contexts are kept only if the file has not changed since
+func (c *digestCache) store(filename, context string, status *SignatureStatus) {
+	if c == nil || status == nil {
+		return
+	}
+	stamp, err := statFile(filename)
+	if err != nil {
+		return
+	}
+	sidecar, err := statFile(filename + detachedSignatureExt)
+	if err != nil {
+		return
+	}
+	digest, err := fileDigest(filename)
+	if err != nil {
+		return
+	}
+
+	result := cacheResult{
+		Status:      status.Status,
+		Signer:      status.SignerCertificate,
+		Fingerprint: status.SignerFingerprint,
+		SelfSigned:  status.IsSelfSigned,
+		TimestampBy: status.TimestampCertificate,
+		Timestamp:   status.TimestampTime,
+	}
+	// A time-stamped signature outlives its certificate
+	if status.TimestampTime.IsZero() {
+		result.Expires = status.SignerExpires
+	}
+
+	key := cacheKey(filename)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	entry, ok := c.files[key]
+	if !ok || entry.Digest != digest || entry.Sidecar != sidecar {
+		entry = &cacheEntry{Results: make(map[string]cacheResult)}
+		c.files[key] = entry
+	}
+	entry.fileStamp = stamp
+	entry.Digest = digest
+	entry.Sidecar = sidecar
+	entry.Recorded = time.Now().UnixNano()
+	entry.Results[context] = result
+	c.dirty = true
+}
+
+// isCacheableStatus reports whether a --status result only depends on the
+// file and its signature, not on the trust store or the time. Valid is not
+// one of them: it needs a trusted chain, which the trust store can take away.
+// Nor are statuses with nested signatures, as the cache only keeps the primary
+func isCacheableStatus(status *SignatureStatus) bool {
+	if len(status.Nested) > 0 {
+		return false
+	}
+	switch status.Status {
+	case StatusNotSigned, StatusHashMismatch, StatusBadSignature:
+		return true
+	}
+	return false
+}
+
+// prune drops entries for files that are gone or changed and results that
+// expired, or every entry if all is set; it returns how many entries were
+// dropped
+func (c *digestCache) prune(all bool) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := time.Now()
+	pruned := 0
+	for key, entry := range c.files {
+		for context, result := range entry.Results {
+			if !result.Expires.IsZero() && now.After(result.Expires) {
+				delete(entry.Results, context)
+				c.dirty = true
+			}
+		}
+		stamp, err := statFile(key)
+		if all || err != nil || stamp != entry.fileStamp || len(entry.Results) == 0 {
+			delete(c.files, key)
+			pruned++
+		}
+	}
+	if pruned > 0 || all {
+		c.dirty = true
+	}
+	return pruned
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"crypto/x509"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestDigestCache(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "cache.json")
+	file := filepath.Join(dir, "app.bin")
+	os.WriteFile(file, []byte("original"), 0644)
+
+	cache, err := loadDigestCache(path)
+	if err != nil {
+		t.Fatalf("Failed to load cache: %v", err)
+	}
+	status := &SignatureStatus{Status: StatusValid, SignerCertificate: "LocalSign-Test", SignerExpires: time.Now().Add(time.Hour)}
+	cache.store(file, "sign:a", status)
+
+	if got, ok := cache.lookup(file, "sign:a"); !ok || got.SignerCertificate != "LocalSign-Test" {
+		t.Fatalf("Expected a cache hit, got %+v, %v", got, ok)
+	}
+	if _, ok := cache.lookup(file, "sign:b"); ok {
+		t.Error("Expected a miss for another context")
+	}
+
+	// Saved and loaded again
+	if err := cache.save(); err != nil {
+		t.Fatalf("Failed to save cache: %v", err)
+	}
+	if cache, err = loadDigestCache(path); err != nil {
+		t.Fatalf("Failed to reload cache: %v", err)
+	}
+	if _, ok := cache.lookup(file, "sign:a"); !ok {
+		t.Error("Expected a hit after reloading the cache")
+	}
+
+	// Touched but unchanged content still hits
+	later := time.Now().Add(time.Minute)
+	os.Chtimes(file, later, later)
+	if _, ok := cache.lookup(file, "sign:a"); !ok {
+		t.Error("Expected a hit for a touched file with the same content")
+	}
+
+	// Changed content of the same size misses, even with the old stamp
+	info, _ := os.Stat(file)
+	os.WriteFile(file, []byte("modified"), 0644)
+	os.Chtimes(file, info.ModTime(), info.ModTime())
+	if _, ok := cache.lookup(file, "sign:a"); ok {
+		t.Error("Expected a miss for changed content")
+	}
+
+	// A new or removed detached signature misses
+	cache.store(file, "sign:a", status)
+	os.WriteFile(file+detachedSignatureExt, []byte("sig"), 0644)
+	if _, ok := cache.lookup(file, "sign:a"); ok {
+		t.Error("Expected a miss after the detached signature changed")
+	}
+
+	// Expired results miss
+	cache.store(file, "sign:a", &SignatureStatus{Status: StatusValid, SignerExpires: time.Now().Add(-time.Hour)})
+	if _, ok := cache.lookup(file, "sign:a"); ok {
+		t.Error("Expected a miss for an expired result")
+	}
+
+	var disabled *digestCache
+	disabled.store(file, "sign:a", status)
+	if _, ok := disabled.lookup(file, "sign:a"); ok || disabled.save() != nil {
+		t.Error("Expected a nil cache to be disabled")
+	}
+}
+
+func TestDigestCachePrune(t *testing.T) {
+	dir := t.TempDir()
+	cache, _ := loadDigestCache(filepath.Join(dir, "cache.json"))
+	status := &SignatureStatus{Status: StatusNotSigned}
+
+	var files []string
+	for _, name := range []string{"kept", "deleted", "changed"} {
+		file := filepath.Join(dir, name)
+		os.WriteFile(file, []byte(name), 0644)
+		cache.store(file, statusCacheContext, status)
+		files = append(files, file)
+	}
+	os.Remove(files[1])
+	os.WriteFile(files[2], []byte("changed content"), 0644)
+
+	if pruned := cache.prune(false); pruned != 2 {
+		t.Errorf("Expected 2 entries pruned, got %d", pruned)
+	}
+	if _, ok := cache.lookup(files[0], statusCacheContext); !ok {
+		t.Error("Expected the unchanged file to stay cached")
+	}
+	if pruned := cache.prune(true); pruned != 1 || len(cache.files) != 0 {
+		t.Errorf("Expected --all to empty the cache, pruned %d", pruned)
+	}
+}
+
+func TestPlanSigningUsesCache(t *testing.T) {
+	t.Setenv("HOME", t.TempDir())
+	cert := newTestCertificate(t, "LocalSign-Test")
+	trustTestCertificate(t, cert)
+	opts := defaultSignOptions()
+
+	file := filepath.Join(t.TempDir(), "app.exe")
+	os.WriteFile(file, buildTestPE(), 0755)
+	if err := signFile(file, cert, opts); err != nil {
+		t.Fatalf("Failed to sign: %v", err)
+	}
+
+	cache, _ := loadDigestCache(filepath.Join(t.TempDir(), "cache.json"))
+	plan := planSigning(file, cert, opts, cache)
+	if plan.Decision != signDecisionSkip || plan.Cached {
+		t.Fatalf("Expected an uncached skip, got %+v", plan)
+	}
+	cache.store(file, signCacheContext(cert, opts), plan.Status)
+
+	if plan := planSigning(file, cert, opts, cache); plan.Decision != signDecisionSkip || !plan.Cached {
+		t.Errorf("Expected a cached skip, got %+v", plan)
+	}
+	appended := &signOptions{Digests: opts.Digests, Append: true}
+	if plan := planSigning(file, cert, appended, cache); plan.Cached {
+		t.Error("Expected other signing options to miss the cache")
+	}
+
+	// Trust is not cached: once the certificate is no longer trusted the
+	// file is verified, and signed, again
+	signatureVerifyRoots = x509.NewCertPool()
+	if plan := planSigning(file, cert, opts, cache); plan.Cached || plan.Decision != signDecisionSign {
+		t.Errorf("Expected an untrusted certificate to miss the cache, got %+v", plan)
+	}
+	if isCacheableStatus(plan.Status) {
+		t.Error("Valid depends on the trust store and must not be cached by --status")
+	}
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+)
+
+// cacheCommandUsage summarizes the "cache" subcommands
+const cacheCommandUsage = `usage: selfsign-path cache prune [--all]`
+
+// runCacheCommand handles the "cache" subcommand
+func runCacheCommand(args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf(cacheCommandUsage)
+	}
+
+	switch args[0] {
+	case "prune":
+		return runCachePruneCommand(args[1:])
+	}
+	return fmt.Errorf("unknown cache command %q\n%s", args[0], cacheCommandUsage)
+}
+
+// runCachePruneCommand drops digest cache entries for files that were
+// removed or changed, or the whole cache with --all
+func runCachePruneCommand(args []string) error {
+	fs := flag.NewFlagSet("cache prune", flag.ContinueOnError)
+	all := fs.Bool("all", false, "Drop every entry, e.g. after changing trust stores outside the tool")
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	}
+
+	path, err := getCachePath()
+	if err != nil {
+		return err
+	}
+	cache, err := loadDigestCache(path)
+	if err != nil {
+		return err
+	}
+
+	total := len(cache.files)
+	pruned := cache.prune(*all)
+	if err := cache.save(); err != nil {
+		return err
+	}
+	fmt.Printf("Pruned %d of %d cache entries in %s.\n", pruned, total, path)
+	return nil
+}
@@ -1,126 +1,361 @@
 package main
 
 import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
 	"crypto/rand"
 	"crypto/rsa"
+	"crypto/sha1"
 	"crypto/x509"
 	"crypto/x509/pkix"
+	"encoding/asn1"
 	"encoding/pem"
 	"fmt"
+	"io"
 	"math/big"
 	"os"
 	"path/filepath"
 	"runtime"
+	"strings"
 	"time"
 )
 
+// Certificate extension object identifiers
+var (
+	oidExtensionExtKeyUsage    = asn1.ObjectIdentifier{2, 5, 29, 37}
+	oidExtKeyUsageTimeStamping = asn1.ObjectIdentifier{1, 3, 6, 1, 5, 5, 7, 3, 8}
+)
+
+// Local certificate authority settings
+const (
+	localRootCAName               = "LocalSign-Root-CA"
+	localRootCAValidity           = 10 * 365 * 24 * time.Hour
+	issuedCertificateValidity     = 90 * 24 * time.Hour
+	issuedCertificateRenewBefore  = 14 * 24 * time.Hour
+	selfSignedCertificateValidity = 3 * 365 * 24 * time.Hour
+)
+
 // Certificate represents a signing certificate
 type Certificate struct {
 	Subject    string
 	Cert       *x509.Certificate
-	PrivateKey *rsa.PrivateKey
+	PrivateKey crypto.Signer
+	// Chain holds the certificates that issued Cert, nearest issuer first
+	Chain []*x509.Certificate
 }
 
 // getCertificate obtains a certificate for signing - either from files or by creating one
-func getCertificate() (*Certificate, error) {
+func getCertificate(w io.Writer) (*Certificate, error) {
+	if *flagPFXFile != "" {
+		password, err := getPFXPassword(*flagPFXPasswordFile)
+		if err != nil {
+			return nil, err
+		}
+		return loadCertificateFromPFX(*flagPFXFile, password)
+	}
 	if *flagCertFile != "" && *flagKeyFile != "" {
 		return loadCertificateFromFile(*flagCertFile, *flagKeyFile)
 	}
-	return getOrCreateSelfSignedCertificate(*flagName)
+	return getOrCreateSigningCertificate(w, *flagName)
 }
 
-// loadCertificateFromFile loads a certificate and private key from files
+// loadCertificateFromFile loads a certificate and private key from files.
+// The certificate may be DER or PEM, including bundles with issuer
+// certificates, and the key PEM, DER or Microsoft PVK
 func loadCertificateFromFile(certFile, keyFile string) (*Certificate, error) {
-	// Load certificate file
-	certData, err := os.ReadFile(certFile)
+	certs, err := readCertificateFile(certFile)
 	if err != nil {
-		return nil, fmt.Errorf("failed to read certificate file %s: %w", certFile, err)
+		return nil, err
 	}
 
-	certBlock, _ := pem.Decode(certData)
-	if certBlock == nil {
-		return nil, fmt.Errorf("failed to decode PEM certificate from %s", certFile)
-	}
-
-	cert, err := x509.ParseCertificate(certBlock.Bytes)
+	privateKey, err := readPrivateKeyFile(keyFile)
 	if err != nil {
-		return nil, fmt.Errorf("failed to parse certificate from %s: %w", certFile, err)
+		return nil, err
 	}
 
-	// Load private key file
-	keyData, err := os.ReadFile(keyFile)
+	// A bundle may hold issuers too; the key picks out the signing certificate
+	cert, err := certificateForKey(privateKey, certs)
 	if err != nil {
-		return nil, fmt.Errorf("failed to read key file %s: %w", keyFile, err)
+		return nil, fmt.Errorf("private key from %s does not match certificate %s", keyFile, certFile)
 	}
+	return cert, nil
+}
 
-	keyBlock, _ := pem.Decode(keyData)
-	if keyBlock == nil {
-		return nil, fmt.Errorf("failed to decode PEM private key from %s", keyFile)
+// parsePrivateKey decodes a PKCS#1 RSA, SEC1 EC or PKCS#8 private key
+func parsePrivateKey(block *pem.Block) (crypto.Signer, error) {
+	switch block.Type {
+	case "RSA PRIVATE KEY":
+		return x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "EC PRIVATE KEY":
+		return x509.ParseECPrivateKey(block.Bytes)
 	}
 
-	privateKey, err := x509.ParsePKCS1PrivateKey(keyBlock.Bytes)
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
 	if err != nil {
-		// Try PKCS8 format
-		key, err := x509.ParsePKCS8PrivateKey(keyBlock.Bytes)
-		if err != nil {
-			return nil, fmt.Errorf("failed to parse private key from %s: %w", keyFile, err)
+		// Fall back to the legacy formats for PEM blocks with other labels
+		if rsaKey, rsaErr := x509.ParsePKCS1PrivateKey(block.Bytes); rsaErr == nil {
+			return rsaKey, nil
 		}
-		var ok bool
-		privateKey, ok = key.(*rsa.PrivateKey)
-		if !ok {
-			return nil, fmt.Errorf("private key from %s is not an RSA key", keyFile)
+		if ecKey, ecErr := x509.ParseECPrivateKey(block.Bytes); ecErr == nil {
+			return ecKey, nil
 		}
+		return nil, err
 	}
 
-	return &Certificate{
-		Subject:    cert.Subject.CommonName,
-		Cert:       cert,
-		PrivateKey: privateKey,
-	}, nil
+	signer, ok := key.(crypto.Signer)
+	if !ok {
+		return nil, fmt.Errorf("unsupported private key type %T", key)
+	}
+	return signer, nil
+}
+
+// keyTypes lists the key types accepted by --key-type
+var keyTypes = []string{"rsa2048", "rsa4096", "p256", "p384", "ed25519"}
+
+// isValidKeyType reports whether keyType is one of keyTypes
+func isValidKeyType(keyType string) bool {
+	for _, t := range keyTypes {
+		if t == keyType {
+			return true
+		}
+	}
+	return false
+}
+
+// generatePrivateKey creates a new private key of the given type
+func generatePrivateKey(keyType string) (crypto.Signer, error) {
+	switch keyType {
+	case "rsa2048":
+		return rsa.GenerateKey(rand.Reader, 2048)
+	case "rsa4096":
+		return rsa.GenerateKey(rand.Reader, 4096)
+	case "p256":
+		return ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	case "p384":
+		return ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	case "ed25519":
+		_, key, err := ed25519.GenerateKey(rand.Reader)
+		return key, err
+	}
+	return nil, fmt.Errorf("unsupported key type %q (use %s)", keyType, strings.Join(keyTypes, ", "))
+}
+
+// describeKeyType names the key type of pub the way --key-type does
+func describeKeyType(pub crypto.PublicKey) string {
+	switch key := pub.(type) {
+	case *rsa.PublicKey:
+		return fmt.Sprintf("rsa%d", key.N.BitLen())
+	case *ecdsa.PublicKey:
+		return strings.ToLower(strings.ReplaceAll(key.Curve.Params().Name, "-", ""))
+	case ed25519.PublicKey:
+		return "ed25519"
+	}
+	return fmt.Sprintf("%T", pub)
+}
+
+// getOrCreateSigningCertificate gets an existing code signing certificate or
+// issues a new one from the local root CA
+func getOrCreateSigningCertificate(w io.Writer, subjectName string) (*Certificate, error) {
+	return getOrCreateIssuedCertificate(w, subjectName, x509.ExtKeyUsageCodeSigning, *flagKeyType)
 }
 
-// getOrCreateSelfSignedCertificate gets an existing certificate or creates a new one
-func getOrCreateSelfSignedCertificate(subjectName string) (*Certificate, error) {
-	// Try to load existing certificate
+// getOrCreateTimestampCertificate gets or creates the certificate used by the built-in time-stamping authority
+func getOrCreateTimestampCertificate(w io.Writer, subjectName, keyType string) (*Certificate, error) {
+	return getOrCreateIssuedCertificate(w, subjectName, x509.ExtKeyUsageTimeStamping, keyType)
+}
+
+// getOrCreateIssuedCertificate loads the stored certificate with the given
+// name, issuing a new one from the local root CA when there is none or when
+// the stored one is about to expire
+func getOrCreateIssuedCertificate(w io.Writer, subjectName string, usage x509.ExtKeyUsage, keyType string) (*Certificate, error) {
 	certDir := getCertificateDirectory()
 	certFile := filepath.Join(certDir, fmt.Sprintf("%s.crt", subjectName))
 	keyFile := filepath.Join(certDir, fmt.Sprintf("%s.key", subjectName))
 
 	if _, err := os.Stat(certFile); err == nil {
 		if _, err := os.Stat(keyFile); err == nil {
-			fmt.Printf("Using existing certificate: %s\n", subjectName)
-			return loadCertificateFromFile(certFile, keyFile)
+			cert, err := loadStoredCertificate(subjectName)
+			if err != nil {
+				return nil, err
+			}
+
+			// Self-signed certificates from older versions, and certificates
+			// issued by someone else, are used as they are
+			if len(cert.Chain) == 0 || time.Until(cert.Cert.NotAfter) > issuedCertificateRenewBefore {
+				fmt.Fprintf(w, "Using existing certificate: %s\n", subjectName)
+				return cert, nil
+			}
+			fmt.Fprintf(w, "Certificate %s expires %s, renewing it\n", subjectName, cert.Cert.NotAfter.Format("2006-01-02"))
 		}
 	}
 
-	// Create new certificate
-	fmt.Printf("Creating new self-signed certificate with subject: %s\n", subjectName)
-	return createSelfSignedCertificate(subjectName)
+	root, err := getOrCreateLocalRootCA(w, keyType)
+	if err != nil {
+		return nil, fmt.Errorf("failed to obtain local root CA: %w", err)
+	}
+
+	fmt.Fprintf(w, "Issuing new certificate with subject: %s\n", subjectName)
+	cert, err := issueCertificate(root, subjectName, usage, keyType)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := saveCertificateFiles(w, subjectName, cert.Cert, cert.PrivateKey); err != nil {
+		fmt.Fprintf(w, "Warning: Failed to save certificate to disk: %v\n", err)
+	}
+	return cert, nil
+}
+
+// loadStoredCertificate loads a certificate and key from the certificate
+// directory, with the local root CA as its chain when the root issued it
+func loadStoredCertificate(subjectName string) (*Certificate, error) {
+	certDir := getCertificateDirectory()
+	cert, err := loadCertificateFromFile(
+		filepath.Join(certDir, fmt.Sprintf("%s.crt", subjectName)),
+		filepath.Join(certDir, fmt.Sprintf("%s.key", subjectName)),
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	if subjectName != localRootCAName && !isSelfSignedCertificate(cert.Cert) {
+		if root, err := loadLocalRootCA(); err == nil && cert.Cert.CheckSignatureFrom(root.Cert) == nil {
+			cert.Chain = []*x509.Certificate{root.Cert}
+		}
+	}
+	return cert, nil
+}
+
+// loadLocalRootCA loads the local root CA from the certificate directory
+func loadLocalRootCA() (*Certificate, error) {
+	certDir := getCertificateDirectory()
+	return loadCertificateFromFile(
+		filepath.Join(certDir, fmt.Sprintf("%s.crt", localRootCAName)),
+		filepath.Join(certDir, fmt.Sprintf("%s.key", localRootCAName)),
+	)
+}
+
+// getOrCreateLocalRootCA loads the local root CA, creating it and installing
+// it into the system trust store on first use
+func getOrCreateLocalRootCA(w io.Writer, keyType string) (*Certificate, error) {
+	certDir := getCertificateDirectory()
+	if _, err := os.Stat(filepath.Join(certDir, fmt.Sprintf("%s.crt", localRootCAName))); err == nil {
+		return loadLocalRootCA()
+	}
+
+	fmt.Fprintf(w, "Creating local root CA: %s\n", localRootCAName)
+	root, err := createLocalRootCA(localRootCAName, keyType)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := saveCertificateFiles(w, localRootCAName, root.Cert, root.PrivateKey); err != nil {
+		return nil, fmt.Errorf("failed to save root CA: %w", err)
+	}
+
+	// Only the root goes into the trust store; issued certificates chain to it
+	result, err := installCertificateToStore(root.Cert)
+	printTrustInstallResult(w, result)
+	switch {
+	case err != nil:
+		fmt.Fprintf(w, "Warning: Failed to install root CA to system trust store: %v\n", err)
+		fmt.Fprintf(w, "Root CA created but not installed to system trust store.\n")
+	case result.SystemTrusted:
+		fmt.Fprintf(w, "Root CA installed to system trust store.\n")
+	default:
+		fmt.Fprintf(w, "Root CA created but not trusted system-wide; run \"trust install\" as administrator.\n")
+	}
+
+	return root, nil
+}
+
+// createLocalRootCA creates a long-lived self-signed CA certificate that may
+// only issue end-entity certificates
+func createLocalRootCA(subjectName, keyType string) (*Certificate, error) {
+	privateKey, err := generatePrivateKey(keyType)
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate private key: %w", err)
+	}
+
+	template, err := newCertificateTemplate(subjectName, privateKey.Public(), localRootCAValidity)
+	if err != nil {
+		return nil, err
+	}
+	template.KeyUsage = x509.KeyUsageCertSign | x509.KeyUsageCRLSign | x509.KeyUsageDigitalSignature
+	template.IsCA = true
+	template.MaxPathLenZero = true
+
+	certDER, err := x509.CreateCertificate(rand.Reader, template, template, privateKey.Public(), privateKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create root CA certificate: %w", err)
+	}
+	cert, err := x509.ParseCertificate(certDER)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse created certificate: %w", err)
+	}
+
+	return &Certificate{
+		Subject:    subjectName,
+		Cert:       cert,
+		PrivateKey: privateKey,
+	}, nil
+}
+
+// issueCertificate issues a short-lived end-entity certificate for the given
+// extended key usage, signed by issuer
+func issueCertificate(issuer *Certificate, subjectName string, usage x509.ExtKeyUsage, keyType string) (*Certificate, error) {
+	privateKey, err := generatePrivateKey(keyType)
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate private key: %w", err)
+	}
+
+	template, err := newLeafTemplate(subjectName, usage, privateKey.Public(), issuedCertificateValidity)
+	if err != nil {
+		return nil, err
+	}
+	// Never outlive the issuer
+	if template.NotAfter.After(issuer.Cert.NotAfter) {
+		template.NotAfter = issuer.Cert.NotAfter
+	}
+
+	certDER, err := x509.CreateCertificate(rand.Reader, template, issuer.Cert, privateKey.Public(), issuer.PrivateKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create certificate: %w", err)
+	}
+	cert, err := x509.ParseCertificate(certDER)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse created certificate: %w", err)
+	}
+
+	return &Certificate{
+		Subject:    subjectName,
+		Cert:       cert,
+		PrivateKey: privateKey,
+		Chain:      append([]*x509.Certificate{issuer.Cert}, issuer.Chain...),
+	}, nil
 }
 
-// createSelfSignedCertificate creates a new self-signed certificate
-func createSelfSignedCertificate(subjectName string) (*Certificate, error) {
+// createSelfSignedCertificate creates a standalone self-signed code signing
+// certificate and installs it into the trust store. It is used for one-time
+// identities whose key is destroyed after signing, where a shared root CA
+// key would outlive them
+func createSelfSignedCertificate(w io.Writer, subjectName string) (*Certificate, error) {
 	// Generate private key
-	privateKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	privateKey, err := generatePrivateKey(*flagKeyType)
 	if err != nil {
 		return nil, fmt.Errorf("failed to generate private key: %w", err)
 	}
 
-	// Create certificate template
-	template := x509.Certificate{
-		SerialNumber: big.NewInt(1),
-		Subject: pkix.Name{
-			CommonName: subjectName,
-		},
-		NotBefore:             time.Now(),
-		NotAfter:              time.Now().AddDate(3, 0, 0), // Valid for 3 years
-		KeyUsage:              x509.KeyUsageDigitalSignature,
-		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageCodeSigning},
-		BasicConstraintsValid: true,
+	template, err := newLeafTemplate(subjectName, x509.ExtKeyUsageCodeSigning, privateKey.Public(), selfSignedCertificateValidity)
+	if err != nil {
+		return nil, err
 	}
 
 	// Create the certificate
-	certDER, err := x509.CreateCertificate(rand.Reader, &template, &template, &privateKey.PublicKey, privateKey)
+	certDER, err := x509.CreateCertificate(rand.Reader, template, template, privateKey.Public(), privateKey)
 	if err != nil {
 		return nil, fmt.Errorf("failed to create certificate: %w", err)
 	}
@@ -131,16 +366,21 @@ func createSelfSignedCertificate(subjectName string) (*Certificate, error) {
 	}
 
 	// Save certificate and key to files
-	if err := saveCertificateFiles(subjectName, cert, privateKey); err != nil {
-		fmt.Printf("Warning: Failed to save certificate to disk: %v\n", err)
+	if err := saveCertificateFiles(w, subjectName, cert, privateKey); err != nil {
+		fmt.Fprintf(w, "Warning: Failed to save certificate to disk: %v\n", err)
 	}
 
 	// Try to install certificate to system store (platform-specific)
-	if err := installCertificateToStore(cert); err != nil {
-		fmt.Printf("Warning: Failed to install certificate to system store: %v\n", err)
-		fmt.Printf("Certificate created but not installed to system trust store.\n")
-	} else {
-		fmt.Printf("Certificate installed to system trust store.\n")
+	result, err := installCertificateToStore(cert)
+	printTrustInstallResult(w, result)
+	switch {
+	case err != nil:
+		fmt.Fprintf(w, "Warning: Failed to install certificate to system store: %v\n", err)
+		fmt.Fprintf(w, "Certificate created but not installed to system trust store.\n")
+	case result.SystemTrusted:
+		fmt.Fprintf(w, "Certificate installed to system trust store.\n")
+	default:
+		fmt.Fprintf(w, "Certificate created but not trusted system-wide.\n")
 	}
 
 	return &Certificate{
@@ -150,40 +390,158 @@ func createSelfSignedCertificate(subjectName string) (*Certificate, error) {
 	}, nil
 }
 
-// getCertificateDirectory returns the directory where certificates are stored
-func getCertificateDirectory() string {
-	var certDir string
-	
+// newCertificateTemplate returns a template with a random serial number and
+// a subject key identifier for pub, valid from now for the given duration
+func newCertificateTemplate(subjectName string, pub crypto.PublicKey, validity time.Duration) (*x509.Certificate, error) {
+	serial, err := randomSerialNumber()
+	if err != nil {
+		return nil, err
+	}
+	ski, err := subjectKeyID(pub)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	return &x509.Certificate{
+		SerialNumber: serial,
+		Subject: pkix.Name{
+			CommonName: subjectName,
+		},
+		// Allow for clock skew between machines
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              now.Add(validity),
+		SubjectKeyId:          ski,
+		BasicConstraintsValid: true,
+	}, nil
+}
+
+// newLeafTemplate returns an end-entity certificate template for the given
+// extended key usage
+func newLeafTemplate(subjectName string, usage x509.ExtKeyUsage, pub crypto.PublicKey, validity time.Duration) (*x509.Certificate, error) {
+	template, err := newCertificateTemplate(subjectName, pub, validity)
+	if err != nil {
+		return nil, err
+	}
+	template.KeyUsage = x509.KeyUsageDigitalSignature
+	template.ExtKeyUsage = []x509.ExtKeyUsage{usage}
+
+	if usage == x509.ExtKeyUsageTimeStamping {
+		template.ExtraExtensions = append(template.ExtraExtensions, timestampingExtKeyUsageExtension())
+	}
+	return template, nil
+}
+
+// randomSerialNumber returns a random positive serial number of up to 128 bits
+func randomSerialNumber() (*big.Int, error) {
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate serial number: %w", err)
+	}
+	return serial.Add(serial, big.NewInt(1)), nil
+}
+
+// subjectKeyID computes a key identifier as the SHA-1 hash of the subject
+// public key (RFC 5280 section 4.2.1.2, method 1)
+func subjectKeyID(pub crypto.PublicKey) ([]byte, error) {
+	spkiDER, err := x509.MarshalPKIXPublicKey(pub)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal public key: %w", err)
+	}
+	var spki struct {
+		Algorithm        pkix.AlgorithmIdentifier
+		SubjectPublicKey asn1.BitString
+	}
+	if _, err := asn1.Unmarshal(spkiDER, &spki); err != nil {
+		return nil, fmt.Errorf("failed to decode public key: %w", err)
+	}
+	ski := sha1.Sum(spki.SubjectPublicKey.Bytes)
+	return ski[:], nil
+}
+
+// timestampingExtKeyUsageExtension returns the critical extended key usage
+// extension RFC 3161 requires on time-stamping certificates
+func timestampingExtKeyUsageExtension() pkix.Extension {
+	ekuValue, _ := asn1.Marshal([]asn1.ObjectIdentifier{oidExtKeyUsageTimeStamping})
+	return pkix.Extension{
+		Id:       oidExtensionExtKeyUsage,
+		Critical: true,
+		Value:    ekuValue,
+	}
+}
+
+// getDataDirectory returns the directory the tool keeps its data in
+func getDataDirectory() (string, error) {
 	if runtime.GOOS == "windows" {
 		// Use AppData on Windows
 		appData := os.Getenv("APPDATA")
 		if appData == "" {
 			appData = filepath.Join(os.Getenv("USERPROFILE"), "AppData", "Roaming")
 		}
-		certDir = filepath.Join(appData, "selfsign-path-tool", "certificates")
-	} else {
-		// Use ~/.local/share on Unix-like systems
-		homeDir, err := os.UserHomeDir()
-		if err != nil {
-			// Fallback to /tmp
-			certDir = "/tmp/selfsign-path-tool-certificates"
-		} else {
-			certDir = filepath.Join(homeDir, ".local", "share", "selfsign-path-tool", "certificates")
-		}
+		return filepath.Join(appData, "selfsign-path-tool"), nil
+	}
+
+	// Use ~/.local/share on Unix-like systems
+	homeDir, err := os.UserHomeDir()
+	if err != nil {
+		return "", err
 	}
+	return filepath.Join(homeDir, ".local", "share", "selfsign-path-tool"), nil
+}
 
-	// Create directory if it doesn't exist
+// certificateDirectoryPath returns the directory where certificates are
+// stored, without creating it
+func certificateDirectoryPath() string {
+	if dataDir, err := getDataDirectory(); err == nil {
+		return filepath.Join(dataDir, "certificates")
+	}
+	// Fallback to /tmp
+	return "/tmp/selfsign-path-tool-certificates"
+}
+
+// getCertificateDirectory returns the directory where certificates are stored
+func getCertificateDirectory() string {
+	certDir := certificateDirectoryPath()
+
+	// Create directory if it doesn't exist; the warning goes to stderr, as
+	// stdout may carry a report
 	if err := os.MkdirAll(certDir, 0700); err != nil {
-		fmt.Printf("Warning: Failed to create certificate directory %s: %v\n", certDir, err)
+		fmt.Fprintf(os.Stderr, "Warning: Failed to create certificate directory %s: %v\n", certDir, err)
 	}
 
 	return certDir
 }
 
 // saveCertificateFiles saves the certificate and private key to disk
-func saveCertificateFiles(subjectName string, cert *x509.Certificate, privateKey *rsa.PrivateKey) error {
+func saveCertificateFiles(w io.Writer, subjectName string, cert *x509.Certificate, privateKey crypto.Signer) error {
 	certDir := getCertificateDirectory()
-	
+
+	// Keys that replace an encrypted key, or that join an encrypted root CA,
+	// stay encrypted without --encrypt-key
+	keyFile := filepath.Join(certDir, fmt.Sprintf("%s.key", subjectName))
+	encrypt := *flagEncryptKey || isEncryptedKeyFile(keyFile) ||
+		isEncryptedKeyFile(filepath.Join(certDir, fmt.Sprintf("%s.key", localRootCAName)))
+
+	var keyBlock *pem.Block
+	if encrypt {
+		passphrase, err := getNewKeyPassphrase()
+		if err != nil {
+			return err
+		}
+		if keyBlock, err = encryptPrivateKey(privateKey, passphrase); err != nil {
+			return err
+		}
+	} else {
+		privateKeyBytes, err := x509.MarshalPKCS8PrivateKey(privateKey)
+		if err != nil {
+			return fmt.Errorf("failed to marshal private key: %w", err)
+		}
+		keyBlock = &pem.Block{
+			Type:  "PRIVATE KEY",
+			Bytes: privateKeyBytes,
+		}
+	}
+
 	// Save certificate
 	certFile := filepath.Join(certDir, fmt.Sprintf("%s.crt", subjectName))
 	certOut, err := os.Create(certFile)
@@ -199,30 +557,91 @@ func saveCertificateFiles(subjectName string, cert *x509.Certificate, privateKey
 		return fmt.Errorf("failed to write certificate: %w", err)
 	}
 
-	// Save private key
-	keyFile := filepath.Join(certDir, fmt.Sprintf("%s.key", subjectName))
-	keyOut, err := os.Create(keyFile)
+	// Save private key, readable by the owner only from the start; an
+	// existing key file keeps its mode, so it is tightened too
+	keyOut, err := os.OpenFile(keyFile, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
 	if err != nil {
 		return fmt.Errorf("failed to create key file: %w", err)
 	}
 	defer keyOut.Close()
 
 	if err := keyOut.Chmod(0600); err != nil {
-		fmt.Printf("Warning: Failed to set key file permissions: %v\n", err)
-	}
-
-	privateKeyBytes, err := x509.MarshalPKCS8PrivateKey(privateKey)
-	if err != nil {
-		return fmt.Errorf("failed to marshal private key: %w", err)
+		return fmt.Errorf("failed to set key file permissions: %w", err)
 	}
 
-	if err := pem.Encode(keyOut, &pem.Block{
-		Type:  "PRIVATE KEY",
-		Bytes: privateKeyBytes,
-	}); err != nil {
+	if err := pem.Encode(keyOut, keyBlock); err != nil {
 		return fmt.Errorf("failed to write private key: %w", err)
 	}
 
-	fmt.Printf("Saved certificate files to: %s\n", certDir)
+	fmt.Fprintf(w, "Saved certificate files to: %s\n", certDir)
 	return nil
-}
\ No newline at end of file
+}
+
+// getOwnCertificates returns the certificates this tool signs with: every
+// stored identity plus the configured ones, such as the signing certificate
+func getOwnCertificates(configured ...*x509.Certificate) []*x509.Certificate {
+	var certs []*x509.Certificate
+
+	certFiles, _ := filepath.Glob(filepath.Join(certificateDirectoryPath(), "*.crt"))
+
+	for _, certFile := range certFiles {
+		certData, err := os.ReadFile(certFile)
+		if err != nil {
+			continue
+		}
+		if certBlock, _ := pem.Decode(certData); certBlock != nil {
+			certData = certBlock.Bytes
+		}
+		if cert, err := x509.ParseCertificate(certData); err == nil {
+			certs = append(certs, cert)
+		}
+	}
+
+	return append(certs, configured...)
+}
+
+// loadOwnCertificates returns getOwnCertificates with the certificate given
+// with --cert-file or --pfx, for runs that do not load the signing identity.
+// It reads, and decrypts, those files, so a run calls it once and passes the
+// certificates down
+func loadOwnCertificates() []*x509.Certificate {
+	var configured []*x509.Certificate
+
+	// Issuers in a --cert-file bundle are not ours, only the end-entity certificate is
+	if *flagCertFile != "" {
+		if bundle, err := readCertificateFile(*flagCertFile); err == nil {
+			for _, cert := range bundle {
+				if !cert.IsCA {
+					configured = append(configured, cert)
+				}
+			}
+		}
+	}
+
+	if *flagPFXFile != "" {
+		if password, err := getPFXPassword(*flagPFXPasswordFile); err == nil {
+			if pfxCert, err := loadCertificateFromPFX(*flagPFXFile, password); err == nil {
+				configured = append(configured, pfxCert.Cert)
+			}
+		}
+	}
+
+	return getOwnCertificates(configured...)
+}
+
+// isOwnCertificate reports whether a signer certificate belongs to this tool,
+// either because its key matches a stored or configured certificate, or
+// because it was issued by a stored CA such as the local root. The subject
+// name alone proves nothing, as another copy of the tool uses the same names
+func isOwnCertificate(cert *x509.Certificate, ownCerts []*x509.Certificate) bool {
+	for _, own := range ownCerts {
+		if bytes.Equal(cert.RawSubjectPublicKeyInfo, own.RawSubjectPublicKeyInfo) {
+			return true
+		}
+		// Certificates rotated out of the directory still chain to the root
+		if own.IsCA && cert.CheckSignatureFrom(own) == nil {
+			return true
+		}
+	}
+	return false
+}
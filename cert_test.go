@@ -0,0 +1,204 @@
+package main
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"io"
+	"math/big"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestKeyTypesSignAndVerify(t *testing.T) {
+	_, opensslErr := exec.LookPath("openssl")
+
+	for _, keyType := range []string{"rsa2048", "p256", "p384", "ed25519"} {
+		t.Run(keyType, func(t *testing.T) {
+			key, err := generatePrivateKey(keyType)
+			if err != nil {
+				t.Fatalf("Failed to generate %s key: %v", keyType, err)
+			}
+			cert := newTestCertificateWithKey(t, "LocalSign-Test", key)
+			trustTestCertificate(t, cert)
+
+			peFile := signTestPE(t, cert)
+			if status, err := getFileSignatureStatus(peFile, nil); err != nil || status.Status != StatusValid {
+				t.Errorf("Expected valid Authenticode signature, got %+v (%v)", status, err)
+			}
+			if keyType == "ed25519" {
+				// RFC 8419 pairs Ed25519 with SHA-512
+				data, _ := os.ReadFile(peFile)
+				img, _ := parsePEImage(data)
+				entries, _ := img.certificates()
+				sd, err := parseSignedData(entries[0].Certificate)
+				if err != nil {
+					t.Fatalf("Failed to parse signature: %v", err)
+				}
+				if hash, err := hashFromAlgorithmID(sd.SignerInfos[0].DigestAlgorithm); err != nil || hash != crypto.SHA512 {
+					t.Errorf("Expected an Ed25519 signature over SHA-512, got %v (%v)", hash, err)
+				}
+
+				module := filepath.Join(t.TempDir(), "module.ko")
+				os.WriteFile(module, []byte("\x7fELF module"), 0644)
+				if err := signELFFile(module, cert, defaultSignOptions()); err == nil || !strings.Contains(err.Error(), "Ed25519 cannot sign kernel modules") {
+					t.Errorf("Expected Ed25519 module signing to be rejected, got %v", err)
+				}
+			}
+
+			dir := t.TempDir()
+			dataFile := filepath.Join(dir, "data.bin")
+			os.WriteFile(dataFile, []byte("payload to sign"), 0644)
+			if err := signDetachedFile(dataFile, cert, defaultSignOptions()); err != nil {
+				t.Fatalf("Failed to sign file: %v", err)
+			}
+			if status, err := verifyDetachedFile(dataFile); err != nil || status.Status != StatusValid {
+				t.Errorf("Expected valid detached signature, got %+v (%v)", status, err)
+			}
+
+			// OpenSSL 3.0 can't verify Ed25519 CMS signatures itself
+			if opensslErr != nil || keyType == "ed25519" {
+				return
+			}
+			caFile := filepath.Join(dir, "ca.pem")
+			os.WriteFile(caFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Cert.Raw}), 0644)
+			cmd := exec.Command("openssl", "cms", "-verify", "-binary", "-inform", "DER",
+				"-in", dataFile+detachedSignatureExt, "-content", dataFile,
+				"-CAfile", caFile, "-purpose", "any", "-out", os.DevNull)
+			if output, err := cmd.CombinedOutput(); err != nil {
+				t.Errorf("openssl cms -verify failed: %v\n%s", err, output)
+			}
+		})
+	}
+}
+
+func TestGeneratePrivateKeyRejectsUnknownType(t *testing.T) {
+	if _, err := generatePrivateKey("dsa1024"); err == nil {
+		t.Error("Expected an error for an unsupported key type")
+	}
+	if isValidKeyType("dsa1024") || !isValidKeyType("p384") {
+		t.Error("isValidKeyType does not match the supported key types")
+	}
+}
+
+func TestLoadCertificateSEC1Key(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Failed to generate key: %v", err)
+	}
+	cert := newTestCertificateWithKey(t, "LocalSign-Test", key)
+
+	dir := t.TempDir()
+	certFile := filepath.Join(dir, "signer.crt")
+	keyFile := filepath.Join(dir, "signer.key")
+	os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Cert.Raw}), 0644)
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatalf("Failed to marshal key: %v", err)
+	}
+	os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600)
+
+	loaded, err := loadCertificateFromFile(certFile, keyFile)
+	if err != nil {
+		t.Fatalf("Failed to load SEC1 key: %v", err)
+	}
+	if _, ok := loaded.PrivateKey.(*ecdsa.PrivateKey); !ok {
+		t.Errorf("Expected an ECDSA key, got %T", loaded.PrivateKey)
+	}
+
+	// A key that doesn't belong to the certificate is rejected
+	other, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	otherDER, _ := x509.MarshalECPrivateKey(other)
+	os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: otherDER}), 0600)
+	if _, err := loadCertificateFromFile(certFile, keyFile); err == nil || !strings.Contains(err.Error(), "does not match") {
+		t.Errorf("Expected mismatched key to be rejected, got %v", err)
+	}
+}
+
+func TestIssueCertificateFromLocalRoot(t *testing.T) {
+	root, err := createLocalRootCA(localRootCAName, "p256")
+	if err != nil {
+		t.Fatalf("Failed to create root CA: %v", err)
+	}
+	if !root.Cert.IsCA || !root.Cert.MaxPathLenZero || len(root.Cert.SubjectKeyId) == 0 {
+		t.Errorf("Root CA has wrong basic constraints or no SKI: %+v", root.Cert)
+	}
+
+	leaf, err := issueCertificate(root, "LocalSign-Test", x509.ExtKeyUsageCodeSigning, "p256")
+	if err != nil {
+		t.Fatalf("Failed to issue certificate: %v", err)
+	}
+	if leaf.Cert.IsCA || leaf.Cert.SerialNumber.Cmp(big.NewInt(1)) == 0 {
+		t.Errorf("Leaf should be a non-CA certificate with a random serial")
+	}
+	if !bytes.Equal(leaf.Cert.AuthorityKeyId, root.Cert.SubjectKeyId) || len(leaf.Cert.SubjectKeyId) == 0 {
+		t.Errorf("Leaf AKI/SKI do not link to the root")
+	}
+	if len(leaf.Chain) != 1 || leaf.Chain[0] != root.Cert {
+		t.Errorf("Expected the root in the leaf's chain, got %d certificates", len(leaf.Chain))
+	}
+
+	// Trusting only the root is enough for signatures made with the leaf
+	trustTestCertificate(t, root)
+	filename := signTestPE(t, leaf)
+	if status, err := getFileSignatureStatus(filename, nil); err != nil || status.Status != StatusValid || status.IsSelfSigned {
+		t.Errorf("Expected valid signature chaining to the root, got %+v (%v)", status, err)
+	}
+}
+
+func TestGetOrCreateSigningCertificateRenews(t *testing.T) {
+	t.Setenv("HOME", t.TempDir())
+
+	// An existing root CA keeps the test from touching the system trust store
+	root, err := createLocalRootCA(localRootCAName, "p256")
+	if err != nil {
+		t.Fatalf("Failed to create root CA: %v", err)
+	}
+	if err := saveCertificateFiles(io.Discard, localRootCAName, root.Cert, root.PrivateKey); err != nil {
+		t.Fatalf("Failed to save root CA: %v", err)
+	}
+
+	first, err := getOrCreateSigningCertificate(io.Discard, "LocalSign-Test")
+	if err != nil {
+		t.Fatalf("Failed to issue certificate: %v", err)
+	}
+	if err := first.Cert.CheckSignatureFrom(root.Cert); err != nil {
+		t.Fatalf("Certificate was not issued by the local root: %v", err)
+	}
+
+	second, err := getOrCreateSigningCertificate(io.Discard, "LocalSign-Test")
+	if err != nil {
+		t.Fatalf("Failed to load certificate: %v", err)
+	}
+	if second.Cert.SerialNumber.Cmp(first.Cert.SerialNumber) != 0 || len(second.Chain) != 1 {
+		t.Errorf("Expected the stored certificate to be reused with its chain")
+	}
+
+	// A certificate close to expiry is replaced by a new one from the same root
+	template, _ := newLeafTemplate("LocalSign-Test", x509.ExtKeyUsageCodeSigning, first.PrivateKey.Public(), 24*time.Hour)
+	expiringDER, err := x509.CreateCertificate(rand.Reader, template, root.Cert, first.PrivateKey.Public(), root.PrivateKey)
+	if err != nil {
+		t.Fatalf("Failed to create expiring certificate: %v", err)
+	}
+	expiring, _ := x509.ParseCertificate(expiringDER)
+	saveCertificateFiles(io.Discard, "LocalSign-Test", expiring, first.PrivateKey)
+
+	renewed, err := getOrCreateSigningCertificate(io.Discard, "LocalSign-Test")
+	if err != nil {
+		t.Fatalf("Failed to renew certificate: %v", err)
+	}
+	if renewed.Cert.SerialNumber.Cmp(expiring.SerialNumber) == 0 || time.Until(renewed.Cert.NotAfter) < issuedCertificateRenewBefore {
+		t.Errorf("Expected a freshly issued certificate")
+	}
+	if !isOwnCertificate(expiring, getOwnCertificates()) {
+		t.Errorf("Rotated certificates from the local root should still count as our own")
+	}
+}
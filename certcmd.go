@@ -0,0 +1,437 @@
+package main
+
+import (
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// certCommandUsage summarizes the "cert" subcommands
+const certCommandUsage = `usage: selfsign-path cert list
+       selfsign-path cert show [-n CERT_NAME]
+       selfsign-path cert create [-n CERT_NAME] [--key-type TYPE] [--force]
+       selfsign-path cert delete -n CERT_NAME
+       selfsign-path cert export [--format pfx|pem|der] [-n CERT_NAME] [-o FILE] [--password-file FILE]
+       selfsign-path cert import [-n CERT_NAME] [--key KEY_FILE] [--password-file FILE] [--force] FILE`
+
+// storedIdentity is a certificate in the certificate directory
+type storedIdentity struct {
+	Name     string
+	Cert     *x509.Certificate
+	CertFile string
+	KeyFile  string
+}
+
+// runCertCommand handles the "cert" subcommand
+func runCertCommand(args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf(certCommandUsage)
+	}
+
+	switch args[0] {
+	case "list":
+		return runCertListCommand(args[1:])
+	case "show":
+		return runCertShowCommand(args[1:])
+	case "create":
+		return runCertCreateCommand(args[1:])
+	case "delete":
+		return runCertDeleteCommand(args[1:])
+	case "export":
+		return runCertExportCommand(args[1:])
+	case "import":
+		return runCertImportCommand(args[1:])
+	}
+	return fmt.Errorf("unknown cert command %q\n%s", args[0], certCommandUsage)
+}
+
+// listStoredIdentities returns the certificates in the certificate directory,
+// sorted by name
+func listStoredIdentities() ([]storedIdentity, error) {
+	certDir := getCertificateDirectory()
+	certFiles, err := filepath.Glob(filepath.Join(certDir, "*.crt"))
+	if err != nil {
+		return nil, err
+	}
+
+	var identities []storedIdentity
+	for _, certFile := range certFiles {
+		certs, err := readCertificateFile(certFile)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Warning: %v\n", err)
+			continue
+		}
+		name := strings.TrimSuffix(filepath.Base(certFile), ".crt")
+		identities = append(identities, storedIdentity{
+			Name:     name,
+			Cert:     certs[0],
+			CertFile: certFile,
+			KeyFile:  filepath.Join(certDir, name+".key"),
+		})
+	}
+	return identities, nil
+}
+
+// findStoredIdentity returns the stored identity with the given name
+func findStoredIdentity(name string) (*storedIdentity, error) {
+	certDir := getCertificateDirectory()
+	certFile := filepath.Join(certDir, name+".crt")
+	certs, err := readCertificateFile(certFile)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, fmt.Errorf("no stored certificate named %q (see \"selfsign-path cert list\")", name)
+		}
+		return nil, err
+	}
+	return &storedIdentity{
+		Name:     name,
+		Cert:     certs[0],
+		CertFile: certFile,
+		KeyFile:  filepath.Join(certDir, name+".key"),
+	}, nil
+}
+
+// trustStatus describes whether cert is trusted through the trust store,
+// either directly or through the installed local root CA
+func trustStatus(cert *x509.Certificate, root *x509.Certificate, rootInstalled bool) string {
+	switch {
+	case isCertificateInstalled(cert):
+		return "installed"
+	case root != nil && rootInstalled && !cert.Equal(root) && cert.CheckSignatureFrom(root) == nil:
+		return "via root"
+	}
+	return "no"
+}
+
+// validityStatus describes where now falls in the certificate validity period
+func validityStatus(cert *x509.Certificate) string {
+	now := time.Now()
+	switch {
+	case now.Before(cert.NotBefore):
+		return "not yet valid"
+	case now.After(cert.NotAfter):
+		return "expired"
+	}
+	return fmt.Sprintf("valid, %d days left", int(time.Until(cert.NotAfter).Hours()/24))
+}
+
+// certificateFingerprint returns the SHA-256 fingerprint as hex
+func certificateFingerprint(cert *x509.Certificate) string {
+	sum := sha256.Sum256(cert.Raw)
+	return hex.EncodeToString(sum[:])
+}
+
+// runCertListCommand prints a table of the stored identities
+func runCertListCommand(args []string) error {
+	fs := flag.NewFlagSet("cert list", flag.ContinueOnError)
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	}
+
+	identities, err := listStoredIdentities()
+	if err != nil {
+		return err
+	}
+	if len(identities) == 0 {
+		fmt.Printf("No certificates stored in %s\n", getCertificateDirectory())
+		return nil
+	}
+
+	var root *x509.Certificate
+	var rootInstalled bool
+	if rootCA, err := findStoredIdentity(localRootCAName); err == nil {
+		root = rootCA.Cert
+		rootInstalled = isCertificateInstalled(root)
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "NAME\tSUBJECT\tKEY\tVALID FROM\tVALID UNTIL\tTRUSTED\tSHA-256")
+	for _, id := range identities {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\t%s\n",
+			id.Name,
+			id.Cert.Subject.CommonName,
+			describeKeyType(id.Cert.PublicKey),
+			id.Cert.NotBefore.Format("2006-01-02"),
+			id.Cert.NotAfter.Format("2006-01-02"),
+			trustStatus(id.Cert, root, rootInstalled),
+			certificateFingerprint(id.Cert)[:16],
+		)
+	}
+	return w.Flush()
+}
+
+// runCertShowCommand prints the details of one stored identity
+func runCertShowCommand(args []string) error {
+	fs := flag.NewFlagSet("cert show", flag.ContinueOnError)
+	name := fs.String("n", "LocalSign-SelfSigned", "Subject name of the stored certificate to show")
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	}
+
+	id, err := findStoredIdentity(*name)
+	if err != nil {
+		return err
+	}
+	cert := id.Cert
+
+	var root *x509.Certificate
+	var rootInstalled bool
+	if rootCA, err := findStoredIdentity(localRootCAName); err == nil {
+		root = rootCA.Cert
+		rootInstalled = isCertificateInstalled(root)
+	}
+
+	usage := "code signing"
+	switch {
+	case cert.IsCA:
+		usage = "certificate authority"
+	case len(cert.ExtKeyUsage) > 0 && cert.ExtKeyUsage[0] == x509.ExtKeyUsageTimeStamping:
+		usage = "time stamping"
+	}
+
+	keyStatus := "missing"
+	if isEncryptedKeyFile(id.KeyFile) {
+		keyStatus = "encrypted"
+	} else if _, err := os.Stat(id.KeyFile); err == nil {
+		keyStatus = "plain"
+	}
+
+	sha1Sum := sha1.Sum(cert.Raw)
+	fmt.Printf("Name:          %s\n", id.Name)
+	fmt.Printf("Subject:       %s\n", cert.Subject)
+	fmt.Printf("Issuer:        %s\n", cert.Issuer)
+	fmt.Printf("Serial:        %x\n", cert.SerialNumber)
+	fmt.Printf("Key type:      %s\n", describeKeyType(cert.PublicKey))
+	fmt.Printf("Usage:         %s\n", usage)
+	fmt.Printf("Valid from:    %s\n", cert.NotBefore.Format(time.RFC3339))
+	fmt.Printf("Valid until:   %s (%s)\n", cert.NotAfter.Format(time.RFC3339), validityStatus(cert))
+	fmt.Printf("SHA-1:         %X\n", sha1Sum)
+	fmt.Printf("SHA-256:       %s\n", certificateFingerprint(cert))
+	fmt.Printf("Trusted:       %s\n", trustStatus(cert, root, rootInstalled))
+	fmt.Printf("Certificate:   %s\n", id.CertFile)
+	fmt.Printf("Private key:   %s (%s)\n", id.KeyFile, keyStatus)
+	return nil
+}
+
+// runCertCreateCommand issues a new code signing certificate from the local
+// root CA, replacing a stored one only with --force
+func runCertCreateCommand(args []string) error {
+	fs := flag.NewFlagSet("cert create", flag.ContinueOnError)
+	name := fs.String("n", "LocalSign-SelfSigned", "Subject name of the certificate to create")
+	keyType := fs.String("key-type", "rsa2048", "Key type (rsa2048, rsa4096, p256, p384, ed25519)")
+	force := fs.Bool("force", false, "Replace a stored certificate with the same name")
+	fs.BoolVar(flagEncryptKey, "encrypt-key", false, "Encrypt the private key with the key passphrase")
+	fs.StringVar(flagPassphraseFile, "passphrase-file", "", "Read the key passphrase from this file instead of $"+keyPassphraseEnv)
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	}
+
+	if !isValidKeyType(*keyType) {
+		return fmt.Errorf("unsupported key type %q (use %s)", *keyType, strings.Join(keyTypes, ", "))
+	}
+	if *name == localRootCAName {
+		return fmt.Errorf("%s is created automatically when the first certificate is issued", localRootCAName)
+	}
+	if _, err := findStoredIdentity(*name); err == nil && !*force {
+		return fmt.Errorf("certificate %s already exists; use --force to replace it", *name)
+	}
+
+	root, err := getOrCreateLocalRootCA(os.Stdout, *keyType)
+	if err != nil {
+		return fmt.Errorf("failed to obtain local root CA: %w", err)
+	}
+
+	cert, err := issueCertificate(root, *name, x509.ExtKeyUsageCodeSigning, *keyType)
+	if err != nil {
+		return err
+	}
+	if err := saveCertificateFiles(os.Stdout, *name, cert.Cert, cert.PrivateKey); err != nil {
+		return fmt.Errorf("failed to save certificate: %w", err)
+	}
+
+	fmt.Printf("Created %s (%s, valid until %s)\n", *name, *keyType, cert.Cert.NotAfter.Format("2006-01-02"))
+	return nil
+}
+
+// runCertDeleteCommand removes a stored identity's certificate and key files
+func runCertDeleteCommand(args []string) error {
+	fs := flag.NewFlagSet("cert delete", flag.ContinueOnError)
+	name := fs.String("n", "", "Subject name of the stored certificate to delete")
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	}
+
+	if *name == "" {
+		return fmt.Errorf("cert delete requires -n CERT_NAME")
+	}
+	id, err := findStoredIdentity(*name)
+	if err != nil {
+		return err
+	}
+
+	if err := os.Remove(id.CertFile); err != nil {
+		return fmt.Errorf("failed to delete %s: %w", id.CertFile, err)
+	}
+	if err := os.Remove(id.KeyFile); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to delete %s: %w", id.KeyFile, err)
+	}
+
+	fmt.Printf("Deleted certificate %s\n", id.Name)
+	if id.Cert.IsCA {
+		fmt.Printf("Certificates it issued are no longer renewed; a new root CA is created with the next certificate.\n")
+	}
+	if isCertificateInstalled(id.Cert) {
+		fmt.Printf("Note: the certificate is still installed in the system trust store.\n")
+	}
+	return nil
+}
+
+// runCertExportCommand writes a stored signing identity to a file
+func runCertExportCommand(args []string) error {
+	fs := flag.NewFlagSet("cert export", flag.ContinueOnError)
+	format := fs.String("format", "pfx", "Output format: pfx (with private key), pem (certificate chain) or der (certificate)")
+	name := fs.String("n", "LocalSign-SelfSigned", "Subject name of the stored certificate to export")
+	output := fs.String("o", "", "Output file (default CERT_NAME.pfx, .pem or .cer)")
+	passwordFile := fs.String("password-file", "", "Read the PFX password from this file instead of $"+pfxPasswordEnv)
+	fs.StringVar(flagPassphraseFile, "passphrase-file", "", "Read the key passphrase from this file instead of $"+keyPassphraseEnv)
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	}
+
+	var data []byte
+	var ext, contents string
+	switch *format {
+	case "pfx":
+		cert, err := loadStoredCertificate(*name)
+		if err != nil {
+			return fmt.Errorf("failed to load certificate %s: %w", *name, err)
+		}
+
+		password, err := getPFXPassword(*passwordFile)
+		if err != nil {
+			return err
+		}
+
+		if data, err = encodePFX(cert, password); err != nil {
+			return err
+		}
+		ext = ".pfx"
+		contents = fmt.Sprintf("%s with %d issuer certificate(s)", cert.Subject, len(cert.Chain))
+
+	case "pem", "der":
+		// Certificates only, so the private key is never decrypted
+		id, err := findStoredIdentity(*name)
+		if err != nil {
+			return err
+		}
+		certs, err := readCertificateFile(id.CertFile)
+		if err != nil {
+			return err
+		}
+		if root, err := findStoredIdentity(localRootCAName); err == nil && id.Name != localRootCAName && id.Cert.CheckSignatureFrom(root.Cert) == nil {
+			certs = append(certs, root.Cert)
+		}
+
+		if *format == "der" {
+			data, ext = id.Cert.Raw, ".cer"
+			contents = id.Cert.Subject.CommonName
+		} else {
+			for _, cert := range certs {
+				data = append(data, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw})...)
+			}
+			ext = ".pem"
+			contents = fmt.Sprintf("%s with %d issuer certificate(s)", id.Cert.Subject.CommonName, len(certs)-1)
+		}
+
+	default:
+		return fmt.Errorf("unsupported export format %q", *format)
+	}
+
+	outFile := *output
+	if outFile == "" {
+		outFile = *name + ext
+	}
+	if err := os.WriteFile(outFile, data, 0600); err != nil {
+		return fmt.Errorf("failed to write %s: %w", outFile, err)
+	}
+
+	fmt.Printf("Exported %s to: %s\n", contents, outFile)
+	return nil
+}
+
+// runCertImportCommand stores an identity from a PFX file, or from a
+// certificate and key file, in the certificate directory
+func runCertImportCommand(args []string) error {
+	fs := flag.NewFlagSet("cert import", flag.ContinueOnError)
+	name := fs.String("n", "", "Name to store the identity under (default: the certificate subject)")
+	keyFile := fs.String("key", "", "Private key file, when FILE is a certificate rather than a PFX file")
+	passwordFile := fs.String("password-file", "", "Read the PFX password from this file instead of $"+pfxPasswordEnv)
+	force := fs.Bool("force", false, "Replace a stored certificate with the same name")
+	fs.BoolVar(flagEncryptKey, "encrypt-key", false, "Encrypt the stored private key with the key passphrase")
+	fs.StringVar(flagPassphraseFile, "passphrase-file", "", "Read the key passphrase from this file instead of $"+keyPassphraseEnv)
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	}
+
+	if fs.NArg() != 1 {
+		return fmt.Errorf("cert import requires exactly one FILE\n%s", certCommandUsage)
+	}
+	file := fs.Arg(0)
+
+	var cert *Certificate
+	var err error
+	if *keyFile != "" {
+		cert, err = loadCertificateFromFile(file, *keyFile)
+	} else {
+		var password string
+		if password, err = getPFXPassword(*passwordFile); err != nil {
+			return err
+		}
+		cert, err = loadCertificateFromPFX(file, password)
+	}
+	if err != nil {
+		return err
+	}
+
+	storeName := *name
+	if storeName == "" {
+		storeName = cert.Cert.Subject.CommonName
+	}
+	if storeName == "" || strings.ContainsAny(storeName, `/\`) {
+		return fmt.Errorf("cannot store the certificate under %q; choose a name with -n", storeName)
+	}
+	if _, err := findStoredIdentity(storeName); err == nil && !*force {
+		return fmt.Errorf("certificate %s already exists; use --force to replace it", storeName)
+	}
+
+	if err := saveCertificateFiles(os.Stdout, storeName, cert.Cert, cert.PrivateKey); err != nil {
+		return fmt.Errorf("failed to save certificate: %w", err)
+	}
+
+	// Issuer certificates follow the signing certificate in the .crt bundle
+	if len(cert.Chain) > 0 {
+		f, err := os.OpenFile(filepath.Join(getCertificateDirectory(), storeName+".crt"), os.O_APPEND|os.O_WRONLY, 0644)
+		if err != nil {
+			return fmt.Errorf("failed to store issuer certificates: %w", err)
+		}
+		defer f.Close()
+		for _, issuer := range cert.Chain {
+			if err := pem.Encode(f, &pem.Block{Type: "CERTIFICATE", Bytes: issuer.Raw}); err != nil {
+				return fmt.Errorf("failed to store issuer certificates: %w", err)
+			}
+		}
+	}
+
+	fmt.Printf("Imported %s with %d issuer certificate(s) as %s\n", cert.Cert.Subject.CommonName, len(cert.Chain), storeName)
+	return nil
+}
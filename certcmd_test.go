@@ -0,0 +1,145 @@
+package main
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// setupTestCertificateStore points the certificate directory at a temporary
+// home holding a local root CA, so no command touches the system trust store
+func setupTestCertificateStore(t *testing.T) *Certificate {
+	t.Helper()
+	t.Setenv("HOME", t.TempDir())
+
+	root, err := createLocalRootCA(localRootCAName, "p256")
+	if err != nil {
+		t.Fatalf("Failed to create root CA: %v", err)
+	}
+	if err := saveCertificateFiles(io.Discard, localRootCAName, root.Cert, root.PrivateKey); err != nil {
+		t.Fatalf("Failed to save root CA: %v", err)
+	}
+	return root
+}
+
+func TestCertCreateListDelete(t *testing.T) {
+	root := setupTestCertificateStore(t)
+
+	if err := runCertCommand([]string{"create", "-n", "LocalSign-Test", "--key-type", "p384"}); err != nil {
+		t.Fatalf("cert create failed: %v", err)
+	}
+	if err := runCertCommand([]string{"create", "-n", "LocalSign-Test"}); err == nil {
+		t.Error("Expected cert create to refuse replacing an existing certificate")
+	}
+	if err := runCertCommand([]string{"create", "-n", localRootCAName}); err == nil {
+		t.Error("Expected cert create to refuse creating the root CA")
+	}
+
+	identities, err := listStoredIdentities()
+	if err != nil || len(identities) != 2 {
+		t.Fatalf("Expected the root and one issued certificate, got %d (%v)", len(identities), err)
+	}
+	created := identities[1]
+	if created.Name != "LocalSign-Test" || describeKeyType(created.Cert.PublicKey) != "p384" {
+		t.Errorf("Unexpected stored identity %s (%s)", created.Name, describeKeyType(created.Cert.PublicKey))
+	}
+	if err := created.Cert.CheckSignatureFrom(root.Cert); err != nil {
+		t.Errorf("Created certificate was not issued by the local root: %v", err)
+	}
+
+	if err := runCertCommand([]string{"create", "-n", "LocalSign-Test", "--force"}); err != nil {
+		t.Fatalf("cert create --force failed: %v", err)
+	}
+	replaced, _ := findStoredIdentity("LocalSign-Test")
+	if replaced.Cert.Equal(created.Cert) || describeKeyType(replaced.Cert.PublicKey) != "rsa2048" {
+		t.Error("Expected --force to replace the certificate")
+	}
+
+	if err := runCertCommand([]string{"list"}); err != nil {
+		t.Errorf("cert list failed: %v", err)
+	}
+	if err := runCertCommand([]string{"show", "-n", "LocalSign-Test"}); err != nil {
+		t.Errorf("cert show failed: %v", err)
+	}
+
+	if err := runCertCommand([]string{"delete"}); err == nil {
+		t.Error("Expected cert delete without -n to fail")
+	}
+	if err := runCertCommand([]string{"delete", "-n", "LocalSign-Test"}); err != nil {
+		t.Fatalf("cert delete failed: %v", err)
+	}
+	for _, ext := range []string{".crt", ".key"} {
+		if _, err := os.Stat(filepath.Join(getCertificateDirectory(), "LocalSign-Test"+ext)); !os.IsNotExist(err) {
+			t.Errorf("Expected LocalSign-Test%s to be deleted", ext)
+		}
+	}
+	if err := runCertCommand([]string{"show", "-n", "LocalSign-Test"}); err == nil {
+		t.Error("Expected cert show of a deleted certificate to fail")
+	}
+}
+
+func TestCertExportImport(t *testing.T) {
+	root := setupTestCertificateStore(t)
+	t.Setenv(pfxPasswordEnv, "s3cret")
+	dir := t.TempDir()
+
+	if err := runCertCommand([]string{"create", "-n", "LocalSign-Test"}); err != nil {
+		t.Fatalf("cert create failed: %v", err)
+	}
+	pfxFile := filepath.Join(dir, "test.pfx")
+	pemFile := filepath.Join(dir, "test.pem")
+	if err := runCertCommand([]string{"export", "-n", "LocalSign-Test", "-o", pfxFile}); err != nil {
+		t.Fatalf("cert export failed: %v", err)
+	}
+	if err := runCertCommand([]string{"export", "-n", "LocalSign-Test", "--format", "pem", "-o", pemFile}); err != nil {
+		t.Fatalf("cert export --format pem failed: %v", err)
+	}
+	if certs, err := readCertificateFile(pemFile); err != nil || len(certs) != 2 || !certs[1].Equal(root.Cert) {
+		t.Errorf("Expected the PEM export to hold the certificate and root CA")
+	}
+
+	// The PFX is imported under a new name with its issuer
+	if err := runCertCommand([]string{"import", "-n", "Imported", pfxFile}); err != nil {
+		t.Fatalf("cert import failed: %v", err)
+	}
+	if err := runCertCommand([]string{"import", "-n", "Imported", pfxFile}); err == nil {
+		t.Error("Expected cert import to refuse replacing an existing certificate")
+	}
+	imported, err := loadStoredCertificate("Imported")
+	if err != nil {
+		t.Fatalf("Failed to load imported identity: %v", err)
+	}
+	original, _ := findStoredIdentity("LocalSign-Test")
+	if !imported.Cert.Equal(original.Cert) || len(imported.Chain) != 1 {
+		t.Error("Imported identity does not match the exported one")
+	}
+
+	// A certificate and key pair is imported under its subject name
+	if err := runCertCommand([]string{"delete", "-n", "LocalSign-Test"}); err != nil {
+		t.Fatalf("cert delete failed: %v", err)
+	}
+	keyFile := filepath.Join(getCertificateDirectory(), "Imported.key")
+	if err := runCertCommand([]string{"import", "--key", keyFile, pemFile}); err != nil {
+		t.Fatalf("cert import --key failed: %v", err)
+	}
+	if id, err := findStoredIdentity("LocalSign-Test"); err != nil || !id.Cert.Equal(original.Cert) {
+		t.Errorf("Expected the certificate to be stored under its subject name (%v)", err)
+	}
+
+	if err := runCertCommand([]string{"export", "--format", "p7b"}); err == nil {
+		t.Error("Expected an unsupported export format to fail")
+	}
+}
+
+func TestDescribeKeyType(t *testing.T) {
+	for _, keyType := range keyTypes {
+		key, err := generatePrivateKey(keyType)
+		if err != nil {
+			t.Fatalf("Failed to generate %s key: %v", keyType, err)
+		}
+		if got := describeKeyType(key.Public()); got != keyType {
+			t.Errorf("describeKeyType(%s) = %s", keyType, got)
+		}
+	}
+}
@@ -0,0 +1,357 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// File kinds told apart by classifyFile
+const (
+	fileKindPE      = "PE"
+	fileKindELF     = "ELF"
+	fileKindMachO   = "Mach-O"
+	fileKindOLE     = "OLE"
+	fileKindCAB     = "CAB"
+	fileKindZIP     = "ZIP"
+	fileKindScript  = "Script"
+	fileKindUnknown = "Unknown"
+)
+
+// classifyHeaderSize is how much of a file is read to classify it
+const classifyHeaderSize = 4096
+
+// fileClass is what a file holds, judged by its content rather than its name
+type fileClass struct {
+	Kind string
+	// Description details the kind, e.g. "PE32+ x64 .NET console executable"
+	Description string
+	// Object is set for relocatable objects, such as .o files and kernel
+	// modules, which are linked or loaded rather than run
+	Object bool
+}
+
+func (c fileClass) String() string {
+	if c.Description != "" {
+		return c.Description
+	}
+	return c.Kind
+}
+
+// isExecutable reports whether the file is a native executable, library or
+// driver, the files worth signing wherever they are found. Relocatable
+// objects are not, so kernel modules are only picked up by extension
+func (c fileClass) isExecutable() bool {
+	return !c.Object && (c.Kind == fileKindPE || c.Kind == fileKindELF || c.Kind == fileKindMachO)
+}
+
+// extensionKinds are the kinds of content that extensions promise; a file
+// found in a directory whose content breaks the promise is skipped
+var extensionKinds = map[string]string{
+	".exe": fileKindPE, ".dll": fileKindPE, ".sys": fileKindPE, ".ocx": fileKindPE,
+	".scr": fileKindPE, ".cpl": fileKindPE, ".efi": fileKindPE, ".drv": fileKindPE,
+	".msi": fileKindOLE, ".msp": fileKindOLE, ".msm": fileKindOLE,
+	".ko": fileKindELF, ".so": fileKindELF,
+	".cab": fileKindCAB,
+}
+
+// scriptExtensions name the script languages recognised without a #! line
+var scriptExtensions = map[string]string{
+	".ps1": "PowerShell script", ".psm1": "PowerShell module", ".psd1": "PowerShell data file",
+	".vbs": "VBScript", ".js": "JScript", ".wsf": "Windows Script File",
+	".bat": "batch file", ".cmd": "batch file",
+	".sh": "shell script", ".py": "Python script",
+}
+
+// classifyFile sniffs the content of a file to tell what it is
+func classifyFile(filename string) fileClass {
+	f, err := os.Open(filename)
+	if err != nil {
+		return fileClass{Kind: fileKindUnknown}
+	}
+	defer f.Close()
+
+	header := make([]byte, classifyHeaderSize)
+	n, err := io.ReadFull(f, header)
+	if err != nil && err != io.ErrUnexpectedEOF {
+		return fileClass{Kind: fileKindUnknown}
+	}
+	header = header[:n]
+
+	switch {
+	case bytes.HasPrefix(header, []byte("MZ")):
+		if class, ok := classifyPE(f); ok {
+			return class
+		}
+	case bytes.HasPrefix(header, []byte("\x7fELF")):
+		return classifyELF(header)
+	case bytes.HasPrefix(header, []byte("\xd0\xcf\x11\xe0\xa1\xb1\x1a\xe1")):
+		return classifyOLE(f, header)
+	case bytes.HasPrefix(header, []byte("MSCF\x00\x00\x00\x00")):
+		return fileClass{Kind: fileKindCAB, Description: "Cabinet archive"}
+	case bytes.HasPrefix(header, []byte("PK\x03\x04")), bytes.HasPrefix(header, []byte("PK\x05\x06")):
+		return classifyZIP(filename)
+	}
+	if class, ok := classifyMachO(header); ok {
+		return class
+	}
+	return classifyText(filename, header)
+}
+
+// PE machine types, subsystems and header fields read by classifyPE
+var peMachines = map[uint16]string{
+	0x14c: "x86", 0x8664: "x64", 0xaa64: "ARM64", 0x1c0: "ARM", 0x1c4: "ARM",
+	0x200: "IA-64", 0xebc: "EBC", 0x5064: "RISC-V64",
+}
+
+var peSubsystems = map[uint16]string{
+	1: "native", 2: "GUI", 3: "console", 9: "Windows CE",
+	10: "EFI application", 11: "EFI boot service driver", 12: "EFI runtime driver", 13: "EFI ROM",
+	16: "boot application",
+}
+
+const (
+	peSubsystemOffset          = 68
+	peCharacteristicsDLL       = 0x2000
+	imageDirectoryEntryCLRMeta = 14
+)
+
+// classifyPE describes a PE image by its format, machine, runtime and subsystem
+func classifyPE(f *os.File) (fileClass, bool) {
+	dosHeader := make([]byte, 0x40)
+	if _, err := f.ReadAt(dosHeader, 0); err != nil {
+		return fileClass{}, false
+	}
+	peOffset := int64(binary.LittleEndian.Uint32(dosHeader[0x3c:]))
+
+	// Signature, COFF header and the largest optional header up to the CLR directory
+	headers := make([]byte, 4+20+112+16*8)
+	n, _ := f.ReadAt(headers, peOffset)
+	headers = headers[:n]
+	if len(headers) < 24 || string(headers[:4]) != "PE\x00\x00" {
+		return fileClass{}, false
+	}
+
+	coff := headers[4:24]
+	machine, ok := peMachines[binary.LittleEndian.Uint16(coff)]
+	if !ok {
+		machine = fmt.Sprintf("machine 0x%x", binary.LittleEndian.Uint16(coff))
+	}
+	role := "executable"
+	if binary.LittleEndian.Uint16(coff[18:])&peCharacteristicsDLL != 0 {
+		role = "DLL"
+	}
+
+	opt := headers[24:]
+	if len(opt) < peSubsystemOffset+2 {
+		return fileClass{Kind: fileKindPE, Description: "PE " + machine + " " + role}, true
+	}
+	format, numDirsOffset, dirsOffset := "PE32", 92, 96
+	if binary.LittleEndian.Uint16(opt) == peMagicPE32Plus {
+		format, numDirsOffset, dirsOffset = "PE32+", 108, 112
+	}
+
+	parts := []string{format, machine}
+	clrDir := dirsOffset + imageDirectoryEntryCLRMeta*8
+	if len(opt) >= clrDir+8 && binary.LittleEndian.Uint32(opt[numDirsOffset:]) > imageDirectoryEntryCLRMeta &&
+		binary.LittleEndian.Uint32(opt[clrDir:]) != 0 {
+		parts = append(parts, ".NET")
+	}
+
+	subsystem := binary.LittleEndian.Uint16(opt[peSubsystemOffset:])
+	switch name := peSubsystems[subsystem]; {
+	case strings.HasPrefix(name, "EFI"):
+		// The EFI image type says what it is better than DLL or executable
+		parts = append(parts, name)
+	case subsystem == 1 && role == "executable":
+		parts = append(parts, "driver")
+	case name != "":
+		parts = append(parts, name, role)
+	default:
+		parts = append(parts, role)
+	}
+	return fileClass{Kind: fileKindPE, Description: strings.Join(parts, " ")}, true
+}
+
+// ELF types and machines read by classifyELF
+var elfTypes = map[uint16]string{elfTypeRelocatable: "relocatable object", 2: "executable", 3: "shared object", 4: "core dump"}
+
+// elfTypeRelocatable is the ELF type of object files and kernel modules
+const elfTypeRelocatable = 1
+
+var elfMachines = map[uint16]string{
+	3: "x86", 0x3e: "x86-64", 0x28: "ARM", 0xb7: "AArch64", 0xf3: "RISC-V",
+	0x14: "PowerPC", 0x15: "PowerPC64", 0x16: "s390", 0x08: "MIPS", 0x102: "LoongArch",
+}
+
+// classifyELF describes an ELF file by its class, machine and type
+func classifyELF(header []byte) fileClass {
+	if len(header) < 20 {
+		return fileClass{Kind: fileKindELF, Description: "ELF"}
+	}
+	class := "ELF32"
+	if header[4] == 2 {
+		class = "ELF64"
+	}
+	var order binary.ByteOrder = binary.LittleEndian
+	if header[5] == 2 {
+		order = binary.BigEndian
+	}
+
+	parts := []string{class}
+	if machine, ok := elfMachines[order.Uint16(header[18:])]; ok {
+		parts = append(parts, machine)
+	}
+	elfType := order.Uint16(header[16:])
+	if name, ok := elfTypes[elfType]; ok {
+		parts = append(parts, name)
+	}
+	return fileClass{Kind: fileKindELF, Description: strings.Join(parts, " "), Object: elfType == elfTypeRelocatable}
+}
+
+// Mach-O CPU and file types read by classifyMachO
+var machOCPUs = map[uint32]string{7: "x86", 0x01000007: "x86-64", 12: "ARM", 0x0100000c: "ARM64", 18: "PowerPC"}
+
+var machOFileTypes = map[uint32]string{machOTypeObject: "object", 2: "executable", 6: "dylib", 8: "bundle", 11: "kext"}
+
+// machOTypeObject is the Mach-O file type of object files
+const machOTypeObject = 1
+
+// classifyMachO recognises thin and universal Mach-O binaries
+func classifyMachO(header []byte) (fileClass, bool) {
+	if len(header) < 16 {
+		return fileClass{}, false
+	}
+
+	switch binary.BigEndian.Uint32(header) {
+	case 0xcafebabe:
+		// Java class files share the magic; their version follows, which is
+		// far above any number of architectures
+		count := binary.BigEndian.Uint32(header[4:])
+		if count == 0 || count > 30 {
+			return fileClass{}, false
+		}
+		return fileClass{Kind: fileKindMachO, Description: fmt.Sprintf("Mach-O universal binary (%d architectures)", count)}, true
+	case 0xfeedface, 0xcefaedfe, 0xfeedfacf, 0xcffaedfe:
+	default:
+		return fileClass{}, false
+	}
+
+	var order binary.ByteOrder = binary.BigEndian
+	if header[0] == 0xce || header[0] == 0xcf {
+		order = binary.LittleEndian
+	}
+	parts := []string{"Mach-O"}
+	if header[0] == 0xcf || header[3] == 0xcf {
+		parts[0] = "Mach-O 64-bit"
+	}
+	if cpu, ok := machOCPUs[order.Uint32(header[4:])]; ok {
+		parts = append(parts, cpu)
+	}
+	fileType := order.Uint32(header[12:])
+	if name, ok := machOFileTypes[fileType]; ok {
+		parts = append(parts, name)
+	}
+	return fileClass{Kind: fileKindMachO, Description: strings.Join(parts, " "), Object: fileType == machOTypeObject}, true
+}
+
+// OLE root storage class IDs of Windows Installer files, in their on-disk
+// byte order
+var oleInstallerClasses = map[string]string{
+	"\x84\x10\x0c\x00\x00\x00\x00\x00\xc0\x00\x00\x00\x00\x00\x00\x46": "MSI installer package",
+	"\x86\x10\x0c\x00\x00\x00\x00\x00\xc0\x00\x00\x00\x00\x00\x00\x46": "MSI patch",
+	"\x82\x10\x0c\x00\x00\x00\x00\x00\xc0\x00\x00\x00\x00\x00\x00\x46": "MSI transform",
+}
+
+// classifyOLE tells Windows Installer files from other OLE compound
+// documents by the class ID of the root storage
+func classifyOLE(f *os.File, header []byte) fileClass {
+	class := fileClass{Kind: fileKindOLE, Description: "OLE compound document"}
+	if len(header) < 0x34 {
+		return class
+	}
+
+	sectorShift := binary.LittleEndian.Uint16(header[0x1e:])
+	if sectorShift < 7 || sectorShift > 16 {
+		return class
+	}
+	dirSector := int64(binary.LittleEndian.Uint32(header[0x30:]))
+	clsid := make([]byte, 16)
+	if _, err := f.ReadAt(clsid, (dirSector+1)<<sectorShift+0x50); err != nil {
+		return class
+	}
+	if description, ok := oleInstallerClasses[string(clsid)]; ok {
+		class.Description = description
+	}
+	return class
+}
+
+// zipPackageMarkers identify ZIP based package formats by a member name
+var zipPackageMarkers = []struct {
+	name        string
+	description string
+}{
+	{"AppxMetadata/AppxBundleManifest.xml", "APPX/MSIX bundle"},
+	{"AppxManifest.xml", "APPX/MSIX package"},
+	{"extension.vsixmanifest", "VSIX package"},
+	{"AndroidManifest.xml", "Android package"},
+	{"META-INF/MANIFEST.MF", "Java archive"},
+}
+
+// classifyZIP tells ZIP based package formats apart by their members
+func classifyZIP(filename string) fileClass {
+	class := fileClass{Kind: fileKindZIP, Description: "ZIP archive"}
+	r, err := zip.OpenReader(filename)
+	if err != nil {
+		return class
+	}
+	defer r.Close()
+
+	names := make(map[string]bool, len(r.File))
+	for _, f := range r.File {
+		names[f.Name] = true
+		if !strings.Contains(f.Name, "/") && path.Ext(f.Name) == ".nuspec" {
+			class.Description = "NuGet package"
+		}
+	}
+	for _, marker := range zipPackageMarkers {
+		if names[marker.name] {
+			class.Description = marker.description
+			break
+		}
+	}
+	return class
+}
+
+// classifyText recognises scripts, by a #! line or by extension, among
+// files without binary content
+func classifyText(filename string, header []byte) fileClass {
+	if bytes.IndexByte(header, 0) >= 0 && !bytes.HasPrefix(header, []byte("\xff\xfe")) {
+		return fileClass{Kind: fileKindUnknown, Description: "data"}
+	}
+
+	if bytes.HasPrefix(header, []byte("#!")) {
+		line := string(header[2:])
+		if end := strings.IndexAny(line, "\r\n"); end >= 0 {
+			line = line[:end]
+		}
+		fields := strings.Fields(line)
+		if len(fields) > 0 {
+			interpreter := path.Base(fields[0])
+			if interpreter == "env" && len(fields) > 1 {
+				interpreter = fields[1]
+			}
+			return fileClass{Kind: fileKindScript, Description: interpreter + " script"}
+		}
+	}
+	if description, ok := scriptExtensions[strings.ToLower(filepath.Ext(filename))]; ok {
+		return fileClass{Kind: fileKindScript, Description: description}
+	}
+	return fileClass{Kind: fileKindUnknown, Description: "text"}
+}
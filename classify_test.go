@@ -0,0 +1,101 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestClassifyFile(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name string, data []byte) string {
+		file := filepath.Join(dir, name)
+		if err := os.WriteFile(file, data, 0644); err != nil {
+			t.Fatal(err)
+		}
+		return file
+	}
+
+	const opt = 0x40 + 4 + 20
+	efi := buildTestPE()
+	binary.LittleEndian.PutUint16(efi[opt+peSubsystemOffset:], 10)
+	dotnet := buildTestPE()
+	binary.LittleEndian.PutUint16(dotnet[opt+peSubsystemOffset:], 3)
+	binary.LittleEndian.PutUint32(dotnet[opt+112+imageDirectoryEntryCLRMeta*8:], 0x2000)
+	binary.LittleEndian.PutUint16(dotnet[0x40+4+18:], 0x2022)
+
+	elf := make([]byte, 64)
+	copy(elf, "\x7fELF\x02\x01\x01")
+	binary.LittleEndian.PutUint16(elf[16:], 3)
+	binary.LittleEndian.PutUint16(elf[18:], 0x3e)
+
+	machO := make([]byte, 32)
+	binary.LittleEndian.PutUint32(machO, 0xfeedfacf)
+	binary.LittleEndian.PutUint32(machO[4:], 0x0100000c)
+	binary.LittleEndian.PutUint32(machO[12:], 2)
+	fat := make([]byte, 32)
+	binary.BigEndian.PutUint32(fat, 0xcafebabe)
+	binary.BigEndian.PutUint32(fat[4:], 2)
+	class := make([]byte, 32)
+	binary.BigEndian.PutUint32(class, 0xcafebabe)
+	binary.BigEndian.PutUint32(class[4:], 61) // minor 0, major 61
+
+	msi := make([]byte, 1024)
+	copy(msi, "\xd0\xcf\x11\xe0\xa1\xb1\x1a\xe1")
+	binary.LittleEndian.PutUint16(msi[0x1e:], 9)
+	copy(msi[512+0x50:], "\x84\x10\x0c\x00\x00\x00\x00\x00\xc0\x00\x00\x00\x00\x00\x00\x46")
+
+	appx := zipWith(t, "AppxManifest.xml", "[Content_Types].xml")
+	nupkg := zipWith(t, "Example.nuspec", "lib/net8.0/Example.dll")
+
+	tests := []struct {
+		name string
+		data []byte
+		kind string
+		want string
+	}{
+		{"app", buildTestPE(), fileKindPE, "PE32+ x64 executable"},
+		{"BOOTX64.EFI", efi, fileKindPE, "PE32+ x64 EFI application"},
+		{"lib.dll", dotnet, fileKindPE, "PE32+ x64 .NET console DLL"},
+		{"tool", elf, fileKindELF, "ELF64 x86-64 shared object"},
+		{"macho", machO, fileKindMachO, "Mach-O 64-bit ARM64 executable"},
+		{"universal", fat, fileKindMachO, "Mach-O universal binary (2 architectures)"},
+		{"Main.class", class, fileKindUnknown, "data"},
+		{"setup.msi", msi, fileKindOLE, "MSI installer package"},
+		{"data.cab", []byte("MSCF\x00\x00\x00\x00rest"), fileKindCAB, "Cabinet archive"},
+		{"app.msix", appx, fileKindZIP, "APPX/MSIX package"},
+		{"pkg.nupkg", nupkg, fileKindZIP, "NuGet package"},
+		{"build", []byte("#!/usr/bin/env python3\nprint()\n"), fileKindScript, "python3 script"},
+		{"install.ps1", []byte("Write-Host hi\n"), fileKindScript, "PowerShell script"},
+		{"fake.exe", []byte("not a program\n"), fileKindUnknown, "text"},
+	}
+	for _, tt := range tests {
+		got := classifyFile(write(tt.name, tt.data))
+		if got.Kind != tt.kind || got.String() != tt.want {
+			t.Errorf("%s: got %s (%s), want %s (%s)", tt.name, got.Kind, got, tt.kind, tt.want)
+		}
+	}
+
+	if got := classifyFile(filepath.Join(dir, "missing")); got.Kind != fileKindUnknown {
+		t.Errorf("Expected a missing file to be unknown, got %s", got.Kind)
+	}
+}
+
+func zipWith(t *testing.T, names ...string) []byte {
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	for _, name := range names {
+		w, err := zw.Create(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w.Write([]byte("content"))
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
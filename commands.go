@@ -0,0 +1,280 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+)
+
+// longFlagNames are the long names accepted for single-letter flags
+var longFlagNames = map[string]string{
+	"r": "recurse",
+	"n": "name",
+	"c": "cert-file",
+	"k": "key-file",
+	"j": "jobs",
+	"o": "output",
+	"h": "help",
+}
+
+// Options of the file commands, named as on the legacy command line
+var (
+	selectionOptions   = []string{"r", "ext", "include", "exclude"}
+	certificateOptions = []string{"n", "c", "k", "passphrase-file", "encrypt-key", "pfx", "pfx-password-file", "key-type"}
+	signingOptions     = []string{"append", "force", "replace", "digest", "timestamp-url", "dry-run", "no-cache"}
+	reportOptions      = []string{"output", "j"}
+)
+
+// command is a command of the tool
+type command struct {
+	name string
+	// usage is the synopsis of the command and its subcommands
+	usage       string
+	description string
+	run         func(args []string) error
+}
+
+// commands returns the commands of the tool, in the order of the help
+func commands() []command {
+	return []command{
+		{"sign", "usage: selfsign-path sign [OPTIONS] file_or_pattern...",
+			"Sign files, skipping those already signed by the certificate.",
+			fileCommand("sign", append(append(append(selectionOptions, certificateOptions...), signingOptions...), reportOptions...), nil)},
+		{"verify", "usage: selfsign-path verify [OPTIONS] file_or_pattern...",
+			"Verify the signatures of files, failing unless every file has a Valid signature.",
+			fileCommand("verify", append(append(selectionOptions, "no-cache"), reportOptions...), func() {
+				*flagStatus, *flagRequireSigned = true, true
+			})},
+		{"status", "usage: selfsign-path status [OPTIONS] file_or_pattern...",
+			"Print the signature status and type of files.",
+			fileCommand("status", append(append(selectionOptions, "no-cache", "require-signed"), reportOptions...), func() {
+				*flagStatus = true
+			})},
+		{"clear", "usage: selfsign-path clear [OPTIONS] [file_or_pattern...]",
+			"Remove the signatures made by this tool from files, and with --purge-cert its certificates from the trust store.",
+			fileCommand("clear", append(append(selectionOptions, "dry-run", "purge-cert"), reportOptions...), func() {
+				*flagClear = true
+			})},
+		{"cert", certCommandUsage, "Manage the stored certificates.", runCertCommand},
+		{"trust", trustCommandUsage, "Install, remove and check certificates in the system trust stores.", runTrustCommand},
+		{"cache", cacheCommandUsage, "Maintain the digest cache.", runCacheCommand},
+		{"tsa", tsaCommandUsage, "Run a local time-stamping authority.", runTSACommand},
+		{"help", "usage: selfsign-path help [COMMAND [SUBCOMMAND]]", "Show the help of the tool or of a command.", runHelpCommand},
+	}
+}
+
+// findCommand returns the command with the given name, or nil
+func findCommand(name string) *command {
+	for _, cmd := range commands() {
+		if cmd.name == name {
+			return &cmd
+		}
+	}
+	return nil
+}
+
+// runCommand runs a command; -h or --help in place of a subcommand prints
+// the command's help
+func runCommand(cmd *command, args []string) error {
+	if len(args) > 0 && isHelpArg(args[0]) && !isFileCommand(cmd.name) {
+		printCommandHelp(os.Stdout, cmd.name, nil)
+		return flag.ErrHelp
+	}
+	return cmd.run(args)
+}
+
+// isHelpArg reports whether an argument asks for help
+func isHelpArg(arg string) bool {
+	switch arg {
+	case "-h", "--h", "-help", "--help":
+		return true
+	}
+	return false
+}
+
+// isFileCommand reports whether a command processes files with the options
+// of the legacy command line
+func isFileCommand(name string) bool {
+	switch name {
+	case "sign", "verify", "status", "clear":
+		return true
+	}
+	return false
+}
+
+// fileCommand returns the run function of a command processing files, which
+// accepts the given legacy options and sets the mode flags with setMode
+func fileCommand(name string, options []string, setMode func()) func([]string) error {
+	return func(args []string) error {
+		fs := newFileCommandFlagSet(name, options)
+		if err := parseFlags(fs, args); err != nil {
+			return err
+		}
+		if setMode != nil {
+			setMode()
+		}
+		if fs.NArg() == 0 && name != "clear" {
+			return fmt.Errorf("no files or patterns specified (see \"selfsign-path help %s\")", name)
+		}
+		return runFileCommand(fs.Args())
+	}
+}
+
+// newFileCommandFlagSet returns a flag set sharing the given flags, and
+// their values, with the legacy command line
+func newFileCommandFlagSet(name string, options []string) *flag.FlagSet {
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	for _, option := range options {
+		f := flag.Lookup(option)
+		fs.Var(f.Value, f.Name, f.Usage)
+	}
+	return fs
+}
+
+// addLongNames defines the long names of the single-letter flags of fs
+func addLongNames(fs *flag.FlagSet) {
+	for short, long := range longFlagNames {
+		if f := fs.Lookup(short); f != nil && fs.Lookup(long) == nil {
+			fs.Var(f.Value, long, f.Usage)
+		}
+	}
+}
+
+// parseFlags parses the flags of a command, accepting the long names of its
+// single-letter flags. -h or --help prints the command's help to stdout
+func parseFlags(fs *flag.FlagSet, args []string) error {
+	addLongNames(fs)
+	fs.SetOutput(io.Discard)
+	fs.Usage = func() {}
+
+	err := fs.Parse(args)
+	if errors.Is(err, flag.ErrHelp) {
+		printCommandHelp(os.Stdout, fs.Name(), fs)
+		return err
+	}
+	if err != nil {
+		return fmt.Errorf("%w (see \"selfsign-path help %s\")", err, fs.Name())
+	}
+	return nil
+}
+
+// runHelpCommand prints the help of the tool, or of the named command
+func runHelpCommand(args []string) error {
+	if len(args) == 0 {
+		showHelp()
+		return nil
+	}
+	cmd := findCommand(args[0])
+	if cmd == nil {
+		return fmt.Errorf("unknown command %q (see \"selfsign-path help\")", args[0])
+	}
+	// A subcommand prints its own help, with its flags
+	err := runCommand(cmd, append(args[1:], "--help"))
+	if errors.Is(err, flag.ErrHelp) {
+		return nil
+	}
+	return err
+}
+
+// printCommandHelp prints the usage of a command or subcommand, the
+// description of a command and the flags of fs, if given
+func printCommandHelp(w io.Writer, name string, fs *flag.FlagSet) {
+	top, sub, _ := strings.Cut(name, " ")
+	cmd := findCommand(top)
+	if cmd == nil {
+		return
+	}
+
+	usage := cmd.usage
+	if sub != "" {
+		var lines []string
+		for _, line := range strings.Split(cmd.usage, "\n") {
+			line = strings.TrimPrefix(strings.TrimSpace(line), "usage: ")
+			if line == "selfsign-path "+name || strings.HasPrefix(line, "selfsign-path "+name+" ") {
+				lines = append(lines, line)
+			}
+		}
+		usage = "usage: " + strings.Join(lines, "\n       ")
+	}
+	fmt.Fprintln(w, usage)
+	if sub == "" {
+		fmt.Fprintf(w, "\n%s\n", cmd.description)
+	}
+	if fs != nil && hasFlags(fs) {
+		fmt.Fprintf(w, "\nOptions:\n")
+		printFlags(w, fs)
+	}
+	if sub == "" && !isFileCommand(top) && top != "help" {
+		fmt.Fprintf(w, "\nRun \"selfsign-path help %s SUBCOMMAND\" for the options of a subcommand.\n", top)
+	}
+}
+
+// hasFlags reports whether any flag is defined in fs
+func hasFlags(fs *flag.FlagSet) bool {
+	found := false
+	fs.VisitAll(func(*flag.Flag) { found = true })
+	return found
+}
+
+// printFlags lists the flags of fs, with the short and long names of a flag
+// on one line
+func printFlags(w io.Writer, fs *flag.FlagSet) {
+	// Aliases share their value
+	names := make(map[flag.Value][]*flag.Flag)
+	var order []flag.Value
+	fs.VisitAll(func(f *flag.Flag) {
+		if _, ok := names[f.Value]; !ok {
+			order = append(order, f.Value)
+		}
+		names[f.Value] = append(names[f.Value], f)
+	})
+	sort.SliceStable(order, func(i, j int) bool {
+		return primaryFlagName(names[order[i]]) < primaryFlagName(names[order[j]])
+	})
+
+	for _, value := range order {
+		flags := names[value]
+		sort.Slice(flags, func(i, j int) bool { return len(flags[i].Name) < len(flags[j].Name) })
+
+		var spelled []string
+		for _, f := range flags {
+			if len(f.Name) == 1 {
+				spelled = append(spelled, "-"+f.Name)
+			} else {
+				spelled = append(spelled, "--"+f.Name)
+			}
+		}
+		long := flags[len(flags)-1]
+		argName, usage := flag.UnquoteUsage(long)
+		// Unless the usage names it, the argument is named after the flag
+		if argName != "" && argName == strings.ToLower(argName) {
+			argName = strings.ToUpper(strings.ReplaceAll(long.Name, "-", "_"))
+		}
+		if argName != "" {
+			argName = " " + argName
+		}
+
+		fmt.Fprintf(w, "    %s%s\n        %s", strings.Join(spelled, ", "), argName, usage)
+		switch long.DefValue {
+		case "", "false", "0":
+		default:
+			fmt.Fprintf(w, " (default %s)", long.DefValue)
+		}
+		fmt.Fprintln(w)
+	}
+}
+
+// primaryFlagName returns the name a flag is listed by: its long name
+func primaryFlagName(flags []*flag.Flag) string {
+	name := flags[0].Name
+	for _, f := range flags {
+		if len(f.Name) > len(name) {
+			name = f.Name
+		}
+	}
+	return name
+}
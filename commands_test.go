@@ -0,0 +1,36 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"strings"
+	"testing"
+)
+
+func TestCommandFlags(t *testing.T) {
+	fs := flag.NewFlagSet("trust status", flag.ContinueOnError)
+	name := fs.String("n", localRootCAName, "Subject name of the stored certificate to look for")
+	all := fs.Bool("all", false, "Every certificate")
+	if err := parseFlags(fs, []string{"--name", "LocalSign-Test", "-all", "extra"}); err != nil {
+		t.Fatalf("Failed to parse flags: %v", err)
+	}
+	if *name != "LocalSign-Test" || !*all || fs.NArg() != 1 {
+		t.Errorf("Unexpected flags: name %q, all %v, args %v", *name, *all, fs.Args())
+	}
+
+	var buf bytes.Buffer
+	printFlags(&buf, fs)
+	help := buf.String()
+	if !strings.Contains(help, "    -n, --name NAME\n") || !strings.Contains(help, "    --all\n") {
+		t.Errorf("Expected -n and --name on one line, got\n%s", help)
+	}
+	if !strings.Contains(help, "(default "+localRootCAName+")") {
+		t.Errorf("Expected the default name, got\n%s", help)
+	}
+
+	// A file command only takes its own options
+	status := newFileCommandFlagSet("status", []string{"r", "require-signed"})
+	if err := parseFlags(status, []string{"--force", "app.exe"}); err == nil {
+		t.Error("Expected status to reject --force")
+	}
+}
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"bufio"
+	"crypto"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+)
+
+// detachedSignatureExt is appended to a file name to get its detached CMS signature
+const detachedSignatureExt = ".p7s"
+
+// legacySignatureExt is the key=value sidecar written by older versions of the tool
+const legacySignatureExt = ".sig"
+
+// hashFile computes the digest of a file's contents
+func hashFile(filename string, hash crypto.Hash) ([]byte, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open file: %w", err)
+	}
+	defer f.Close()
+
+	h := hash.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return nil, fmt.Errorf("failed to read file: %w", err)
+	}
+	return h.Sum(nil), nil
+}
+
+// signDetachedFile writes a detached CMS SignedData over the file contents to
+// filename.p7s, verifiable with "openssl cms -verify -binary -content filename"
+func signDetachedFile(filename string, cert *Certificate, opts *signOptions) error {
+	hash := cmsDigestFor(cert.Cert.PublicKey, crypto.SHA256)
+	digest, err := hashFile(filename, hash)
+	if err != nil {
+		return err
+	}
+
+	signingTime, err := newCMSAttribute(oidSigningTime, time.Now().UTC())
+	if err != nil {
+		return err
+	}
+
+	der, err := createSignedData(cert, cmsSignOptions{
+		ContentType:      oidData,
+		MessageDigest:    digest,
+		Hash:             hash,
+		SignedAttributes: []cmsAttribute{signingTime},
+	})
+	if err != nil {
+		return fmt.Errorf("failed to create CMS signature: %w", err)
+	}
+
+	if opts.TimestampURL != "" {
+		sd, err := parseSignedData(der)
+		if err != nil {
+			return err
+		}
+		if err := addTimestamp(sd, opts.TimestampURL); err != nil {
+			return fmt.Errorf("failed to time-stamp signature: %w", err)
+		}
+		if der, err = marshalSignedData(*sd); err != nil {
+			return err
+		}
+	}
+
+	if err := os.WriteFile(filename+detachedSignatureExt, der, 0644); err != nil {
+		return fmt.Errorf("failed to write signature file: %w", err)
+	}
+
+	// The detached signature supersedes any legacy sidecar
+	if isLegacySignatureFile(filename + legacySignatureExt) {
+		os.Remove(filename + legacySignatureExt)
+	}
+
+	return nil
+}
+
+// verifyDetachedFile verifies the detached CMS signature of a file
+func verifyDetachedFile(filename string) (*SignatureStatus, error) {
+	der, err := os.ReadFile(filename + detachedSignatureExt)
+	if os.IsNotExist(err) {
+		return &SignatureStatus{Status: StatusNotSigned}, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read signature file: %w", err)
+	}
+
+	sd, err := parseSignedData(der)
+	if err != nil {
+		return nil, err
+	}
+	if !sd.ContentInfo.ContentType.Equal(oidData) || len(sd.ContentInfo.Content.Bytes) > 0 {
+		return nil, fmt.Errorf("signature file is not a detached CMS signature")
+	}
+
+	signer, err := signedDataSigner(sd)
+	if err != nil {
+		return nil, err
+	}
+	certs, err := x509.ParseCertificates(sd.Certificates.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse signature certificates: %w", err)
+	}
+	si := &sd.SignerInfos[0]
+
+	status := &SignatureStatus{
+		SignerCertificate: signer.Subject.CommonName,
+		SignerFingerprint: certificateFingerprint(signer),
+		SignerExpires:     signer.NotAfter,
+		IsSelfSigned:      isSelfSignedCertificate(signer),
+	}
+
+	hash, err := hashFromAlgorithmID(si.DigestAlgorithm)
+	if err != nil {
+		return nil, err
+	}
+	digest, err := hashFile(filename, hash)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := verifySignerInfo(si, signer, digest); err != nil {
+		switch {
+		case errors.Is(err, errMessageDigestMismatch):
+			status.Status = StatusHashMismatch
+			return status, nil
+		case errors.Is(err, errBadSignature):
+			status.Status = StatusBadSignature
+			return status, nil
+		}
+		return nil, err
+	}
+
+	applySignerTrust(status, si, signer, certs)
+	return status, nil
+}
+
+// removeDetachedSignature deletes the detached signature of a file when it
+// was made with one of ownCerts, along with any legacy sidecar; with dryRun
+// it only reports whether it would
+func removeDetachedSignature(filename string, ownCerts []*x509.Certificate, dryRun bool) (bool, error) {
+	removed := false
+
+	if der, err := os.ReadFile(filename + detachedSignatureExt); err == nil {
+		sd, err := parseSignedData(der)
+		if err != nil {
+			return false, err
+		}
+		signer, err := signedDataSigner(sd)
+		if err != nil {
+			return false, err
+		}
+		if isOwnCertificate(signer, ownCerts) {
+			if err := removeUnlessDryRun(filename+detachedSignatureExt, dryRun); err != nil {
+				return false, fmt.Errorf("failed to remove signature file: %w", err)
+			}
+			removed = true
+		}
+	}
+
+	if isLegacySignatureFile(filename + legacySignatureExt) {
+		if err := removeUnlessDryRun(filename+legacySignatureExt, dryRun); err != nil {
+			return false, fmt.Errorf("failed to remove signature file: %w", err)
+		}
+		removed = true
+	}
+
+	return removed, nil
+}
+
+// removeUnlessDryRun removes a file unless dryRun is set
+func removeUnlessDryRun(filename string, dryRun bool) error {
+	if dryRun {
+		return nil
+	}
+	return os.Remove(filename)
+}
+
+// isLegacySignatureFile reports whether a file is a key=value sidecar
+// written by older versions of this tool
+func isLegacySignatureFile(signatureFile string) bool {
+	f, err := os.Open(signatureFile)
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(io.LimitReader(f, 4096))
+	for scanner.Scan() {
+		if strings.HasPrefix(scanner.Text(), "SIGNED_BY=") {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"encoding/pem"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+)
+
+func TestDetachedSignature(t *testing.T) {
+	t.Setenv("HOME", t.TempDir())
+	cert := newTestCertificate(t, "LocalSign-Test")
+	saveCertificateFiles(io.Discard, cert.Subject, cert.Cert, cert.PrivateKey)
+	filename := filepath.Join(t.TempDir(), "script.sh")
+	if err := os.WriteFile(filename, []byte("#!/bin/sh\necho hello\n"), 0755); err != nil {
+		t.Fatalf("Failed to write test file: %v", err)
+	}
+	os.WriteFile(filename+legacySignatureExt, []byte("SIGNED_BY=LocalSign-Test\n"), 0644)
+
+	if err := signFile(filename, cert, defaultSignOptions()); err != nil {
+		t.Fatalf("Failed to sign file: %v", err)
+	}
+	if _, err := os.Stat(filename + detachedSignatureExt); err != nil {
+		t.Fatalf("Expected a .p7s signature: %v", err)
+	}
+	if _, err := os.Stat(filename + legacySignatureExt); !os.IsNotExist(err) {
+		t.Error("Signing should replace the legacy .sig sidecar")
+	}
+
+	trustTestCertificate(t, cert)
+	status, err := getFileSignatureStatus(filename, nil)
+	if err != nil || status.Status != StatusValid || status.SignerCertificate != "LocalSign-Test" {
+		t.Errorf("Expected valid detached signature, got %+v (%v)", status, err)
+	}
+
+	os.WriteFile(filename, []byte("#!/bin/sh\nrm -rf /\n"), 0755)
+	if status, _ := getFileSignatureStatus(filename, nil); status.Status != StatusHashMismatch {
+		t.Errorf("Expected HashMismatch for modified file, got %s", status.Status)
+	}
+
+	removed, err := removeSelfSignedSignature(filename, getOwnCertificates())
+	if err != nil || !removed {
+		t.Fatalf("Expected detached signature to be removed, got %v (%v)", removed, err)
+	}
+	if status, _ := getFileSignatureStatus(filename, nil); status.Status != StatusNotSigned {
+		t.Errorf("Expected NotSigned after clearing, got %s", status.Status)
+	}
+}
+
+func TestDetachedSignatureOpenSSL(t *testing.T) {
+	if _, err := exec.LookPath("openssl"); err != nil {
+		t.Skip("openssl not available")
+	}
+
+	cert := newTestCertificate(t, "LocalSign-Test")
+	dir := t.TempDir()
+	filename := filepath.Join(dir, "data.bin")
+	os.WriteFile(filename, []byte("payload to sign"), 0644)
+	if err := signDetachedFile(filename, cert, defaultSignOptions()); err != nil {
+		t.Fatalf("Failed to sign file: %v", err)
+	}
+
+	caFile := filepath.Join(dir, "ca.pem")
+	os.WriteFile(caFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Cert.Raw}), 0644)
+
+	cmd := exec.Command("openssl", "cms", "-verify", "-binary", "-inform", "DER",
+		"-in", filename+detachedSignatureExt, "-content", filename,
+		"-CAfile", caFile, "-purpose", "any", "-out", os.DevNull)
+	if output, err := cmd.CombinedOutput(); err != nil {
+		t.Errorf("openssl cms -verify failed: %v\n%s", err, output)
+	}
+}
@@ -0,0 +1,290 @@
+package main
+
+import (
+	"crypto/x509"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// How a dry run would come by the signing certificate
+const (
+	certificateUse   = "use"
+	certificateIssue = "issue"
+	certificateRenew = "renew"
+)
+
+// certificatePlan describes the signing certificate a run would use, and
+// whether getting it would create certificates or change trust stores
+type certificatePlan struct {
+	Subject string `json:"subject"`
+	// Action is use, issue or renew
+	Action string `json:"action"`
+	Source string `json:"source"`
+	// Fingerprint is empty when the certificate does not exist yet
+	Fingerprint string `json:"fingerprint,omitempty"`
+	// CreateRoot is set when the local root CA would be created, and
+	// installed into TrustStores
+	CreateRoot  bool               `json:"create_root,omitempty"`
+	TrustStores []trustStoreStatus `json:"trust_stores,omitempty"`
+
+	cert *x509.Certificate
+}
+
+func (p *certificatePlan) String() string {
+	var s string
+	switch p.Action {
+	case certificateIssue:
+		s = fmt.Sprintf("would issue %s from the local root CA", p.Subject)
+	case certificateRenew:
+		s = fmt.Sprintf("would renew %s, which expires %s", p.Subject, p.cert.NotAfter.Format("2006-01-02"))
+	default:
+		s = fmt.Sprintf("would use %s from %s", p.Subject, p.Source)
+	}
+	if p.CreateRoot {
+		s += fmt.Sprintf(", creating the local root CA %s", localRootCAName)
+	}
+	return s
+}
+
+// planCertificate works out the signing certificate getCertificate would
+// return, without creating, renewing or installing anything. Neither the
+// stored private key nor a --key-file is read, so no passphrase is asked for
+func planCertificate() (*certificatePlan, error) {
+	switch {
+	case *flagPFXFile != "":
+		password, err := getPFXPassword(*flagPFXPasswordFile)
+		if err != nil {
+			return nil, err
+		}
+		cert, err := loadCertificateFromPFX(*flagPFXFile, password)
+		if err != nil {
+			return nil, err
+		}
+		return &certificatePlan{Subject: cert.Subject, Action: certificateUse, Source: *flagPFXFile,
+			Fingerprint: certificateFingerprint(cert.Cert), cert: cert.Cert}, nil
+	case *flagCertFile != "" && *flagKeyFile != "":
+		// The key may be encrypted, so only its presence is checked; of a
+		// bundle, the end-entity certificate is the one the key would match
+		if _, err := os.Stat(*flagKeyFile); err != nil {
+			return nil, fmt.Errorf("failed to read private key file: %w", err)
+		}
+		certs, err := readCertificateFile(*flagCertFile)
+		if err != nil {
+			return nil, err
+		}
+		cert := certs[0]
+		for _, c := range certs {
+			if !c.IsCA {
+				cert = c
+				break
+			}
+		}
+		return &certificatePlan{Subject: cert.Subject.CommonName, Action: certificateUse, Source: *flagCertFile,
+			Fingerprint: certificateFingerprint(cert), cert: cert}, nil
+	}
+
+	// Mirrors getOrCreateIssuedCertificate and getOrCreateLocalRootCA
+	certDir := certificateDirectoryPath()
+	certFile := filepath.Join(certDir, fmt.Sprintf("%s.crt", *flagName))
+	rootFile := filepath.Join(certDir, fmt.Sprintf("%s.crt", localRootCAName))
+	plan := &certificatePlan{Subject: *flagName, Action: certificateIssue, Source: certFile}
+
+	_, certErr := os.Stat(certFile)
+	_, keyErr := os.Stat(filepath.Join(certDir, fmt.Sprintf("%s.key", *flagName)))
+	if certErr == nil && keyErr == nil {
+		certs, err := readCertificateFile(certFile)
+		if err != nil {
+			return nil, err
+		}
+		plan.cert = certs[0]
+
+		issued := false
+		if roots, err := readCertificateFile(rootFile); err == nil && !isSelfSignedCertificate(plan.cert) {
+			issued = plan.cert.CheckSignatureFrom(roots[0]) == nil
+		}
+		if !issued || time.Until(plan.cert.NotAfter) > issuedCertificateRenewBefore {
+			plan.Action = certificateUse
+			plan.Fingerprint = certificateFingerprint(plan.cert)
+			return plan, nil
+		}
+		plan.Action = certificateRenew
+	}
+
+	if _, err := os.Stat(rootFile); err != nil {
+		plan.CreateRoot = true
+		plan.TrustStores = trustInstallPlanPlatform()
+	}
+	return plan, nil
+}
+
+// checkWritable reports an error if a file could not be opened for writing;
+// the file is not truncated or otherwise changed
+func checkWritable(filename string) error {
+	f, err := os.OpenFile(filename, os.O_WRONLY, 0)
+	if err != nil {
+		return err
+	}
+	return f.Close()
+}
+
+// checkSignable reports why signing a file would fail, as far as can be told
+// without signing it
+func checkSignable(filename string, class fileClass) error {
+	switch class.Kind {
+	case fileKindPE:
+		data, err := os.ReadFile(filename)
+		if err != nil {
+			return fmt.Errorf("failed to read file: %w", err)
+		}
+		if _, err := parsePEImage(data); err != nil {
+			return fmt.Errorf("failed to parse PE file: %w", err)
+		}
+		return checkWritable(filename)
+	case fileKindELF:
+		// Only kernel modules are signed in place
+		if class.Object {
+			return checkWritable(filename)
+		}
+	}
+	f, err := os.Open(filename)
+	if err != nil {
+		return err
+	}
+	return f.Close()
+}
+
+// dryRunVerbs phrase the decisions of a dry run
+var dryRunVerbs = map[string]string{
+	signDecisionSign:    "Would sign",
+	signDecisionSkip:    "Would skip",
+	signDecisionResign:  "Would re-sign",
+	signDecisionReplace: "Would replace the signature of",
+	clearDecisionClear:  "Would clear",
+	clearDecisionKeep:   "Would leave",
+	decisionError:       "Would fail on",
+}
+
+// Decisions of a dry run besides those of planSigning
+const (
+	clearDecisionClear = "clear"
+	clearDecisionKeep  = "keep"
+	decisionError      = "error"
+)
+
+// dryRunLine formats the plan for one file
+func dryRunLine(result fileResult) string {
+	reason := result.Reason
+	if result.Error != "" {
+		reason = result.Error
+	}
+	return fmt.Sprintf("%s %s [%s]: %s\n", dryRunVerbs[result.Decision], result.Path, result.Type, reason)
+}
+
+// planSignFiles reports what signing files would do, with the certificate
+// it would use, without changing any file, certificate, cache or trust store
+func planSignFiles(w io.Writer, files []string) ([]fileResult, *certificatePlan, error) {
+	opts, err := getSignOptions()
+	if err != nil {
+		return nil, nil, err
+	}
+	plan, err := planCertificate()
+	if err != nil {
+		return nil, nil, &exitError{exitCertificateError, fmt.Errorf("failed to obtain signing certificate: %w", err)}
+	}
+
+	fmt.Fprintf(w, "Dry run: no files, certificates or trust stores are changed.\n")
+	fmt.Fprintf(w, "Certificate: %s\n", plan)
+	for _, store := range plan.TrustStores {
+		fmt.Fprintf(w, "  %s %s: %s\n", store.Store, store.Location, store.Status)
+	}
+	fmt.Fprintln(w)
+
+	// The cache is read to plan like a real run would, but never saved
+	var cache *digestCache
+	if !*flagNoCache {
+		cache = openDigestCache(w)
+	}
+
+	results := processFiles(w, files, *flagJobs, func(file string) (fileResult, string) {
+		class := classifyFile(file)
+		result := fileResult{Path: file, Action: "sign", Type: class.String()}
+		if err := checkSignable(file, class); err != nil {
+			result.Status, result.Decision, result.Error = resultError, decisionError, err.Error()
+			return result, dryRunLine(result)
+		}
+
+		if plan.cert == nil || plan.Action == certificateRenew {
+			result.Status, result.Decision, result.Reason = resultWouldSign, signDecisionSign, "new certificate"
+			if opts.Replace {
+				result.Decision = signDecisionReplace
+			}
+			return result, dryRunLine(result)
+		}
+
+		p := planSigning(file, &Certificate{Subject: plan.Subject, Cert: plan.cert}, opts, cache)
+		if p.Decision == signDecisionSkip {
+			skipped := newFileResult(file, "sign", p.Status)
+			skipped.Type = result.Type
+			result = skipped
+			result.Status = resultSkipped
+		} else {
+			result.Status = resultWouldSign
+		}
+		result.Decision, result.Reason = p.Decision, p.Reason
+		return result, dryRunLine(result)
+	})
+
+	fmt.Fprintf(w, "\nWould sign %d and skip %d of %d file(s); %d would fail.\n",
+		countStatus(results, resultWouldSign), countStatus(results, resultSkipped), len(files), countStatus(results, resultError))
+	return results, plan, nil
+}
+
+// planClearSignatures reports which files --clear would remove this tool's
+// signatures from, without changing them
+func planClearSignatures(w io.Writer, files []string) ([]fileResult, error) {
+	fmt.Fprintf(w, "Dry run: no files, certificates or trust stores are changed.\n\n")
+
+	ownCerts := loadOwnCertificates()
+	results := processFiles(w, files, *flagJobs, func(file string) (fileResult, string) {
+		class := classifyFile(file)
+		result := fileResult{Path: file, Action: "clear", Type: class.String()}
+		found, err := hasSelfSignedSignature(file, ownCerts)
+		if err == nil && found && (class.Kind == fileKindPE || class.Kind == fileKindELF && class.Object) {
+			err = checkWritable(file)
+		}
+
+		switch {
+		case err != nil:
+			result.Status, result.Decision, result.Error = resultError, decisionError, err.Error()
+		case found:
+			result.Status, result.Decision, result.Reason = resultWouldRemove, clearDecisionClear, "signed by this tool"
+		default:
+			result.Status, result.Decision, result.Reason = resultUnchanged, clearDecisionKeep, "no signature from this tool"
+		}
+		return result, dryRunLine(result)
+	})
+
+	fmt.Fprintf(w, "\nWould remove signatures from %d of %d file(s); %d would fail.\n",
+		countStatus(results, resultWouldRemove), len(files), countStatus(results, resultError))
+	return results, nil
+}
+
+// planUninstallCertificates lists the certificates "trust uninstall", or
+// --purge-cert, would remove from the trust store
+func planUninstallCertificates(w io.Writer) {
+	var installed []string
+	for _, cert := range loadOwnCertificates() {
+		if isCertificateInstalled(cert) {
+			installed = append(installed, cert.Subject.CommonName)
+		}
+	}
+	if len(installed) == 0 {
+		fmt.Fprintf(w, "No installed certificates would be removed from the trust store.\n")
+		return
+	}
+	fmt.Fprintf(w, "Would remove from the trust store: %s\n", strings.Join(installed, ", "))
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"encoding/pem"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestDryRunChangesNothing(t *testing.T) {
+	t.Setenv("HOME", t.TempDir())
+	dir := t.TempDir()
+	file := filepath.Join(dir, "data.txt")
+	os.WriteFile(file, []byte("payload\n"), 0644)
+	missing := filepath.Join(dir, "missing.txt")
+
+	// Without a certificate, one would be issued and the root CA created
+	results, plan, err := planSignFiles(io.Discard, []string{file, missing})
+	if err != nil {
+		t.Fatalf("Failed to plan signing: %v", err)
+	}
+	if plan.Action != certificateIssue || !plan.CreateRoot || plan.Fingerprint != "" {
+		t.Errorf("Expected a new certificate and root CA, got %+v", plan)
+	}
+	if results[0].Decision != signDecisionSign || results[0].Status != resultWouldSign {
+		t.Errorf("Expected the file to be signed, got %+v", results[0])
+	}
+	if results[1].Decision != decisionError || results[1].Error == "" {
+		t.Errorf("Expected a missing file to fail, got %+v", results[1])
+	}
+	if _, err := os.Stat(certificateDirectoryPath()); !os.IsNotExist(err) {
+		t.Errorf("Dry run should not create the certificate directory: %v", err)
+	}
+
+	// With a stored root and certificate they are used as they are
+	root, _ := createLocalRootCA(localRootCAName, "p256")
+	saveCertificateFiles(io.Discard, localRootCAName, root.Cert, root.PrivateKey)
+	cert, err := getOrCreateSigningCertificate(io.Discard, *flagName)
+	if err != nil {
+		t.Fatalf("Failed to issue certificate: %v", err)
+	}
+	trustTestCertificate(t, root)
+	if err := signFile(file, cert, defaultSignOptions()); err != nil {
+		t.Fatalf("Failed to sign: %v", err)
+	}
+	signature, _ := os.ReadFile(file + detachedSignatureExt)
+
+	results, plan, err = planSignFiles(io.Discard, []string{file})
+	if err != nil {
+		t.Fatalf("Failed to plan signing: %v", err)
+	}
+	if plan.Action != certificateUse || plan.CreateRoot || plan.Fingerprint != certificateFingerprint(cert.Cert) {
+		t.Errorf("Expected the stored certificate to be used, got %+v", plan)
+	}
+	if results[0].Decision != signDecisionSkip || results[0].Status != resultSkipped {
+		t.Errorf("Expected the signed file to be skipped, got %+v", results[0])
+	}
+
+	results, err = planClearSignatures(io.Discard, []string{file})
+	if err != nil || results[0].Decision != clearDecisionClear || results[0].Status != resultWouldRemove {
+		t.Errorf("Expected the signature to be planned for removal, got %+v (%v)", results, err)
+	}
+	if data, err := os.ReadFile(file + detachedSignatureExt); err != nil || string(data) != string(signature) {
+		t.Errorf("Dry run should leave the signature in place: %v", err)
+	}
+}
+
+func TestPlanCertificateLeavesKeyFileEncrypted(t *testing.T) {
+	dir := t.TempDir()
+	cert := newTestCertificate(t, "Release Signing")
+	block, err := encryptPrivateKey(cert.PrivateKey, "correct horse")
+	if err != nil {
+		t.Fatalf("Failed to encrypt key: %v", err)
+	}
+	certFile, keyFile := filepath.Join(dir, "signing.crt"), filepath.Join(dir, "signing.key")
+	os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Cert.Raw}), 0644)
+	os.WriteFile(keyFile, pem.EncodeToMemory(block), 0600)
+
+	savedCert, savedKey := *flagCertFile, *flagKeyFile
+	*flagCertFile, *flagKeyFile = certFile, keyFile
+	t.Cleanup(func() { *flagCertFile, *flagKeyFile = savedCert, savedKey })
+
+	// A wrong passphrase shows the key is never decrypted
+	t.Setenv(keyPassphraseEnv, "wrong")
+	plan, err := planCertificate()
+	if err != nil {
+		t.Fatalf("Failed to plan the certificate: %v", err)
+	}
+	if plan.Action != certificateUse || plan.Subject != "Release Signing" || plan.Fingerprint != certificateFingerprint(cert.Cert) {
+		t.Errorf("Expected the configured certificate to be used, got %+v", plan)
+	}
+}
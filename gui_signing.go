@@ -3,6 +3,9 @@
 package main
 
 import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
 	"crypto/rand"
 	"crypto/rsa"
 	"fmt"
@@ -45,10 +48,14 @@ func (app *GuiApp) performSigning() {
 	app.appendOutput(fmt.Sprintf("Signing %d files...", len(app.selectedFiles)))
 	signedCount := 0
 	
+	// Signatures already on the files, such as a vendor's, are kept and ours
+	// is nested under them
+	opts := defaultSignOptions()
+	opts.Append = true
 	for i, file := range app.selectedFiles {
 		app.appendOutput(fmt.Sprintf("Signing file %d of %d: %s", i+1, len(app.selectedFiles), filepath.Base(file)))
 		
-		if err := signFile(file, cert); err != nil {
+		if err := signFile(file, cert, opts); err != nil {
 			app.appendOutput(fmt.Sprintf("Failed to sign %s: %v", filepath.Base(file), err))
 			results.WriteString(fmt.Sprintf("✗ Failed: %s - %v\n", filepath.Base(file), err))
 		} else {
@@ -62,7 +69,7 @@ func (app *GuiApp) performSigning() {
 	
 	// Step 3: Install certificate to store
 	app.appendOutput("Installing certificate to Windows certificate store...")
-	if err := installCertificateToStore(cert.Cert); err != nil {
+	if _, err := installCertificateToStore(cert.Cert); err != nil {
 		app.appendOutput(fmt.Sprintf("Warning: Failed to install certificate to store: %v", err))
 		results.WriteString(fmt.Sprintf("⚠ Warning: Certificate store installation failed: %v\n", err))
 		results.WriteString("You may need to run as administrator for certificate store access.\n")
@@ -95,14 +102,14 @@ func (app *GuiApp) performSigning() {
 }
 
 // createOneTimeSigningCertificate creates a certificate and private key for one-time use
-func (app *GuiApp) createOneTimeSigningCertificate() (*Certificate, *rsa.PrivateKey, error) {
+func (app *GuiApp) createOneTimeSigningCertificate() (*Certificate, crypto.Signer, error) {
 	// Generate a unique name for this signing session
 	subjectName := "LocalSign-OneTime-" + generateRandomString(8)
 	
 	app.appendOutput(fmt.Sprintf("Generating certificate with subject: %s", subjectName))
 	
 	// Create the certificate (this will create both cert and key)
-	cert, err := createSelfSignedCertificate(subjectName)
+	cert, err := createSelfSignedCertificate(os.Stdout, subjectName)
 	if err != nil {
 		return nil, nil, fmt.Errorf("failed to create certificate: %w", err)
 	}
@@ -114,21 +121,30 @@ func (app *GuiApp) createOneTimeSigningCertificate() (*Certificate, *rsa.Private
 }
 
 // securelyDeletePrivateKey securely deletes the private key from memory and disk
-func (app *GuiApp) securelyDeletePrivateKey(privateKey *rsa.PrivateKey) error {
+func (app *GuiApp) securelyDeletePrivateKey(privateKey crypto.Signer) error {
 	var errors []string
 	
 	// 1. Overwrite the private key in memory
 	if privateKey != nil {
-		// Overwrite key components with random data
-		if privateKey.D != nil {
-			privateKey.D.SetBytes(make([]byte, (privateKey.D.BitLen()+7)/8))
-		}
-		if privateKey.Primes != nil {
-			for _, prime := range privateKey.Primes {
+		// Overwrite key components with zeros
+		switch key := privateKey.(type) {
+		case *rsa.PrivateKey:
+			if key.D != nil {
+				key.D.SetBytes(make([]byte, (key.D.BitLen()+7)/8))
+			}
+			for _, prime := range key.Primes {
 				if prime != nil {
 					prime.SetBytes(make([]byte, (prime.BitLen()+7)/8))
 				}
 			}
+		case *ecdsa.PrivateKey:
+			if key.D != nil {
+				key.D.SetBytes(make([]byte, (key.D.BitLen()+7)/8))
+			}
+		case ed25519.PrivateKey:
+			for i := range key {
+				key[i] = 0
+			}
 		}
 		
 		// Force garbage collection to clear any remaining references
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"bytes"
+	"crypto/x509"
+	"encoding/asn1"
+	"errors"
+	"fmt"
+	"unicode/utf16"
+)
+
+// Java stores trusted certificate entries in PKCS#12 as certificate bags with
+// this attribute, holding the extended key usages the anchor is trusted for
+var (
+	oidJavaTrustedKeyUsage = asn1.ObjectIdentifier{2, 16, 840, 1, 113894, 746875, 1, 1}
+	oidAnyExtendedKeyUsage = asn1.ObjectIdentifier{2, 5, 29, 37, 0}
+)
+
+// javaTrustStorePassword is the well-known password of Java cacerts files
+const javaTrustStorePassword = "changeit"
+
+// jksMagic starts the proprietary JKS keystore format
+var jksMagic = []byte{0xfe, 0xed, 0xfe, 0xed}
+
+// errJKSKeyStore is returned for keystores in the JKS format, which is not
+// supported; JDK 18 and later ship cacerts as PKCS#12
+var errJKSKeyStore = errors.New("JKS keystores are not supported, only PKCS#12")
+
+// javaTrustedCert is a trusted certificate entry of a Java keystore
+type javaTrustedCert struct {
+	Alias string
+	Cert  *x509.Certificate
+}
+
+// decodeJavaTrustStore returns the trusted certificates of a PKCS#12 Java
+// keystore and whether it is protected by an integrity MAC
+func decodeJavaTrustStore(data []byte, password string) ([]javaTrustedCert, bool, error) {
+	if bytes.HasPrefix(data, jksMagic) {
+		return nil, false, errJKSKeyStore
+	}
+
+	bags, hasMAC, err := decodePFXBags(data, password)
+	if err != nil {
+		return nil, false, err
+	}
+
+	var entries []javaTrustedCert
+	for _, bag := range bags {
+		if !bag.BagID.Equal(oidCertBag) {
+			return nil, false, fmt.Errorf("keystore holds private keys, not only trusted certificates")
+		}
+		cert, err := parseCertBag(bag)
+		if err != nil {
+			return nil, false, err
+		}
+		if cert == nil {
+			continue
+		}
+		entries = append(entries, javaTrustedCert{Alias: bagFriendlyName(bag), Cert: cert})
+	}
+	return entries, hasMAC, nil
+}
+
+// encodeJavaTrustStore writes trusted certificate entries as a PKCS#12 Java
+// keystore with a single unencrypted SafeContents, the layout of the JDK's
+// own cacerts, adding an integrity MAC when withMAC is set
+func encodeJavaTrustStore(entries []javaTrustedCert, password string, withMAC bool) ([]byte, error) {
+	usageDER, err := asn1.Marshal(oidAnyExtendedKeyUsage)
+	if err != nil {
+		return nil, err
+	}
+	trustedUsage := cmsAttribute{
+		Type:   oidJavaTrustedKeyUsage,
+		Values: asn1.RawValue{Class: asn1.ClassUniversal, Tag: asn1.TagSet, IsCompound: true, Bytes: usageDER},
+	}
+
+	bags := make([]safeBag, 0, len(entries))
+	for _, entry := range entries {
+		bagDER, err := asn1.Marshal(certBag{ID: oidCertTypeX509, Data: entry.Cert.Raw})
+		if err != nil {
+			return nil, fmt.Errorf("failed to encode certificate bag: %w", err)
+		}
+		alias, err := friendlyNameAttribute(entry.Alias)
+		if err != nil {
+			return nil, err
+		}
+		bags = append(bags, safeBag{
+			BagID:      oidCertBag,
+			BagValue:   explicitContent(bagDER),
+			Attributes: []cmsAttribute{alias, trustedUsage},
+		})
+	}
+
+	safeContents, err := asn1.Marshal(bags)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode certificate bags: %w", err)
+	}
+	safeContentsData, err := asn1.Marshal(safeContents)
+	if err != nil {
+		return nil, err
+	}
+	authSafe, err := asn1.Marshal([]contentInfo{{ContentType: oidData, Content: explicitContent(safeContentsData)}})
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode authenticated safe: %w", err)
+	}
+
+	var macData *pfxMacData
+	if withMAC {
+		if macData, err = computePFXMac(authSafe, password); err != nil {
+			return nil, err
+		}
+	}
+	return marshalPFX(authSafe, macData)
+}
+
+// bagFriendlyName returns the friendlyName attribute of a safe bag, the
+// alias of a Java keystore entry
+func bagFriendlyName(bag safeBag) string {
+	for _, attr := range bag.Attributes {
+		if !attr.Type.Equal(oidFriendlyName) {
+			continue
+		}
+		var name asn1.RawValue
+		if _, err := asn1.Unmarshal(attr.Values.Bytes, &name); err != nil || name.Tag != asn1.TagBMPString || len(name.Bytes)%2 != 0 {
+			return ""
+		}
+		units := make([]uint16, len(name.Bytes)/2)
+		for i := range units {
+			units[i] = uint16(name.Bytes[2*i])<<8 | uint16(name.Bytes[2*i+1])
+		}
+		return string(utf16.Decode(units))
+	}
+	return ""
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestJavaTrustStoreRoundTrip(t *testing.T) {
+	first := newTestCertificate(t, "LocalSign-Root-CA")
+	second := newTestCertificate(t, "Vendor Root")
+	entries := []javaTrustedCert{
+		{Alias: "selfsign-path-localsign-root-ca", Cert: first.Cert},
+		{Alias: "vendor root [jdk]", Cert: second.Cert},
+	}
+
+	for _, withMAC := range []bool{true, false} {
+		data, err := encodeJavaTrustStore(entries, javaTrustStorePassword, withMAC)
+		if err != nil {
+			t.Fatalf("Failed to encode keystore: %v", err)
+		}
+
+		decoded, hasMAC, err := decodeJavaTrustStore(data, javaTrustStorePassword)
+		if err != nil {
+			t.Fatalf("Failed to decode keystore (MAC %v): %v", withMAC, err)
+		}
+		if hasMAC != withMAC {
+			t.Errorf("Expected MAC %v, got %v", withMAC, hasMAC)
+		}
+		if len(decoded) != 2 {
+			t.Fatalf("Expected 2 entries, got %d", len(decoded))
+		}
+		for i, entry := range decoded {
+			if entry.Alias != entries[i].Alias || !entry.Cert.Equal(entries[i].Cert) {
+				t.Errorf("Entry %d decoded as %q", i, entry.Alias)
+			}
+		}
+
+		if withMAC {
+			if _, _, err := decodeJavaTrustStore(data, "wrong"); err == nil {
+				t.Error("Expected a MAC error with the wrong password")
+			}
+		}
+	}
+
+	if _, _, err := decodeJavaTrustStore(append(append([]byte(nil), jksMagic...), 0, 0, 0, 2), javaTrustStorePassword); err != errJKSKeyStore {
+		t.Errorf("Expected the JKS error, got %v", err)
+	}
+}
+
+func TestJavaTrustStoreKeytool(t *testing.T) {
+	if _, err := exec.LookPath("keytool"); err != nil {
+		t.Skip("keytool not available")
+	}
+
+	cert := newTestCertificate(t, "LocalSign-Root-CA")
+	data, err := encodeJavaTrustStore([]javaTrustedCert{{Alias: "selfsign-path-localsign-root-ca", Cert: cert.Cert}}, javaTrustStorePassword, true)
+	if err != nil {
+		t.Fatalf("Failed to encode keystore: %v", err)
+	}
+	keyStore := filepath.Join(t.TempDir(), "cacerts")
+	os.WriteFile(keyStore, data, 0644)
+
+	// keytool lists entries as "alias, date, trustedCertEntry,"
+	out, err := exec.Command("keytool", "-list", "-keystore", keyStore, "-storepass", javaTrustStorePassword).CombinedOutput()
+	if err != nil {
+		t.Fatalf("keytool failed to read the keystore: %v\n%s", err, out)
+	}
+	if !strings.Contains(string(out), "selfsign-path-localsign-root-ca") || !strings.Contains(string(out), "trustedCertEntry") {
+		t.Errorf("Expected a trusted certificate entry, got:\n%s", out)
+	}
+}
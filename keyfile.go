@@ -0,0 +1,340 @@
+package main
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/rc4"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/binary"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"os"
+)
+
+// Microsoft PVK file and PRIVATEKEYBLOB constants
+const (
+	pvkMagic           = 0xb0b5f11e
+	pvkHeaderSize      = 24
+	privateKeyBlob     = 0x07
+	blobHeaderSize     = 8
+	rsaPrivateMagic    = 0x32415352 // "RSA2"
+	calgRSASign        = 0x2400
+	calgRSAKeyExchange = 0xa400
+)
+
+// keyPassphraseEnv names the environment variable holding the key passphrase
+const keyPassphraseEnv = "SELFSIGN_KEY_PASSPHRASE"
+
+// pvkHeader is the header of a Microsoft PVK file
+type pvkHeader struct {
+	Magic     uint32
+	Reserved  uint32
+	KeyType   uint32
+	Encrypted uint32
+	SaltLen   uint32
+	KeyLen    uint32
+}
+
+// promptedKeyPassphrase caches a passphrase typed at the prompt, so a run
+// that unlocks both the root CA and a signing key asks only once
+var promptedKeyPassphrase *string
+
+// getKeyPassphrase returns the passphrase for an encrypted private key from
+// --passphrase-file, the SELFSIGN_KEY_PASSPHRASE environment variable or,
+// when stdin is a terminal, an interactive prompt
+func getKeyPassphrase() (string, error) {
+	if passphrase, ok, err := configuredKeyPassphrase(); ok || err != nil {
+		return passphrase, err
+	}
+	if promptedKeyPassphrase != nil {
+		return *promptedKeyPassphrase, nil
+	}
+	if !isTerminal(os.Stdin) {
+		return "", fmt.Errorf("key is encrypted; set %s or use --passphrase-file", keyPassphraseEnv)
+	}
+
+	passphrase, err := readPassphrase("Private key passphrase: ")
+	if err != nil {
+		return "", err
+	}
+	promptedKeyPassphrase = &passphrase
+	return passphrase, nil
+}
+
+// getNewKeyPassphrase returns the passphrase to encrypt a new private key
+// with, asking twice when it has to be typed in
+func getNewKeyPassphrase() (string, error) {
+	if passphrase, ok, err := configuredKeyPassphrase(); ok || err != nil {
+		return passphrase, err
+	}
+	if promptedKeyPassphrase != nil {
+		return *promptedKeyPassphrase, nil
+	}
+	if !isTerminal(os.Stdin) {
+		return "", fmt.Errorf("encrypting the key needs a passphrase; set %s or use --passphrase-file", keyPassphraseEnv)
+	}
+
+	passphrase, err := readPassphrase("New private key passphrase: ")
+	if err != nil {
+		return "", err
+	}
+	if passphrase == "" {
+		return "", errors.New("the passphrase must not be empty")
+	}
+	confirm, err := readPassphrase("Confirm passphrase: ")
+	if err != nil {
+		return "", err
+	}
+	if confirm != passphrase {
+		return "", errors.New("the passphrases do not match")
+	}
+	promptedKeyPassphrase = &passphrase
+	return passphrase, nil
+}
+
+// configuredKeyPassphrase returns the passphrase from --passphrase-file or
+// the environment, reporting whether one was configured. Like a typed one, it
+// must not be empty
+func configuredKeyPassphrase() (string, bool, error) {
+	if *flagPassphraseFile != "" {
+		data, err := os.ReadFile(*flagPassphraseFile)
+		if err != nil {
+			return "", false, fmt.Errorf("failed to read passphrase file: %w", err)
+		}
+		if passphrase := firstLine(data); passphrase != "" {
+			return passphrase, true, nil
+		}
+		return "", true, fmt.Errorf("the passphrase in %s must not be empty", *flagPassphraseFile)
+	}
+	if passphrase, ok := os.LookupEnv(keyPassphraseEnv); ok {
+		if passphrase == "" {
+			return "", true, fmt.Errorf("the passphrase in %s must not be empty", keyPassphraseEnv)
+		}
+		return passphrase, true, nil
+	}
+	return "", false, nil
+}
+
+// readCertificateFile reads every certificate from a PEM file or bundle, or
+// from a DER encoded .cer file
+func readCertificateFile(certFile string) ([]*x509.Certificate, error) {
+	data, err := os.ReadFile(certFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read certificate file %s: %w", certFile, err)
+	}
+
+	var certs []*x509.Certificate
+	if bytes.Contains(data, []byte("-----BEGIN")) {
+		for rest := data; ; {
+			var block *pem.Block
+			if block, rest = pem.Decode(rest); block == nil {
+				break
+			}
+			if block.Type != "CERTIFICATE" {
+				continue
+			}
+			cert, err := x509.ParseCertificate(block.Bytes)
+			if err != nil {
+				return nil, fmt.Errorf("failed to parse certificate from %s: %w", certFile, err)
+			}
+			certs = append(certs, cert)
+		}
+	} else if certs, err = x509.ParseCertificates(data); err != nil {
+		return nil, fmt.Errorf("failed to parse certificate from %s: %w", certFile, err)
+	}
+
+	if len(certs) == 0 {
+		return nil, fmt.Errorf("no certificates found in %s", certFile)
+	}
+	return certs, nil
+}
+
+// readPrivateKeyFile reads a private key in PEM, DER or Microsoft PVK form,
+// decrypting encrypted PKCS#8 and PVK keys with the key passphrase
+func readPrivateKeyFile(keyFile string) (crypto.Signer, error) {
+	data, err := os.ReadFile(keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read key file %s: %w", keyFile, err)
+	}
+
+	var key crypto.Signer
+	switch {
+	case len(data) >= 4 && binary.LittleEndian.Uint32(data) == pvkMagic:
+		key, err = parsePVK(data)
+	case bytes.Contains(data, []byte("-----BEGIN")):
+		block, _ := pem.Decode(data)
+		if block == nil {
+			return nil, fmt.Errorf("failed to decode PEM private key from %s", keyFile)
+		}
+		if block.Type == "ENCRYPTED PRIVATE KEY" {
+			key, err = decryptPrivateKey(block.Bytes)
+		} else {
+			key, err = parsePrivateKey(block)
+		}
+	case isEncryptedPrivateKey(data):
+		key, err = decryptPrivateKey(data)
+	default:
+		key, err = parsePrivateKey(&pem.Block{Bytes: data})
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse private key from %s: %w", keyFile, err)
+	}
+	return key, nil
+}
+
+// isEncryptedPrivateKey reports whether der is a PKCS#8 EncryptedPrivateKeyInfo
+func isEncryptedPrivateKey(der []byte) bool {
+	var epki encryptedPrivateKeyInfo
+	rest, err := asn1.Unmarshal(der, &epki)
+	return err == nil && len(rest) == 0 && len(epki.EncryptedData) > 0
+}
+
+// decryptPrivateKey decrypts a PKCS#8 EncryptedPrivateKeyInfo
+func decryptPrivateKey(der []byte) (crypto.Signer, error) {
+	var epki encryptedPrivateKeyInfo
+	if _, err := asn1.Unmarshal(der, &epki); err != nil {
+		return nil, fmt.Errorf("failed to decode encrypted private key: %w", err)
+	}
+
+	passphrase, err := getKeyPassphrase()
+	if err != nil {
+		return nil, err
+	}
+	keyDER, err := pbeDecrypt(epki.Algorithm, passphrase, epki.EncryptedData)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt private key: %w", err)
+	}
+	return parsePrivateKey(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER})
+}
+
+// encryptPrivateKey returns key as a PEM "ENCRYPTED PRIVATE KEY" block,
+// protected with PBES2 using scrypt and AES-256-CBC
+func encryptPrivateKey(key crypto.Signer, passphrase string) (*pem.Block, error) {
+	keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal private key: %w", err)
+	}
+
+	alg, encrypted, err := pbes2EncryptScrypt(passphrase, keyDER)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encrypt private key: %w", err)
+	}
+	der, err := asn1.Marshal(encryptedPrivateKeyInfo{Algorithm: alg, EncryptedData: encrypted})
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode encrypted private key: %w", err)
+	}
+	return &pem.Block{Type: "ENCRYPTED PRIVATE KEY", Bytes: der}, nil
+}
+
+// isEncryptedKeyFile reports whether keyFile holds an encrypted PKCS#8 key
+func isEncryptedKeyFile(keyFile string) bool {
+	data, err := os.ReadFile(keyFile)
+	if err != nil {
+		return false
+	}
+	block, _ := pem.Decode(data)
+	return block != nil && block.Type == "ENCRYPTED PRIVATE KEY"
+}
+
+// parsePVK decodes an RSA key from a Microsoft PVK file, as written by
+// makecert and pvk2pfx, decrypting it when it is protected with RC4
+func parsePVK(data []byte) (crypto.Signer, error) {
+	var header pvkHeader
+	if err := binary.Read(bytes.NewReader(data), binary.LittleEndian, &header); err != nil {
+		return nil, fmt.Errorf("truncated PVK header")
+	}
+	body := data[pvkHeaderSize:]
+	if uint64(header.SaltLen)+uint64(header.KeyLen) > uint64(len(body)) || header.KeyLen < blobHeaderSize {
+		return nil, fmt.Errorf("truncated PVK file")
+	}
+	salt := body[:header.SaltLen]
+	blob := append([]byte(nil), body[header.SaltLen:header.SaltLen+header.KeyLen]...)
+
+	if header.Encrypted == 0 {
+		return parsePrivateKeyBlob(blob)
+	}
+
+	passphrase, err := getKeyPassphrase()
+	if err != nil {
+		return nil, err
+	}
+
+	// The key is SHA1(salt || password), either all 128 bits or, for keys
+	// exported under the old export rules, 40 bits padded with zeros. Only
+	// the blob after its header is encrypted
+	h := sha1.New()
+	h.Write(salt)
+	h.Write([]byte(passphrase))
+	digest := h.Sum(nil)
+	weak := append(append([]byte(nil), digest[:5]...), make([]byte, 11)...)
+
+	for _, rc4Key := range [][]byte{digest[:16], weak} {
+		decrypted := append([]byte(nil), blob...)
+		c, err := rc4.NewCipher(rc4Key)
+		if err != nil {
+			return nil, err
+		}
+		c.XORKeyStream(decrypted[blobHeaderSize:], decrypted[blobHeaderSize:])
+		if binary.LittleEndian.Uint32(decrypted[blobHeaderSize:]) == rsaPrivateMagic {
+			return parsePrivateKeyBlob(decrypted)
+		}
+	}
+	return nil, errors.New("failed to decrypt PVK key, the passphrase may be wrong")
+}
+
+// parsePrivateKeyBlob decodes a CryptoAPI PRIVATEKEYBLOB holding an RSA key
+func parsePrivateKeyBlob(blob []byte) (crypto.Signer, error) {
+	if len(blob) < blobHeaderSize+12 || blob[0] != privateKeyBlob {
+		return nil, fmt.Errorf("not a PRIVATEKEYBLOB")
+	}
+	if alg := binary.LittleEndian.Uint32(blob[4:]); alg != calgRSASign && alg != calgRSAKeyExchange {
+		return nil, fmt.Errorf("unsupported PVK key algorithm 0x%x", alg)
+	}
+	if binary.LittleEndian.Uint32(blob[blobHeaderSize:]) != rsaPrivateMagic {
+		return nil, fmt.Errorf("not an RSA private key blob")
+	}
+
+	bitLen := int(binary.LittleEndian.Uint32(blob[blobHeaderSize+4:]))
+	pubExp := binary.LittleEndian.Uint32(blob[blobHeaderSize+8:])
+	rest := blob[blobHeaderSize+12:]
+
+	// Integers are stored little-endian: modulus, primes, CRT values, then
+	// the private exponent
+	byteLen, halfLen := (bitLen+7)/8, (bitLen+15)/16
+	next := func(n int) (*big.Int, error) {
+		if len(rest) < n {
+			return nil, fmt.Errorf("truncated RSA private key blob")
+		}
+		be := make([]byte, n)
+		for i := range be {
+			be[i] = rest[n-1-i]
+		}
+		rest = rest[n:]
+		return new(big.Int).SetBytes(be), nil
+	}
+
+	var values [7]*big.Int
+	for i, n := range []int{byteLen, halfLen, halfLen, halfLen, halfLen, halfLen, byteLen} {
+		v, err := next(n)
+		if err != nil {
+			return nil, err
+		}
+		values[i] = v
+	}
+
+	key := &rsa.PrivateKey{
+		PublicKey: rsa.PublicKey{N: values[0], E: int(pubExp)},
+		D:         values[6],
+		Primes:    []*big.Int{values[1], values[2]},
+	}
+	if err := key.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid RSA key in PVK: %w", err)
+	}
+	key.Precompute()
+	return key, nil
+}
@@ -0,0 +1,230 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/pem"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"testing"
+)
+
+func TestLoadCertificateDERAndBundle(t *testing.T) {
+	identity := newTestIdentity(t)
+	dir := t.TempDir()
+	keyDER, _ := x509.MarshalPKCS8PrivateKey(identity.PrivateKey)
+
+	// DER .cer with a DER PKCS#8 key
+	cerFile := filepath.Join(dir, "signer.cer")
+	derKeyFile := filepath.Join(dir, "signer.der")
+	os.WriteFile(cerFile, identity.Cert.Raw, 0644)
+	os.WriteFile(derKeyFile, keyDER, 0600)
+	cert, err := loadCertificateFromFile(cerFile, derKeyFile)
+	if err != nil {
+		t.Fatalf("Failed to load DER certificate: %v", err)
+	}
+	if !cert.Cert.Equal(identity.Cert) || len(cert.Chain) != 0 {
+		t.Errorf("DER certificate loaded incorrectly")
+	}
+
+	// PEM bundle listing the root before the signing certificate
+	bundleFile := filepath.Join(dir, "bundle.pem")
+	keyFile := filepath.Join(dir, "signer.key")
+	bundle := append(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: identity.Chain[0].Raw}),
+		pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: identity.Cert.Raw})...)
+	os.WriteFile(bundleFile, bundle, 0644)
+	os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER}), 0600)
+	cert, err = loadCertificateFromFile(bundleFile, keyFile)
+	if err != nil {
+		t.Fatalf("Failed to load PEM bundle: %v", err)
+	}
+	if !cert.Cert.Equal(identity.Cert) || len(cert.Chain) != 1 || !cert.Chain[0].Equal(identity.Chain[0]) {
+		t.Errorf("Expected the signing certificate with the root as chain")
+	}
+}
+
+func TestLoadCertificatePVK(t *testing.T) {
+	if _, err := exec.LookPath("openssl"); err != nil {
+		t.Skip("openssl not available")
+	}
+	cert := newTestCertificate(t, "LocalSign-Test")
+	dir := t.TempDir()
+
+	cerFile := filepath.Join(dir, "signer.cer")
+	keyFile := filepath.Join(dir, "signer.pem")
+	os.WriteFile(cerFile, cert.Cert.Raw, 0644)
+	os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(cert.PrivateKey.(*rsa.PrivateKey))}), 0600)
+
+	t.Setenv(keyPassphraseEnv, "makecert")
+	for _, mode := range []string{"none", "strong", "weak"} {
+		pvkFile := filepath.Join(dir, "signer-"+mode+".pvk")
+		// RC4 encryption needs the legacy provider in OpenSSL 3
+		out, err := exec.Command("openssl", "rsa", "-provider", "legacy", "-provider", "default",
+			"-in", keyFile, "-outform", "PVK", "-pvk-"+mode, "-passout", "pass:makecert", "-out", pvkFile).CombinedOutput()
+		if err != nil {
+			t.Logf("Skipping %s PVK, openssl could not write it: %s", mode, out)
+			continue
+		}
+
+		loaded, err := loadCertificateFromFile(cerFile, pvkFile)
+		if err != nil {
+			t.Errorf("Failed to load %s PVK: %v", mode, err)
+			continue
+		}
+		if !loaded.Cert.Equal(cert.Cert) {
+			t.Errorf("%s PVK loaded the wrong certificate", mode)
+		}
+	}
+
+	t.Setenv(keyPassphraseEnv, "wrong")
+	if _, err := loadCertificateFromFile(cerFile, filepath.Join(dir, "signer-strong.pvk")); err == nil {
+		t.Error("Expected a wrong passphrase to be rejected")
+	}
+}
+
+func TestScryptVectors(t *testing.T) {
+	// RFC 7914 section 12
+	vectors := []struct {
+		password, salt string
+		n, r, p        int
+		want           string
+	}{
+		{"", "", 16, 1, 1, "77d6576238657b203b19ca42c18a0497f16b4844e3074ae8dfdffa3fede21442fcd0069ded0948f8326a753a0fc81f17e8d3e0fb2e0d3628cf35e20c38d18906"},
+		{"password", "NaCl", 1024, 8, 16, "fdbabe1c9d3472007856e7190d01e9fe7c6ad7cbc8237830e77376634b3731622eaf30d92e22a3886ff109279d9830dac727afb94a83ee6d8360cbdfa2cc0640"},
+	}
+	for _, v := range vectors {
+		got, err := scryptKey([]byte(v.password), []byte(v.salt), v.n, v.r, v.p, 64)
+		if err != nil {
+			t.Fatalf("scrypt failed: %v", err)
+		}
+		if hex.EncodeToString(got) != v.want {
+			t.Errorf("scrypt(%q, %q, N=%d) = %x", v.password, v.salt, v.n, got)
+		}
+	}
+
+	if _, err := scryptKey([]byte("x"), nil, 1<<24, 8, 1, 32); err == nil {
+		t.Error("Expected scrypt parameters needing 2 GiB to be rejected")
+	}
+}
+
+func TestEncryptedStoredKey(t *testing.T) {
+	t.Setenv("HOME", t.TempDir())
+	t.Setenv(keyPassphraseEnv, "correct horse")
+	*flagEncryptKey = true
+	defer func() { *flagEncryptKey = false }()
+
+	root, err := createLocalRootCA(localRootCAName, "p256")
+	if err != nil {
+		t.Fatalf("Failed to create root CA: %v", err)
+	}
+	if err := saveCertificateFiles(io.Discard, localRootCAName, root.Cert, root.PrivateKey); err != nil {
+		t.Fatalf("Failed to save root CA: %v", err)
+	}
+	rootKeyFile := filepath.Join(getCertificateDirectory(), localRootCAName+".key")
+	if !isEncryptedKeyFile(rootKeyFile) {
+		t.Fatal("Expected the root key to be stored encrypted")
+	}
+	if info, err := os.Stat(rootKeyFile); err != nil {
+		t.Fatalf("Failed to stat key file: %v", err)
+	} else if runtime.GOOS != "windows" && info.Mode().Perm() != 0600 {
+		t.Errorf("Expected the key file to be readable by its owner only, got %v", info.Mode())
+	}
+
+	// Keys issued from an encrypted root stay encrypted without --encrypt-key
+	*flagEncryptKey = false
+	cert, err := getOrCreateSigningCertificate(io.Discard, "LocalSign-Test")
+	if err != nil {
+		t.Fatalf("Failed to issue certificate from encrypted root: %v", err)
+	}
+	if !isEncryptedKeyFile(filepath.Join(getCertificateDirectory(), "LocalSign-Test.key")) {
+		t.Error("Expected the issued key to be stored encrypted")
+	}
+
+	loaded, err := loadStoredCertificate("LocalSign-Test")
+	if err != nil {
+		t.Fatalf("Failed to load encrypted key: %v", err)
+	}
+	if !loaded.Cert.Equal(cert.Cert) || len(loaded.Chain) != 1 {
+		t.Error("Encrypted identity loaded incorrectly")
+	}
+
+	// A passphrase file is read up to its first line break, and takes
+	// precedence over the environment
+	passphraseFile := filepath.Join(t.TempDir(), "passphrase.txt")
+	os.WriteFile(passphraseFile, []byte("correct horse\r\nnot part of it\n"), 0600)
+	*flagPassphraseFile = passphraseFile
+	t.Setenv(keyPassphraseEnv, "wrong")
+	if _, err := loadStoredCertificate("LocalSign-Test"); err != nil {
+		t.Errorf("Failed to load the key with the first line of the passphrase file: %v", err)
+	}
+	*flagPassphraseFile = ""
+
+	if _, err := loadStoredCertificate("LocalSign-Test"); err == nil {
+		t.Error("Expected a wrong passphrase to be rejected")
+	}
+
+	// An empty passphrase would leave the key as good as unencrypted
+	t.Setenv(keyPassphraseEnv, "")
+	if _, err := getNewKeyPassphrase(); err == nil {
+		t.Error("Expected an empty passphrase to be rejected")
+	}
+
+	// Without a passphrase source a non-interactive run fails cleanly
+	os.Unsetenv(keyPassphraseEnv)
+	if _, err := loadStoredCertificate("LocalSign-Test"); err == nil {
+		t.Error("Expected an encrypted key without a passphrase to fail")
+	}
+}
+
+func TestEncryptedKeyOpenSSLInterop(t *testing.T) {
+	if _, err := exec.LookPath("openssl"); err != nil {
+		t.Skip("openssl not available")
+	}
+	identity := newTestIdentity(t)
+	dir := t.TempDir()
+	t.Setenv(keyPassphraseEnv, "interop")
+
+	// OpenSSL reads our scrypt protected key
+	block, err := encryptPrivateKey(identity.PrivateKey, "interop")
+	if err != nil {
+		t.Fatalf("Failed to encrypt key: %v", err)
+	}
+	ours := filepath.Join(dir, "ours.key")
+	os.WriteFile(ours, pem.EncodeToMemory(block), 0600)
+	out, err := exec.Command("openssl", "pkcs8", "-in", ours, "-passin", "pass:interop", "-nocrypt", "-topk8", "-outform", "DER").Output()
+	if err != nil {
+		t.Fatalf("openssl could not decrypt the key: %v", err)
+	}
+	keyDER, _ := x509.MarshalPKCS8PrivateKey(identity.PrivateKey)
+	if !bytes.Equal(out, keyDER) {
+		t.Error("openssl decrypted a different key")
+	}
+
+	// We read keys OpenSSL encrypted with PBKDF2 and with scrypt, PEM and DER
+	plain := filepath.Join(dir, "plain.key")
+	os.WriteFile(plain, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER}), 0600)
+	for name, args := range map[string][]string{
+		"pbkdf2.pem": {"-v2", "aes-256-cbc"},
+		"scrypt.pem": {"-scrypt"},
+		"pbkdf2.der": {"-v2", "aes-128-cbc", "-outform", "DER"},
+	} {
+		keyFile := filepath.Join(dir, name)
+		cmd := append([]string{"pkcs8", "-topk8", "-in", plain, "-passout", "pass:interop", "-out", keyFile}, args...)
+		if out, err := exec.Command("openssl", cmd...).CombinedOutput(); err != nil {
+			t.Fatalf("openssl failed to write %s: %v\n%s", name, err, out)
+		}
+		key, err := readPrivateKeyFile(keyFile)
+		if err != nil {
+			t.Errorf("Failed to read %s: %v", name, err)
+			continue
+		}
+		if _, err := certificateForKey(key, []*x509.Certificate{identity.Cert}); err != nil {
+			t.Errorf("%s decrypted to a different key", name)
+		}
+	}
+}
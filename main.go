@@ -1,36 +1,124 @@
 package main
 
 import (
+	"errors"
 	"flag"
 	"fmt"
+	"io"
+	"io/fs"
 	"os"
+	"path"
 	"path/filepath"
 	"runtime"
 	"strings"
+	"time"
 )
 
 const version = "1.0.0"
 
+// Exit codes; when several apply to a run, the highest is used
+const (
+	exitOK = 0
+	// exitUsage is for invalid arguments and errors stopping the whole run
+	exitUsage = 1
+	// exitPartialFailure is for files that could not be signed, cleared or read
+	exitPartialFailure = 2
+	// exitVerificationFailed is for tampered files, and unsigned ones with --require-signed
+	exitVerificationFailed = 3
+	// exitCertificateError is for a signing certificate that cannot be loaded or
+	// created, and untrusted or expired signers with --require-signed
+	exitCertificateError = 4
+)
+
+// exitError is an error that ends the process with a specific exit code
+type exitError struct {
+	code int
+	err  error
+}
+
+func (e *exitError) Error() string { return e.err.Error() }
+
+func (e *exitError) Unwrap() error { return e.err }
+
+// exitCodeOf returns the exit code for an error ending the process
+func exitCodeOf(err error) int {
+	var exitErr *exitError
+	if errors.As(err, &exitErr) {
+		return exitErr.code
+	}
+	return exitUsage
+}
+
 // Command line flags
 var (
-	flagRecurse  = flag.Bool("r", false, "Recursively search for and process files in any specified directories")
-	flagName     = flag.String("n", "LocalSign-SelfSigned", "Specify the subject name of the certificate to use for signing")
-	flagCertFile = flag.String("c", "", "Specify the path to the certificate file (.cer or .pem)")
-	flagKeyFile  = flag.String("k", "", "Specify the path to the private key file (.pvk or .key)")
-	flagClear    = flag.Bool("clear", false, "Remove self-signed signatures created by this tool from the specified files")
-	flagStatus   = flag.Bool("status", false, "Print the signing status of the specified files instead of signing them")
-	flagHelp     = flag.Bool("h", false, "Display help documentation and exit")
-	flagVersion  = flag.Bool("version", false, "Display version information and exit")
-	flagGUI      = flag.Bool("gui", false, "Launch the graphical user interface (Windows only)")
+	flagRecurse         = flag.Bool("r", false, "Recursively search for and process files in any specified directories")
+	flagName            = flag.String("n", "LocalSign-SelfSigned", "Specify the subject name of the certificate to use for signing")
+	flagCertFile        = flag.String("c", "", "Specify the path to the certificate file (.cer or .pem)")
+	flagKeyFile         = flag.String("k", "", "Specify the path to the private key file (.pvk or .key)")
+	flagPassphraseFile  = flag.String("passphrase-file", "", "Read the private key passphrase from this file instead of $"+keyPassphraseEnv)
+	flagEncryptKey      = flag.Bool("encrypt-key", false, "Encrypt newly generated private keys with the key passphrase")
+	flagPFXFile         = flag.String("pfx", "", "Sign with the certificate and key from a PKCS#12 (.pfx/.p12) file")
+	flagPFXPasswordFile = flag.String("pfx-password-file", "", "Read the PFX password from this file instead of $"+pfxPasswordEnv)
+	flagKeyType         = flag.String("key-type", "rsa2048", "Key type for newly generated certificates (rsa2048, rsa4096, p256, p384, ed25519)")
+	flagAppend          = flag.Bool("append", false, "Add the signature as a nested signature instead of replacing existing ones")
+	flagForce           = flag.Bool("force", false, "Sign files even when they are already validly signed by the certificate")
+	flagReplace         = flag.Bool("replace", false, "Remove the signatures this tool made from files before signing them again")
+	flagDigest          = flag.String("digest", "sha256", "Comma separated digest algorithms to sign with (sha1, sha256, sha384, sha512)")
+	flagTimestampURL    = flag.String("timestamp-url", "", "RFC 3161 time-stamping authority URL used to counter-sign signatures")
+	flagClear           = flag.Bool("clear", false, "Remove self-signed signatures created by this tool from the specified files")
+	flagPurgeCert       = flag.Bool("purge-cert", false, "With --clear, also remove this tool's certificates from the trust store")
+	flagStatus          = flag.Bool("status", false, "Print the signing status of the specified files instead of signing them")
+	flagDryRun          = flag.Bool("dry-run", false, "Print what signing or --clear would do without changing files, certificates or trust stores")
+	flagNoCache         = flag.Bool("no-cache", false, "Sign and verify every file instead of skipping unchanged files found in the digest cache")
+	flagOutput          = flag.String("output", outputText, "Report format: text, json, csv or junit")
+	flagExt             = flag.String("ext", "", "Comma separated extensions to pick up in directories, replacing the defaults, or extending them with a leading +")
+	flagJobs            = flag.Int("j", runtime.GOMAXPROCS(0), "Sign, verify or clear up to `N` files in parallel")
+	flagRequireSigned   = flag.Bool("require-signed", false, "With --status, fail unless every file has a valid, trusted signature")
+	flagHelp            = flag.Bool("h", false, "Display help documentation and exit")
+	flagVersion         = flag.Bool("version", false, "Display version information and exit")
+	flagGUI             = flag.Bool("gui", false, "Launch the graphical user interface (Windows only)")
+)
+
+// Repeatable file selection flags
+var (
+	flagInclude stringList
+	flagExclude stringList
 )
 
 func init() {
+	flag.Var(&flagInclude, "include", "Only process files matching this `PATTERN`; may be repeated")
+	flag.Var(&flagExclude, "exclude", "Skip files and directories matching this `PATTERN`; may be repeated")
+	// -r, -n, -c, -k and -j are also accepted as --recurse, --name, ...
+	addLongNames(flag.CommandLine)
+
 	// Set custom usage message
 	flag.Usage = showHelp
+	// Report bad flags with the usage exit code rather than the flag package's 2
+	flag.CommandLine.Init(os.Args[0], flag.ContinueOnError)
 }
 
 func main() {
-	flag.Parse()
+	// Commands are handled before the legacy flag-only invocation, which
+	// signs, or with --status or --clear checks or clears, the files given
+	if len(os.Args) > 1 {
+		if cmd := findCommand(os.Args[1]); cmd != nil {
+			if err := runCommand(cmd, os.Args[2:]); err != nil {
+				if errors.Is(err, flag.ErrHelp) {
+					os.Exit(exitOK)
+				}
+				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+				os.Exit(exitCodeOf(err))
+			}
+			os.Exit(exitOK)
+		}
+	}
+
+	if err := flag.CommandLine.Parse(os.Args[1:]); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			os.Exit(exitOK)
+		}
+		os.Exit(exitUsage)
+	}
 
 	if *flagVersion {
 		fmt.Printf("selfsign-path-tool version %s\n", version)
@@ -58,94 +146,173 @@ func main() {
 		os.Exit(0)
 	}
 
+	if err := runFileCommand(flag.Args()); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(exitCodeOf(err))
+	}
+}
+
+// runFileCommand checks the options given for signing, checking or clearing
+// files and processes the files, then with --purge-cert removes the tool's
+// certificates from the trust store
+func runFileCommand(patterns []string) error {
 	// Validate certificate and key file parameters
 	if *flagCertFile != "" && *flagKeyFile == "" {
-		fmt.Fprintf(os.Stderr, "Error: --cert-file requires --key-file to be specified.\n")
-		os.Exit(1)
+		return fmt.Errorf("--cert-file requires --key-file to be specified")
 	}
 
 	if *flagKeyFile != "" && *flagCertFile == "" {
-		fmt.Fprintf(os.Stderr, "Error: --key-file requires --cert-file to be specified.\n")
-		os.Exit(1)
+		return fmt.Errorf("--key-file requires --cert-file to be specified")
+	}
+
+	if *flagPFXFile != "" && (*flagCertFile != "" || *flagKeyFile != "") {
+		return fmt.Errorf("--pfx cannot be combined with --cert-file or --key-file")
+	}
+
+	if !isValidKeyType(*flagKeyType) {
+		return fmt.Errorf("unsupported --key-type %q; use one of %s", *flagKeyType, strings.Join(keyTypes, ", "))
+	}
+
+	if !isValidOutputFormat(*flagOutput) {
+		return fmt.Errorf("unsupported --output %q; use one of %s", *flagOutput, strings.Join(outputFormats, ", "))
+	}
+
+	if *flagJobs < 1 {
+		return fmt.Errorf("-j must be at least 1")
+	}
+
+	if *flagRequireSigned && !*flagStatus {
+		return fmt.Errorf("--require-signed can only be used with --status")
+	}
+
+	if (*flagForce || *flagReplace) && (*flagStatus || *flagClear) {
+		return fmt.Errorf("--force and --replace can only be used when signing")
 	}
 
-	// Get file patterns from remaining arguments
-	patterns := flag.Args()
-	if len(patterns) == 0 {
-		fmt.Fprintf(os.Stderr, "Error: No files or patterns specified.\n")
-		os.Exit(1)
+	if *flagDryRun && *flagStatus {
+		return fmt.Errorf("--dry-run cannot be used with --status, which changes nothing")
+	}
+
+	if *flagPurgeCert && !*flagClear {
+		return fmt.Errorf("--purge-cert can only be used with --clear")
+	}
+
+	if len(patterns) == 0 && !*flagPurgeCert {
+		return fmt.Errorf("no files or patterns specified")
+	}
+
+	// In machine-readable modes stdout carries only the report; progress
+	// messages go to stderr
+	progress := os.Stdout
+	if *flagOutput != outputText {
+		progress = os.Stderr
 	}
 
 	// Main execution logic
-	if err := run(patterns); err != nil {
-		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
-		os.Exit(1)
+	if len(patterns) > 0 {
+		if err := run(progress, patterns); err != nil {
+			return err
+		}
 	}
+
+	if *flagPurgeCert && *flagDryRun {
+		fmt.Fprintln(progress)
+		planUninstallCertificates(progress)
+	} else if *flagPurgeCert {
+		fmt.Fprintf(progress, "\nRemoving certificates from the trust store...\n")
+		if err := uninstallCertificates(progress, nil); err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
-func run(patterns []string) error {
+// run processes the files matching patterns, printing progress to w and the
+// report to stdout
+func run(w io.Writer, patterns []string) error {
 	// Get target files from patterns
-	files, err := getTargetFiles(patterns, *flagRecurse)
+	sel, err := newFileSelection(*flagExt, flagInclude, flagExclude)
+	if err != nil {
+		return err
+	}
+	files, err := getTargetFiles(w, patterns, *flagRecurse, sel)
 	if err != nil {
 		return fmt.Errorf("failed to get target files: %w", err)
 	}
 
 	if len(files) == 0 {
-		fmt.Printf("No files found matching the specified patterns.\n")
-		return nil
+		fmt.Fprintf(w, "No files found matching the specified patterns.\n")
+		// Machine-readable reports are still written, empty
+		if *flagOutput == outputText {
+			return nil
+		}
+	} else {
+		fmt.Fprintf(w, "Found %d file(s) to process.\n", len(files))
 	}
 
-	fmt.Printf("Found %d file(s) to process.\n", len(files))
+	action := "sign"
+	process := signFiles
+	var certPlan *certificatePlan
+	switch {
+	case *flagStatus:
+		action, process = "status", showStatus
+	case *flagClear && *flagDryRun:
+		action, process = "clear", planClearSignatures
+	case *flagClear:
+		action, process = "clear", clearSignatures
+	case *flagDryRun && len(files) > 0:
+		process = func(w io.Writer, files []string) (results []fileResult, err error) {
+			results, certPlan, err = planSignFiles(w, files)
+			return results, err
+		}
+	}
 
-	if *flagStatus {
-		return showStatus(files)
-	} else if *flagClear {
-		return clearSignatures(files)
-	} else {
-		return signFiles(files)
+	start := time.Now()
+	results, err := process(w, files)
+	if err != nil {
+		return err
+	}
+	summary := summarizeResults(action, results, time.Since(start))
+	summary.DryRun, summary.Certificate = *flagDryRun, certPlan
+	if err := writeReport(os.Stdout, w, *flagOutput, summary, results); err != nil {
+		return fmt.Errorf("failed to write report: %w", err)
 	}
+	return checkResults(results, *flagRequireSigned)
 }
 
-func getTargetFiles(patterns []string, recursive bool) ([]string, error) {
+func getTargetFiles(w io.Writer, patterns []string, recursive bool, sel *fileSelection) ([]string, error) {
 	var files []string
 	seen := make(map[string]bool)
+	add := func(found []string) {
+		for _, file := range found {
+			if !seen[file] {
+				files = append(files, file)
+				seen[file] = true
+			}
+		}
+	}
 
 	for _, pattern := range patterns {
 		// Check if it's a directory
 		if info, err := os.Stat(pattern); err == nil && info.IsDir() {
-			dirFiles, err := getFilesFromDirectory(pattern, recursive)
+			dirFiles, err := getFilesFromDirectory(w, pattern, recursive, sel)
 			if err != nil {
 				return nil, fmt.Errorf("failed to get files from directory %s: %w", pattern, err)
 			}
-			for _, file := range dirFiles {
-				if !seen[file] {
-					files = append(files, file)
-					seen[file] = true
-				}
-			}
+			add(dirFiles)
 		} else if strings.ContainsAny(pattern, "*?[]") {
 			// It's a glob pattern
-			matches, err := filepath.Glob(pattern)
+			matches, err := getFilesFromPattern(pattern, recursive, sel)
 			if err != nil {
 				return nil, fmt.Errorf("invalid pattern %s: %w", pattern, err)
 			}
-			for _, match := range matches {
-				if info, err := os.Stat(match); err == nil && !info.IsDir() {
-					if !seen[match] {
-						files = append(files, match)
-						seen[match] = true
-					}
-				}
-			}
+			add(matches)
 		} else {
 			// It's a specific file
 			if _, err := os.Stat(pattern); err == nil {
-				if !seen[pattern] {
-					files = append(files, pattern)
-					seen[pattern] = true
-				}
+				add([]string{pattern})
 			} else {
-				fmt.Printf("Warning: File not found: %s\n", pattern)
+				fmt.Fprintf(w, "Warning: File not found: %s\n", pattern)
 			}
 		}
 	}
@@ -153,107 +320,258 @@ func getTargetFiles(patterns []string, recursive bool) ([]string, error) {
 	return files, nil
 }
 
-func getFilesFromDirectory(dir string, recursive bool) ([]string, error) {
-	var files []string
-	
-	// Executable file extensions we care about
-	extensions := map[string]bool{
-		".exe": true, ".dll": true, ".msi": true, ".sys": true,
-		".com": true, ".ocx": true, ".scr": true, ".cpl": true,
+func getFilesFromDirectory(w io.Writer, dir string, recursive bool, sel *fileSelection) ([]string, error) {
+	maxDepth := 0
+	if recursive {
+		maxDepth = -1
+	}
+	return walkFiles(dir, maxDepth, sel, func(rel string) bool {
+		return sel.picks(w, filepath.Join(dir, filepath.FromSlash(rel)), rel)
+	})
+}
+
+// getFilesFromPattern expands a pattern that may use "**" by walking the
+// directory before its first wildcard. With recursion, a pattern without "**"
+// also matches in every subdirectory, so -r 'bin/*.dll' finds bin/x/y.dll
+func getFilesFromPattern(pattern string, recursive bool, sel *fileSelection) ([]string, error) {
+	base, rest := splitGlobPattern(pattern)
+	if _, err := path.Match(strings.ReplaceAll(rest, "**", "*"), ""); err != nil {
+		return nil, err
+	}
+	if recursive && !strings.Contains(rest, "**") {
+		rest = "**/" + rest
 	}
+	if info, err := os.Stat(base); err != nil || !info.IsDir() {
+		return nil, nil
+	}
+
+	// Without "**" the pattern only reaches as deep as it has segments
+	maxDepth := -1
+	if !strings.Contains(rest, "**") {
+		maxDepth = strings.Count(rest, "/")
+	}
+	return walkFiles(base, maxDepth, sel, func(rel string) bool {
+		return matchGlob(rest, rel) && sel.matches(rel)
+	})
+}
+
+// walkFiles returns the files under root whose slash-separated path relative
+// to root is accepted by match, descending at most maxDepth directories below
+// root (-1 for no limit) and skipping excluded directories
+func walkFiles(root string, maxDepth int, sel *fileSelection, match func(rel string) bool) ([]string, error) {
+	var files []string
 
-	walkFunc := func(path string, info os.FileInfo, err error) error {
+	walkFunc := func(file string, entry fs.DirEntry, err error) error {
 		if err != nil {
 			return err
 		}
 
-		// Skip directories
-		if info.IsDir() {
-			if !recursive && path != dir {
+		rel, err := filepath.Rel(root, file)
+		if err != nil {
+			return err
+		}
+		rel = filepath.ToSlash(rel)
+
+		if entry.IsDir() {
+			if rel == "." {
+				return nil
+			}
+			if (maxDepth >= 0 && strings.Count(rel, "/") >= maxDepth) || sel.excludesDirectory(rel) {
 				return filepath.SkipDir
 			}
 			return nil
 		}
 
-		// Check if file has an extension we care about
-		ext := strings.ToLower(filepath.Ext(path))
-		if extensions[ext] {
-			files = append(files, path)
+		if isRegularEntry(file, entry) && match(rel) {
+			files = append(files, file)
 		}
-
 		return nil
 	}
 
-	if err := filepath.Walk(dir, walkFunc); err != nil {
+	if err := filepath.WalkDir(root, walkFunc); err != nil {
 		return nil, err
 	}
 
 	return files, nil
 }
 
-func showStatus(files []string) error {
-	fmt.Printf("\nSignature Status Report:\n")
-	fmt.Printf("========================================\n")
+// isRegularEntry reports whether a directory entry is a regular file or a
+// symbolic link to one; links to directories are not followed
+func isRegularEntry(file string, entry fs.DirEntry) bool {
+	if entry.Type()&fs.ModeSymlink != 0 {
+		info, err := os.Stat(file)
+		return err == nil && info.Mode().IsRegular()
+	}
+	return entry.Type().IsRegular()
+}
+
+func showStatus(w io.Writer, files []string) ([]fileResult, error) {
+	// The text report is the status listing itself
+	text := *flagOutput == outputText
+	if text {
+		fmt.Fprintf(w, "\nSignature Status Report:\n")
+		fmt.Fprintf(w, "========================================\n")
+	}
 
-	for _, file := range files {
-		status, err := getFileSignatureStatus(file)
+	var cache *digestCache
+	if !*flagNoCache {
+		cache = openDigestCache(w)
+	}
+	ownCerts := loadOwnCertificates()
+
+	results := processFiles(w, files, *flagJobs, func(file string) (fileResult, string) {
+		var out strings.Builder
+		class := classifyFile(file)
+		if text {
+			fmt.Fprintf(&out, "\nFile: %s\n", file)
+			fmt.Fprintf(&out, "Type: %s\n", class)
+		}
+
+		status, ok := cache.lookup(file, statusCacheContext)
+		var err error
+		if !ok {
+			status, err = getFileSignatureStatus(file, ownCerts)
+			if err == nil && isCacheableStatus(status) {
+				cache.store(file, statusCacheContext, status)
+			}
+		}
 		if err != nil {
-			fmt.Printf("\nFile: %s\n", file)
-			fmt.Printf("Status: Error - %v\n", err)
-		} else {
-			fmt.Printf("\nFile: %s\n", file)
-			fmt.Printf("Status: %s\n", status.Status)
+			if text {
+				fmt.Fprintf(&out, "Status: Error - %v\n", err)
+			}
+			result := errorFileResult(file, "status", err)
+			result.Type = class.String()
+			return result, out.String()
+		}
+
+		if text {
+			fmt.Fprintf(&out, "Status: %s\n", status.Status)
 			if status.SignerCertificate != "" {
-				fmt.Printf("Signer: %s\n", status.SignerCertificate)
-				fmt.Printf("Self-signed: %t\n", status.IsSelfSigned)
+				fmt.Fprintf(&out, "Signer: %s\n", status.SignerCertificate)
+				fmt.Fprintf(&out, "Self-signed: %t\n", status.IsSelfSigned)
 			}
 			if status.TimestampCertificate != "" {
-				fmt.Printf("Timestamp: %s\n", status.TimestampCertificate)
+				fmt.Fprintf(&out, "Timestamp: %s (%s)\n", status.TimestampCertificate, status.TimestampTime.Format(time.RFC3339))
+			}
+			for _, nested := range status.Nested {
+				fmt.Fprintf(&out, "Nested signature: %s (%s)\n", nested.SignerCertificate, nested.Status)
 			}
 		}
-	}
+		result := newFileResult(file, "status", status)
+		result.Type = class.String()
+		return result, out.String()
+	})
 
-	return nil
+	if err := cache.save(); err != nil {
+		fmt.Fprintf(w, "Warning: Failed to save the digest cache: %v\n", err)
+	}
+	return results, nil
 }
 
-func clearSignatures(files []string) error {
-	fmt.Printf("Removing self-signed signatures...\n")
-	removedCount := 0
-
-	for _, file := range files {
-		if removed, err := removeSelfSignedSignature(file); err != nil {
-			fmt.Printf("Error processing %s: %v\n", file, err)
-		} else if removed {
-			fmt.Printf("Removed self-signed signature from: %s\n", file)
-			removedCount++
+func clearSignatures(w io.Writer, files []string) ([]fileResult, error) {
+	fmt.Fprintf(w, "Removing self-signed signatures...\n")
+
+	ownCerts := loadOwnCertificates()
+	results := processFiles(w, files, *flagJobs, func(file string) (fileResult, string) {
+		removed, err := removeSelfSignedSignature(file, ownCerts)
+		switch {
+		case err != nil:
+			return errorFileResult(file, "clear", err), fmt.Sprintf("Error processing %s: %v\n", file, err)
+		case removed:
+			return fileResult{Path: file, Action: "clear", Status: resultRemoved}, fmt.Sprintf("Removed self-signed signature from: %s\n", file)
 		}
-	}
+		return fileResult{Path: file, Action: "clear", Status: resultUnchanged}, ""
+	})
 
-	fmt.Printf("\nRemoved signatures from %d file(s).\n", removedCount)
-	return nil
+	fmt.Fprintf(w, "\nRemoved signatures from %d file(s).\n", countStatus(results, resultRemoved))
+	return results, nil
 }
 
-func signFiles(files []string) error {
-	// Get or create certificate
-	cert, err := getCertificate()
+func signFiles(w io.Writer, files []string) ([]fileResult, error) {
+	if len(files) == 0 {
+		return nil, nil
+	}
+
+	opts, err := getSignOptions()
 	if err != nil {
-		return fmt.Errorf("failed to obtain signing certificate: %w", err)
+		return nil, err
 	}
 
-	fmt.Printf("Signing files with certificate: %s\n", cert.Subject)
-	signedCount := 0
+	// Get or create certificate; it is loaded once, before the workers start,
+	// and its key is only read while signing
+	cert, err := getCertificate(w)
+	if err != nil {
+		return nil, &exitError{exitCertificateError, fmt.Errorf("failed to obtain signing certificate: %w", err)}
+	}
 
-	for _, file := range files {
-		if err := signFile(file, cert); err != nil {
-			fmt.Printf("Warning: Failed to sign %s: %v\n", file, err)
-		} else {
-			fmt.Printf("Successfully signed: %s\n", file)
-			signedCount++
-		}
+	fmt.Fprintf(w, "Signing files with certificate: %s\n", cert.Subject)
+	fingerprint := certificateFingerprint(cert.Cert)
+
+	var cache *digestCache
+	if !*flagNoCache {
+		cache = openDigestCache(w)
 	}
+	context := signCacheContext(cert, opts)
+	ownCerts := getOwnCertificates(cert.Cert)
+
+	results := processFiles(w, files, *flagJobs, func(file string) (fileResult, string) {
+		plan := planSigning(file, cert, opts, cache)
+		if plan.Decision == signDecisionSkip {
+			if !plan.Cached && !plan.Foreign {
+				cache.store(file, context, plan.Status)
+			}
+			result := newFileResult(file, "sign", plan.Status)
+			result.Status = resultSkipped
+			result.Decision, result.Reason = plan.Decision, plan.Reason
+			return result, fmt.Sprintf("Skipped (%s): %s\n", plan.Reason, file)
+		}
 
-	fmt.Printf("\nSuccessfully signed %d out of %d file(s).\n", signedCount, len(files))
-	return nil
+		if plan.Decision == signDecisionReplace {
+			if _, err := removeSelfSignedSignature(file, ownCerts); err != nil {
+				err = fmt.Errorf("failed to remove existing signature: %w", err)
+				return errorFileResult(file, "sign", err), fmt.Sprintf("Warning: Failed to sign %s: %v\n", file, err)
+			}
+		}
+		if err := signFile(file, cert, opts); err != nil {
+			return errorFileResult(file, "sign", err), fmt.Sprintf("Warning: Failed to sign %s: %v\n", file, err)
+		}
+
+		result := fileResult{
+			Path:        file,
+			Action:      "sign",
+			Status:      resultSigned,
+			Decision:    plan.Decision,
+			Reason:      plan.Reason,
+			Signer:      cert.Subject,
+			Fingerprint: fingerprint,
+		}
+		// The time-stamp time is only known from the signature just written,
+		// and only a signature that verifies is worth caching
+		if opts.TimestampURL != "" || cache != nil {
+			if status, err := getFileSignatureStatus(file, ownCerts); err == nil {
+				if !status.TimestampTime.IsZero() {
+					result.Timestamp = status.TimestampTime.UTC().Format(time.RFC3339)
+				}
+				if status.Status == StatusValid && status.SignerFingerprint == fingerprint {
+					cache.store(file, context, status)
+				}
+			}
+		}
+
+		verb := map[string]string{
+			signDecisionSign:    "Signed",
+			signDecisionResign:  "Re-signed",
+			signDecisionReplace: "Replaced signature",
+		}[plan.Decision]
+		return result, fmt.Sprintf("%s (%s): %s\n", verb, plan.Reason, file)
+	})
+
+	fmt.Fprintf(w, "\nSuccessfully signed %d out of %d file(s), %d already signed.\n",
+		countStatus(results, resultSigned), len(files), countStatus(results, resultSkipped))
+	if err := cache.save(); err != nil {
+		fmt.Fprintf(w, "Warning: Failed to save the digest cache: %v\n", err)
+	}
+	return results, nil
 }
 
 func showHelp() {
@@ -261,13 +579,22 @@ func showHelp() {
     selfsign-path - A utility to manage and apply self-signed code signatures to executables and libraries.
 
 SYNOPSIS
+    selfsign-path sign [OPTIONS] file_or_pattern...
+    selfsign-path verify|status [OPTIONS] file_or_pattern...
+    selfsign-path clear [OPTIONS] [file_or_pattern...]
+    selfsign-path cert list|show|create|delete|export|import [OPTIONS]
+    selfsign-path trust install|uninstall|status [-n CERT_NAME]
+    selfsign-path cache prune [--all]
+    selfsign-path tsa serve [--listen ADDR] [-n CERT_NAME] [--key-type TYPE]
+    selfsign-path help [COMMAND [SUBCOMMAND]]
     selfsign-path [OPTIONS] file_or_pattern...
 
 DESCRIPTION
-    The selfsign-path tool automates the process of code signing using a self-signed
-    certificate. Upon first run, it generates a new self-signed code-signing
-    certificate and installs it into the system's certificate store. Subsequent runs 
-    will use this existing certificate.
+    The selfsign-path tool automates the process of code signing using a local
+    certificate authority. Upon first run, it creates a local root CA, installs
+    it into the system's certificate store, and issues a short-lived code-signing
+    certificate from it. Subsequent runs use this certificate and reissue it from
+    the same root when it nears expiry, so trust never has to be reinstalled.
 
     The tool can sign new files, re-sign existing files, or append a signature.
     It can also be used to check the signature status of files or to remove its
@@ -277,31 +604,242 @@ DESCRIPTION
 ARGUMENTS
     file_or_pattern
         One or more space-separated paths to files or directories.
-        Supports glob-like patterns (e.g., *.exe, bin/*) to specify multiple files.
+        Supports glob-like patterns (e.g., *.exe, bin/*) to specify multiple files,
+        where ** matches any number of directories (e.g., 'src/**/*.dll'). Quote
+        patterns so the tool, not the shell, expands them.
+
+COMMANDS
+    sign [OPTIONS] file_or_pattern...
+        Sign files, skipping those already signed by the certificate.
+
+    verify [OPTIONS] file_or_pattern...
+        Check the signatures of files like status, failing unless every file
+        has a Valid signature, as --status --require-signed does.
+
+    status [OPTIONS] file_or_pattern...
+        Print the signature status and type of files, as --status does.
+
+    clear [OPTIONS] [file_or_pattern...]
+        Remove the signatures this tool made from files, as --clear does.
+
+    help [COMMAND [SUBCOMMAND]]
+        Show this help, or the usage and options of a command. Every command
+        also shows its help with -h or --help.
+
+    Each command accepts only the options that apply to it. Run without a
+    command, the tool signs the files given, or checks or clears them with
+    --status or --clear, accepting every option; a file named like a
+    command must then be given as a path, such as ./sign.
+
+    tsa serve [--listen ADDR] [-n CERT_NAME] [--key-type TYPE]
+        Run an RFC 3161 time-stamping authority over HTTP, signing tokens with
+        a time-stamping certificate from the local certificate store (created
+        on first use, default name LocalSign-TSA, with a key of the given
+        --key-type). Listens on 127.0.0.1:3161 unless --listen is given.
+
+    cert list
+        List the stored certificates with their subject, key type, validity,
+        trust store status and SHA-256 fingerprint.
+
+    cert show [-n CERT_NAME]
+        Show the details of a stored certificate.
+
+    cert create [-n CERT_NAME] [--key-type TYPE] [--force]
+        Issue a new code signing certificate from the local root CA. An
+        existing certificate with the same name is only replaced with --force.
+
+    cert delete -n CERT_NAME
+        Delete a stored certificate and its private key.
+
+    cert export [--format pfx|pem|der] [-n CERT_NAME] [-o FILE] [--password-file FILE]
+        Export a stored signing identity, with its private key and the local
+        root CA, as a PKCS#12 file (CERT_NAME.pfx unless -o is given). The
+        password is read from --password-file or $SELFSIGN_PFX_PASSWORD. The
+        file uses AES-256 encryption and imports on Windows with
+        "certutil -importpfx". --format pem writes the certificate chain and
+        --format der the certificate alone, without the private key.
+
+    cert import [-n CERT_NAME] [--key KEY_FILE] [--password-file FILE] [--force] FILE
+        Store the identity from a PFX file, or from a certificate FILE and
+        --key, under CERT_NAME (default: the certificate subject).
+
+    trust install [-n CERT_NAME]
+        Install a stored certificate, by default the local root CA, into the
+        system trust store. On Linux it is added as a p11-kit trust anchor
+        where "trust" is available, else to a CA directory, and also to the
+        NSS databases of Chrome and Firefox (with certutil) and the PKCS#12
+        cacerts keystores of installed JDKs. Each store is checked after the
+        update and the stores now holding the certificate are listed; the
+        command fails when the certificate is not trusted system-wide.
+
+    trust uninstall [-n CERT_NAME]
+        Remove the certificates this tool installed from the system trust
+        store, or only the one named CERT_NAME, and refresh the store. On
+        Linux this covers p11-kit, every CA directory, the user fallback
+        directory, NSS databases and Java keystores; on Windows, the machine
+        and user Trusted Root stores.
+
+    trust status [-n CERT_NAME]
+        List the trust stores found and whether a stored certificate, by
+        default the local root CA, is installed in each.
+
+    cache prune [--all]
+        Drop the digest cache entries of files that were deleted or changed
+        since they were recorded, or every entry with --all.
 
 OPTIONS
+    Single-letter options also have long names (-r and --recurse), and long
+    options may be given with one dash or two.
+
     -r, --recurse
         Recursively search for and process files in any specified directories.
+        Glob patterns then match in every subdirectory below their first
+        wildcard too, so -r 'bin/*.dll' also finds bin/x86/app.dll.
+
+    --ext EXTENSIONS
+        Comma separated extensions of the files picked up in directories,
+        replacing the defaults (.exe, .dll, .msi, .sys, .com, .ocx, .scr,
+        .cpl). Start the list with + to add to the defaults instead, as in
+        --ext +.ko for kernel modules, or use * for every file. Files matched by a glob pattern are taken
+        whatever their extension. Files in directories are also checked by
+        content: one whose content does not match its extension, such as a
+        text file named .exe, is skipped with a warning, and executables
+        without a listed extension (PE, ELF, Mach-O) are picked up unless the
+        list replaces the defaults.
+
+    --include PATTERN, --exclude PATTERN
+        Only process, or skip, files found in directories and by patterns
+        whose path matches PATTERN; excluded directories are not searched.
+        A pattern without a slash matches the file name at any depth, one
+        with a slash the path relative to the directory searched, and **
+        matches any number of directories. Both may be repeated or given
+        comma separated lists. Files named explicitly are always processed.
 
     -n <CERT_NAME>, --name <CERT_NAME>
         Specify the subject name of the certificate to use for signing. If not
-        found, a new certificate with this name is created. Defaults to a
-        pre-configured name if not provided.
+        found, a new certificate with this name is issued by the local root CA.
+        Defaults to a pre-configured name if not provided.
 
     -c <CERT_FILE>, --cert-file <CERT_FILE>
-        Specify the path to the certificate file (.cer or .pem). This bypasses
-        the default certificate generation and lookup. Requires --key-file.
+        Specify the path to the certificate file (.cer or .pem). DER and PEM
+        are detected automatically; a PEM bundle may list issuer certificates
+        after, or before, the signing certificate. This bypasses the default
+        certificate generation and lookup. Requires --key-file.
 
     -k <KEY_FILE>, --key-file <KEY_FILE>
         Specify the path to the private key file (.pvk or .key). Required if
-        --cert-file is used.
+        --cert-file is used. RSA, ECDSA and Ed25519 keys are accepted in
+        PKCS#8, PKCS#1 ("RSA PRIVATE KEY") or SEC1 ("EC PRIVATE KEY") PEM or
+        DER form, and RSA keys in Microsoft PVK form as written by makecert.
+
+    --passphrase-file <FILE>
+        Read the passphrase of encrypted private keys from the first line of
+        FILE. Defaults to the SELFSIGN_KEY_PASSPHRASE environment variable,
+        then to a prompt when run from a terminal.
+
+    --encrypt-key
+        Store newly generated private keys as encrypted PKCS#8 (scrypt and
+        AES-256) instead of plain PEM. Keys issued by an encrypted root CA,
+        and keys replacing an encrypted key, are always encrypted.
+
+    --pfx <PFX_FILE>
+        Sign with the certificate, private key and issuer certificates from a
+        PKCS#12 (.pfx/.p12) file. The password is read from the
+        SELFSIGN_PFX_PASSWORD environment variable or --pfx-password-file.
+        Cannot be combined with --cert-file or --key-file.
+
+    --pfx-password-file <FILE>
+        Read the --pfx password from the first line of FILE.
+
+    --key-type <TYPE>
+        Key type used when a new certificate is generated: rsa2048 (default),
+        rsa4096, p256, p384 or ed25519. Signatures use the matching algorithm
+        (RSA PKCS#1 v1.5, ECDSA or Ed25519). Existing certificates keep their
+        key.
+
+    --append
+        Add the signature as a nested signature to files that are already
+        signed, keeping their existing signatures. Unsigned files are signed
+        normally, and a nested signature already made with the certificate is
+        replaced rather than added again.
+
+    --force
+        Sign files that already carry a valid signature from the signing
+        certificate. By default they are skipped, leaving them and their
+        time-stamps untouched; files that are unsigned, signed by another
+        certificate, invalid or missing a requested digest or time-stamp are
+        signed.
+
+    --replace
+        Remove the signatures this tool made from each file before signing it
+        again, as --clear does; implies --force. With --append this also
+        removes the nested signatures of this tool's other certificates.
+
+    --digest <ALGORITHMS>
+        Comma separated list of digest algorithms to sign with (sha1, sha256,
+        sha384, sha512). The first one becomes the primary signature and the
+        others are nested. Defaults to sha256. Use "sha1,sha256" to produce
+        dual-signed files for older Windows versions. Ed25519 keys always
+        sign with SHA-512, as RFC 8419 requires, and cannot sign kernel
+        modules.
+
+    --timestamp-url <URL>
+        Request an RFC 3161 time-stamp from the given time-stamping authority
+        and store it as a counter-signature, so the signature stays valid after
+        the signing certificate expires.
 
     --clear
         Remove self-signed signatures created by this tool from the specified
         files. It will not affect other valid signatures.
 
+    --purge-cert
+        With --clear, also remove the certificates this tool installed from
+        the system trust store, as "trust uninstall" does. File arguments are
+        optional when --purge-cert is given.
+
     --status
         Print the signing status of the specified files instead of signing them.
+        Embedded Authenticode signatures, appended kernel module signatures
+        and detached .p7s signatures are verified cryptographically and
+        reported as Valid, NotSigned, HashMismatch, BadSignature,
+        UntrustedRoot or Expired. The type of each file, told by its content
+        (e.g. "PE32+ x64 .NET console executable"), is reported as well.
+
+    --output FORMAT
+        Report the result for each file as text (the default), json, csv or
+        junit. Every record has the path, action, status, file type, signer,
+        signer SHA-256 fingerprint, time-stamp time and error; json adds a
+        summary object, and junit makes a test case per file, failing those
+        --status does not find Valid. Only the report is written to stdout;
+        progress messages go to stderr.
+
+    --dry-run
+        Print what signing, or --clear, would do to each file (sign, skip,
+        re-sign, clear, leave or fail, with the file type and the reason)
+        and which certificate would be used, issued or renewed, including
+        whether the local root CA would be created and which trust stores it
+        would be installed into, without changing any file, certificate,
+        cache or trust store. With --clear --purge-cert, also lists the
+        certificates that would be removed from the trust store. Reports
+        carry the same records as a real run, with the decision and reason
+        of each file and the certificate plan.
+
+    --no-cache
+        Sign and verify every file. By default a digest cache in the tool's
+        data directory remembers the files already signed with the same
+        certificate and options, keyed by path, size, modification time,
+        inode and SHA-256, and skips them while they and their detached
+        signatures are unchanged and the certificate is trusted. --status
+        caches files that are unsigned or whose signature is broken.
+
+    -j N, --jobs N
+        Sign, verify or clear up to N files in parallel (default: the number
+        of CPUs). Output and reports keep the order of the files.
+
+    --require-signed
+        With --status, exit with an error unless every file has a Valid
+        signature: 3 if any file is unsigned, 4 if any signer is untrusted or
+        expired.
 
     -h, --help
         Display this help documentation and exit.
@@ -314,25 +852,74 @@ OPTIONS
 
 EXAMPLES
     Sign a single executable:
-        selfsign-path myapp.exe
+        selfsign-path sign myapp.exe
 
     Sign all DLLs in a directory and its subdirectories:
-        selfsign-path -r 'bin/*.dll'
+        selfsign-path sign --recurse 'bin/*.dll'
 
     Check the signature status of all executables in the current directory:
-        selfsign-path --status *.exe
+        selfsign-path status *.exe
+
+    Publish the signature status of a build as a CI test report:
+        selfsign-path status --output junit -r dist/ > signatures.xml
+
+    Show the options of the sign command:
+        selfsign-path help sign
 
     Sign files using a custom-named certificate:
-        selfsign-path -n "My Custom Cert" myapp.exe
+        selfsign-path sign --name "My Custom Cert" myapp.exe
 
     Sign a file using specific certificate and key files:
-        selfsign-path --cert-file /path/to/my.crt --key-file /path/to/my.key myapp.exe
+        selfsign-path sign --cert-file /path/to/my.crt --key-file /path/to/my.key myapp.exe
+
+    Sign the same way with the flag-only form of earlier versions:
+        selfsign-path -c /path/to/my.crt -k /path/to/my.key myapp.exe
+
+    Sign with an identity from a PFX file:
+        SELFSIGN_PFX_PASSWORD=secret selfsign-path sign --pfx codesign.pfx myapp.exe
+
+    Export the generated identity for import on another machine:
+        selfsign-path cert export --password-file pw.txt -o codesign.pfx
+
+    List the stored certificates and their trust status:
+        selfsign-path cert list
+
+    Create an ECDSA P-256 certificate and sign with it:
+        selfsign-path sign --key-type p256 -n "LocalSign-EC" myapp.exe
+
+    Dual-sign a driver with SHA-1 and SHA-256 signatures:
+        selfsign-path sign --digest sha1,sha256 mydriver.sys
+
+    Add a signature to a file that already carries a vendor signature:
+        selfsign-path sign --append vendor.dll
+
+    Sign a Linux kernel module the same way scripts/sign-file does:
+        selfsign-path sign mydriver.ko
 
     Remove self-signatures from all files in a release folder:
-        selfsign-path --clear -r release/
+        selfsign-path clear -r release/
+
+    Remove self-signatures and the tool's certificates from a test machine:
+        selfsign-path clear --purge-cert -r release/
+
+    Sign using a local time-stamping authority:
+        selfsign-path tsa serve --listen 127.0.0.1:3161 &
+        selfsign-path sign --timestamp-url http://127.0.0.1:3161/ myapp.exe
 
     Launch the graphical user interface (Windows only):
         selfsign-path --gui
 
+    Fail a release pipeline unless every binary carries a valid signature:
+        selfsign-path verify -r dist/
+
+EXIT STATUS
+    0   Every file was processed successfully.
+    1   Invalid usage, or an error that stopped the whole run.
+    2   Some files could not be signed, cleared or read.
+    3   A signature failed verification (HashMismatch or BadSignature), or
+        with --require-signed a file is not signed.
+    4   The signing certificate could not be loaded or created, or with
+        --require-signed a signer is untrusted or expired.
+    When several apply, the highest status is used.
 `)
 }
\ No newline at end of file
@@ -3,6 +3,7 @@ package main
 import (
 	"os"
 	"os/exec"
+	"path/filepath"
 	"strings"
 	"testing"
 )
@@ -51,3 +52,50 @@ func TestGUIFlag(t *testing.T) {
 		t.Error("Should show Windows-only error message")
 	}
 }
+
+func TestCLIExitCodes(t *testing.T) {
+	cmd := exec.Command("go", "build", "-o", "test-binary")
+	if err := cmd.Run(); err != nil {
+		t.Fatalf("Failed to build binary: %v", err)
+	}
+	defer os.Remove("test-binary")
+	binary, _ := filepath.Abs("test-binary")
+
+	dir := t.TempDir()
+	unsigned := filepath.Join(dir, "unsigned.txt")
+	os.WriteFile(unsigned, []byte("hello\n"), 0644)
+
+	tests := []struct {
+		args []string
+		want int
+	}{
+		{[]string{"--bogus-flag"}, exitUsage},
+		{[]string{"--require-signed", unsigned}, exitUsage},
+		{[]string{"--status", unsigned}, exitOK},
+		{[]string{"--status", "--require-signed", unsigned}, exitVerificationFailed},
+		{[]string{"--pfx", filepath.Join(dir, "missing.pfx"), unsigned}, exitCertificateError},
+		{[]string{"cert", "list", "--bogus-flag"}, exitUsage},
+		{[]string{"--recurse", "--status", unsigned}, exitOK},
+		{[]string{"status", "--jobs", "2", unsigned}, exitOK},
+		{[]string{"verify", unsigned}, exitVerificationFailed},
+		{[]string{"status", "--force", unsigned}, exitUsage},
+		{[]string{"sign"}, exitUsage},
+		{[]string{"sign", "--help"}, exitOK},
+		{[]string{"help", "cert", "export"}, exitOK},
+		{[]string{"help", "bogus"}, exitUsage},
+	}
+	for _, tt := range tests {
+		cmd := exec.Command(binary, tt.args...)
+		cmd.Env = append(os.Environ(), "HOME="+dir)
+		err := cmd.Run()
+		got := 0
+		if exitErr, ok := err.(*exec.ExitError); ok {
+			got = exitErr.ExitCode()
+		} else if err != nil {
+			t.Fatalf("Failed to run %v: %v", tt.args, err)
+		}
+		if got != tt.want {
+			t.Errorf("%v: expected exit code %d, got %d", tt.args, tt.want, got)
+		}
+	}
+}
@@ -0,0 +1,233 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/x509"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+)
+
+// moduleSignatureMagic terminates a signature appended by scripts/sign-file
+const moduleSignatureMagic = "~Module signature appended~\n"
+
+// Module signature trailer constants from include/linux/module_signature.h
+const (
+	moduleSignatureInfoSize = 12
+	pkeyIDPKCS7             = 2
+)
+
+// moduleSignatureInfo mirrors struct module_signature
+type moduleSignatureInfo struct {
+	Algo      uint8
+	Hash      uint8
+	IDType    uint8
+	SignerLen uint8
+	KeyIDLen  uint8
+	_         [3]uint8
+	SigLen    uint32 // big endian on disk
+}
+
+// isKernelModule reports whether the named file is a relocatable ELF object,
+// as kernel modules are; only those take module signatures
+func isKernelModule(filename string) bool {
+	class := classifyFile(filename)
+	return class.Kind == fileKindELF && class.Object
+}
+
+// splitModuleSignature separates file data into the signed payload and the
+// appended PKCS#7 signature, if there is one
+func splitModuleSignature(data []byte) ([]byte, []byte, error) {
+	if !bytes.HasSuffix(data, []byte(moduleSignatureMagic)) {
+		return data, nil, nil
+	}
+
+	trailerEnd := len(data) - len(moduleSignatureMagic)
+	if trailerEnd < moduleSignatureInfoSize {
+		return nil, nil, fmt.Errorf("truncated module signature")
+	}
+
+	var info moduleSignatureInfo
+	if err := binary.Read(bytes.NewReader(data[trailerEnd-moduleSignatureInfoSize:trailerEnd]), binary.BigEndian, &info); err != nil {
+		return nil, nil, fmt.Errorf("failed to decode module signature info: %w", err)
+	}
+	if info.IDType != pkeyIDPKCS7 {
+		return nil, nil, fmt.Errorf("unsupported module signature type %d", info.IDType)
+	}
+
+	sigEnd := trailerEnd - moduleSignatureInfoSize
+	sigStart := sigEnd - int(info.SigLen)
+	if sigStart < 0 {
+		return nil, nil, fmt.Errorf("module signature length exceeds file size")
+	}
+	return data[:sigStart], data[sigStart:sigEnd], nil
+}
+
+// signELFFile appends a PKCS#7 signature and module_signature trailer in the
+// format produced by the kernel's scripts/sign-file, replacing any existing one
+func signELFFile(filename string, cert *Certificate, opts *signOptions) error {
+	// Module signatures carry no signed attributes, which Ed25519 requires
+	if _, ok := cert.PrivateKey.Public().(ed25519.PublicKey); ok {
+		return fmt.Errorf("Ed25519 cannot sign kernel modules; use an RSA or ECDSA certificate")
+	}
+	// The kernel only checks modules; executables and shared objects with a
+	// trailer appended would just carry dead bytes
+	if !isKernelModule(filename) {
+		return fmt.Errorf("module signatures are only for kernel modules, and %s is not a relocatable ELF object", filename)
+	}
+
+	info, err := os.Stat(filename)
+	if err != nil {
+		return fmt.Errorf("failed to stat file: %w", err)
+	}
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return fmt.Errorf("failed to read file: %w", err)
+	}
+
+	payload, _, err := splitModuleSignature(data)
+	if err != nil {
+		return err
+	}
+
+	hash := opts.Digests[0]
+	h := hash.New()
+	h.Write(payload)
+
+	// Like sign-file, sign the digest directly and leave the certificate
+	// out; the kernel finds the key in its keyring by issuer and serial
+	signature, err := createSignedData(cert, cmsSignOptions{
+		ContentType:    oidData,
+		MessageDigest:  h.Sum(nil),
+		Hash:           hash,
+		NoAttributes:   true,
+		NoCertificates: true,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to create module signature: %w", err)
+	}
+
+	var buf bytes.Buffer
+	buf.Write(payload)
+	buf.Write(signature)
+	binary.Write(&buf, binary.BigEndian, moduleSignatureInfo{
+		IDType: pkeyIDPKCS7,
+		SigLen: uint32(len(signature)),
+	})
+	buf.WriteString(moduleSignatureMagic)
+
+	if err := os.WriteFile(filename, buf.Bytes(), info.Mode().Perm()); err != nil {
+		return fmt.Errorf("failed to write signed file: %w", err)
+	}
+	return nil
+}
+
+// verifyELFFile verifies the appended module signature of an ELF file; as
+// signatures usually leave out their certificate, the signer is also looked
+// up in ownCerts
+func verifyELFFile(filename string, ownCerts []*x509.Certificate) (*SignatureStatus, error) {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read file: %w", err)
+	}
+
+	payload, signature, err := splitModuleSignature(data)
+	if err != nil {
+		return nil, err
+	}
+	if signature == nil {
+		return &SignatureStatus{Status: StatusNotSigned}, nil
+	}
+
+	sd, err := parseSignedData(signature)
+	if err != nil {
+		return nil, err
+	}
+	if len(sd.SignerInfos) != 1 {
+		return nil, fmt.Errorf("expected one signer, found %d", len(sd.SignerInfos))
+	}
+	si := &sd.SignerInfos[0]
+
+	// sign-file omits certificates, so look the signer up locally as well
+	certs, err := x509.ParseCertificates(sd.Certificates.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse signature certificates: %w", err)
+	}
+	signer, err := findSignerCertificate(append(certs, ownCerts...), si.IssuerAndSerialNumber)
+	if err != nil {
+		// Without the certificate the signature can't be checked or trusted
+		return &SignatureStatus{Status: StatusUntrustedRoot}, nil
+	}
+
+	status := &SignatureStatus{
+		SignerCertificate: signer.Subject.CommonName,
+		SignerFingerprint: certificateFingerprint(signer),
+		SignerExpires:     signer.NotAfter,
+		IsSelfSigned:      isSelfSignedCertificate(signer),
+	}
+
+	hash, err := hashFromAlgorithmID(si.DigestAlgorithm)
+	if err != nil {
+		return nil, err
+	}
+	h := hash.New()
+	h.Write(payload)
+
+	if err := verifySignerInfo(si, signer, h.Sum(nil)); err != nil {
+		switch {
+		case errors.Is(err, errMessageDigestMismatch):
+			status.Status = StatusHashMismatch
+			return status, nil
+		case errors.Is(err, errBadSignature):
+			status.Status = StatusBadSignature
+			return status, nil
+		}
+		return nil, err
+	}
+
+	applySignerTrust(status, si, signer, certs)
+	return status, nil
+}
+
+// removeOwnELFSignature strips an appended module signature made with one of
+// ownCerts; with dryRun it only reports whether there is one
+func removeOwnELFSignature(filename string, ownCerts []*x509.Certificate, dryRun bool) (bool, error) {
+	info, err := os.Stat(filename)
+	if err != nil {
+		return false, fmt.Errorf("failed to stat file: %w", err)
+	}
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return false, fmt.Errorf("failed to read file: %w", err)
+	}
+
+	payload, signature, err := splitModuleSignature(data)
+	if err != nil {
+		return false, err
+	}
+	if signature == nil {
+		return false, nil
+	}
+
+	sd, err := parseSignedData(signature)
+	if err != nil {
+		return false, err
+	}
+	if len(sd.SignerInfos) != 1 {
+		return false, nil
+	}
+	signer, err := findSignerCertificate(ownCerts, sd.SignerInfos[0].IssuerAndSerialNumber)
+	if err != nil || !isOwnCertificate(signer, ownCerts) {
+		return false, nil
+	}
+	if dryRun {
+		return true, nil
+	}
+
+	if err := os.WriteFile(filename, payload, info.Mode().Perm()); err != nil {
+		return false, fmt.Errorf("failed to write file: %w", err)
+	}
+	return true, nil
+}
@@ -0,0 +1,145 @@
+//go:build linux
+
+package main
+
+import (
+	"bytes"
+	"encoding/pem"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+)
+
+// testELFData is enough of an ELF header, with type 1 (relocatable), for the
+// file to be detected as a kernel module
+var testELFData = append([]byte("\x7fELF\x02\x01\x01\x00\x00\x00\x00\x00\x00\x00\x00\x00\x01\x00"), bytes.Repeat([]byte{0x5a}, 256)...)
+
+func TestModuleSignature(t *testing.T) {
+	t.Setenv("HOME", t.TempDir())
+	cert := newTestCertificate(t, "LocalSign-Test")
+	os.MkdirAll(getCertificateDirectory(), 0700)
+	if err := saveCertificateFiles(io.Discard, "LocalSign-Test", cert.Cert, cert.PrivateKey); err != nil {
+		t.Fatalf("Failed to save certificate: %v", err)
+	}
+
+	filename := filepath.Join(t.TempDir(), "driver.ko")
+	if err := os.WriteFile(filename, testELFData, 0644); err != nil {
+		t.Fatalf("Failed to write test ELF: %v", err)
+	}
+
+	if err := signFile(filename, cert, defaultSignOptions()); err != nil {
+		t.Fatalf("Failed to sign ELF file: %v", err)
+	}
+	// Re-signing replaces the trailer rather than stacking another one
+	if err := signFile(filename, cert, defaultSignOptions()); err != nil {
+		t.Fatalf("Failed to re-sign ELF file: %v", err)
+	}
+
+	data, _ := os.ReadFile(filename)
+	if !bytes.HasSuffix(data, []byte(moduleSignatureMagic)) {
+		t.Fatal("Expected module signature magic at end of file")
+	}
+	payload, signature, err := splitModuleSignature(data)
+	if err != nil || !bytes.Equal(payload, testELFData) || signature == nil {
+		t.Fatalf("Expected a single signature over the original data (%v)", err)
+	}
+	if _, err := os.Stat(filename + detachedSignatureExt); !os.IsNotExist(err) {
+		t.Error("ELF files should not get a detached signature")
+	}
+
+	trustTestCertificate(t, cert)
+	status, err := getFileSignatureStatus(filename, getOwnCertificates())
+	if err != nil || status.Status != StatusValid || status.SignerCertificate != "LocalSign-Test" {
+		t.Errorf("Expected valid module signature, got %+v (%v)", status, err)
+	}
+
+	tampered := append([]byte{}, data...)
+	tampered[10] ^= 0xff
+	os.WriteFile(filename, tampered, 0644)
+	if status, _ := getFileSignatureStatus(filename, getOwnCertificates()); status.Status != StatusHashMismatch {
+		t.Errorf("Expected HashMismatch for modified file, got %s", status.Status)
+	}
+
+	removed, err := removeSelfSignedSignature(filename, getOwnCertificates())
+	if err != nil || !removed {
+		t.Fatalf("Expected module signature to be removed, got %v (%v)", removed, err)
+	}
+	if status, _ := getFileSignatureStatus(filename, getOwnCertificates()); status.Status != StatusNotSigned {
+		t.Errorf("Expected NotSigned after clearing, got %s", status.Status)
+	}
+}
+
+func TestModuleSignatureUnknownSigner(t *testing.T) {
+	t.Setenv("HOME", t.TempDir())
+	cert := newTestCertificate(t, "LocalSign-Test")
+
+	filename := filepath.Join(t.TempDir(), "driver.ko")
+	os.WriteFile(filename, testELFData, 0644)
+	if err := signELFFile(filename, cert, defaultSignOptions()); err != nil {
+		t.Fatalf("Failed to sign ELF file: %v", err)
+	}
+
+	// The signature carries no certificate, so an unknown key can't be trusted
+	if status, err := verifyELFFile(filename, getOwnCertificates()); err != nil || status.Status != StatusUntrustedRoot {
+		t.Errorf("Expected UntrustedRoot for unknown signer, got %+v (%v)", status, err)
+	}
+	if removed, _ := removeOwnELFSignature(filename, getOwnCertificates(), false); removed {
+		t.Error("Signatures from unknown certificates must not be removed")
+	}
+}
+
+func TestELFExecutableSignedDetached(t *testing.T) {
+	t.Setenv("HOME", t.TempDir())
+	cert := newTestCertificate(t, "LocalSign-Test")
+
+	// Type 3 is a shared object, or a position independent executable
+	executable := append([]byte(nil), testELFData...)
+	executable[16] = 3
+	filename := filepath.Join(t.TempDir(), "libtool.so")
+	os.WriteFile(filename, executable, 0755)
+
+	if err := signELFFile(filename, cert, defaultSignOptions()); err == nil {
+		t.Error("Expected module signing of a shared object to be refused")
+	}
+	if err := signFile(filename, cert, defaultSignOptions()); err != nil {
+		t.Fatalf("Failed to sign shared object: %v", err)
+	}
+	if data, _ := os.ReadFile(filename); !bytes.Equal(data, executable) {
+		t.Error("Shared objects should not be changed by signing")
+	}
+	if _, err := os.Stat(filename + detachedSignatureExt); err != nil {
+		t.Errorf("Expected a detached signature: %v", err)
+	}
+}
+
+func TestModuleSignatureOpenSSL(t *testing.T) {
+	if _, err := exec.LookPath("openssl"); err != nil {
+		t.Skip("openssl not available")
+	}
+
+	cert := newTestCertificate(t, "LocalSign-Test")
+	dir := t.TempDir()
+	filename := filepath.Join(dir, "driver.ko")
+	os.WriteFile(filename, testELFData, 0644)
+	if err := signELFFile(filename, cert, defaultSignOptions()); err != nil {
+		t.Fatalf("Failed to sign ELF file: %v", err)
+	}
+
+	data, _ := os.ReadFile(filename)
+	payload, signature, _ := splitModuleSignature(data)
+	contentFile := filepath.Join(dir, "content")
+	sigFile := filepath.Join(dir, "sig.p7s")
+	certFile := filepath.Join(dir, "signer.pem")
+	os.WriteFile(contentFile, payload, 0644)
+	os.WriteFile(sigFile, signature, 0644)
+	os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Cert.Raw}), 0644)
+
+	out, err := exec.Command("openssl", "cms", "-verify", "-binary", "-inform", "DER",
+		"-in", sigFile, "-content", contentFile, "-certfile", certFile, "-CAfile", certFile,
+		"-purpose", "any", "-out", os.DevNull).CombinedOutput()
+	if err != nil {
+		t.Errorf("openssl failed to verify module signature: %v\n%s", err, out)
+	}
+}
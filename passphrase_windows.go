@@ -0,0 +1,45 @@
+//go:build windows
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strings"
+	"syscall"
+)
+
+// enableEchoInput is the console mode flag that echoes typed characters
+const enableEchoInput = 0x0004
+
+var procSetConsoleMode = kernel32.NewProc("SetConsoleMode")
+
+// readPassphrase prompts on stderr and reads a line from the console on
+// stdin with echo turned off
+func readPassphrase(prompt string) (string, error) {
+	fmt.Fprint(os.Stderr, prompt)
+	defer fmt.Fprintln(os.Stderr)
+
+	handle := syscall.Handle(os.Stdin.Fd())
+	var mode uint32
+	if err := syscall.GetConsoleMode(handle, &mode); err != nil {
+		return "", fmt.Errorf("failed to read console mode: %w", err)
+	}
+	if r, _, err := procSetConsoleMode.Call(uintptr(handle), uintptr(mode&^enableEchoInput)); r == 0 {
+		return "", fmt.Errorf("failed to disable console echo: %w", err)
+	}
+	defer procSetConsoleMode.Call(uintptr(handle), uintptr(mode))
+
+	line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil && line == "" {
+		return "", fmt.Errorf("failed to read passphrase: %w", err)
+	}
+	return strings.TrimRight(line, "\r\n"), nil
+}
+
+// isTerminal reports whether f is a console
+func isTerminal(f *os.File) bool {
+	var mode uint32
+	return syscall.GetConsoleMode(syscall.Handle(f.Fd()), &mode) == nil
+}
@@ -0,0 +1,466 @@
+package main
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/des"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/binary"
+	"fmt"
+	"hash"
+	"math/bits"
+	"unicode/utf16"
+)
+
+// Password-based encryption object identifiers (PKCS#5 and PKCS#12)
+var (
+	oidPBES2  = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 5, 13}
+	oidPBKDF2 = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 5, 12}
+	oidScrypt = asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 11591, 4, 11}
+
+	oidHMACWithSHA1   = asn1.ObjectIdentifier{1, 2, 840, 113549, 2, 7}
+	oidHMACWithSHA256 = asn1.ObjectIdentifier{1, 2, 840, 113549, 2, 9}
+	oidHMACWithSHA384 = asn1.ObjectIdentifier{1, 2, 840, 113549, 2, 10}
+	oidHMACWithSHA512 = asn1.ObjectIdentifier{1, 2, 840, 113549, 2, 11}
+
+	oidAES128CBC  = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 1, 2}
+	oidAES192CBC  = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 1, 22}
+	oidAES256CBC  = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 1, 42}
+	oidDESEDE3CBC = asn1.ObjectIdentifier{1, 2, 840, 113549, 3, 7}
+
+	oidPBEWithSHAAnd3KeyTripleDESCBC = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 12, 1, 3}
+	oidPBEWithSHAAnd128BitRC2CBC     = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 12, 1, 5}
+	oidPBEWithSHAAnd40BitRC2CBC      = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 12, 1, 6}
+)
+
+// pbes2Iterations is the PBKDF2 iteration count used when encrypting
+const pbes2Iterations = 100000
+
+// scrypt cost parameters used when encrypting private keys (16 MiB of memory,
+// the OpenSSL defaults) and the memory limit accepted when decrypting
+const (
+	scryptCost        = 1 << 14
+	scryptBlockSize   = 8
+	scryptParallelism = 1
+	scryptMaxMemory   = 1 << 30
+)
+
+// pbes2Params are the PBES2 parameters (RFC 8018)
+type pbes2Params struct {
+	KeyDerivationFunc pkix.AlgorithmIdentifier
+	EncryptionScheme  pkix.AlgorithmIdentifier
+}
+
+// pbkdf2Params are the PBKDF2 parameters; a missing PRF means HMAC-SHA1
+type pbkdf2Params struct {
+	Salt           []byte
+	IterationCount int
+	KeyLength      int                      `asn1:"optional"`
+	PRF            pkix.AlgorithmIdentifier `asn1:"optional"`
+}
+
+// scryptParams are the scrypt key derivation parameters (RFC 7914 section 7)
+type scryptParams struct {
+	Salt                     []byte
+	CostParameter            int
+	BlockSize                int
+	ParallelizationParameter int
+	KeyLength                int `asn1:"optional"`
+}
+
+// pkcs12PBEParams are the parameters of the PKCS#12 password-based schemes
+type pkcs12PBEParams struct {
+	Salt       []byte
+	Iterations int
+}
+
+// encryptedPrivateKeyInfo is a PKCS#8 EncryptedPrivateKeyInfo
+type encryptedPrivateKeyInfo struct {
+	Algorithm     pkix.AlgorithmIdentifier
+	EncryptedData []byte
+}
+
+// pbkdf2Key derives a key from password with PBKDF2 (RFC 8018 section 5.2)
+func pbkdf2Key(newHash func() hash.Hash, password, salt []byte, iterations, keyLen int) []byte {
+	prf := hmac.New(newHash, password)
+	hashLen := prf.Size()
+	numBlocks := (keyLen + hashLen - 1) / hashLen
+
+	var buf [4]byte
+	dk := make([]byte, 0, numBlocks*hashLen)
+	u := make([]byte, hashLen)
+	for block := 1; block <= numBlocks; block++ {
+		prf.Reset()
+		prf.Write(salt)
+		binary.BigEndian.PutUint32(buf[:], uint32(block))
+		prf.Write(buf[:])
+		dk = prf.Sum(dk)
+		t := dk[len(dk)-hashLen:]
+		copy(u, t)
+
+		for n := 2; n <= iterations; n++ {
+			prf.Reset()
+			prf.Write(u)
+			u = u[:0]
+			u = prf.Sum(u)
+			for i := range u {
+				t[i] ^= u[i]
+			}
+		}
+	}
+	return dk[:keyLen]
+}
+
+// pkcs12KDF derives key material from a BMPString password with the PKCS#12
+// key derivation function (RFC 7292 appendix B). id is 1 for keys, 2 for IVs
+// and 3 for MAC keys
+func pkcs12KDF(hash crypto.Hash, password, salt []byte, id byte, iterations, size int) []byte {
+	u := hash.Size()
+	v := 64
+	if hash == crypto.SHA384 || hash == crypto.SHA512 {
+		v = 128
+	}
+
+	fill := func(src []byte) []byte {
+		if len(src) == 0 {
+			return nil
+		}
+		out := make([]byte, v*((len(src)+v-1)/v))
+		for i := range out {
+			out[i] = src[i%len(src)]
+		}
+		return out
+	}
+
+	d := bytes.Repeat([]byte{id}, v)
+	i := append(fill(salt), fill(password)...)
+
+	var result []byte
+	for len(result) < size {
+		h := hash.New()
+		h.Write(d)
+		h.Write(i)
+		a := h.Sum(nil)
+		for n := 1; n < iterations; n++ {
+			h.Reset()
+			h.Write(a)
+			a = h.Sum(a[:0])
+		}
+		result = append(result, a...)
+
+		if len(result) < size {
+			// Each v-byte block of I becomes (I_j + B + 1) mod 2^(8v)
+			b := fill(a[:u])[:v]
+			for j := 0; j < len(i); j += v {
+				carry := 1
+				for k := v - 1; k >= 0; k-- {
+					sum := int(i[j+k]) + int(b[k]) + carry
+					i[j+k] = byte(sum)
+					carry = sum >> 8
+				}
+			}
+		}
+	}
+	return result[:size]
+}
+
+// bmpPassword encodes a password as a NUL terminated big-endian UTF-16
+// string, the form PKCS#12 key derivation expects
+func bmpPassword(password string) []byte {
+	units := utf16.Encode([]rune(password))
+	out := make([]byte, 0, 2*len(units)+2)
+	for _, unit := range units {
+		out = append(out, byte(unit>>8), byte(unit))
+	}
+	return append(out, 0, 0)
+}
+
+// prfHash maps a PBKDF2 PRF identifier to its hash function
+func prfHash(prf pkix.AlgorithmIdentifier) (crypto.Hash, error) {
+	switch {
+	case len(prf.Algorithm) == 0, prf.Algorithm.Equal(oidHMACWithSHA1):
+		return crypto.SHA1, nil
+	case prf.Algorithm.Equal(oidHMACWithSHA256):
+		return crypto.SHA256, nil
+	case prf.Algorithm.Equal(oidHMACWithSHA384):
+		return crypto.SHA384, nil
+	case prf.Algorithm.Equal(oidHMACWithSHA512):
+		return crypto.SHA512, nil
+	}
+	return 0, fmt.Errorf("unsupported PBKDF2 PRF: %v", prf.Algorithm)
+}
+
+// pbes2Cipher returns the cipher constructor and key size of a PBES2 encryption scheme
+func pbes2Cipher(scheme asn1.ObjectIdentifier) (func([]byte) (cipher.Block, error), int, error) {
+	switch {
+	case scheme.Equal(oidAES128CBC):
+		return aes.NewCipher, 16, nil
+	case scheme.Equal(oidAES192CBC):
+		return aes.NewCipher, 24, nil
+	case scheme.Equal(oidAES256CBC):
+		return aes.NewCipher, 32, nil
+	case scheme.Equal(oidDESEDE3CBC):
+		return des.NewTripleDESCipher, 24, nil
+	}
+	return nil, 0, fmt.Errorf("unsupported PBES2 encryption scheme: %v", scheme)
+}
+
+// pbes2Key derives a keySize byte encryption key from password with the
+// PBES2 key derivation function kdf, either PBKDF2 or scrypt
+func pbes2Key(kdf pkix.AlgorithmIdentifier, password string, keySize int) ([]byte, error) {
+	switch {
+	case kdf.Algorithm.Equal(oidPBKDF2):
+		var params pbkdf2Params
+		if _, err := asn1.Unmarshal(kdf.Parameters.FullBytes, &params); err != nil {
+			return nil, fmt.Errorf("failed to decode PBKDF2 parameters: %w", err)
+		}
+		prf, err := prfHash(params.PRF)
+		if err != nil {
+			return nil, err
+		}
+		return pbkdf2Key(prf.New, []byte(password), params.Salt, params.IterationCount, keySize), nil
+
+	case kdf.Algorithm.Equal(oidScrypt):
+		var params scryptParams
+		if _, err := asn1.Unmarshal(kdf.Parameters.FullBytes, &params); err != nil {
+			return nil, fmt.Errorf("failed to decode scrypt parameters: %w", err)
+		}
+		return scryptKey([]byte(password), params.Salt, params.CostParameter, params.BlockSize, params.ParallelizationParameter, keySize)
+	}
+	return nil, fmt.Errorf("unsupported key derivation function: %v", kdf.Algorithm)
+}
+
+// pbeDecrypt decrypts data protected with a PBES2 or PKCS#12 password-based
+// encryption scheme
+func pbeDecrypt(alg pkix.AlgorithmIdentifier, password string, ciphertext []byte) ([]byte, error) {
+	var block cipher.Block
+	var iv []byte
+
+	switch {
+	case alg.Algorithm.Equal(oidPBES2):
+		var params pbes2Params
+		if _, err := asn1.Unmarshal(alg.Parameters.FullBytes, &params); err != nil {
+			return nil, fmt.Errorf("failed to decode PBES2 parameters: %w", err)
+		}
+		newCipher, keySize, err := pbes2Cipher(params.EncryptionScheme.Algorithm)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := asn1.Unmarshal(params.EncryptionScheme.Parameters.FullBytes, &iv); err != nil {
+			return nil, fmt.Errorf("failed to decode encryption IV: %w", err)
+		}
+		key, err := pbes2Key(params.KeyDerivationFunc, password, keySize)
+		if err != nil {
+			return nil, err
+		}
+		if block, err = newCipher(key); err != nil {
+			return nil, err
+		}
+
+	case alg.Algorithm.Equal(oidPBEWithSHAAnd3KeyTripleDESCBC),
+		alg.Algorithm.Equal(oidPBEWithSHAAnd128BitRC2CBC),
+		alg.Algorithm.Equal(oidPBEWithSHAAnd40BitRC2CBC):
+		var params pkcs12PBEParams
+		if _, err := asn1.Unmarshal(alg.Parameters.FullBytes, &params); err != nil {
+			return nil, fmt.Errorf("failed to decode PBE parameters: %w", err)
+		}
+		bmp := bmpPassword(password)
+		iv = pkcs12KDF(crypto.SHA1, bmp, params.Salt, 2, params.Iterations, 8)
+
+		var err error
+		switch {
+		case alg.Algorithm.Equal(oidPBEWithSHAAnd3KeyTripleDESCBC):
+			block, err = des.NewTripleDESCipher(pkcs12KDF(crypto.SHA1, bmp, params.Salt, 1, params.Iterations, 24))
+		case alg.Algorithm.Equal(oidPBEWithSHAAnd128BitRC2CBC):
+			block, err = newRC2Cipher(pkcs12KDF(crypto.SHA1, bmp, params.Salt, 1, params.Iterations, 16), 128)
+		default:
+			block, err = newRC2Cipher(pkcs12KDF(crypto.SHA1, bmp, params.Salt, 1, params.Iterations, 5), 40)
+		}
+		if err != nil {
+			return nil, err
+		}
+
+	default:
+		return nil, fmt.Errorf("unsupported encryption algorithm: %v", alg.Algorithm)
+	}
+
+	if len(iv) != block.BlockSize() || len(ciphertext) == 0 || len(ciphertext)%block.BlockSize() != 0 {
+		return nil, fmt.Errorf("malformed encrypted data")
+	}
+	plaintext := make([]byte, len(ciphertext))
+	cipher.NewCBCDecrypter(block, iv).CryptBlocks(plaintext, ciphertext)
+
+	// A wrong password almost always shows up as broken padding
+	padLen := int(plaintext[len(plaintext)-1])
+	if padLen == 0 || padLen > block.BlockSize() || !bytes.Equal(plaintext[len(plaintext)-padLen:], bytes.Repeat([]byte{byte(padLen)}, padLen)) {
+		return nil, fmt.Errorf("decryption failed, the password may be wrong")
+	}
+	return plaintext[:len(plaintext)-padLen], nil
+}
+
+// pbes2Encrypt encrypts data with PBES2 using PBKDF2-HMAC-SHA256 and AES-256-CBC
+func pbes2Encrypt(password string, plaintext []byte) (pkix.AlgorithmIdentifier, []byte, error) {
+	salt := make([]byte, 16)
+	if _, err := rand.Read(salt); err != nil {
+		return pkix.AlgorithmIdentifier{}, nil, fmt.Errorf("failed to generate salt: %w", err)
+	}
+
+	kdfParams, err := asn1.Marshal(pbkdf2Params{
+		Salt:           salt,
+		IterationCount: pbes2Iterations,
+		PRF:            pkix.AlgorithmIdentifier{Algorithm: oidHMACWithSHA256, Parameters: asn1.NullRawValue},
+	})
+	if err != nil {
+		return pkix.AlgorithmIdentifier{}, nil, err
+	}
+
+	key := pbkdf2Key(crypto.SHA256.New, []byte(password), salt, pbes2Iterations, 32)
+	return pbes2Seal(pkix.AlgorithmIdentifier{Algorithm: oidPBKDF2, Parameters: asn1.RawValue{FullBytes: kdfParams}}, key, plaintext)
+}
+
+// pbes2EncryptScrypt encrypts data with PBES2 using scrypt and AES-256-CBC
+func pbes2EncryptScrypt(password string, plaintext []byte) (pkix.AlgorithmIdentifier, []byte, error) {
+	salt := make([]byte, 16)
+	if _, err := rand.Read(salt); err != nil {
+		return pkix.AlgorithmIdentifier{}, nil, fmt.Errorf("failed to generate salt: %w", err)
+	}
+
+	kdfParams, err := asn1.Marshal(scryptParams{
+		Salt:                     salt,
+		CostParameter:            scryptCost,
+		BlockSize:                scryptBlockSize,
+		ParallelizationParameter: scryptParallelism,
+	})
+	if err != nil {
+		return pkix.AlgorithmIdentifier{}, nil, err
+	}
+
+	key, err := scryptKey([]byte(password), salt, scryptCost, scryptBlockSize, scryptParallelism, 32)
+	if err != nil {
+		return pkix.AlgorithmIdentifier{}, nil, err
+	}
+	return pbes2Seal(pkix.AlgorithmIdentifier{Algorithm: oidScrypt, Parameters: asn1.RawValue{FullBytes: kdfParams}}, key, plaintext)
+}
+
+// pbes2Seal encrypts data with AES-256-CBC under a key derived by kdf and
+// returns the matching PBES2 algorithm identifier
+func pbes2Seal(kdf pkix.AlgorithmIdentifier, key, plaintext []byte) (pkix.AlgorithmIdentifier, []byte, error) {
+	iv := make([]byte, aes.BlockSize)
+	if _, err := rand.Read(iv); err != nil {
+		return pkix.AlgorithmIdentifier{}, nil, fmt.Errorf("failed to generate IV: %w", err)
+	}
+	ivParam, err := asn1.Marshal(iv)
+	if err != nil {
+		return pkix.AlgorithmIdentifier{}, nil, err
+	}
+	params, err := asn1.Marshal(pbes2Params{
+		KeyDerivationFunc: kdf,
+		EncryptionScheme:  pkix.AlgorithmIdentifier{Algorithm: oidAES256CBC, Parameters: asn1.RawValue{FullBytes: ivParam}},
+	})
+	if err != nil {
+		return pkix.AlgorithmIdentifier{}, nil, err
+	}
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return pkix.AlgorithmIdentifier{}, nil, err
+	}
+
+	padLen := aes.BlockSize - len(plaintext)%aes.BlockSize
+	padded := append(append([]byte(nil), plaintext...), bytes.Repeat([]byte{byte(padLen)}, padLen)...)
+	ciphertext := make([]byte, len(padded))
+	cipher.NewCBCEncrypter(block, iv).CryptBlocks(ciphertext, padded)
+
+	return pkix.AlgorithmIdentifier{Algorithm: oidPBES2, Parameters: asn1.RawValue{FullBytes: params}}, ciphertext, nil
+}
+
+// scryptKey derives a key from password with scrypt (RFC 7914)
+func scryptKey(password, salt []byte, n, r, p, keyLen int) ([]byte, error) {
+	if n <= 1 || n&(n-1) != 0 {
+		return nil, fmt.Errorf("scrypt cost parameter must be a power of 2 greater than 1")
+	}
+	if r <= 0 || p <= 0 || uint64(r)*uint64(p) >= 1<<30 {
+		return nil, fmt.Errorf("invalid scrypt parameters r=%d p=%d", r, p)
+	}
+	if uint64(128)*uint64(r)*uint64(n) > scryptMaxMemory {
+		return nil, fmt.Errorf("scrypt parameters N=%d r=%d need too much memory", n, r)
+	}
+
+	b := pbkdf2Key(sha256.New, password, salt, 1, p*128*r)
+	xy := make([]uint32, 64*r)
+	v := make([]uint32, 32*n*r)
+	for i := 0; i < p; i++ {
+		scryptROMix(b[i*128*r:], r, n, v, xy)
+	}
+	return pbkdf2Key(sha256.New, password, b, 1, keyLen), nil
+}
+
+// scryptROMix mixes one 128*r byte block of b in place (RFC 7914 section 5)
+func scryptROMix(b []byte, r, n int, v, xy []uint32) {
+	words := 32 * r
+	x, y := xy[:words], xy[words:]
+	for i := range x {
+		x[i] = binary.LittleEndian.Uint32(b[4*i:])
+	}
+
+	for i := 0; i < n; i++ {
+		copy(v[i*words:], x)
+		scryptBlockMix(x, y, r)
+	}
+	for i := 0; i < n; i++ {
+		j := int(x[(2*r-1)*16] & uint32(n-1))
+		for k, w := range v[j*words : (j+1)*words] {
+			x[k] ^= w
+		}
+		scryptBlockMix(x, y, r)
+	}
+
+	for i, w := range x {
+		binary.LittleEndian.PutUint32(b[4*i:], w)
+	}
+}
+
+// scryptBlockMix runs Salsa20/8 over the 2*r 64 byte blocks of b, writing the
+// even outputs before the odd ones (RFC 7914 section 4)
+func scryptBlockMix(b, y []uint32, r int) {
+	var x [16]uint32
+	copy(x[:], b[(2*r-1)*16:])
+	for i := 0; i < 2*r; i++ {
+		for k := range x {
+			x[k] ^= b[i*16+k]
+		}
+		salsa208(&x)
+		copy(y[(i/2+(i%2)*r)*16:], x[:])
+	}
+	copy(b, y)
+}
+
+// salsa208 applies the Salsa20/8 core to b
+func salsa208(b *[16]uint32) {
+	x := *b
+	quarter := func(a, b, c, d int) {
+		x[b] ^= bits.RotateLeft32(x[a]+x[d], 7)
+		x[c] ^= bits.RotateLeft32(x[b]+x[a], 9)
+		x[d] ^= bits.RotateLeft32(x[c]+x[b], 13)
+		x[a] ^= bits.RotateLeft32(x[d]+x[c], 18)
+	}
+	for round := 0; round < 8; round += 2 {
+		quarter(0, 4, 8, 12)
+		quarter(5, 9, 13, 1)
+		quarter(10, 14, 2, 6)
+		quarter(15, 3, 7, 11)
+		quarter(0, 1, 2, 3)
+		quarter(5, 6, 7, 4)
+		quarter(10, 11, 8, 9)
+		quarter(15, 12, 13, 14)
+	}
+	for i := range b {
+		b[i] += x[i]
+	}
+}
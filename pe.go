@@ -0,0 +1,231 @@
+package main
+
+import (
+	"bytes"
+	"crypto"
+	"encoding/binary"
+	"fmt"
+)
+
+// PE format constants
+const (
+	peMagicPE32     = 0x10b
+	peMagicPE32Plus = 0x20b
+
+	// imageDirectoryEntrySecurity is the index of the certificate table data directory
+	imageDirectoryEntrySecurity = 4
+
+	// WIN_CERTIFICATE header values
+	winCertRevision2_0          = 0x0200
+	winCertTypePKCSSignedData   = 0x0002
+	winCertificateHeaderSize    = 8
+	peCertificateTableAlignment = 8
+)
+
+// peImage holds the offsets of a PE file needed for Authenticode processing
+type peImage struct {
+	data []byte
+
+	// checksumOffset is the file offset of the optional header CheckSum field
+	checksumOffset int
+	// securityDirOffset is the file offset of the certificate table data directory entry
+	securityDirOffset int
+	// certTableOffset and certTableSize locate the certificate table, zero if absent
+	certTableOffset int
+	certTableSize   int
+}
+
+// winCertificate is a single entry of the PE certificate table
+type winCertificate struct {
+	Revision        uint16
+	CertificateType uint16
+	Certificate     []byte
+}
+
+// isPEData reports whether the data starts with a DOS header pointing to a PE signature
+func isPEData(data []byte) bool {
+	if len(data) < 0x40 || data[0] != 'M' || data[1] != 'Z' {
+		return false
+	}
+	peOffset := int(binary.LittleEndian.Uint32(data[0x3c:]))
+	if peOffset < 0 || peOffset+4 > len(data) {
+		return false
+	}
+	return bytes.Equal(data[peOffset:peOffset+4], []byte("PE\x00\x00"))
+}
+
+// parsePEImage locates the Authenticode relevant structures of a PE file
+func parsePEImage(data []byte) (*peImage, error) {
+	if !isPEData(data) {
+		return nil, fmt.Errorf("not a PE file")
+	}
+
+	peOffset := int(binary.LittleEndian.Uint32(data[0x3c:]))
+	coffOffset := peOffset + 4
+	if coffOffset+20 > len(data) {
+		return nil, fmt.Errorf("truncated COFF header")
+	}
+	optSize := int(binary.LittleEndian.Uint16(data[coffOffset+16:]))
+	optOffset := coffOffset + 20
+	if optSize < 2 || optOffset+optSize > len(data) {
+		return nil, fmt.Errorf("truncated optional header")
+	}
+
+	var numDirsOffset, dirsOffset int
+	switch binary.LittleEndian.Uint16(data[optOffset:]) {
+	case peMagicPE32:
+		numDirsOffset, dirsOffset = 92, 96
+	case peMagicPE32Plus:
+		numDirsOffset, dirsOffset = 108, 112
+	default:
+		return nil, fmt.Errorf("unknown optional header magic")
+	}
+	if numDirsOffset+4 > optSize {
+		return nil, fmt.Errorf("optional header too small")
+	}
+
+	numDirs := int(binary.LittleEndian.Uint32(data[optOffset+numDirsOffset:]))
+	if numDirs <= imageDirectoryEntrySecurity {
+		return nil, fmt.Errorf("PE file has no certificate table directory")
+	}
+	secDirOffset := optOffset + dirsOffset + imageDirectoryEntrySecurity*8
+	if secDirOffset+8 > optOffset+optSize {
+		return nil, fmt.Errorf("optional header too small for certificate table directory")
+	}
+
+	img := &peImage{
+		data:              data,
+		checksumOffset:    optOffset + 64,
+		securityDirOffset: secDirOffset,
+		certTableOffset:   int(binary.LittleEndian.Uint32(data[secDirOffset:])),
+		certTableSize:     int(binary.LittleEndian.Uint32(data[secDirOffset+4:])),
+	}
+
+	if img.certTableSize == 0 {
+		img.certTableOffset = 0
+	} else if img.certTableOffset <= secDirOffset || img.certTableOffset+img.certTableSize > len(data) {
+		return nil, fmt.Errorf("certificate table lies outside the file")
+	}
+
+	return img, nil
+}
+
+// hasCertificateTable reports whether the image carries a certificate table
+func (img *peImage) hasCertificateTable() bool {
+	return img.certTableSize > 0
+}
+
+// contentEnd returns the end of the image data covered by the Authenticode digest
+func (img *peImage) contentEnd() int {
+	if img.hasCertificateTable() {
+		return img.certTableOffset
+	}
+	return len(img.data)
+}
+
+// authenticodeDigest computes the Authenticode image hash, excluding the
+// checksum, the certificate table directory entry and the certificate table
+func (img *peImage) authenticodeDigest(hash crypto.Hash) []byte {
+	h := hash.New()
+	h.Write(img.data[:img.checksumOffset])
+	h.Write(img.data[img.checksumOffset+4 : img.securityDirOffset])
+	h.Write(img.data[img.securityDirOffset+8 : img.contentEnd()])
+
+	// An unsigned image is padded to the certificate table alignment
+	// before the table is appended, and that padding is hashed
+	if !img.hasCertificateTable() {
+		if pad := paddingFor(len(img.data), peCertificateTableAlignment); pad > 0 {
+			h.Write(make([]byte, pad))
+		}
+	}
+	return h.Sum(nil)
+}
+
+// certificates decodes the entries of the certificate table
+func (img *peImage) certificates() ([]winCertificate, error) {
+	var certs []winCertificate
+	table := img.data[img.certTableOffset : img.certTableOffset+img.certTableSize]
+
+	for len(table) > 0 {
+		if len(table) < winCertificateHeaderSize {
+			return nil, fmt.Errorf("truncated WIN_CERTIFICATE header")
+		}
+		length := int(binary.LittleEndian.Uint32(table))
+		if length < winCertificateHeaderSize || length > len(table) {
+			return nil, fmt.Errorf("invalid WIN_CERTIFICATE length %d", length)
+		}
+		certs = append(certs, winCertificate{
+			Revision:        binary.LittleEndian.Uint16(table[4:]),
+			CertificateType: binary.LittleEndian.Uint16(table[6:]),
+			Certificate:     table[winCertificateHeaderSize:length],
+		})
+
+		next := length + paddingFor(length, peCertificateTableAlignment)
+		if next > len(table) {
+			next = len(table)
+		}
+		table = table[next:]
+	}
+
+	return certs, nil
+}
+
+// withCertificates returns a copy of the image with its certificate table
+// replaced by the given entries and the checksum recomputed; an empty list
+// removes the table entirely
+func (img *peImage) withCertificates(certs []winCertificate) []byte {
+	out := make([]byte, img.contentEnd(), img.contentEnd()+4096)
+	copy(out, img.data[:img.contentEnd()])
+
+	tableOffset, tableSize := 0, 0
+	if len(certs) > 0 {
+		if pad := paddingFor(len(out), peCertificateTableAlignment); pad > 0 {
+			out = append(out, make([]byte, pad)...)
+		}
+		tableOffset = len(out)
+		for _, cert := range certs {
+			var header [winCertificateHeaderSize]byte
+			binary.LittleEndian.PutUint32(header[0:], uint32(winCertificateHeaderSize+len(cert.Certificate)))
+			binary.LittleEndian.PutUint16(header[4:], cert.Revision)
+			binary.LittleEndian.PutUint16(header[6:], cert.CertificateType)
+			out = append(out, header[:]...)
+			out = append(out, cert.Certificate...)
+			if pad := paddingFor(len(out), peCertificateTableAlignment); pad > 0 {
+				out = append(out, make([]byte, pad)...)
+			}
+		}
+		tableSize = len(out) - tableOffset
+	}
+
+	binary.LittleEndian.PutUint32(out[img.securityDirOffset:], uint32(tableOffset))
+	binary.LittleEndian.PutUint32(out[img.securityDirOffset+4:], uint32(tableSize))
+	binary.LittleEndian.PutUint32(out[img.checksumOffset:], peChecksum(out, img.checksumOffset))
+
+	return out
+}
+
+// peChecksum computes the optional header CheckSum the same way as
+// CheckSumMappedFile, treating the checksum field itself as zero
+func peChecksum(data []byte, checksumOffset int) uint32 {
+	var sum uint64
+	for i := 0; i < len(data); i += 2 {
+		var word uint64
+		if i+1 < len(data) {
+			word = uint64(binary.LittleEndian.Uint16(data[i:]))
+		} else {
+			word = uint64(data[i])
+		}
+		if i >= checksumOffset && i < checksumOffset+4 {
+			word = 0
+		}
+		sum += word
+		sum = (sum & 0xffff) + (sum >> 16)
+	}
+	sum = (sum & 0xffff) + (sum >> 16)
+	return uint32(sum) + uint32(len(data))
+}
+
+// paddingFor returns the number of bytes needed to align length to a multiple of align
+func paddingFor(length, align int) int {
+	return (align - length%align) % align
+}
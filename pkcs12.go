@@ -0,0 +1,616 @@
+package main
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// PKCS#12 object identifiers
+var (
+	oidEncryptedData       = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 7, 6}
+	oidKeyBag              = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 12, 10, 1, 1}
+	oidPKCS8ShroudedKeyBag = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 12, 10, 1, 2}
+	oidCertBag             = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 12, 10, 1, 3}
+	oidCertTypeX509        = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 22, 1}
+	oidFriendlyName        = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 20}
+	oidLocalKeyID          = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 21}
+)
+
+// pfxPasswordEnv names the environment variable holding the PFX password
+const pfxPasswordEnv = "SELFSIGN_PFX_PASSWORD"
+
+// pfxMACIterations is the PKCS#12 KDF iteration count for the integrity MAC
+const pfxMACIterations = 2048
+
+// pfxPDU is the outer PKCS#12 structure
+type pfxPDU struct {
+	Version  int
+	AuthSafe contentInfo
+	MacData  pfxMacData `asn1:"optional"`
+}
+
+// pfxMacData carries the password-based integrity MAC
+type pfxMacData struct {
+	Mac        pfxDigestInfo
+	MacSalt    []byte
+	Iterations int `asn1:"optional,default:1"`
+}
+
+// pfxDigestInfo is a DigestInfo holding the MAC value
+type pfxDigestInfo struct {
+	Algorithm pkix.AlgorithmIdentifier
+	Digest    []byte
+}
+
+// encryptedData is the PKCS#7 EncryptedData content type
+type encryptedData struct {
+	Version              int
+	EncryptedContentInfo encryptedContentInfo
+}
+
+// encryptedContentInfo holds password-encrypted SafeContents
+type encryptedContentInfo struct {
+	ContentType                asn1.ObjectIdentifier
+	ContentEncryptionAlgorithm pkix.AlgorithmIdentifier
+	EncryptedContent           asn1.RawValue `asn1:"optional,tag:0"`
+}
+
+// safeBag is a single key or certificate in a SafeContents
+type safeBag struct {
+	BagID      asn1.ObjectIdentifier
+	BagValue   asn1.RawValue  `asn1:"tag:0,explicit"`
+	Attributes []cmsAttribute `asn1:"set,optional"`
+}
+
+// certBag holds a DER encoded certificate
+type certBag struct {
+	ID   asn1.ObjectIdentifier
+	Data []byte `asn1:"tag:0,explicit"`
+}
+
+// getPFXPassword reads the PFX password from passwordFile, or from the
+// SELFSIGN_PFX_PASSWORD environment variable when no file is given
+func getPFXPassword(passwordFile string) (string, error) {
+	if passwordFile != "" {
+		data, err := os.ReadFile(passwordFile)
+		if err != nil {
+			return "", fmt.Errorf("failed to read password file: %w", err)
+		}
+		return firstLine(data), nil
+	}
+	if password, ok := os.LookupEnv(pfxPasswordEnv); ok {
+		return password, nil
+	}
+	return "", fmt.Errorf("no PFX password given; set %s or use a password file", pfxPasswordEnv)
+}
+
+// firstLine returns the first line of a password file, without its line ending
+func firstLine(data []byte) string {
+	line, _, _ := strings.Cut(string(data), "\n")
+	return strings.TrimSuffix(line, "\r")
+}
+
+// loadCertificateFromPFX loads a signing identity from a PKCS#12 file
+func loadCertificateFromPFX(pfxFile, password string) (*Certificate, error) {
+	data, err := os.ReadFile(pfxFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read PFX file %s: %w", pfxFile, err)
+	}
+	cert, err := decodePFX(data, password)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load PFX file %s: %w", pfxFile, err)
+	}
+	return cert, nil
+}
+
+// decodePFX extracts the private key, its certificate and the certificate's
+// issuers from PKCS#12 data
+func decodePFX(data []byte, password string) (*Certificate, error) {
+	bags, _, err := decodePFXBags(data, password)
+	if err != nil {
+		return nil, err
+	}
+
+	var keys []crypto.Signer
+	var certs []*x509.Certificate
+	for _, bag := range bags {
+		switch {
+		case bag.BagID.Equal(oidCertBag):
+			cert, err := parseCertBag(bag)
+			if err != nil {
+				return nil, err
+			}
+			if cert != nil {
+				certs = append(certs, cert)
+			}
+
+		case bag.BagID.Equal(oidPKCS8ShroudedKeyBag), bag.BagID.Equal(oidKeyBag):
+			keyDER := bag.BagValue.Bytes
+			if bag.BagID.Equal(oidPKCS8ShroudedKeyBag) {
+				var epki encryptedPrivateKeyInfo
+				if _, err := asn1.Unmarshal(keyDER, &epki); err != nil {
+					return nil, fmt.Errorf("failed to decode shrouded key: %w", err)
+				}
+				if keyDER, err = pbeDecrypt(epki.Algorithm, password, epki.EncryptedData); err != nil {
+					return nil, err
+				}
+			}
+			key, err := x509.ParsePKCS8PrivateKey(keyDER)
+			if err != nil {
+				return nil, fmt.Errorf("failed to parse private key: %w", err)
+			}
+			signer, ok := key.(crypto.Signer)
+			if !ok {
+				return nil, fmt.Errorf("unsupported private key type %T", key)
+			}
+			keys = append(keys, signer)
+		}
+	}
+
+	if len(keys) != 1 {
+		return nil, fmt.Errorf("expected one private key, found %d", len(keys))
+	}
+	return certificateForKey(keys[0], certs)
+}
+
+// decodePFXBags checks the integrity MAC of PKCS#12 data, when it has one,
+// and returns every safe bag with encrypted SafeContents decrypted
+func decodePFXBags(data []byte, password string) ([]safeBag, bool, error) {
+	der, err := berToDER(data)
+	if err != nil {
+		return nil, false, err
+	}
+
+	var pfx pfxPDU
+	if _, err := asn1.Unmarshal(der, &pfx); err != nil {
+		return nil, false, fmt.Errorf("failed to decode PFX: %w", err)
+	}
+	if pfx.Version != 3 {
+		return nil, false, fmt.Errorf("unsupported PFX version %d", pfx.Version)
+	}
+	if !pfx.AuthSafe.ContentType.Equal(oidData) {
+		return nil, false, fmt.Errorf("public-key protected PFX files are not supported")
+	}
+	var authSafe []byte
+	if _, err := asn1.Unmarshal(pfx.AuthSafe.Content.Bytes, &authSafe); err != nil {
+		return nil, false, fmt.Errorf("failed to decode PFX content: %w", err)
+	}
+
+	hasMAC := len(pfx.MacData.Mac.Digest) > 0
+	if hasMAC {
+		if err := verifyPFXMac(&pfx.MacData, authSafe, password); err != nil {
+			return nil, false, err
+		}
+	}
+
+	var contents []contentInfo
+	if _, err := asn1.Unmarshal(authSafe, &contents); err != nil {
+		return nil, false, fmt.Errorf("failed to decode authenticated safe: %w", err)
+	}
+
+	var bags []safeBag
+	for _, ci := range contents {
+		var safeContents []byte
+		switch {
+		case ci.ContentType.Equal(oidData):
+			if _, err := asn1.Unmarshal(ci.Content.Bytes, &safeContents); err != nil {
+				return nil, false, fmt.Errorf("failed to decode safe contents: %w", err)
+			}
+		case ci.ContentType.Equal(oidEncryptedData):
+			var ed encryptedData
+			if _, err := asn1.Unmarshal(ci.Content.Bytes, &ed); err != nil {
+				return nil, false, fmt.Errorf("failed to decode encrypted safe contents: %w", err)
+			}
+			eci := ed.EncryptedContentInfo
+			ciphertext, err := implicitOctetString(eci.EncryptedContent)
+			if err != nil {
+				return nil, false, err
+			}
+			if safeContents, err = pbeDecrypt(eci.ContentEncryptionAlgorithm, password, ciphertext); err != nil {
+				return nil, false, err
+			}
+		default:
+			return nil, false, fmt.Errorf("unsupported safe contents type: %v", ci.ContentType)
+		}
+
+		var contentBags []safeBag
+		if _, err := asn1.Unmarshal(safeContents, &contentBags); err != nil {
+			return nil, false, fmt.Errorf("failed to decode safe bags: %w", err)
+		}
+		bags = append(bags, contentBags...)
+	}
+	return bags, hasMAC, nil
+}
+
+// parseCertBag returns the X.509 certificate in a certificate bag, or nil for
+// other certificate types
+func parseCertBag(bag safeBag) (*x509.Certificate, error) {
+	var cb certBag
+	if _, err := asn1.Unmarshal(bag.BagValue.Bytes, &cb); err != nil {
+		return nil, fmt.Errorf("failed to decode certificate bag: %w", err)
+	}
+	if !cb.ID.Equal(oidCertTypeX509) {
+		return nil, nil
+	}
+	cert, err := x509.ParseCertificate(cb.Data)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse certificate: %w", err)
+	}
+	return cert, nil
+}
+
+// certificateForKey picks the certificate matching key and orders the
+// certificates that issued it, nearest issuer first
+func certificateForKey(key crypto.Signer, certs []*x509.Certificate) (*Certificate, error) {
+	pub, ok := key.Public().(interface{ Equal(crypto.PublicKey) bool })
+	if !ok {
+		return nil, fmt.Errorf("unsupported private key type %T", key)
+	}
+
+	var leaf *x509.Certificate
+	for _, cert := range certs {
+		if pub.Equal(cert.PublicKey) {
+			leaf = cert
+			break
+		}
+	}
+	if leaf == nil {
+		return nil, fmt.Errorf("no certificate matches the private key")
+	}
+
+	var chain []*x509.Certificate
+	for current := leaf; !isSelfSignedCertificate(current) && len(chain) < len(certs); {
+		var issuer *x509.Certificate
+		for _, cert := range certs {
+			if cert != current && bytes.Equal(current.RawIssuer, cert.RawSubject) && current.CheckSignatureFrom(cert) == nil {
+				issuer = cert
+				break
+			}
+		}
+		if issuer == nil {
+			break
+		}
+		chain = append(chain, issuer)
+		current = issuer
+	}
+
+	return &Certificate{
+		Subject:    leaf.Subject.CommonName,
+		Cert:       leaf,
+		PrivateKey: key,
+		Chain:      chain,
+	}, nil
+}
+
+// verifyPFXMac checks the password-based integrity MAC over the authenticated safe
+func verifyPFXMac(macData *pfxMacData, authSafe []byte, password string) error {
+	hash, err := hashFromAlgorithmID(macData.Mac.Algorithm)
+	if err != nil {
+		return fmt.Errorf("unsupported PFX MAC: %w", err)
+	}
+
+	passwords := [][]byte{bmpPassword(password)}
+	if password == "" {
+		// An empty password is encoded either as an empty string or as nothing at all
+		passwords = append(passwords, nil)
+	}
+	for _, bmp := range passwords {
+		key := pkcs12KDF(hash, bmp, macData.MacSalt, 3, macData.Iterations, hash.Size())
+		mac := hmac.New(hash.New, key)
+		mac.Write(authSafe)
+		if hmac.Equal(mac.Sum(nil), macData.Mac.Digest) {
+			return nil
+		}
+	}
+	return errors.New("PFX integrity check failed, the password may be wrong")
+}
+
+// encodePFX writes a signing identity and its issuers as PKCS#12 protected by
+// password, using PBES2 with AES-256 and an HMAC-SHA256 integrity MAC
+func encodePFX(cert *Certificate, password string) ([]byte, error) {
+	localKeyID := sha1.Sum(cert.Cert.Raw)
+	leafAttrs, err := pfxBagAttributes(cert.Subject, localKeyID[:])
+	if err != nil {
+		return nil, err
+	}
+
+	// Certificates go into a single encrypted SafeContents
+	certBags := make([]safeBag, 0, 1+len(cert.Chain))
+	for i, c := range append([]*x509.Certificate{cert.Cert}, cert.Chain...) {
+		bagDER, err := asn1.Marshal(certBag{ID: oidCertTypeX509, Data: c.Raw})
+		if err != nil {
+			return nil, fmt.Errorf("failed to encode certificate bag: %w", err)
+		}
+		bag := safeBag{BagID: oidCertBag, BagValue: explicitContent(bagDER)}
+		if i == 0 {
+			bag.Attributes = leafAttrs
+		}
+		certBags = append(certBags, bag)
+	}
+	certContents, err := asn1.Marshal(certBags)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode certificate bags: %w", err)
+	}
+	certAlg, encryptedCerts, err := pbes2Encrypt(password, certContents)
+	if err != nil {
+		return nil, err
+	}
+	encryptedCertsDER, err := asn1.Marshal(encryptedData{
+		EncryptedContentInfo: encryptedContentInfo{
+			ContentType:                oidData,
+			ContentEncryptionAlgorithm: certAlg,
+			EncryptedContent:           asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 0, Bytes: encryptedCerts},
+		},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode encrypted certificates: %w", err)
+	}
+
+	// The key is shrouded on its own inside a plain SafeContents
+	keyDER, err := x509.MarshalPKCS8PrivateKey(cert.PrivateKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal private key: %w", err)
+	}
+	keyAlg, encryptedKey, err := pbes2Encrypt(password, keyDER)
+	if err != nil {
+		return nil, err
+	}
+	shroudedDER, err := asn1.Marshal(encryptedPrivateKeyInfo{Algorithm: keyAlg, EncryptedData: encryptedKey})
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode shrouded key: %w", err)
+	}
+	keyContents, err := asn1.Marshal([]safeBag{{
+		BagID:      oidPKCS8ShroudedKeyBag,
+		BagValue:   explicitContent(shroudedDER),
+		Attributes: leafAttrs,
+	}})
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode key bag: %w", err)
+	}
+	keyContentsData, err := asn1.Marshal(keyContents)
+	if err != nil {
+		return nil, err
+	}
+
+	authSafe, err := asn1.Marshal([]contentInfo{
+		{ContentType: oidEncryptedData, Content: explicitContent(encryptedCertsDER)},
+		{ContentType: oidData, Content: explicitContent(keyContentsData)},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode authenticated safe: %w", err)
+	}
+
+	macData, err := computePFXMac(authSafe, password)
+	if err != nil {
+		return nil, err
+	}
+	return marshalPFX(authSafe, macData)
+}
+
+// computePFXMac computes an HMAC-SHA256 integrity MAC over the authenticated safe
+func computePFXMac(authSafe []byte, password string) (*pfxMacData, error) {
+	salt := make([]byte, 16)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, fmt.Errorf("failed to generate salt: %w", err)
+	}
+	macKey := pkcs12KDF(crypto.SHA256, bmpPassword(password), salt, 3, pfxMACIterations, crypto.SHA256.Size())
+	mac := hmac.New(crypto.SHA256.New, macKey)
+	mac.Write(authSafe)
+	macAlg, err := digestAlgorithmID(crypto.SHA256)
+	if err != nil {
+		return nil, err
+	}
+	return &pfxMacData{
+		Mac:        pfxDigestInfo{Algorithm: macAlg, Digest: mac.Sum(nil)},
+		MacSalt:    salt,
+		Iterations: pfxMACIterations,
+	}, nil
+}
+
+// marshalPFX wraps an authenticated safe, and its MAC if there is one, into a PFX
+func marshalPFX(authSafe []byte, macData *pfxMacData) ([]byte, error) {
+	authSafeData, err := asn1.Marshal(authSafe)
+	if err != nil {
+		return nil, err
+	}
+	pdu := pfxPDU{
+		Version:  3,
+		AuthSafe: contentInfo{ContentType: oidData, Content: explicitContent(authSafeData)},
+	}
+	if macData != nil {
+		pdu.MacData = *macData
+	}
+	pfx, err := asn1.Marshal(pdu)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode PFX: %w", err)
+	}
+	return pfx, nil
+}
+
+// pfxBagAttributes returns the friendlyName and localKeyID bag attributes
+// that tie a key to its certificate
+func pfxBagAttributes(friendlyName string, localKeyID []byte) ([]cmsAttribute, error) {
+	nameAttr, err := friendlyNameAttribute(friendlyName)
+	if err != nil {
+		return nil, err
+	}
+	keyIDDER, err := asn1.Marshal(localKeyID)
+	if err != nil {
+		return nil, err
+	}
+	return []cmsAttribute{
+		nameAttr,
+		{Type: oidLocalKeyID, Values: asn1.RawValue{Class: asn1.ClassUniversal, Tag: asn1.TagSet, IsCompound: true, Bytes: keyIDDER}},
+	}, nil
+}
+
+// friendlyNameAttribute returns a friendlyName bag attribute
+func friendlyNameAttribute(friendlyName string) (cmsAttribute, error) {
+	// encoding/asn1 can't marshal a BMPString, so build it by hand
+	name := bmpPassword(friendlyName)
+	nameDER, err := asn1.Marshal(asn1.RawValue{Class: asn1.ClassUniversal, Tag: asn1.TagBMPString, Bytes: name[:len(name)-2]})
+	if err != nil {
+		return cmsAttribute{}, err
+	}
+	return cmsAttribute{Type: oidFriendlyName, Values: asn1.RawValue{Class: asn1.ClassUniversal, Tag: asn1.TagSet, IsCompound: true, Bytes: nameDER}}, nil
+}
+
+// explicitContent wraps DER in the [0] EXPLICIT tag used for ContentInfo and bag values
+func explicitContent(der []byte) asn1.RawValue {
+	return asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 0, IsCompound: true, Bytes: der}
+}
+
+// implicitOctetString returns the contents of an implicitly tagged OCTET
+// STRING, joining the segments of a constructed BER encoding
+func implicitOctetString(raw asn1.RawValue) ([]byte, error) {
+	if !raw.IsCompound {
+		return raw.Bytes, nil
+	}
+	var joined []byte
+	for rest := raw.Bytes; len(rest) > 0; {
+		var segment []byte
+		var err error
+		if rest, err = asn1.Unmarshal(rest, &segment); err != nil {
+			return nil, fmt.Errorf("failed to decode encrypted content: %w", err)
+		}
+		joined = append(joined, segment...)
+	}
+	return joined, nil
+}
+
+// berToDER rewrites BER as DER where it matters to encoding/asn1: indefinite
+// lengths become definite and constructed OCTET STRINGs are joined. PFX
+// files exported by Windows and Java commonly use both
+func berToDER(ber []byte) ([]byte, error) {
+	der, rest, err := convertBERElement(ber, 0)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode BER: %w", err)
+	}
+	if len(rest) > 0 {
+		return nil, fmt.Errorf("failed to decode BER: trailing data")
+	}
+	return der, nil
+}
+
+// convertBERElement converts the first element of data, returning the
+// remaining bytes
+func convertBERElement(data []byte, depth int) ([]byte, []byte, error) {
+	if depth > 64 {
+		return nil, nil, errors.New("nesting too deep")
+	}
+	if len(data) < 2 {
+		return nil, nil, errors.New("truncated element")
+	}
+
+	// Identifier octets, including high tag numbers
+	idLen := 1
+	if data[0]&0x1f == 0x1f {
+		for idLen < len(data) && data[idLen]&0x80 != 0 {
+			idLen++
+		}
+		idLen++
+	}
+	if idLen >= len(data) {
+		return nil, nil, errors.New("truncated tag")
+	}
+	identifier := data[:idLen]
+	constructed := data[0]&0x20 != 0
+
+	// Length octets
+	lengthByte := data[idLen]
+	offset := idLen + 1
+	indefinite := lengthByte == 0x80
+	length := int(lengthByte)
+	if lengthByte > 0x80 {
+		n := int(lengthByte & 0x7f)
+		if n > 4 || offset+n > len(data) {
+			return nil, nil, errors.New("unsupported length")
+		}
+		length = 0
+		for _, b := range data[offset : offset+n] {
+			length = length<<8 | int(b)
+		}
+		offset += n
+	}
+
+	if !constructed {
+		if indefinite || offset+length > len(data) || length < 0 {
+			return nil, nil, errors.New("malformed primitive element")
+		}
+		return encodeDERElement(identifier, data[offset:offset+length]), data[offset+length:], nil
+	}
+
+	var content, rest []byte
+	if indefinite {
+		content = data[offset:]
+	} else {
+		if offset+length > len(data) || length < 0 {
+			return nil, nil, errors.New("element exceeds data")
+		}
+		content, rest = data[offset:offset+length], data[offset+length:]
+	}
+
+	var children [][]byte
+	for {
+		if indefinite {
+			if len(content) >= 2 && content[0] == 0 && content[1] == 0 {
+				rest = content[2:]
+				break
+			}
+			if len(content) == 0 {
+				return nil, nil, errors.New("missing end-of-contents")
+			}
+		} else if len(content) == 0 {
+			break
+		}
+		child, remaining, err := convertBERElement(content, depth+1)
+		if err != nil {
+			return nil, nil, err
+		}
+		children = append(children, child)
+		content = remaining
+	}
+
+	// A constructed universal OCTET STRING becomes one primitive string
+	if data[0] == 0x24 {
+		var joined []byte
+		for _, child := range children {
+			var segment asn1.RawValue
+			if _, err := asn1.Unmarshal(child, &segment); err != nil {
+				return nil, nil, err
+			}
+			joined = append(joined, segment.Bytes...)
+		}
+		return encodeDERElement([]byte{0x04}, joined), rest, nil
+	}
+
+	return encodeDERElement(identifier, bytes.Join(children, nil)), rest, nil
+}
+
+// encodeDERElement encodes an element with a definite length
+func encodeDERElement(identifier, content []byte) []byte {
+	out := append([]byte(nil), identifier...)
+	switch n := len(content); {
+	case n < 0x80:
+		out = append(out, byte(n))
+	case n < 0x100:
+		out = append(out, 0x81, byte(n))
+	case n < 0x10000:
+		out = append(out, 0x82, byte(n>>8), byte(n))
+	case n < 0x1000000:
+		out = append(out, 0x83, byte(n>>16), byte(n>>8), byte(n))
+	default:
+		out = append(out, 0x84, byte(n>>24), byte(n>>16), byte(n>>8), byte(n))
+	}
+	return append(out, content...)
+}
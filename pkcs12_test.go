@@ -0,0 +1,176 @@
+package main
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/pem"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestRC2Vectors(t *testing.T) {
+	// Test vectors from RFC 2268 section 5
+	vectors := []struct {
+		key, plaintext, ciphertext string
+		bits                       int
+	}{
+		{"0000000000000000", "0000000000000000", "ebb773f993278eff", 63},
+		{"ffffffffffffffff", "ffffffffffffffff", "278b27e42e2f0d49", 64},
+		{"3000000000000000", "1000000000000001", "30649edf9be7d2c2", 64},
+		{"88bca90e90875a7f0f79c384627bafb2", "0000000000000000", "2269552ab0f85ca6", 128},
+	}
+	for _, v := range vectors {
+		key, _ := hex.DecodeString(v.key)
+		plaintext, _ := hex.DecodeString(v.plaintext)
+		block, err := newRC2Cipher(key, v.bits)
+		if err != nil {
+			t.Fatalf("Failed to create cipher: %v", err)
+		}
+		out := make([]byte, rc2BlockSize)
+		block.Encrypt(out, plaintext)
+		if hex.EncodeToString(out) != v.ciphertext {
+			t.Errorf("RC2 key %s: got %x, want %s", v.key, out, v.ciphertext)
+		}
+		block.Decrypt(out, out)
+		if !bytes.Equal(out, plaintext) {
+			t.Errorf("RC2 key %s: decryption did not round trip", v.key)
+		}
+	}
+}
+
+func TestPBKDF2Vector(t *testing.T) {
+	// RFC 6070 test vector 2
+	dk := pbkdf2Key(crypto.SHA1.New, []byte("password"), []byte("salt"), 2, 20)
+	if hex.EncodeToString(dk) != "ea6c014dc72d6f8ccd1ed92ace1d41f0d8de8957" {
+		t.Errorf("Unexpected PBKDF2 output %x", dk)
+	}
+}
+
+func newTestIdentity(t *testing.T) *Certificate {
+	t.Helper()
+	root, err := createLocalRootCA(localRootCAName, "p256")
+	if err != nil {
+		t.Fatalf("Failed to create root CA: %v", err)
+	}
+	leaf, err := issueCertificate(root, "LocalSign-Test", x509.ExtKeyUsageCodeSigning, "rsa2048")
+	if err != nil {
+		t.Fatalf("Failed to issue certificate: %v", err)
+	}
+	return leaf
+}
+
+func TestPFXRoundTrip(t *testing.T) {
+	identity := newTestIdentity(t)
+
+	pfx, err := encodePFX(identity, "s3cret")
+	if err != nil {
+		t.Fatalf("Failed to encode PFX: %v", err)
+	}
+
+	decoded, err := decodePFX(pfx, "s3cret")
+	if err != nil {
+		t.Fatalf("Failed to decode PFX: %v", err)
+	}
+	if !decoded.Cert.Equal(identity.Cert) || decoded.Subject != "LocalSign-Test" {
+		t.Errorf("Decoded certificate does not match")
+	}
+	if len(decoded.Chain) != 1 || !decoded.Chain[0].Equal(identity.Chain[0]) {
+		t.Errorf("Expected the root CA as chain, got %d certificates", len(decoded.Chain))
+	}
+	if pub, ok := decoded.PrivateKey.Public().(interface{ Equal(crypto.PublicKey) bool }); !ok || !pub.Equal(identity.Cert.PublicKey) {
+		t.Errorf("Decoded key does not match the certificate")
+	}
+
+	if _, err := decodePFX(pfx, "wrong"); err == nil || !strings.Contains(err.Error(), "password") {
+		t.Errorf("Expected a password error, got %v", err)
+	}
+}
+
+func TestPFXPasswordFile(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "password.txt")
+	for content, want := range map[string]string{
+		"s3cret":              "s3cret",
+		"s3cret\r\n":          "s3cret",
+		"s3cret\nsecond line": "s3cret",
+		"\ns3cret":            "",
+	} {
+		os.WriteFile(file, []byte(content), 0600)
+		if got, err := getPFXPassword(file); err != nil || got != want {
+			t.Errorf("%q: expected %q, got %q (%v)", content, want, got, err)
+		}
+	}
+}
+
+func TestPFXOpenSSLInterop(t *testing.T) {
+	if _, err := exec.LookPath("openssl"); err != nil {
+		t.Skip("openssl not available")
+	}
+	identity := newTestIdentity(t)
+	dir := t.TempDir()
+
+	// openssl must accept what we export
+	ours := filepath.Join(dir, "ours.pfx")
+	pfx, err := encodePFX(identity, "s3cret")
+	if err != nil {
+		t.Fatalf("Failed to encode PFX: %v", err)
+	}
+	os.WriteFile(ours, pfx, 0600)
+	out, err := exec.Command("openssl", "pkcs12", "-in", ours, "-passin", "pass:s3cret", "-nodes").CombinedOutput()
+	if err != nil || !strings.Contains(string(out), "PRIVATE KEY") || strings.Count(string(out), "BEGIN CERTIFICATE") != 2 {
+		t.Fatalf("openssl failed to read exported PFX: %v\n%s", err, out)
+	}
+
+	// and we must read what openssl exports, in current and legacy encryption
+	certFile := filepath.Join(dir, "cert.pem")
+	keyFile := filepath.Join(dir, "key.pem")
+	chainFile := filepath.Join(dir, "chain.pem")
+	keyDER, _ := x509.MarshalPKCS8PrivateKey(identity.PrivateKey)
+	os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: identity.Cert.Raw}), 0644)
+	os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER}), 0600)
+	os.WriteFile(chainFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: identity.Chain[0].Raw}), 0644)
+
+	variants := map[string][]string{
+		"aes":  nil,
+		"3des": {"-keypbe", "PBE-SHA1-3DES", "-certpbe", "PBE-SHA1-3DES", "-macalg", "sha1"},
+		"rc2":  {"-legacy"},
+	}
+	for name, extra := range variants {
+		theirs := filepath.Join(dir, name+".pfx")
+		args := append([]string{"pkcs12", "-export", "-in", certFile, "-inkey", keyFile, "-certfile", chainFile,
+			"-passout", "pass:s3cret", "-out", theirs}, extra...)
+		if out, err := exec.Command("openssl", args...).CombinedOutput(); err != nil {
+			if name == "rc2" {
+				t.Logf("Skipping RC2 variant, openssl legacy provider unavailable: %s", out)
+				continue
+			}
+			t.Fatalf("openssl export (%s) failed: %v\n%s", name, err, out)
+		}
+
+		cert, err := loadCertificateFromPFX(theirs, "s3cret")
+		if err != nil {
+			t.Errorf("Failed to load openssl %s PFX: %v", name, err)
+			continue
+		}
+		if !cert.Cert.Equal(identity.Cert) || len(cert.Chain) != 1 {
+			t.Errorf("openssl %s PFX decoded to the wrong identity", name)
+		}
+	}
+}
+
+func TestBERToDERIndefiniteLength(t *testing.T) {
+	// SEQUENCE (indefinite) { constructed OCTET STRING { "ab", "cd" } }
+	ber := []byte{0x30, 0x80, 0x24, 0x80, 0x04, 0x02, 'a', 'b', 0x04, 0x02, 'c', 'd', 0x00, 0x00, 0x00, 0x00}
+	der, err := berToDER(ber)
+	if err != nil {
+		t.Fatalf("Failed to convert BER: %v", err)
+	}
+	want := []byte{0x30, 0x06, 0x04, 0x04, 'a', 'b', 'c', 'd'}
+	if !bytes.Equal(der, want) {
+		t.Errorf("Got %x, want %x", der, want)
+	}
+}
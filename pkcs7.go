@@ -0,0 +1,358 @@
+package main
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	_ "crypto/sha1"
+	_ "crypto/sha256"
+	_ "crypto/sha512"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"fmt"
+	"math/big"
+	"sort"
+)
+
+// Object identifiers used by the PKCS#7 / CMS structures
+var (
+	oidData          = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 7, 1}
+	oidSignedData    = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 7, 2}
+	oidContentType   = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 3}
+	oidMessageDigest = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 4}
+	oidSigningTime   = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 5}
+
+	oidSHA1   = asn1.ObjectIdentifier{1, 3, 14, 3, 2, 26}
+	oidSHA256 = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 2, 1}
+	oidSHA384 = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 2, 2}
+	oidSHA512 = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 2, 3}
+
+	oidRSAEncryption   = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 1, 1}
+	oidECDSAWithSHA1   = asn1.ObjectIdentifier{1, 2, 840, 10045, 4, 1}
+	oidECDSAWithSHA256 = asn1.ObjectIdentifier{1, 2, 840, 10045, 4, 3, 2}
+	oidECDSAWithSHA384 = asn1.ObjectIdentifier{1, 2, 840, 10045, 4, 3, 3}
+	oidECDSAWithSHA512 = asn1.ObjectIdentifier{1, 2, 840, 10045, 4, 3, 4}
+	oidEd25519         = asn1.ObjectIdentifier{1, 3, 101, 112}
+)
+
+// contentInfo is the outer PKCS#7 ContentInfo wrapper
+type contentInfo struct {
+	ContentType asn1.ObjectIdentifier
+	Content     asn1.RawValue `asn1:"explicit,optional,tag:0"`
+}
+
+// signedData is the PKCS#7 SignedData structure (RFC 2315 / RFC 5652)
+type signedData struct {
+	Version          int
+	DigestAlgorithms []pkix.AlgorithmIdentifier `asn1:"set"`
+	ContentInfo      contentInfo
+	Certificates     asn1.RawValue `asn1:"optional,tag:0"`
+	CRLs             asn1.RawValue `asn1:"optional,tag:1"`
+	SignerInfos      []signerInfo  `asn1:"set"`
+}
+
+// issuerAndSerial identifies a signer certificate
+type issuerAndSerial struct {
+	Issuer       asn1.RawValue
+	SerialNumber *big.Int
+}
+
+// signerInfo describes a single signature inside a SignedData
+type signerInfo struct {
+	Version                   int
+	IssuerAndSerialNumber     issuerAndSerial
+	DigestAlgorithm           pkix.AlgorithmIdentifier
+	AuthenticatedAttributes   asn1.RawValue `asn1:"optional,tag:0"`
+	DigestEncryptionAlgorithm pkix.AlgorithmIdentifier
+	EncryptedDigest           []byte
+	UnauthenticatedAttributes asn1.RawValue `asn1:"optional,tag:1"`
+}
+
+// cmsAttribute is a single signed or unsigned attribute
+type cmsAttribute struct {
+	Type   asn1.ObjectIdentifier
+	Values asn1.RawValue `asn1:"set"`
+}
+
+// cmsSignOptions controls how createSignedData builds a SignedData structure
+type cmsSignOptions struct {
+	// Version is the SignedData version, 1 when left at zero
+	Version int
+	// ContentType is the type of the encapsulated content
+	ContentType asn1.ObjectIdentifier
+	// Content is the DER encoding placed in the encapsulated content;
+	// leave empty for a detached signature
+	Content []byte
+	// MessageDigest is the digest of the signed content, computed with Hash
+	MessageDigest []byte
+	// Hash is the digest algorithm used for the message digest and signature
+	Hash crypto.Hash
+	// SignedAttributes are added after contentType and messageDigest
+	SignedAttributes []cmsAttribute
+	// NoAttributes signs MessageDigest directly without any signed attributes
+	NoAttributes bool
+	// NoCertificates leaves the signer's certificates out of the SignedData
+	NoCertificates bool
+}
+
+// newCMSAttribute builds an attribute holding a single DER-encoded value
+func newCMSAttribute(attrType asn1.ObjectIdentifier, value interface{}) (cmsAttribute, error) {
+	valueDER, err := asn1.Marshal(value)
+	if err != nil {
+		return cmsAttribute{}, fmt.Errorf("failed to encode attribute %v: %w", attrType, err)
+	}
+	return cmsAttribute{
+		Type:   attrType,
+		Values: asn1.RawValue{Class: asn1.ClassUniversal, Tag: asn1.TagSet, IsCompound: true, Bytes: valueDER},
+	}, nil
+}
+
+// marshalAttributeSet encodes attributes as a DER SET OF, returning the
+// element bytes sorted as DER requires
+func marshalAttributeSet(attrs []cmsAttribute) ([]byte, error) {
+	encoded := make([][]byte, 0, len(attrs))
+	for _, attr := range attrs {
+		der, err := asn1.Marshal(attr)
+		if err != nil {
+			return nil, fmt.Errorf("failed to encode attribute %v: %w", attr.Type, err)
+		}
+		encoded = append(encoded, der)
+	}
+	sort.Slice(encoded, func(i, j int) bool {
+		return bytes.Compare(encoded[i], encoded[j]) < 0
+	})
+	return bytes.Join(encoded, nil), nil
+}
+
+// digestAlgorithmID returns the algorithm identifier for a hash function
+func digestAlgorithmID(hash crypto.Hash) (pkix.AlgorithmIdentifier, error) {
+	var oid asn1.ObjectIdentifier
+	switch hash {
+	case crypto.SHA1:
+		oid = oidSHA1
+	case crypto.SHA256:
+		oid = oidSHA256
+	case crypto.SHA384:
+		oid = oidSHA384
+	case crypto.SHA512:
+		oid = oidSHA512
+	default:
+		return pkix.AlgorithmIdentifier{}, fmt.Errorf("unsupported digest algorithm: %v", hash)
+	}
+	return pkix.AlgorithmIdentifier{Algorithm: oid, Parameters: asn1.NullRawValue}, nil
+}
+
+// hashFromAlgorithmID maps a digest algorithm identifier back to a hash function
+func hashFromAlgorithmID(alg pkix.AlgorithmIdentifier) (crypto.Hash, error) {
+	switch {
+	case alg.Algorithm.Equal(oidSHA1):
+		return crypto.SHA1, nil
+	case alg.Algorithm.Equal(oidSHA256):
+		return crypto.SHA256, nil
+	case alg.Algorithm.Equal(oidSHA384):
+		return crypto.SHA384, nil
+	case alg.Algorithm.Equal(oidSHA512):
+		return crypto.SHA512, nil
+	}
+	return 0, fmt.Errorf("unsupported digest algorithm: %v", alg.Algorithm)
+}
+
+// signatureAlgorithmID returns the signature algorithm identifier for the signing key
+func signatureAlgorithmID(cert *Certificate, hash crypto.Hash) (pkix.AlgorithmIdentifier, error) {
+	switch cert.PrivateKey.Public().(type) {
+	case *rsa.PublicKey:
+		return pkix.AlgorithmIdentifier{Algorithm: oidRSAEncryption, Parameters: asn1.NullRawValue}, nil
+	case *ecdsa.PublicKey:
+		switch hash {
+		case crypto.SHA1:
+			return pkix.AlgorithmIdentifier{Algorithm: oidECDSAWithSHA1}, nil
+		case crypto.SHA256:
+			return pkix.AlgorithmIdentifier{Algorithm: oidECDSAWithSHA256}, nil
+		case crypto.SHA384:
+			return pkix.AlgorithmIdentifier{Algorithm: oidECDSAWithSHA384}, nil
+		case crypto.SHA512:
+			return pkix.AlgorithmIdentifier{Algorithm: oidECDSAWithSHA512}, nil
+		}
+		return pkix.AlgorithmIdentifier{}, fmt.Errorf("unsupported digest algorithm for ECDSA: %v", hash)
+	case ed25519.PublicKey:
+		// RFC 8419: the parameters are absent
+		return pkix.AlgorithmIdentifier{Algorithm: oidEd25519}, nil
+	}
+	return pkix.AlgorithmIdentifier{}, fmt.Errorf("unsupported signing key type %T", cert.PrivateKey)
+}
+
+// cmsDigestFor returns the digest algorithm to pair with the signing key,
+// given by its public key, which is hash except for Ed25519 where RFC 8419
+// requires SHA-512
+func cmsDigestFor(pub crypto.PublicKey, hash crypto.Hash) crypto.Hash {
+	if _, ok := pub.(ed25519.PublicKey); ok {
+		return crypto.SHA512
+	}
+	return hash
+}
+
+// signBytes signs data with key; RSA and ECDSA keys sign its digest, while
+// Ed25519 signs the data itself (RFC 8419)
+func signBytes(key crypto.Signer, hash crypto.Hash, data []byte) ([]byte, error) {
+	if _, ok := key.Public().(ed25519.PublicKey); ok {
+		return key.Sign(rand.Reader, data, crypto.Hash(0))
+	}
+	h := hash.New()
+	h.Write(data)
+	return key.Sign(rand.Reader, h.Sum(nil), hash)
+}
+
+// createSignerInfo signs the given attributes with the certificate's key; with
+// no attributes the signature is made directly over contentDigest
+func createSignerInfo(cert *Certificate, hash crypto.Hash, attrs []cmsAttribute, contentDigest []byte) (*signerInfo, error) {
+	digestAlg, err := digestAlgorithmID(hash)
+	if err != nil {
+		return nil, err
+	}
+	sigAlg, err := signatureAlgorithmID(cert, hash)
+	if err != nil {
+		return nil, err
+	}
+
+	si := &signerInfo{
+		Version: 1,
+		IssuerAndSerialNumber: issuerAndSerial{
+			Issuer:       asn1.RawValue{FullBytes: cert.Cert.RawIssuer},
+			SerialNumber: cert.Cert.SerialNumber,
+		},
+		DigestAlgorithm:           digestAlg,
+		DigestEncryptionAlgorithm: sigAlg,
+	}
+
+	if len(attrs) == 0 {
+		if _, ok := cert.PrivateKey.Public().(ed25519.PublicKey); ok {
+			return nil, fmt.Errorf("Ed25519 keys can only sign with signed attributes")
+		}
+		if si.EncryptedDigest, err = cert.PrivateKey.Sign(rand.Reader, contentDigest, hash); err != nil {
+			return nil, fmt.Errorf("failed to sign: %w", err)
+		}
+		return si, nil
+	}
+
+	attrBytes, err := marshalAttributeSet(attrs)
+	if err != nil {
+		return nil, err
+	}
+
+	// The signature covers the attributes encoded as a universal SET OF,
+	// while the SignerInfo stores them with an implicit [0] tag
+	signedBytes, err := asn1.Marshal(asn1.RawValue{Class: asn1.ClassUniversal, Tag: asn1.TagSet, IsCompound: true, Bytes: attrBytes})
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode signed attributes: %w", err)
+	}
+	si.AuthenticatedAttributes = asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 0, IsCompound: true, Bytes: attrBytes}
+
+	if si.EncryptedDigest, err = signBytes(cert.PrivateKey, hash, signedBytes); err != nil {
+		return nil, fmt.Errorf("failed to sign: %w", err)
+	}
+	return si, nil
+}
+
+// createSignedData builds a DER encoded ContentInfo holding a SignedData
+// with a single signer
+func createSignedData(cert *Certificate, opts cmsSignOptions) ([]byte, error) {
+	var attrs []cmsAttribute
+	if !opts.NoAttributes {
+		contentTypeAttr, err := newCMSAttribute(oidContentType, opts.ContentType)
+		if err != nil {
+			return nil, err
+		}
+		digestAttr, err := newCMSAttribute(oidMessageDigest, opts.MessageDigest)
+		if err != nil {
+			return nil, err
+		}
+		attrs = append([]cmsAttribute{contentTypeAttr, digestAttr}, opts.SignedAttributes...)
+	}
+
+	signer, err := createSignerInfo(cert, opts.Hash, attrs, opts.MessageDigest)
+	if err != nil {
+		return nil, err
+	}
+
+	inner := contentInfo{ContentType: opts.ContentType}
+	if len(opts.Content) > 0 {
+		inner.Content = asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 0, IsCompound: true, Bytes: opts.Content}
+	}
+
+	version := opts.Version
+	if version == 0 {
+		version = 1
+	}
+
+	sd := signedData{
+		Version:          version,
+		DigestAlgorithms: []pkix.AlgorithmIdentifier{signer.DigestAlgorithm},
+		ContentInfo:      inner,
+		SignerInfos:      []signerInfo{*signer},
+	}
+
+	// Embed the signing certificate followed by its issuers
+	if !opts.NoCertificates {
+		certBytes := append([]byte(nil), cert.Cert.Raw...)
+		for _, issuer := range cert.Chain {
+			certBytes = append(certBytes, issuer.Raw...)
+		}
+		sd.Certificates = asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 0, IsCompound: true, Bytes: certBytes}
+	}
+
+	return marshalSignedData(sd)
+}
+
+// marshalSignedData wraps a SignedData in a ContentInfo and encodes it
+func marshalSignedData(sd signedData) ([]byte, error) {
+	sdBytes, err := asn1.Marshal(sd)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode SignedData: %w", err)
+	}
+	der, err := asn1.Marshal(contentInfo{
+		ContentType: oidSignedData,
+		Content:     asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 0, IsCompound: true, Bytes: sdBytes},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode ContentInfo: %w", err)
+	}
+	return der, nil
+}
+
+// parseSignedData decodes a DER encoded ContentInfo holding a SignedData
+func parseSignedData(der []byte) (*signedData, error) {
+	var ci contentInfo
+	rest, err := asn1.Unmarshal(der, &ci)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode ContentInfo: %w", err)
+	}
+	if len(bytes.TrimRight(rest, "\x00")) > 0 {
+		return nil, fmt.Errorf("trailing data after ContentInfo")
+	}
+	if !ci.ContentType.Equal(oidSignedData) {
+		return nil, fmt.Errorf("content type %v is not SignedData", ci.ContentType)
+	}
+
+	var sd signedData
+	if _, err := asn1.Unmarshal(ci.Content.Bytes, &sd); err != nil {
+		return nil, fmt.Errorf("failed to decode SignedData: %w", err)
+	}
+	return &sd, nil
+}
+
+// setUnsignedAttributes replaces the unsigned attributes of a signer
+func setUnsignedAttributes(si *signerInfo, attrs []cmsAttribute) error {
+	if len(attrs) == 0 {
+		si.UnauthenticatedAttributes = asn1.RawValue{}
+		return nil
+	}
+	attrBytes, err := marshalAttributeSet(attrs)
+	if err != nil {
+		return err
+	}
+	si.UnauthenticatedAttributes = asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 1, IsCompound: true, Bytes: attrBytes}
+	return nil
+}
@@ -0,0 +1,324 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Report formats selected with --output
+const (
+	outputText  = "text"
+	outputJSON  = "json"
+	outputCSV   = "csv"
+	outputJUnit = "junit"
+)
+
+// Per-file outcomes of the sign and clear actions; the status action reports
+// the signature status instead
+const (
+	resultSigned    = "Signed"
+	resultSkipped   = "Skipped"
+	resultRemoved   = "Removed"
+	resultUnchanged = "Unchanged"
+	resultError     = "Error"
+)
+
+// Outcomes a dry run plans in place of resultSigned and resultRemoved, so a
+// report of a dry run is never read as files having been changed
+const (
+	resultWouldSign   = "WouldSign"
+	resultWouldRemove = "WouldRemove"
+)
+
+// outputFormats lists the report formats in the order they are documented
+var outputFormats = []string{outputText, outputJSON, outputCSV, outputJUnit}
+
+// isValidOutputFormat reports whether format is a supported --output value
+func isValidOutputFormat(format string) bool {
+	for _, f := range outputFormats {
+		if f == format {
+			return true
+		}
+	}
+	return false
+}
+
+// fileResult is the outcome of a batch action for one file
+type fileResult struct {
+	Path        string `json:"path"`
+	Action      string `json:"action"`
+	Status      string `json:"status"`
+	Type        string `json:"type,omitempty"`
+	Decision    string `json:"decision,omitempty"`
+	Reason      string `json:"reason,omitempty"`
+	Signer      string `json:"signer,omitempty"`
+	Fingerprint string `json:"fingerprint,omitempty"`
+	Timestamp   string `json:"timestamp,omitempty"`
+	Error       string `json:"error,omitempty"`
+	// Nested lists the signatures nested under a PE file's primary one
+	Nested []nestedResult `json:"nested,omitempty"`
+}
+
+// nestedResult is a signature nested under the primary one of a file
+type nestedResult struct {
+	Status      string `json:"status"`
+	Signer      string `json:"signer,omitempty"`
+	Fingerprint string `json:"fingerprint,omitempty"`
+	Timestamp   string `json:"timestamp,omitempty"`
+}
+
+// reportSummary totals the results of a batch action
+type reportSummary struct {
+	Action   string         `json:"action"`
+	Total    int            `json:"total"`
+	Errors   int            `json:"errors"`
+	Statuses map[string]int `json:"statuses"`
+	Duration float64        `json:"duration_seconds"`
+	// DryRun is set when nothing was changed and the results are the plan
+	DryRun bool `json:"dry_run,omitempty"`
+	// Certificate is the signing certificate a dry run would use
+	Certificate *certificatePlan `json:"certificate,omitempty"`
+}
+
+// newFileResult returns the result for path, with the signer details of a
+// signature status if there is one
+func newFileResult(path, action string, status *SignatureStatus) fileResult {
+	result := fileResult{Path: path, Action: action}
+	if status != nil {
+		result.Status = status.Status
+		result.Signer = status.SignerCertificate
+		result.Fingerprint = status.SignerFingerprint
+		if !status.TimestampTime.IsZero() {
+			result.Timestamp = status.TimestampTime.UTC().Format(time.RFC3339)
+		}
+		for _, nested := range status.Nested {
+			n := nestedResult{Status: nested.Status, Signer: nested.SignerCertificate, Fingerprint: nested.SignerFingerprint}
+			if !nested.TimestampTime.IsZero() {
+				n.Timestamp = nested.TimestampTime.UTC().Format(time.RFC3339)
+			}
+			result.Nested = append(result.Nested, n)
+		}
+	}
+	return result
+}
+
+// errorFileResult returns the result for a file the action failed on
+func errorFileResult(path, action string, err error) fileResult {
+	return fileResult{Path: path, Action: action, Status: resultError, Error: err.Error()}
+}
+
+// summarizeResults totals results per status
+func summarizeResults(action string, results []fileResult, duration time.Duration) reportSummary {
+	summary := reportSummary{Action: action, Total: len(results), Statuses: make(map[string]int), Duration: duration.Seconds()}
+	for _, result := range results {
+		summary.Statuses[result.Status]++
+		if result.Error != "" {
+			summary.Errors++
+		}
+	}
+	return summary
+}
+
+// checkResults returns an error carrying the exit code for the results of a
+// batch action: files the action failed on, tampered signatures and, when
+// requireSigned is set, every signature that is not Valid
+func checkResults(results []fileResult, requireSigned bool) error {
+	var failed, tampered, unsigned, untrusted int
+	for _, r := range results {
+		switch {
+		case r.Error != "":
+			failed++
+		case r.Status == StatusHashMismatch || r.Status == StatusBadSignature:
+			tampered++
+		case requireSigned && r.Status == StatusNotSigned:
+			unsigned++
+		case requireSigned && (r.Status == StatusUntrustedRoot || r.Status == StatusExpired):
+			untrusted++
+		}
+	}
+
+	code := exitOK
+	var problems []string
+	for _, p := range []struct {
+		count int
+		code  int
+		what  string
+	}{
+		{failed, exitPartialFailure, "could not be processed"},
+		{tampered, exitVerificationFailed, "failed verification"},
+		{unsigned, exitVerificationFailed, "are not signed"},
+		{untrusted, exitCertificateError, "have an untrusted or expired signer"},
+	} {
+		if p.count == 0 {
+			continue
+		}
+		problems = append(problems, fmt.Sprintf("%d of %d file(s) %s", p.count, len(results), p.what))
+		if p.code > code {
+			code = p.code
+		}
+	}
+
+	if code == exitOK {
+		return nil
+	}
+	return &exitError{code, errors.New(strings.Join(problems, "; "))}
+}
+
+// writeReport writes the results of a batch action in a machine-readable
+// format to w, and what the format has no room for to progress; the text
+// format is printed while the action runs instead
+func writeReport(w, progress io.Writer, format string, summary reportSummary, results []fileResult) error {
+	switch format {
+	case outputJSON:
+		return writeJSONReport(w, results, summary)
+	case outputCSV:
+		return writeCSVReport(w, progress, results, summary)
+	case outputJUnit:
+		return writeJUnitReport(w, results, summary)
+	}
+	return nil
+}
+
+// writeJSONReport writes {"results": [...], "summary": {...}}
+func writeJSONReport(w io.Writer, results []fileResult, summary reportSummary) error {
+	if results == nil {
+		results = []fileResult{}
+	}
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(struct {
+		Results []fileResult  `json:"results"`
+		Summary reportSummary `json:"summary"`
+	}{results, summary})
+}
+
+// writeCSVReport writes one row per file; CSV has no room for the summary,
+// so it goes to progress
+func writeCSVReport(w, progress io.Writer, results []fileResult, summary reportSummary) error {
+	cw := csv.NewWriter(w)
+	cw.Write([]string{"path", "action", "status", "type", "decision", "reason", "signer", "fingerprint", "timestamp", "error"})
+	for _, r := range results {
+		cw.Write([]string{r.Path, r.Action, r.Status, r.Type, r.Decision, r.Reason, r.Signer, r.Fingerprint, r.Timestamp, r.Error})
+	}
+	cw.Flush()
+	if err := cw.Error(); err != nil {
+		return err
+	}
+
+	action := summary.Action
+	if summary.DryRun {
+		action += " (dry run)"
+	}
+	fmt.Fprintf(progress, "%s: %d file(s), %d error(s)", action, summary.Total, summary.Errors)
+	statuses := make([]string, 0, len(summary.Statuses))
+	for status := range summary.Statuses {
+		statuses = append(statuses, status)
+	}
+	sort.Strings(statuses)
+	for _, status := range statuses {
+		fmt.Fprintf(progress, ", %s %d", status, summary.Statuses[status])
+	}
+	fmt.Fprintln(progress)
+	if summary.Certificate != nil {
+		fmt.Fprintf(progress, "certificate: %s\n", summary.Certificate)
+	}
+	return nil
+}
+
+// JUnit XML elements, in the subset understood by common CI servers
+type junitTestSuites struct {
+	XMLName xml.Name         `xml:"testsuites"`
+	Suites  []junitTestSuite `xml:"testsuite"`
+}
+
+type junitTestSuite struct {
+	Name       string          `xml:"name,attr"`
+	Tests      int             `xml:"tests,attr"`
+	Failures   int             `xml:"failures,attr"`
+	Errors     int             `xml:"errors,attr"`
+	Time       string          `xml:"time,attr"`
+	Timestamp  string          `xml:"timestamp,attr"`
+	Properties []junitProperty `xml:"properties>property,omitempty"`
+	Cases      []junitTestCase `xml:"testcase"`
+}
+
+type junitProperty struct {
+	Name  string `xml:"name,attr"`
+	Value string `xml:"value,attr"`
+}
+
+type junitTestCase struct {
+	Name      string        `xml:"name,attr"`
+	ClassName string        `xml:"classname,attr"`
+	Failure   *junitFailure `xml:"failure,omitempty"`
+	Error     *junitFailure `xml:"error,omitempty"`
+	SystemOut string        `xml:"system-out,omitempty"`
+}
+
+type junitFailure struct {
+	Message string `xml:"message,attr"`
+	Type    string `xml:"type,attr"`
+}
+
+// writeJUnitReport writes one test case per file. Errors are JUnit errors;
+// for the status action, a signature that is not Valid is a failure
+func writeJUnitReport(w io.Writer, results []fileResult, summary reportSummary) error {
+	suite := junitTestSuite{
+		Name:      "selfsign-path " + summary.Action,
+		Tests:     summary.Total,
+		Errors:    summary.Errors,
+		Time:      fmt.Sprintf("%.3f", summary.Duration),
+		Timestamp: time.Now().UTC().Format("2006-01-02T15:04:05"),
+	}
+	for _, r := range results {
+		tc := junitTestCase{Name: r.Path, ClassName: "selfsign-path." + r.Action}
+		switch {
+		case r.Error != "":
+			tc.Error = &junitFailure{Message: r.Error, Type: r.Status}
+		case r.Action == "status" && r.Status != StatusValid:
+			tc.Failure = &junitFailure{Message: "signature status is " + r.Status, Type: r.Status}
+			suite.Failures++
+		}
+		if r.Type != "" {
+			tc.SystemOut = fmt.Sprintf("type: %s\n", r.Type)
+		}
+		if r.Decision != "" {
+			tc.SystemOut += fmt.Sprintf("decision: %s (%s)\n", r.Decision, r.Reason)
+		}
+		if r.Signer != "" {
+			tc.SystemOut += fmt.Sprintf("signer: %s\nfingerprint: %s\n", r.Signer, r.Fingerprint)
+			if r.Timestamp != "" {
+				tc.SystemOut += fmt.Sprintf("timestamp: %s\n", r.Timestamp)
+			}
+		}
+		suite.Cases = append(suite.Cases, tc)
+	}
+	for status, count := range summary.Statuses {
+		suite.Properties = append(suite.Properties, junitProperty{Name: "status." + status, Value: fmt.Sprint(count)})
+	}
+	if summary.DryRun {
+		suite.Properties = append(suite.Properties, junitProperty{Name: "dry_run", Value: "true"})
+	}
+	if summary.Certificate != nil {
+		suite.Properties = append(suite.Properties, junitProperty{Name: "certificate", Value: summary.Certificate.String()})
+	}
+	sort.Slice(suite.Properties, func(i, j int) bool { return suite.Properties[i].Name < suite.Properties[j].Name })
+
+	if _, err := io.WriteString(w, xml.Header); err != nil {
+		return err
+	}
+	enc := xml.NewEncoder(w)
+	enc.Indent("", "  ")
+	if err := enc.Encode(junitTestSuites{Suites: []junitTestSuite{suite}}); err != nil {
+		return err
+	}
+	_, err := io.WriteString(w, "\n")
+	return err
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+	"time"
+)
+
+func testFileResults() []fileResult {
+	signed := &SignatureStatus{
+		Status:            StatusValid,
+		SignerCertificate: "LocalSign-SelfSigned",
+		SignerFingerprint: "ab12",
+		TimestampTime:     time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC),
+	}
+	return []fileResult{
+		newFileResult("app.exe", "status", signed),
+		newFileResult("lib.so", "status", &SignatureStatus{Status: StatusNotSigned}),
+		errorFileResult("broken.exe", "status", errors.New("truncated PE header")),
+	}
+}
+
+func TestJSONReport(t *testing.T) {
+	var buf bytes.Buffer
+	results := testFileResults()
+	if err := writeReport(&buf, io.Discard, outputJSON, summarizeResults("status", results, time.Second), results); err != nil {
+		t.Fatalf("Failed to write report: %v", err)
+	}
+
+	var report struct {
+		Results []fileResult
+		Summary reportSummary
+	}
+	if err := json.Unmarshal(buf.Bytes(), &report); err != nil {
+		t.Fatalf("Report is not valid JSON: %v\n%s", err, buf.String())
+	}
+	if len(report.Results) != 3 || report.Results[0].Timestamp != "2024-05-01T12:00:00Z" || report.Results[0].Fingerprint != "ab12" {
+		t.Errorf("Unexpected results %+v", report.Results)
+	}
+	if report.Summary.Total != 3 || report.Summary.Errors != 1 || report.Summary.Statuses[StatusValid] != 1 || report.Summary.Statuses[resultError] != 1 {
+		t.Errorf("Unexpected summary %+v", report.Summary)
+	}
+
+	// An empty batch is an empty list, not null
+	buf.Reset()
+	writeReport(&buf, io.Discard, outputJSON, summarizeResults("sign", nil, 0), nil)
+	if !bytes.Contains(buf.Bytes(), []byte(`"results": []`)) {
+		t.Errorf("Expected an empty results list, got %s", buf.String())
+	}
+}
+
+func TestCSVReport(t *testing.T) {
+	var buf, progress bytes.Buffer
+	results := testFileResults()
+	if err := writeReport(&buf, &progress, outputCSV, summarizeResults("status", results, time.Second), results); err != nil {
+		t.Fatalf("Failed to write report: %v", err)
+	}
+
+	rows, err := csv.NewReader(&buf).ReadAll()
+	if err != nil {
+		t.Fatalf("Report is not valid CSV: %v", err)
+	}
+	if len(rows) != 4 || rows[0][0] != "path" || rows[0][9] != "error" {
+		t.Fatalf("Expected a header and 3 rows, got %v", rows)
+	}
+	if rows[3][2] != resultError || rows[3][9] != "truncated PE header" {
+		t.Errorf("Unexpected error row %v", rows[3])
+	}
+	if !strings.HasPrefix(progress.String(), "status: 3 file(s), 1 error(s)") {
+		t.Errorf("Expected the summary on the progress output, got %q", progress.String())
+	}
+}
+
+func TestJUnitReport(t *testing.T) {
+	var buf bytes.Buffer
+	results := testFileResults()
+	if err := writeReport(&buf, io.Discard, outputJUnit, summarizeResults("status", results, time.Second), results); err != nil {
+		t.Fatalf("Failed to write report: %v", err)
+	}
+
+	var report junitTestSuites
+	if err := xml.Unmarshal(buf.Bytes(), &report); err != nil {
+		t.Fatalf("Report is not valid XML: %v\n%s", err, buf.String())
+	}
+	if len(report.Suites) != 1 {
+		t.Fatalf("Expected one test suite, got %d", len(report.Suites))
+	}
+	suite := report.Suites[0]
+	if suite.Tests != 3 || suite.Failures != 1 || suite.Errors != 1 || len(suite.Cases) != 3 {
+		t.Errorf("Unexpected suite counts: tests %d, failures %d, errors %d", suite.Tests, suite.Failures, suite.Errors)
+	}
+	if suite.Cases[0].Failure != nil || suite.Cases[0].Error != nil {
+		t.Error("Expected the Valid file to pass")
+	}
+	if suite.Cases[1].Failure == nil || suite.Cases[1].Failure.Type != StatusNotSigned {
+		t.Error("Expected the unsigned file to fail")
+	}
+	if suite.Cases[2].Error == nil || suite.Cases[2].Error.Message != "truncated PE header" {
+		t.Error("Expected the broken file to be an error")
+	}
+}
+
+func TestCheckResultsExitCodes(t *testing.T) {
+	valid := fileResult{Path: "a", Action: "status", Status: StatusValid}
+	unsigned := fileResult{Path: "b", Action: "status", Status: StatusNotSigned}
+	untrusted := fileResult{Path: "c", Action: "status", Status: StatusUntrustedRoot}
+	tampered := fileResult{Path: "d", Action: "status", Status: StatusHashMismatch}
+	failed := errorFileResult("e", "sign", errors.New("read-only file"))
+
+	tests := []struct {
+		name          string
+		results       []fileResult
+		requireSigned bool
+		want          int
+	}{
+		{"all valid", []fileResult{valid}, true, exitOK},
+		{"unsigned allowed", []fileResult{valid, unsigned, untrusted}, false, exitOK},
+		{"partial failure", []fileResult{valid, failed}, false, exitPartialFailure},
+		{"tampered", []fileResult{valid, tampered}, false, exitVerificationFailed},
+		{"unsigned required", []fileResult{valid, unsigned}, true, exitVerificationFailed},
+		{"untrusted required", []fileResult{unsigned, untrusted, failed}, true, exitCertificateError},
+		{"empty", nil, true, exitOK},
+	}
+	for _, tt := range tests {
+		err := checkResults(tt.results, tt.requireSigned)
+		got := exitOK
+		if err != nil {
+			got = exitCodeOf(err)
+		}
+		if got != tt.want {
+			t.Errorf("%s: expected exit code %d, got %d (%v)", tt.name, tt.want, got, err)
+		}
+	}
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"path"
+	"strings"
+)
+
+// defaultExtensions are the file extensions picked up when walking directories
+var defaultExtensions = []string{".exe", ".dll", ".msi", ".sys", ".com", ".ocx", ".scr", ".cpl"}
+
+// stringList is a flag that may be given several times, each value also
+// split at commas
+type stringList []string
+
+func (l *stringList) String() string { return strings.Join(*l, ",") }
+
+func (l *stringList) Set(value string) error {
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			*l = append(*l, item)
+		}
+	}
+	return nil
+}
+
+// fileSelection decides which files found by walking directories and
+// expanding patterns are processed
+type fileSelection struct {
+	// extensions are matched against files found in directories; nil means
+	// any file
+	extensions map[string]bool
+	// sniff also picks up executables found in directories whatever their
+	// name; it is off when --ext replaces the default extensions
+	sniff   bool
+	include []string
+	exclude []string
+}
+
+// newFileSelection builds a selection from --ext, --include and --exclude.
+// An --ext list starting with "+" extends the default extensions, otherwise it
+// replaces them, and "*" selects files of any extension
+func newFileSelection(ext string, include, exclude []string) (*fileSelection, error) {
+	for _, pattern := range append(append([]string(nil), include...), exclude...) {
+		if _, err := path.Match(strings.ReplaceAll(pattern, "**", "*"), ""); err != nil {
+			return nil, fmt.Errorf("invalid pattern %q: %w", pattern, err)
+		}
+	}
+	sel := &fileSelection{include: include, exclude: exclude, extensions: make(map[string]bool)}
+
+	list := strings.TrimSpace(ext)
+	if list == "" || strings.HasPrefix(list, "+") {
+		for _, e := range defaultExtensions {
+			sel.extensions[e] = true
+		}
+		sel.sniff = true
+		list = strings.TrimPrefix(list, "+")
+	}
+	for _, e := range strings.Split(list, ",") {
+		e = strings.ToLower(strings.TrimSpace(e))
+		switch {
+		case e == "":
+		case e == "*":
+			sel.extensions = nil
+			return sel, nil
+		case strings.HasPrefix(e, "."):
+			sel.extensions[e] = true
+		default:
+			sel.extensions["."+e] = true
+		}
+	}
+	return sel, nil
+}
+
+// matches reports whether the file at rel, a slash-separated path relative
+// to the directory or pattern base it was found under, passes --include and
+// --exclude
+func (s *fileSelection) matches(rel string) bool {
+	if len(s.include) > 0 && !matchAnyPattern(s.include, rel) {
+		return false
+	}
+	return !matchAnyPattern(s.exclude, rel)
+}
+
+// picks reports whether a file found by walking a directory is processed. It
+// must have a selected extension and hold what the extension promises, so a
+// text file named foo.exe is skipped, or else be an executable by content,
+// such as an extensionless ELF binary or a .node addon. Skipped files are
+// reported to w
+func (s *fileSelection) picks(w io.Writer, file, rel string) bool {
+	if !s.matches(rel) {
+		return false
+	}
+	if s.extensions == nil {
+		return true
+	}
+
+	ext := strings.ToLower(path.Ext(rel))
+	if !s.extensions[ext] {
+		return s.sniff && classifyFile(file).isExecutable()
+	}
+	if kind, ok := extensionKinds[ext]; ok {
+		if class := classifyFile(file); class.Kind != kind {
+			fmt.Fprintf(w, "Warning: Skipping %s: named %s but holds %s\n", file, ext, class)
+			return false
+		}
+	}
+	return true
+}
+
+// excludesDirectory reports whether a directory, and everything under it, is
+// excluded, so the walk can skip it
+func (s *fileSelection) excludesDirectory(rel string) bool {
+	return rel != "." && matchAnyPattern(s.exclude, rel)
+}
+
+// matchAnyPattern reports whether rel matches one of patterns. As in
+// .gitignore, a pattern without a slash matches the base name at any depth;
+// one with a slash matches the whole relative path
+func matchAnyPattern(patterns []string, rel string) bool {
+	for _, pattern := range patterns {
+		pattern = strings.TrimPrefix(strings.ReplaceAll(pattern, "\\", "/"), "./")
+		if !strings.Contains(pattern, "/") {
+			if ok, _ := path.Match(pattern, path.Base(rel)); ok {
+				return true
+			}
+			continue
+		}
+		if matchGlob(pattern, rel) {
+			return true
+		}
+	}
+	return false
+}
+
+// matchGlob reports whether the slash-separated name matches pattern, where
+// a "**" segment matches any number of path segments, including none, and
+// other segments are matched with path.Match
+func matchGlob(pattern, name string) bool {
+	return matchSegments(strings.Split(pattern, "/"), strings.Split(name, "/"))
+}
+
+func matchSegments(pattern, name []string) bool {
+	for len(pattern) > 0 {
+		if pattern[0] == "**" {
+			// Collapse repeated "**" and try every possible split
+			for len(pattern) > 0 && pattern[0] == "**" {
+				pattern = pattern[1:]
+			}
+			if len(pattern) == 0 {
+				return true
+			}
+			for i := 0; i <= len(name); i++ {
+				if matchSegments(pattern, name[i:]) {
+					return true
+				}
+			}
+			return false
+		}
+		if len(name) == 0 {
+			return false
+		}
+		if ok, _ := path.Match(pattern[0], name[0]); !ok {
+			return false
+		}
+		pattern, name = pattern[1:], name[1:]
+	}
+	return len(name) == 0
+}
+
+// splitGlobPattern splits a file pattern into the directory to start walking
+// from, the part of the pattern without wildcards, and the slash-separated
+// pattern for paths below it
+func splitGlobPattern(pattern string) (base, rest string) {
+	segments := strings.Split(strings.ReplaceAll(pattern, "\\", "/"), "/")
+	i := 0
+	for i < len(segments)-1 && !strings.ContainsAny(segments[i], "*?[") {
+		i++
+	}
+	base = strings.Join(segments[:i], "/")
+	switch {
+	case base == "" && i > 0:
+		base = "/"
+	case base == "":
+		base = "."
+	}
+	return base, strings.Join(segments[i:], "/")
+}
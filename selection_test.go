@@ -0,0 +1,162 @@
+package main
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+func TestMatchGlob(t *testing.T) {
+	tests := []struct {
+		pattern, name string
+		want          bool
+	}{
+		{"*.dll", "a.dll", true},
+		{"*.dll", "x/a.dll", false},
+		{"**/*.dll", "a.dll", true},
+		{"**/*.dll", "x/y/a.dll", true},
+		{"bin/**", "bin/x/a.dll", true},
+		{"bin/**", "lib/a.dll", false},
+		{"src/**/test/*.so", "src/test/a.so", true},
+		{"src/**/test/*.so", "src/a/b/test/a.so", true},
+		{"src/**/test/*.so", "src/a/b/test/c/a.so", false},
+		{"a/**/**/b", "a/b", true},
+		{"?.exe", "ab.exe", false},
+	}
+	for _, tt := range tests {
+		if got := matchGlob(tt.pattern, tt.name); got != tt.want {
+			t.Errorf("matchGlob(%q, %q) = %v, want %v", tt.pattern, tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestFileSelectionExtensions(t *testing.T) {
+	dir := t.TempDir()
+	pe := filepath.Join(dir, "app.EXE")
+	os.WriteFile(pe, buildTestPE(), 0644)
+	script := filepath.Join(dir, "run.ps1")
+	os.WriteFile(script, []byte("Write-Host hi\n"), 0644)
+
+	replaced, _ := newFileSelection("ps1, .JAR", nil, nil)
+	if !replaced.picks(io.Discard, script, "x/run.ps1") || !replaced.picks(io.Discard, filepath.Join(dir, "lib.jar"), "lib.jar") || replaced.picks(io.Discard, pe, "app.exe") {
+		t.Error("Expected --ext to replace the default extensions")
+	}
+
+	extended, _ := newFileSelection("+ps1", nil, nil)
+	if !extended.picks(io.Discard, script, "run.ps1") || !extended.picks(io.Discard, pe, "app.EXE") {
+		t.Error("Expected --ext + to extend the default extensions")
+	}
+
+	all, _ := newFileSelection("*", nil, nil)
+	if !all.picks(io.Discard, script, "README") {
+		t.Error("Expected --ext '*' to select every file")
+	}
+
+	// Files matched by a pattern are not filtered by extension
+	if !replaced.matches("app.exe") {
+		t.Error("Expected pattern matches to ignore the extension set")
+	}
+
+	if _, err := newFileSelection("", []string{"[bad"}, nil); err == nil {
+		t.Error("Expected an error for an invalid pattern")
+	}
+}
+
+func TestGetTargetFilesSelection(t *testing.T) {
+	root := t.TempDir()
+	pe := buildTestPE()
+	elf := append([]byte("\x7fELF\x02\x01\x01"), make([]byte, 57)...)
+	module := append([]byte(nil), elf...)
+	module[16] = elfTypeRelocatable
+	for file, content := range map[string][]byte{
+		"app.exe":           pe,
+		"bin/a.dll":         pe,
+		"bin/sub/b.dll":     pe,
+		"bin/sub/notes.txt": []byte("notes\n"),
+		"bin/tool":          elf,
+		"bin/driver.ko":     module,
+		"vendor/c.dll":      pe,
+		"vendor/deep/d.dll": pe,
+		"tests/e.dll":       pe,
+		"tests/fake.exe":    []byte("not a program\n"),
+	} {
+		path := filepath.Join(root, filepath.FromSlash(file))
+		os.MkdirAll(filepath.Dir(path), 0755)
+		os.WriteFile(path, content, 0644)
+	}
+
+	rel := func(files []string) []string {
+		var out []string
+		for _, file := range files {
+			r, _ := filepath.Rel(root, file)
+			out = append(out, filepath.ToSlash(r))
+		}
+		sort.Strings(out)
+		return out
+	}
+
+	tests := []struct {
+		name      string
+		patterns  []string
+		recursive bool
+		ext       string
+		include   []string
+		exclude   []string
+		want      []string
+	}{
+		{"glob", []string{"bin/*.dll"}, false, "", nil, nil, []string{"bin/a.dll"}},
+		{"recursive glob", []string{"bin/*.dll"}, true, "", nil, nil, []string{"bin/a.dll", "bin/sub/b.dll"}},
+		{"globstar", []string{"**/*.dll"}, false, "", nil, []string{"vendor/**"}, []string{"bin/a.dll", "bin/sub/b.dll", "tests/e.dll"}},
+		{"directory", []string{"."}, true, "", nil, []string{"vendor", "tests"}, []string{"app.exe", "bin/a.dll", "bin/sub/b.dll", "bin/tool"}},
+		{"include", []string{"."}, true, "", []string{"bin/**"}, nil, []string{"bin/a.dll", "bin/sub/b.dll", "bin/tool"}},
+		{"content", []string{"tests"}, false, "", nil, nil, []string{"tests/e.dll"}},
+		{"ext", []string{"bin"}, true, "txt", nil, nil, []string{"bin/sub/notes.txt"}},
+		{"kernel modules", []string{"bin"}, false, "+.ko", nil, nil, []string{"bin/a.dll", "bin/driver.ko", "bin/tool"}},
+	}
+
+	wd, _ := os.Getwd()
+	defer os.Chdir(wd)
+	os.Chdir(root)
+
+	for _, tt := range tests {
+		sel, err := newFileSelection(tt.ext, tt.include, tt.exclude)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		files, err := getTargetFiles(io.Discard, tt.patterns, tt.recursive, sel)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		for i, file := range files {
+			files[i] = filepath.Join(root, file)
+		}
+		if got := rel(files); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: got %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestWalkFilesFollowsFileLinks(t *testing.T) {
+	root := t.TempDir()
+	os.WriteFile(filepath.Join(root, "a.dll"), buildTestPE(), 0644)
+	os.Mkdir(filepath.Join(root, "sub"), 0755)
+	if err := os.Symlink("a.dll", filepath.Join(root, "link.dll")); err != nil {
+		t.Skipf("Symbolic links not supported: %v", err)
+	}
+	os.Symlink("sub", filepath.Join(root, "dir.dll"))
+	os.Symlink("missing.dll", filepath.Join(root, "broken.dll"))
+
+	sel, _ := newFileSelection("", nil, nil)
+	files, err := getFilesFromDirectory(io.Discard, root, true, sel)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(files)
+	want := []string{filepath.Join(root, "a.dll"), filepath.Join(root, "link.dll")}
+	if !reflect.DeepEqual(files, want) {
+		t.Errorf("Expected %v, got %v", want, files)
+	}
+}
@@ -1,29 +1,294 @@
 package main
 
+import (
+	"crypto"
+	"crypto/x509"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+)
+
 // SignatureStatus represents the status of a file's signature
 type SignatureStatus struct {
 	Status               string
 	SignerCertificate    string
+	SignerFingerprint    string
+	SignerExpires        time.Time
 	TimestampCertificate string
+	TimestampTime        time.Time
 	IsSelfSigned         bool
+	// Nested holds the signatures nested under the primary one of a PE file
+	Nested []*SignatureStatus
+}
+
+// signOptions controls how files are signed
+type signOptions struct {
+	// Append adds our signature as a nested signature instead of replacing existing ones
+	Append bool
+	// Digests lists the digest algorithms to sign with; the first is the primary signature
+	Digests []crypto.Hash
+	// TimestampURL is the RFC 3161 time-stamping authority to counter-sign with, if any
+	TimestampURL string
+	// Force signs files even when they are already validly signed by the certificate
+	Force bool
+	// Replace removes the signatures this tool made before signing; it implies Force
+	Replace bool
+}
+
+// defaultSignOptions returns the options used when nothing else is requested
+func defaultSignOptions() *signOptions {
+	return &signOptions{Digests: []crypto.Hash{crypto.SHA256}}
 }
 
-// signFile signs a file with the given certificate
-func signFile(filename string, cert *Certificate) error {
-	return signFilePlatform(filename, cert)
+// getSignOptions builds the signing options from the command line flags
+func getSignOptions() (*signOptions, error) {
+	digests, err := parseDigestList(*flagDigest)
+	if err != nil {
+		return nil, err
+	}
+	return &signOptions{
+		Append:       *flagAppend,
+		Digests:      digests,
+		TimestampURL: *flagTimestampURL,
+		Force:        *flagForce,
+		Replace:      *flagReplace,
+	}, nil
 }
 
-// getFileSignatureStatus checks the signature status of a file
-func getFileSignatureStatus(filename string) (*SignatureStatus, error) {
-	return getFileSignatureStatusPlatform(filename)
+// parseDigestList parses a comma separated list of digest algorithm names
+func parseDigestList(list string) ([]crypto.Hash, error) {
+	var digests []crypto.Hash
+	seen := make(map[crypto.Hash]bool)
+
+	for _, name := range strings.Split(list, ",") {
+		var hash crypto.Hash
+		switch strings.ToLower(strings.TrimSpace(name)) {
+		case "sha1":
+			hash = crypto.SHA1
+		case "sha256":
+			hash = crypto.SHA256
+		case "sha384":
+			hash = crypto.SHA384
+		case "sha512":
+			hash = crypto.SHA512
+		default:
+			return nil, fmt.Errorf("unsupported digest algorithm %q", name)
+		}
+		if !seen[hash] {
+			digests = append(digests, hash)
+			seen[hash] = true
+		}
+	}
+
+	return digests, nil
 }
 
-// removeSelfSignedSignature removes self-signed signatures from a file
-func removeSelfSignedSignature(filename string) (bool, error) {
-	return removeSelfSignedSignaturePlatform(filename)
+// signFile signs a file with the given certificate, choosing the signature
+// format by what the file holds rather than by its name
+func signFile(filename string, cert *Certificate, opts *signOptions) error {
+	// PE images, including .NET assemblies and EFI binaries, get an embedded
+	// Authenticode signature on every platform
+	if classifyFile(filename).Kind == fileKindPE {
+		return signPEFile(filename, cert, opts)
+	}
+	return signFilePlatform(filename, cert, opts)
+}
+
+// What signing does with a file, as decided by planSigning
+const (
+	signDecisionSign    = "sign"
+	signDecisionSkip    = "skip"
+	signDecisionResign  = "re-sign"
+	signDecisionReplace = "replace"
+)
+
+// signPlan is the decision for one file and why it was made
+type signPlan struct {
+	Decision string
+	Reason   string
+	// Status is the signature status found, nil when it was not checked
+	Status *SignatureStatus
+	// Cached is set when the status came from the digest cache
+	Cached bool
+	// Foreign is set when a file is skipped to keep another signer's
+	// signature; Status is then not ours, and is not cached
+	Foreign bool
 }
 
-// installCertificateToStore installs the certificate to the system trust store
-func installCertificateToStore(cert interface{}) error {
+// planSigning decides what signing does with a file without changing it.
+// Files already validly signed by cert, and time-stamped if a time-stamp is
+// requested, are skipped unless opts forces or replaces their signature.
+// Files the cache has seen signed that way are skipped without verifying
+// them, as long as cert is still trusted
+func planSigning(filename string, cert *Certificate, opts *signOptions, cache *digestCache) signPlan {
+	switch {
+	case opts.Replace:
+		return signPlan{Decision: signDecisionReplace, Reason: "--replace"}
+	case opts.Force:
+		return signPlan{Decision: signDecisionResign, Reason: "--force"}
+	}
+
+	if status, ok := cache.lookup(filename, signCacheContext(cert, opts)); ok && isStillTrusted(cert, status) {
+		return signPlan{Decision: signDecisionSkip, Reason: "already signed by " + status.SignerCertificate + ", cached", Status: status, Cached: true}
+	}
+
+	// Only whether cert made the signature matters, so no other certificate
+	// is needed to find the signer
+	status, err := getFileSignatureStatus(filename, []*x509.Certificate{cert.Cert})
+	switch {
+	case err != nil:
+		return signPlan{Decision: signDecisionSign, Reason: fmt.Sprintf("status unknown: %v", err)}
+	case status.Status == StatusNotSigned:
+		return signPlan{Decision: signDecisionSign, Reason: "not signed", Status: status}
+	case isPEFile(filename) && opts.Append:
+		// Appended signatures are nested under the ones already there
+		return planPESigning(filename, cert, opts, status)
+	case isPEFile(filename):
+		return planPEReplacing(filename, cert, opts, status)
+	case status.SignerCertificate == "":
+		return signPlan{Decision: signDecisionSign, Reason: "signed by an unknown certificate", Status: status}
+	case status.SignerFingerprint != certificateFingerprint(cert.Cert):
+		return signPlan{Decision: signDecisionSign, Reason: "signed by " + status.SignerCertificate, Status: status}
+	case status.Status != StatusValid:
+		return signPlan{Decision: signDecisionSign, Reason: "signature is " + status.Status, Status: status}
+	case opts.TimestampURL != "" && status.TimestampTime.IsZero():
+		return signPlan{Decision: signDecisionSign, Reason: "not time-stamped", Status: status}
+	}
+	return signPlan{Decision: signDecisionSkip, Reason: "already signed by " + status.SignerCertificate, Status: status}
+}
+
+// isStillTrusted re-runs the chain check of cert for a cached signature made
+// with it, as the trust store may have changed since the signature was cached
+func isStillTrusted(cert *Certificate, status *SignatureStatus) bool {
+	at := time.Now()
+	if !status.TimestampTime.IsZero() {
+		at = status.TimestampTime
+	}
+	return verifyCertificateTrust(cert.Cert, cert.Chain, at, x509.ExtKeyUsageCodeSigning) == StatusValid
+}
+
+// planPEReplacing decides whether a PE file needs signing without --append,
+// which replaces its whole certificate table. Files carrying a signature by
+// another signer, such as a vendor's, are skipped rather than losing it;
+// --append nests a signature under it, and --force or --replace replace it
+func planPEReplacing(filename string, cert *Certificate, opts *signOptions, primary *SignatureStatus) signPlan {
+	plan := planPESigning(filename, cert, opts, primary)
+	if plan.Decision == signDecisionSkip {
+		return plan
+	}
+	signer, err := foreignPESigner(filename, getOwnCertificates(cert.Cert))
+	switch {
+	case err != nil:
+		return signPlan{Decision: signDecisionSign, Reason: fmt.Sprintf("status unknown: %v", err), Status: primary}
+	case signer != "":
+		return signPlan{Decision: signDecisionSkip, Reason: "signed by " + signer + "; use --append to add a signature or --force to replace it",
+			Status: primary, Foreign: true}
+	}
+	return plan
+}
+
+// planPESigning decides whether a PE file, whose primary signature has the
+// given status, needs signing. It does unless cert made a valid signature,
+// nested or not, for every requested digest, time-stamped if a time-stamp
+// is requested
+func planPESigning(filename string, cert *Certificate, opts *signOptions, primary *SignatureStatus) signPlan {
+	own, err := verifyOwnPESignatures(filename, cert.Cert)
+	if err != nil {
+		return signPlan{Decision: signDecisionSign, Reason: fmt.Sprintf("status unknown: %v", err), Status: primary}
+	}
+	if len(own) == 0 {
+		return signPlan{Decision: signDecisionSign, Reason: "not signed by " + cert.Subject, Status: primary}
+	}
+
+	var found *SignatureStatus
+	for _, requested := range opts.Digests {
+		hash := cmsDigestFor(cert.Cert.PublicKey, requested)
+		status, ok := own[hash]
+		switch {
+		case !ok:
+			return signPlan{Decision: signDecisionSign, Reason: "no " + hash.String() + " signature", Status: primary}
+		case status.Status != StatusValid:
+			return signPlan{Decision: signDecisionSign, Reason: hash.String() + " signature is " + status.Status, Status: status}
+		case opts.TimestampURL != "" && status.TimestampTime.IsZero():
+			return signPlan{Decision: signDecisionSign, Reason: hash.String() + " signature is not time-stamped", Status: status}
+		}
+		if found == nil {
+			found = status
+		}
+	}
+	return signPlan{Decision: signDecisionSkip, Reason: "already signed by " + found.SignerCertificate, Status: found}
+}
+
+// getFileSignatureStatus checks the signature status of a file. Signatures
+// that leave out their certificate, like kernel module signatures, are
+// checked against ownCerts
+func getFileSignatureStatus(filename string, ownCerts []*x509.Certificate) (*SignatureStatus, error) {
+	if isPEFile(filename) {
+		return verifyPEFile(filename)
+	}
+	return getFileSignatureStatusPlatform(filename, ownCerts)
+}
+
+// removeSelfSignedSignature removes the signatures made with ownCerts, as
+// returned by getOwnCertificates, from a file
+func removeSelfSignedSignature(filename string, ownCerts []*x509.Certificate) (bool, error) {
+	return clearSelfSignedSignature(filename, ownCerts, false)
+}
+
+// hasSelfSignedSignature reports whether removeSelfSignedSignature would
+// remove a signature from a file, without changing it
+func hasSelfSignedSignature(filename string, ownCerts []*x509.Certificate) (bool, error) {
+	return clearSelfSignedSignature(filename, ownCerts, true)
+}
+
+// clearSelfSignedSignature removes this tool's signatures from a file, or
+// with dryRun only reports whether there are any
+func clearSelfSignedSignature(filename string, ownCerts []*x509.Certificate, dryRun bool) (bool, error) {
+	if isPEFile(filename) {
+		return removeOwnPESignatures(filename, ownCerts, dryRun)
+	}
+	return removeSelfSignedSignaturePlatform(filename, ownCerts, dryRun)
+}
+
+// trustInstallResult describes where an installed certificate landed
+type trustInstallResult struct {
+	// Installed lists the stores now holding the certificate
+	Installed []trustStoreStatus
+	// Failed lists the stores that could not be updated, with the reason
+	Failed []trustStoreStatus
+	// SystemTrusted is set once the system store was refreshed and checked
+	// to trust the certificate
+	SystemTrusted bool
+}
+
+// installCertificateToStore installs the certificate to the system trust
+// store; the result is never nil, and lists the failed stores even on error
+func installCertificateToStore(cert interface{}) (*trustInstallResult, error) {
 	return installCertificateToStorePlatform(cert)
+}
+
+// printTrustInstallResult reports the outcome of installing a certificate
+func printTrustInstallResult(w io.Writer, result *trustInstallResult) {
+	for _, store := range result.Failed {
+		fmt.Fprintf(w, "Warning: Failed to install certificate into %s %s: %s\n", store.Store, store.Location, store.Status)
+	}
+	for _, store := range result.Installed {
+		fmt.Fprintf(w, "Certificate installed into %s %s (%s)\n", store.Store, store.Location, store.Status)
+	}
+	if len(result.Installed) > 0 && !result.SystemTrusted {
+		fmt.Fprintf(w, "Note: Certificate may not be trusted system-wide without administrator privileges.\n")
+	}
+}
+
+// uninstallCertificatesFromStore removes the certificates this tool installed
+// into the trust store, only those with the given subject names if any are
+// given, and describes what was removed
+func uninstallCertificatesFromStore(names []string) ([]string, error) {
+	return uninstallCertificatesPlatform(names)
+}
+
+// isCertificateInstalled reports whether the certificate is in the trust store
+func isCertificateInstalled(cert *x509.Certificate) bool {
+	return isCertificateInstalledPlatform(cert)
 }
\ No newline at end of file
@@ -4,178 +4,229 @@ package main
 
 import (
 	"crypto/x509"
+	"errors"
 	"fmt"
 	"os"
-	"os/exec"
-	"path/filepath"
-	"strings"
-	"time"
 )
 
-// signFilePlatform signs a file on Linux using a simulated approach
-func signFilePlatform(filename string, cert *Certificate) error {
-	// On Linux, there's no standard code signing like Windows Authenticode
-	// We'll create a detached signature file similar to GPG signatures
-	
-	signatureFile := filename + ".sig"
-	
-	// Create a simple signature file indicating the file is signed
-	sigContent := fmt.Sprintf("SIGNED_BY=%s\nTIMESTAMP=%s\nCERT_SUBJECT=%s\nPLATFORM=linux\n", 
-		cert.Subject, 
-		time.Now().Format(time.RFC3339),  // Use current timestamp
-		cert.Cert.Subject.String())
-	
-	if err := os.WriteFile(signatureFile, []byte(sigContent), 0644); err != nil {
-		return fmt.Errorf("failed to create signature file: %w", err)
-	}
-	
-	return nil
+// signFilePlatform signs a non-PE file on Linux
+func signFilePlatform(filename string, cert *Certificate, opts *signOptions) error {
+	// PE images are handled by signPEFile with an embedded Authenticode signature.
+	// Kernel modules get an appended module signature as produced by sign-file,
+	// and anything else, other ELF files included, a detached filename.p7s
+	if isKernelModule(filename) {
+		return signELFFile(filename, cert, opts)
+	}
+	return signDetachedFile(filename, cert, opts)
 }
 
 // getFileSignatureStatusPlatform checks signature status on Linux
-func getFileSignatureStatusPlatform(filename string) (*SignatureStatus, error) {
-	// Check if our simple signature file exists
-	signatureFile := filename + ".sig"
-	
-	if _, err := os.Stat(signatureFile); os.IsNotExist(err) {
-		return &SignatureStatus{
-			Status: "NotSigned",
-		}, nil
-	}
-	
-	// Read signature file
-	sigContent, err := os.ReadFile(signatureFile)
-	if err != nil {
-		return &SignatureStatus{
-			Status: "Error reading signature",
-		}, nil
-	}
-	
-	lines := strings.Split(string(sigContent), "\n")
-	status := &SignatureStatus{
-		Status: "Valid",
-		IsSelfSigned: true,
-	}
-	
-	for _, line := range lines {
-		if strings.HasPrefix(line, "SIGNED_BY=") {
-			status.SignerCertificate = strings.TrimPrefix(line, "SIGNED_BY=")
-		} else if strings.HasPrefix(line, "CERT_SUBJECT=") {
-			subject := strings.TrimPrefix(line, "CERT_SUBJECT=")
-			// Check if self-signed (simplified check)
-			status.IsSelfSigned = strings.Contains(subject, "LocalSign")
-		}
+func getFileSignatureStatusPlatform(filename string, ownCerts []*x509.Certificate) (*SignatureStatus, error) {
+	if isKernelModule(filename) {
+		return verifyELFFile(filename, ownCerts)
 	}
-	
-	return status, nil
+	return verifyDetachedFile(filename)
 }
 
-// removeSelfSignedSignaturePlatform removes self-signed signatures on Linux
-func removeSelfSignedSignaturePlatform(filename string) (bool, error) {
-	signatureFile := filename + ".sig"
-	
-	// Check if signature file exists and is self-signed
-	status, err := getFileSignatureStatusPlatform(filename)
-	if err != nil {
-		return false, err
-	}
-	
-	if status.Status == "NotSigned" {
-		return false, nil
-	}
-	
-	if status.IsSelfSigned {
-		if err := os.Remove(signatureFile); err != nil {
-			return false, fmt.Errorf("failed to remove signature file: %w", err)
+// removeSelfSignedSignaturePlatform removes self-signed signatures on Linux,
+// or with dryRun reports whether it would
+func removeSelfSignedSignaturePlatform(filename string, ownCerts []*x509.Certificate, dryRun bool) (bool, error) {
+	if isKernelModule(filename) {
+		removed, err := removeOwnELFSignature(filename, ownCerts, dryRun)
+		if err != nil {
+			return false, err
 		}
-		return true, nil
+		// Older versions wrote detached signatures for ELF files too
+		detachedRemoved, err := removeDetachedSignature(filename, ownCerts, dryRun)
+		return removed || detachedRemoved, err
 	}
-	
-	return false, nil
+	return removeDetachedSignature(filename, ownCerts, dryRun)
+}
+
+// linuxCertificateDirs are the common system certificate directories on Linux,
+// with the tool compiling each into the system store and its output bundle
+var linuxCertificateDirs = []*caDirectoryStore{
+	// Debian/Ubuntu
+	{dir: "/usr/local/share/ca-certificates", refresh: []string{"update-ca-certificates"}, bundle: "/etc/ssl/certs/ca-certificates.crt"},
+	// Red Hat/CentOS/Fedora, where /etc/ssl/certs is a link to the extracted bundles
+	{dir: "/etc/pki/ca-trust/source/anchors", refresh: []string{"update-ca-trust", "extract"}, bundle: "/etc/pki/ca-trust/extracted/pem/tls-ca-bundle.pem"},
+	// Plain OpenSSL hashed directory
+	{dir: "/etc/ssl/certs", refresh: []string{"openssl", "rehash", "/etc/ssl/certs"}},
 }
 
-// installCertificateToStorePlatform installs certificate to Linux certificate store
-func installCertificateToStorePlatform(certInterface interface{}) error {
+// installCertificateToStorePlatform installs certificate to Linux certificate
+// store and the browser and Java stores found, reporting where it landed
+func installCertificateToStorePlatform(certInterface interface{}) (*trustInstallResult, error) {
+	result := &trustInstallResult{}
 	cert, ok := certInterface.(*x509.Certificate)
 	if !ok {
-		return fmt.Errorf("invalid certificate type")
+		return result, fmt.Errorf("invalid certificate type")
 	}
 
 	// Try to install to system certificate store
 	// Different distributions have different locations and tools
-	return installCertificateLinuxSystem(cert)
+	stores, _ := detectLinuxTrustStores()
+	installCertificateLinuxSystem(cert, stores, result)
+	if !result.SystemTrusted {
+		// If system installation fails, install to user directory
+		if err := installCertificateLinuxUser(cert, result); err != nil {
+			return result, err
+		}
+	}
+
+	// Browsers and Java keep their own stores; failing to update one of them
+	// should not fail the install
+	for _, store := range stores {
+		switch store.(type) {
+		case *nssStore, *javaKeyStore:
+			installIntoTrustStore(store, cert, result, "installed")
+		}
+	}
+	return result, nil
 }
 
-// installCertificateLinuxSystem tries to install certificate to system store
-func installCertificateLinuxSystem(cert *x509.Certificate) error {
-	// Common certificate directories on Linux
-	certDirs := []string{
-		"/usr/local/share/ca-certificates",
-		"/etc/ssl/certs",
-		"/etc/pki/ca-trust/source/anchors",
-	}
-
-	certName := fmt.Sprintf("selfsign-path-%s.crt", cert.Subject.CommonName)
-	
-	// Try each directory
-	for _, certDir := range certDirs {
-		if _, err := os.Stat(certDir); err != nil {
-			continue // Directory doesn't exist
+// installIntoTrustStore installs cert into store and verifies it is there,
+// recording the outcome in result
+func installIntoTrustStore(store linuxTrustStore, cert *x509.Certificate, result *trustInstallResult, status string) bool {
+	err := store.Install(cert)
+	if err == nil {
+		var installed bool
+		if installed, err = store.Contains(cert); err == nil && !installed {
+			err = fmt.Errorf("certificate missing after install")
 		}
-		
-		certPath := filepath.Join(certDir, certName)
-		
-		// Try to write certificate
-		if err := os.WriteFile(certPath, cert.Raw, 0644); err != nil {
-			continue // Can't write to this directory
+	}
+	if err != nil {
+		result.Failed = append(result.Failed, trustStoreStatus{Store: store.Kind(), Location: store.Location(), Status: err.Error()})
+		return false
+	}
+	result.Installed = append(result.Installed, trustStoreStatus{Store: store.Kind(), Location: store.Location(), Status: status})
+	return true
+}
+
+// installCertificateLinuxSystem tries to install certificate to system store,
+// through p11-kit where available and otherwise into the first certificate
+// directory whose refreshed system store then trusts it
+func installCertificateLinuxSystem(cert *x509.Certificate, stores []linuxTrustStore, result *trustInstallResult) {
+	for _, store := range stores {
+		switch store := store.(type) {
+		case *p11KitStore:
+			result.SystemTrusted = installIntoTrustStore(store, cert, result, "installed, verified with trust extract")
+		case *caDirectoryStore:
+			if !store.user {
+				result.SystemTrusted = installIntoTrustStore(store, cert, result, "installed, "+store.trustedBy())
+			}
+		}
+		if result.SystemTrusted {
+			return
 		}
-		
-		// Try to update certificate store
-		updateCertStore(certDir)
-		
-		fmt.Printf("Certificate installed to: %s\n", certPath)
-		return nil
-	}
-	
-	// If system installation fails, install to user directory
-	return installCertificateLinuxUser(cert)
+	}
 }
 
 // installCertificateLinuxUser installs certificate to user certificate store
-func installCertificateLinuxUser(cert *x509.Certificate) error {
-	homeDir, err := os.UserHomeDir()
+func installCertificateLinuxUser(cert *x509.Certificate, result *trustInstallResult) error {
+	certDir, err := userCertificateDirectory()
 	if err != nil {
 		return fmt.Errorf("failed to get user home directory: %w", err)
 	}
-	
-	// Create user certificate directory
-	certDir := filepath.Join(homeDir, ".local", "share", "ca-certificates")
-	if err := os.MkdirAll(certDir, 0755); err != nil {
-		return fmt.Errorf("failed to create user certificate directory: %w", err)
-	}
-	
-	certName := fmt.Sprintf("selfsign-path-%s.crt", cert.Subject.CommonName)
-	certPath := filepath.Join(certDir, certName)
-	
-	if err := os.WriteFile(certPath, cert.Raw, 0644); err != nil {
-		return fmt.Errorf("failed to write certificate to user directory: %w", err)
-	}
-	
-	fmt.Printf("Certificate installed to user directory: %s\n", certPath)
-	fmt.Printf("Note: Certificate may not be trusted system-wide without administrator privileges.\n")
-	
+
+	store := &caDirectoryStore{dir: certDir, user: true}
+	if !installIntoTrustStore(store, cert, result, "installed, "+store.trustedBy()) {
+		return fmt.Errorf("failed to install certificate to user directory: %s", result.Failed[len(result.Failed)-1].Status)
+	}
 	return nil
 }
 
-// updateCertStore runs commands to update the certificate store
-func updateCertStore(certDir string) {
-	// Try different update commands based on the certificate directory
-	switch {
-	case strings.Contains(certDir, "ca-certificates"):
-		// Debian/Ubuntu
-		exec.Command("update-ca-certificates").Run()
-	case strings.Contains(certDir, "ca-trust"):
-		// Red Hat/CentOS/Fedora
-		exec.Command("update-ca-trust").Run()
-	}
-}
\ No newline at end of file
+// isCertificateInstalledPlatform reports whether the certificate is installed
+// into any of the trust stores found
+func isCertificateInstalledPlatform(cert *x509.Certificate) bool {
+	stores, _ := detectLinuxTrustStores()
+	for _, store := range stores {
+		if installed, err := store.Contains(cert); err == nil && installed {
+			return true
+		}
+	}
+	return false
+}
+
+// uninstallCertificatesPlatform removes this tool's anchors from every trust
+// store an install may have written them to and returns what was removed
+func uninstallCertificatesPlatform(names []string) ([]string, error) {
+	stores, _ := detectLinuxTrustStores()
+
+	var removed []string
+	var errs []error
+	for _, store := range stores {
+		storeRemoved, err := store.Uninstall(names)
+		removed = append(removed, storeRemoved...)
+		if err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return removed, errors.Join(errs...)
+}
+
+// trustStoreStatusesPlatform reports whether cert is installed in each trust
+// store found on Linux
+func trustStoreStatusesPlatform(cert *x509.Certificate) []trustStoreStatus {
+	stores, unavailable := detectLinuxTrustStores()
+
+	var statuses []trustStoreStatus
+	for _, store := range stores {
+		status := trustStoreStatus{Store: store.Kind(), Location: store.Location(), Status: "not installed"}
+		installed, err := store.Contains(cert)
+		switch {
+		case err != nil:
+			status.Status = fmt.Sprintf("error: %v", err)
+		case installed:
+			status.Status = "installed"
+		}
+		statuses = append(statuses, status)
+	}
+	return append(statuses, unavailable...)
+}
+
+// trustInstallPlanPlatform lists the stores that installing a new root CA
+// would update, without changing them
+func trustInstallPlanPlatform() []trustStoreStatus {
+	stores, unavailable := detectLinuxTrustStores()
+	root := os.Geteuid() == 0
+
+	var plan []trustStoreStatus
+	haveSystem := false
+	for _, store := range stores {
+		status := trustStoreStatus{Store: store.Kind(), Location: store.Location(), Status: "would install"}
+		system := false
+		switch store := store.(type) {
+		case *p11KitStore:
+			system = true
+		case *caDirectoryStore:
+			if store.user {
+				continue
+			}
+			system = true
+		}
+		if system {
+			// Only the first system store that takes the certificate is used
+			if haveSystem {
+				continue
+			}
+			haveSystem = true
+			if !root {
+				status.Status = "would install if run as root"
+			}
+		}
+		plan = append(plan, status)
+	}
+
+	if !haveSystem || !root {
+		if userDir, err := userCertificateDirectory(); err == nil {
+			user := &caDirectoryStore{dir: userDir, user: true}
+			status := trustStoreStatus{Store: user.Kind(), Location: user.Location(), Status: "would install"}
+			if haveSystem {
+				status.Status = "would install if the system store fails"
+			}
+			plan = append(plan, status)
+		}
+	}
+	return append(plan, unavailable...)
+}
@@ -0,0 +1,255 @@
+//go:build linux
+
+package main
+
+import (
+	"encoding/pem"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// useTestTrustStore redirects the system and user certificate directories to
+// temporary ones and turns off every other trust store of the machine. The
+// system directory is compiled into a bundle like update-ca-certificates does
+func useTestTrustStore(t *testing.T) (systemDir, userDir string) {
+	t.Helper()
+	systemDir = t.TempDir()
+	bundle := filepath.Join(t.TempDir(), "ca-certificates.crt")
+	home := t.TempDir()
+	t.Setenv("HOME", home)
+	t.Setenv("JAVA_HOME", "")
+
+	savedDirs, savedTrust, savedCertutil := linuxCertificateDirs, p11KitTrustCommand, nssCertutilCommand
+	savedJavaHomes, savedJavaStores := javaHomeGlobs, javaSystemKeyStores
+	linuxCertificateDirs = []*caDirectoryStore{
+		{dir: filepath.Join(t.TempDir(), "missing")},
+		{dir: systemDir, refresh: []string{"sh", "-c", `cat "$0"/*.crt > "$1" 2>/dev/null || true`, systemDir, bundle}, bundle: bundle},
+	}
+	p11KitTrustCommand, nssCertutilCommand = "", ""
+	javaHomeGlobs, javaSystemKeyStores = nil, nil
+	t.Cleanup(func() {
+		linuxCertificateDirs, p11KitTrustCommand, nssCertutilCommand = savedDirs, savedTrust, savedCertutil
+		javaHomeGlobs, javaSystemKeyStores = savedJavaHomes, savedJavaStores
+	})
+	return systemDir, filepath.Join(home, ".local", "share", "ca-certificates")
+}
+
+func TestTrustInstallUninstall(t *testing.T) {
+	systemDir, userDir := useTestTrustStore(t)
+
+	first := newTestCertificate(t, "LocalSign-Test")
+	second := newTestCertificate(t, "LocalSign-Other")
+	for _, cert := range []*Certificate{first, second} {
+		result, err := installCertificateToStore(cert.Cert)
+		if err != nil {
+			t.Fatalf("Failed to install %s: %v", cert.Subject, err)
+		}
+		if !result.SystemTrusted || len(result.Installed) != 1 || result.Installed[0].Location != systemDir {
+			t.Errorf("Expected %s verified in the system directory, got %+v", cert.Subject, result)
+		}
+		if !isCertificateInstalled(cert.Cert) {
+			t.Errorf("Expected %s to be reported as installed", cert.Subject)
+		}
+	}
+
+	// A stale anchor from the user fallback directory is found too
+	stale := newTestCertificate(t, "LocalSign-Root-CA")
+	if err := installCertificateLinuxUser(stale.Cert, &trustInstallResult{}); err != nil {
+		t.Fatalf("Failed to install into the user directory: %v", err)
+	}
+
+	// Other anchors in the directory are left alone
+	foreign := filepath.Join(systemDir, "vendor-root.crt")
+	os.WriteFile(foreign, first.Cert.Raw, 0644)
+
+	removed, err := uninstallCertificatesFromStore([]string{"LocalSign-Test"})
+	if err != nil || len(removed) != 1 {
+		t.Fatalf("Expected one certificate removed by name, got %v (%v)", removed, err)
+	}
+	if isCertificateInstalled(first.Cert) || !isCertificateInstalled(second.Cert) {
+		t.Error("Expected only the named certificate to be removed")
+	}
+
+	removed, err = uninstallCertificatesFromStore(nil)
+	if err != nil || len(removed) != 2 {
+		t.Fatalf("Expected the remaining two certificates removed, got %v (%v)", removed, err)
+	}
+	if isCertificateInstalled(second.Cert) || isCertificateInstalled(stale.Cert) {
+		t.Error("Expected every installed certificate to be removed")
+	}
+	if _, err := os.Stat(filepath.Join(userDir, "selfsign-path-LocalSign-Root-CA.crt")); !os.IsNotExist(err) {
+		t.Error("Expected the user directory anchor to be removed")
+	}
+	if _, err := os.Stat(foreign); err != nil {
+		t.Error("Expected certificates of other tools to be kept")
+	}
+}
+
+func TestTrustInstallVerification(t *testing.T) {
+	systemDir, userDir := useTestTrustStore(t)
+	cert := newTestCertificate(t, "LocalSign-Root-CA")
+	certName := "selfsign-path-LocalSign-Root-CA.crt"
+
+	// update-ca-certificates reads PEM only
+	systemStore := linuxCertificateDirs[1]
+	result, err := installCertificateToStore(cert.Cert)
+	if err != nil || !result.SystemTrusted {
+		t.Fatalf("Failed to install: %+v (%v)", result, err)
+	}
+	if data, _ := os.ReadFile(filepath.Join(systemDir, certName)); !strings.HasPrefix(string(data), "-----BEGIN CERTIFICATE-----") {
+		t.Error("Expected the anchor to be written as PEM")
+	}
+	uninstallCertificatesFromStore(nil)
+
+	// A failing refresh tool, or a bundle left without the certificate, is
+	// not reported as trusted and falls back to the user directory
+	for _, refresh := range [][]string{{"false"}, {"true"}} {
+		systemStore.refresh = refresh
+		result, err = installCertificateToStore(cert.Cert)
+		if err != nil {
+			t.Fatalf("Expected the user directory fallback, got %v", err)
+		}
+		if result.SystemTrusted || len(result.Failed) != 1 || result.Failed[0].Location != systemDir {
+			t.Errorf("Expected the system directory to fail with %v, got %+v", refresh, result)
+		}
+		if len(result.Installed) != 1 || result.Installed[0].Location != userDir {
+			t.Errorf("Expected only the user directory to hold the certificate, got %+v", result.Installed)
+		}
+		if _, err := os.Stat(filepath.Join(systemDir, certName)); !os.IsNotExist(err) {
+			t.Error("Expected the unverified anchor to be removed again")
+		}
+	}
+}
+
+func TestTrustJavaKeyStore(t *testing.T) {
+	useTestTrustStore(t)
+
+	javaHome := t.TempDir()
+	t.Setenv("JAVA_HOME", javaHome)
+	keyStore := filepath.Join(javaHome, "lib", "security", "cacerts")
+	os.MkdirAll(filepath.Dir(keyStore), 0755)
+
+	vendor := newTestCertificate(t, "Vendor Root")
+	data, err := encodeJavaTrustStore([]javaTrustedCert{{Alias: "vendor root [jdk]", Cert: vendor.Cert}}, javaTrustStorePassword, false)
+	if err != nil {
+		t.Fatalf("Failed to encode keystore: %v", err)
+	}
+	os.WriteFile(keyStore, data, 0644)
+
+	cert := newTestCertificate(t, "LocalSign-Root-CA")
+	result, err := installCertificateToStore(cert.Cert)
+	if err != nil {
+		t.Fatalf("Failed to install: %v", err)
+	}
+	if len(result.Installed) != 2 || result.Installed[1].Location != keyStore {
+		t.Errorf("Expected the system directory and the keystore in the result, got %+v", result.Installed)
+	}
+
+	data, _ = os.ReadFile(keyStore)
+	entries, hasMAC, err := decodeJavaTrustStore(data, javaTrustStorePassword)
+	if err != nil || hasMAC || len(entries) != 2 {
+		t.Fatalf("Expected 2 entries without MAC, got %d (MAC %v, %v)", len(entries), hasMAC, err)
+	}
+	if entries[1].Alias != "selfsign-path-localsign-root-ca" || !entries[1].Cert.Equal(cert.Cert) {
+		t.Errorf("Unexpected entry %q", entries[1].Alias)
+	}
+
+	statuses := trustStoreStatusesPlatform(cert.Cert)
+	found := false
+	for _, status := range statuses {
+		if status.Store == "Java keystore" {
+			found = status.Location == keyStore && status.Status == "installed"
+		}
+	}
+	if !found {
+		t.Errorf("Expected the keystore reported as installed, got %+v", statuses)
+	}
+
+	if _, err := uninstallCertificatesFromStore(nil); err != nil {
+		t.Fatalf("Failed to uninstall: %v", err)
+	}
+	data, _ = os.ReadFile(keyStore)
+	entries, _, err = decodeJavaTrustStore(data, javaTrustStorePassword)
+	if err != nil || len(entries) != 1 || entries[0].Alias != "vendor root [jdk]" {
+		t.Errorf("Expected only the vendor entry to be left, got %d (%v)", len(entries), err)
+	}
+}
+
+func TestParseP11KitList(t *testing.T) {
+	output := `pkcs11:id=%AA%BB;type=cert
+    type: certificate
+    label: LocalSign-Root-CA
+    trust: anchor
+    category: authority
+
+pkcs11:id=%CC%DD;type=cert
+    type: certificate
+    label: ISRG Root X1
+    trust: anchor
+    category: authority
+`
+	anchors := parseP11KitList([]byte(output))
+	if len(anchors) != 2 {
+		t.Fatalf("Expected 2 anchors, got %d", len(anchors))
+	}
+	if anchors[0].uri != "pkcs11:id=%AA%BB;type=cert" || anchors[0].label != "LocalSign-Root-CA" {
+		t.Errorf("Unexpected first anchor %+v", anchors[0])
+	}
+	if !strings.HasPrefix(anchors[1].uri, "pkcs11:id=%CC%DD") || anchors[1].label != "ISRG Root X1" {
+		t.Errorf("Unexpected second anchor %+v", anchors[1])
+	}
+}
+
+func TestP11KitUninstallOwnAnchors(t *testing.T) {
+	useTestTrustStore(t)
+	dir := t.TempDir()
+
+	// A fake "trust" tool extracting a fixed bundle and logging removals
+	own := newTestCertificate(t, "LocalSign-Test")
+	lookalike := newTestCertificate(t, "LocalSign-Test")
+	if err := saveCertificateFiles(io.Discard, own.Subject, own.Cert, own.PrivateKey); err != nil {
+		t.Fatalf("Failed to save certificate: %v", err)
+	}
+	bundle := filepath.Join(dir, "anchors.pem")
+	var pemData []byte
+	for _, cert := range []*Certificate{own, lookalike} {
+		pemData = append(pemData, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Cert.Raw})...)
+	}
+	os.WriteFile(bundle, pemData, 0644)
+	removedLog := filepath.Join(dir, "removed.pem")
+	script := filepath.Join(dir, "trust")
+	os.WriteFile(script, []byte(`#!/bin/sh
+case "$1" in
+extract) eval last=\${$#}; cp "`+bundle+`" "$last" ;;
+anchor) cat "$3" >> "`+removedLog+`" ;;
+esac
+`), 0755)
+
+	store := &p11KitStore{command: script}
+	removed, err := store.Uninstall(nil)
+	if err != nil || len(removed) != 1 {
+		t.Fatalf("Expected one anchor removed, got %v (%v)", removed, err)
+	}
+	certs, err := readCertificateFile(removedLog)
+	if err != nil || len(certs) != 1 || !certs[0].Equal(own.Cert) {
+		t.Errorf("Expected only the stored certificate removed, not the one sharing its name: %v", err)
+	}
+}
+
+func TestNSSUninstallReportsErrors(t *testing.T) {
+	// A fake certutil that lists the nickname but fails to delete it
+	script := filepath.Join(t.TempDir(), "certutil")
+	os.WriteFile(script, []byte(`#!/bin/sh
+[ "$1" = "-D" ] && { echo "SEC_ERROR_READ_ONLY" >&2; exit 1; }
+exit 0
+`), 0755)
+
+	store := &nssStore{command: script, db: t.TempDir()}
+	removed, err := store.Uninstall([]string{"LocalSign-Test"})
+	if err == nil || len(removed) != 0 {
+		t.Errorf("Expected a failed deletion to be reported, got %v (%v)", removed, err)
+	}
+}
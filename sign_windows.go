@@ -3,6 +3,7 @@
 package main
 
 import (
+	"crypto/sha1"
 	"crypto/x509"
 	"fmt"
 	"os"
@@ -10,7 +11,6 @@ import (
 	"path/filepath"
 	"strings"
 	"syscall"
-	"time"
 )
 
 // Windows API constants
@@ -30,98 +30,43 @@ var (
 	procCertFreeCertificateContext = crypt32.NewProc("CertFreeCertificateContext")
 )
 
-// signFilePlatform signs a file on Windows using a simulated approach
-func signFilePlatform(filename string, cert *Certificate) error {
-	// On Windows, we would typically use SignTool.exe or the Windows Authenticode APIs
-	// For this implementation, we'll create a simple signature file alongside the binary
-	// This is a simplified approach since full Authenticode signing requires more complex implementation
-	
-	signatureFile := filename + ".sig"
-	
-	// Create a simple signature file indicating the file is signed
-	sigContent := fmt.Sprintf("SIGNED_BY=%s\nTIMESTAMP=%s\nCERT_SUBJECT=%s\n", 
-		cert.Subject, 
-		time.Now().Format(time.RFC3339),  // Use current timestamp
-		cert.Cert.Subject.String())
-	
-	if err := os.WriteFile(signatureFile, []byte(sigContent), 0644); err != nil {
-		return fmt.Errorf("failed to create signature file: %w", err)
-	}
-	
-	return nil
+// signFilePlatform signs a non-PE file on Windows with a detached CMS signature
+func signFilePlatform(filename string, cert *Certificate, opts *signOptions) error {
+	// PE images are handled by signPEFile with an embedded Authenticode signature.
+	// Other files can't carry one, so we write filename.p7s alongside them
+	return signDetachedFile(filename, cert, opts)
 }
 
 // getFileSignatureStatusPlatform checks signature status on Windows
-func getFileSignatureStatusPlatform(filename string) (*SignatureStatus, error) {
-	// Check if our simple signature file exists
-	signatureFile := filename + ".sig"
-	
-	if _, err := os.Stat(signatureFile); os.IsNotExist(err) {
-		return &SignatureStatus{
-			Status: "NotSigned",
-		}, nil
-	}
-	
-	// Read signature file
-	sigContent, err := os.ReadFile(signatureFile)
-	if err != nil {
-		return &SignatureStatus{
-			Status: "Error reading signature",
-		}, nil
-	}
-	
-	lines := strings.Split(string(sigContent), "\n")
-	status := &SignatureStatus{
-		Status: "Valid",
-		IsSelfSigned: true,
-	}
-	
-	for _, line := range lines {
-		if strings.HasPrefix(line, "SIGNED_BY=") {
-			status.SignerCertificate = strings.TrimPrefix(line, "SIGNED_BY=")
-		} else if strings.HasPrefix(line, "CERT_SUBJECT=") {
-			subject := strings.TrimPrefix(line, "CERT_SUBJECT=")
-			// Check if self-signed (simplified check)
-			status.IsSelfSigned = strings.Contains(subject, "LocalSign")
-		}
-	}
-	
-	return status, nil
+func getFileSignatureStatusPlatform(filename string, ownCerts []*x509.Certificate) (*SignatureStatus, error) {
+	return verifyDetachedFile(filename)
 }
 
-// removeSelfSignedSignaturePlatform removes self-signed signatures on Windows
-func removeSelfSignedSignaturePlatform(filename string) (bool, error) {
-	signatureFile := filename + ".sig"
-	
-	// Check if signature file exists and is self-signed
-	status, err := getFileSignatureStatusPlatform(filename)
-	if err != nil {
-		return false, err
-	}
-	
-	if status.Status == "NotSigned" {
-		return false, nil
-	}
-	
-	if status.IsSelfSigned {
-		if err := os.Remove(signatureFile); err != nil {
-			return false, fmt.Errorf("failed to remove signature file: %w", err)
-		}
-		return true, nil
-	}
-	
-	return false, nil
+// removeSelfSignedSignaturePlatform removes self-signed signatures on Windows,
+// or with dryRun reports whether it would
+func removeSelfSignedSignaturePlatform(filename string, ownCerts []*x509.Certificate, dryRun bool) (bool, error) {
+	return removeDetachedSignature(filename, ownCerts, dryRun)
 }
 
 // installCertificateToStorePlatform installs certificate to Windows certificate store
-func installCertificateToStorePlatform(certInterface interface{}) error {
+func installCertificateToStorePlatform(certInterface interface{}) (*trustInstallResult, error) {
+	result := &trustInstallResult{}
 	cert, ok := certInterface.(*x509.Certificate)
 	if !ok {
-		return fmt.Errorf("invalid certificate type")
+		return result, fmt.Errorf("invalid certificate type")
 	}
 
 	// Try to use PowerShell to install the certificate (fallback approach)
-	return installCertificateWithPowerShell(cert)
+	store := trustStoreStatus{Store: "Trusted Root", Location: `Cert:\LocalMachine\Root`}
+	if err := installCertificateWithPowerShell(cert); err != nil {
+		store.Status = err.Error()
+		result.Failed = append(result.Failed, store)
+		return result, err
+	}
+	store.Status = "installed, verified by thumbprint"
+	result.Installed = append(result.Installed, store)
+	result.SystemTrusted = true
+	return result, nil
 }
 
 // installCertificateWithPowerShell uses PowerShell to install the certificate
@@ -152,6 +97,10 @@ func installCertificateWithPowerShell(cert *x509.Certificate) error {
 			$store.Open([System.Security.Cryptography.X509Certificates.OpenFlags]::ReadWrite)
 			$store.Add($cert)
 			$store.Close()
+			if (-not (Test-Path "Cert:\LocalMachine\Root\$($cert.Thumbprint)")) {
+				Write-Error 'Certificate missing from the store after adding it'
+				exit 1
+			}
 			Write-Host 'Certificate installed successfully'
 		} catch {
 			Write-Error $_.Exception.Message
@@ -166,6 +115,74 @@ func installCertificateWithPowerShell(cert *x509.Certificate) error {
 	return nil
 }
 
+// isCertificateInstalledPlatform reports whether the certificate is in the
+// machine or user Trusted Root store
+func isCertificateInstalledPlatform(cert *x509.Certificate) bool {
+	thumbprint := fmt.Sprintf("%X", sha1.Sum(cert.Raw))
+	cmd := exec.Command("powershell", "-NoProfile", "-Command",
+		fmt.Sprintf(`if ((Test-Path Cert:\LocalMachine\Root\%[1]s) -or (Test-Path Cert:\CurrentUser\Root\%[1]s)) { exit 0 } else { exit 1 }`, thumbprint))
+	return cmd.Run() == nil
+}
+
+// trustStoreStatusesPlatform reports whether cert is in the machine and user
+// Trusted Root stores
+func trustStoreStatusesPlatform(cert *x509.Certificate) []trustStoreStatus {
+	thumbprint := fmt.Sprintf("%X", sha1.Sum(cert.Raw))
+
+	var statuses []trustStoreStatus
+	for _, location := range []string{"LocalMachine", "CurrentUser"} {
+		status := trustStoreStatus{Store: "Trusted Root", Location: `Cert:\` + location + `\Root`, Status: "not installed"}
+		cmd := exec.Command("powershell", "-NoProfile", "-Command",
+			fmt.Sprintf(`if (Test-Path %s\%s) { exit 0 } else { exit 1 }`, status.Location, thumbprint))
+		if cmd.Run() == nil {
+			status.Status = "installed"
+		}
+		statuses = append(statuses, status)
+	}
+	return statuses
+}
+
+// trustInstallPlanPlatform lists the stores that installing a new root CA
+// would update, without changing them
+func trustInstallPlanPlatform() []trustStoreStatus {
+	return []trustStoreStatus{{Store: "Trusted Root", Location: `Cert:\LocalMachine\Root`, Status: "would install (needs administrator)"}}
+}
+
+// uninstallCertificatesPlatform removes certificates from the machine and user
+// Trusted Root stores: those with the given subject names, or every
+// "LocalSign-" certificate when no names are given
+func uninstallCertificatesPlatform(names []string) ([]string, error) {
+	filter := `$_.Subject -like 'CN=LocalSign-*'`
+	if len(names) > 0 {
+		quoted := make([]string, len(names))
+		for i, name := range names {
+			quoted[i] = "'CN=" + strings.ReplaceAll(name, "'", "''") + "'"
+		}
+		filter = fmt.Sprintf("@(%s) -contains $_.Subject", strings.Join(quoted, ","))
+	}
+
+	cmd := exec.Command("powershell", "-NoProfile", "-Command", fmt.Sprintf(`
+		$ErrorActionPreference = 'Stop'
+		foreach ($location in 'LocalMachine', 'CurrentUser') {
+			Get-ChildItem "Cert:\$location\Root" | Where-Object { %s } | ForEach-Object {
+				Remove-Item $_.PSPath
+				Write-Output "$location\Root: $($_.Subject) ($($_.Thumbprint))"
+			}
+		}`, filter))
+
+	output, err := cmd.CombinedOutput()
+	var removed []string
+	for _, line := range strings.Split(strings.TrimSpace(string(output)), "\n") {
+		if line = strings.TrimSpace(line); strings.Contains(line, `\Root: `) {
+			removed = append(removed, line)
+		}
+	}
+	if err != nil {
+		return removed, fmt.Errorf("failed to remove certificates via PowerShell: %w, output: %s", err, string(output))
+	}
+	return removed, nil
+}
+
 // isRunningAsAdmin checks if the current process is running as administrator
 func isRunningAsAdmin() bool {
 	// Use Windows API IsUserAnAdmin from shell32.dll
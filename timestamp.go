@@ -0,0 +1,274 @@
+package main
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"time"
+)
+
+// RFC 3161 object identifiers
+var (
+	oidTSTInfo              = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 16, 1, 4}
+	oidSigningCertificateV2 = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 16, 2, 47}
+	oidRFC3161CounterSign   = asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 311, 3, 3, 1}
+)
+
+// Content types used on the wire by RFC 3161 over HTTP
+const (
+	timestampQueryContentType = "application/timestamp-query"
+	timestampReplyContentType = "application/timestamp-reply"
+)
+
+// timestampClient is used for requests to a time-stamping authority
+var timestampClient = &http.Client{Timeout: 30 * time.Second}
+
+// messageImprint is the hash of the data being time-stamped
+type messageImprint struct {
+	HashAlgorithm pkix.AlgorithmIdentifier
+	HashedMessage []byte
+}
+
+// timeStampReq is an RFC 3161 TimeStampReq
+type timeStampReq struct {
+	Version        int
+	MessageImprint messageImprint
+	ReqPolicy      asn1.ObjectIdentifier `asn1:"optional"`
+	Nonce          *big.Int              `asn1:"optional"`
+	CertReq        bool                  `asn1:"optional,default:false"`
+	Extensions     []pkix.Extension      `asn1:"optional,tag:0"`
+}
+
+// pkiStatusInfo reports whether a time-stamp request was granted
+type pkiStatusInfo struct {
+	Status       int
+	StatusString []asn1.RawValue `asn1:"optional"`
+	FailInfo     asn1.BitString  `asn1:"optional"`
+}
+
+// timeStampResp is an RFC 3161 TimeStampResp
+type timeStampResp struct {
+	Status         pkiStatusInfo
+	TimeStampToken asn1.RawValue `asn1:"optional"`
+}
+
+// tsAccuracy is the accuracy of the time in a TSTInfo
+type tsAccuracy struct {
+	Seconds int `asn1:"optional"`
+	Millis  int `asn1:"optional,tag:0"`
+	Micros  int `asn1:"optional,tag:1"`
+}
+
+// tstInfo is the signed content of a time-stamp token
+type tstInfo struct {
+	Version        int
+	Policy         asn1.ObjectIdentifier
+	MessageImprint messageImprint
+	SerialNumber   *big.Int
+	GenTime        time.Time        `asn1:"generalized"`
+	Accuracy       tsAccuracy       `asn1:"optional"`
+	Ordering       bool             `asn1:"optional,default:false"`
+	Nonce          *big.Int         `asn1:"optional"`
+	TSA            asn1.RawValue    `asn1:"optional,tag:0"`
+	Extensions     []pkix.Extension `asn1:"optional,tag:1"`
+}
+
+// timestampInfo describes a verified time-stamp token
+type timestampInfo struct {
+	Time   time.Time
+	Signer *x509.Certificate
+	Status string
+}
+
+// requestTimestamp asks the TSA at url for a token over the given data
+func requestTimestamp(url string, data []byte, hash crypto.Hash) ([]byte, error) {
+	hashAlg, err := digestAlgorithmID(hash)
+	if err != nil {
+		return nil, err
+	}
+	h := hash.New()
+	h.Write(data)
+	imprint := messageImprint{HashAlgorithm: hashAlg, HashedMessage: h.Sum(nil)}
+
+	nonce, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 64))
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate nonce: %w", err)
+	}
+
+	reqDER, err := asn1.Marshal(timeStampReq{
+		Version:        1,
+		MessageImprint: imprint,
+		Nonce:          nonce,
+		CertReq:        true,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode time-stamp request: %w", err)
+	}
+
+	resp, err := timestampClient.Post(url, timestampQueryContentType, bytes.NewReader(reqDER))
+	if err != nil {
+		return nil, fmt.Errorf("time-stamp request failed: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("time-stamp server returned %s", resp.Status)
+	}
+	respDER, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read time-stamp response: %w", err)
+	}
+
+	var tsResp timeStampResp
+	if _, err := asn1.Unmarshal(respDER, &tsResp); err != nil {
+		return nil, fmt.Errorf("failed to decode time-stamp response: %w", err)
+	}
+	// 0 is granted, 1 is grantedWithMods
+	if tsResp.Status.Status > 1 {
+		return nil, fmt.Errorf("time-stamp request rejected with status %d", tsResp.Status.Status)
+	}
+	if len(tsResp.TimeStampToken.FullBytes) == 0 {
+		return nil, fmt.Errorf("time-stamp response has no token")
+	}
+
+	token := tsResp.TimeStampToken.FullBytes
+	info, err := parseTimestampToken(token)
+	if err != nil {
+		return nil, err
+	}
+	if info.Nonce == nil || info.Nonce.Cmp(nonce) != 0 {
+		return nil, fmt.Errorf("time-stamp response nonce does not match request")
+	}
+	if !bytes.Equal(info.MessageImprint.HashedMessage, imprint.HashedMessage) {
+		return nil, fmt.Errorf("time-stamp response is for different data")
+	}
+
+	return token, nil
+}
+
+// parseTimestampToken extracts the TSTInfo from a time-stamp token
+func parseTimestampToken(token []byte) (*tstInfo, error) {
+	sd, err := parseSignedData(token)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse time-stamp token: %w", err)
+	}
+	content, err := timestampTokenContent(sd)
+	if err != nil {
+		return nil, err
+	}
+
+	var info tstInfo
+	if _, err := asn1.Unmarshal(content, &info); err != nil {
+		return nil, fmt.Errorf("failed to decode TSTInfo: %w", err)
+	}
+	return &info, nil
+}
+
+// timestampTokenContent returns the DER encoded TSTInfo held in a token
+func timestampTokenContent(sd *signedData) ([]byte, error) {
+	if !sd.ContentInfo.ContentType.Equal(oidTSTInfo) {
+		return nil, fmt.Errorf("time-stamp token does not contain TSTInfo")
+	}
+	var content []byte
+	if _, err := asn1.Unmarshal(sd.ContentInfo.Content.Bytes, &content); err != nil {
+		return nil, fmt.Errorf("failed to decode time-stamp token content: %w", err)
+	}
+	return content, nil
+}
+
+// addTimestamp requests a token over a signature value and stores it as an
+// RFC 3161 counter-signature in the signer's unsigned attributes
+func addTimestamp(sd *signedData, url string) error {
+	si := &sd.SignerInfos[0]
+	hash, err := hashFromAlgorithmID(si.DigestAlgorithm)
+	if err != nil {
+		return err
+	}
+
+	token, err := requestTimestamp(url, si.EncryptedDigest, hash)
+	if err != nil {
+		return err
+	}
+
+	attrs, err := parseAttributes(si.UnauthenticatedAttributes)
+	if err != nil {
+		return err
+	}
+	attrs = append(attrs, cmsAttribute{
+		Type:   oidRFC3161CounterSign,
+		Values: asn1.RawValue{Class: asn1.ClassUniversal, Tag: asn1.TagSet, IsCompound: true, Bytes: token},
+	})
+	return setUnsignedAttributes(si, attrs)
+}
+
+// verifySignerTimestamp verifies the RFC 3161 counter-signature of a signer,
+// returning nil when the signer carries no time-stamp
+func verifySignerTimestamp(si *signerInfo) (*timestampInfo, error) {
+	attrs, err := parseAttributes(si.UnauthenticatedAttributes)
+	if err != nil {
+		return nil, err
+	}
+	tokenValue, ok := findAttribute(attrs, oidRFC3161CounterSign)
+	if !ok {
+		return nil, nil
+	}
+
+	sd, err := parseSignedData(tokenValue.FullBytes)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse time-stamp token: %w", err)
+	}
+	if len(sd.SignerInfos) != 1 {
+		return nil, fmt.Errorf("time-stamp token must have one signer")
+	}
+	content, err := timestampTokenContent(sd)
+	if err != nil {
+		return nil, err
+	}
+	var info tstInfo
+	if _, err := asn1.Unmarshal(content, &info); err != nil {
+		return nil, fmt.Errorf("failed to decode TSTInfo: %w", err)
+	}
+
+	// The token must cover this signer's signature value
+	imprintHash, err := hashFromAlgorithmID(info.MessageImprint.HashAlgorithm)
+	if err != nil {
+		return nil, err
+	}
+	h := imprintHash.New()
+	h.Write(si.EncryptedDigest)
+	if !bytes.Equal(h.Sum(nil), info.MessageImprint.HashedMessage) {
+		return nil, errMessageDigestMismatch
+	}
+
+	certs, err := x509.ParseCertificates(sd.Certificates.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse time-stamp certificates: %w", err)
+	}
+	tsaSigner, err := findSignerCertificate(certs, sd.SignerInfos[0].IssuerAndSerialNumber)
+	if err != nil {
+		return nil, err
+	}
+
+	tokenHash, err := hashFromAlgorithmID(sd.SignerInfos[0].DigestAlgorithm)
+	if err != nil {
+		return nil, err
+	}
+	th := tokenHash.New()
+	th.Write(content)
+	if err := verifySignerInfo(&sd.SignerInfos[0], tsaSigner, th.Sum(nil)); err != nil {
+		return nil, err
+	}
+
+	return &timestampInfo{
+		Time:   info.GenTime,
+		Signer: tsaSigner,
+		Status: verifyCertificateTrust(tsaSigner, certs, info.GenTime, x509.ExtKeyUsageTimeStamping),
+	}, nil
+}
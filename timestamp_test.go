@@ -0,0 +1,121 @@
+package main
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"io"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// newTestTSA starts a time-stamping authority whose clock is offset from now
+func newTestTSA(t *testing.T, offset time.Duration) (*Certificate, string) {
+	t.Helper()
+
+	privateKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("Failed to generate key: %v", err)
+	}
+	template := x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		Subject:               pkix.Name{CommonName: "LocalSign-TSA-Test"},
+		NotBefore:             time.Now().Add(-24 * time.Hour),
+		NotAfter:              time.Now().AddDate(1, 0, 0),
+		KeyUsage:              x509.KeyUsageDigitalSignature,
+		ExtraExtensions:       []pkix.Extension{timestampingExtKeyUsageExtension()},
+		BasicConstraintsValid: true,
+	}
+	certDER, err := x509.CreateCertificate(rand.Reader, &template, &template, &privateKey.PublicKey, privateKey)
+	if err != nil {
+		t.Fatalf("Failed to create certificate: %v", err)
+	}
+	cert, _ := x509.ParseCertificate(certDER)
+	tsaCert := &Certificate{Subject: cert.Subject.CommonName, Cert: cert, PrivateKey: privateKey}
+
+	tsa := &timestampAuthority{cert: tsaCert}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		reqDER, _ := io.ReadAll(r.Body)
+		respDER, err := tsa.respond(reqDER, time.Now().Add(offset))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", timestampReplyContentType)
+		w.Write(respDER)
+	}))
+	t.Cleanup(server.Close)
+
+	return tsaCert, server.URL
+}
+
+func TestTimestampedSignature(t *testing.T) {
+	cert := newTestCertificate(t, "LocalSign-Test")
+	tsaCert, url := newTestTSA(t, 0)
+
+	roots := x509.NewCertPool()
+	roots.AddCert(cert.Cert)
+	roots.AddCert(tsaCert.Cert)
+	signatureVerifyRoots = roots
+	t.Cleanup(func() { signatureVerifyRoots = nil })
+
+	filename := signTestPE(t, cert)
+	opts := &signOptions{Digests: []crypto.Hash{crypto.SHA256}, TimestampURL: url}
+	if err := signFile(filename, cert, opts); err != nil {
+		t.Fatalf("Failed to sign with time-stamp: %v", err)
+	}
+
+	status, err := getFileSignatureStatus(filename, nil)
+	if err != nil {
+		t.Fatalf("Failed to get status: %v", err)
+	}
+	if status.Status != StatusValid {
+		t.Errorf("Expected Valid, got %s", status.Status)
+	}
+	if status.TimestampCertificate != "LocalSign-TSA-Test" {
+		t.Errorf("Expected time-stamp certificate to be reported, got %q", status.TimestampCertificate)
+	}
+	if time.Since(status.TimestampTime) > time.Minute {
+		t.Errorf("Unexpected time-stamp time %v", status.TimestampTime)
+	}
+}
+
+func TestTimestampOutlivesSigningCertificate(t *testing.T) {
+	expired := newTestCertificate(t, "LocalSign-Expired")
+
+	// Re-issue the test certificate so it expired an hour ago
+	template := *expired.Cert
+	template.NotBefore = time.Now().Add(-3 * time.Hour)
+	template.NotAfter = time.Now().Add(-time.Hour)
+	der, err := x509.CreateCertificate(rand.Reader, &template, &template, expired.PrivateKey.Public(), expired.PrivateKey)
+	if err != nil {
+		t.Fatalf("Failed to create expired certificate: %v", err)
+	}
+	expired.Cert, _ = x509.ParseCertificate(der)
+
+	// The TSA clock is set to when the certificate was still valid
+	tsaCert, url := newTestTSA(t, -2*time.Hour)
+	roots := x509.NewCertPool()
+	roots.AddCert(expired.Cert)
+	roots.AddCert(tsaCert.Cert)
+	signatureVerifyRoots = roots
+	t.Cleanup(func() { signatureVerifyRoots = nil })
+
+	filename := signTestPE(t, expired)
+	if status, _ := getFileSignatureStatus(filename, nil); status.Status != StatusExpired {
+		t.Errorf("Expected Expired without a time-stamp, got %s", status.Status)
+	}
+
+	opts := &signOptions{Digests: []crypto.Hash{crypto.SHA256}, TimestampURL: url}
+	if err := signFile(filename, expired, opts); err != nil {
+		t.Fatalf("Failed to sign with time-stamp: %v", err)
+	}
+	if status, _ := getFileSignatureStatus(filename, nil); status.Status != StatusValid {
+		t.Errorf("Expected Valid with a time-stamp inside the validity period, got %s", status.Status)
+	}
+}
@@ -0,0 +1,693 @@
+//go:build linux
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// linuxTrustStore is a place on Linux that trust anchors can be installed into
+type linuxTrustStore interface {
+	// Kind names the kind of store, as shown by "trust status"
+	Kind() string
+	// Location is the directory, database or file holding the anchors
+	Location() string
+	Install(cert *x509.Certificate) error
+	Contains(cert *x509.Certificate) (bool, error)
+	// Uninstall removes this tool's anchors, only those for the given subject
+	// names if any are given, and describes what was removed
+	Uninstall(names []string) ([]string, error)
+}
+
+// External tools used to manage trust stores, variables so tests can turn
+// them off
+var (
+	p11KitTrustCommand = "trust"
+	nssCertutilCommand = "certutil"
+)
+
+// javaHomeGlobs match JDK installations whose cacerts may be updated
+var javaHomeGlobs = []string{"/usr/lib/jvm/*", "/usr/java/*", "/opt/java/*", "/opt/*jdk*"}
+
+// javaSystemKeyStores are distribution-wide Java keystores
+var javaSystemKeyStores = []string{"/etc/ssl/certs/java/cacerts", "/etc/pki/java/cacerts"}
+
+// managedJavaKeyStoreDirs hold keystores generated from the system trust
+// store by update-ca-certificates or update-ca-trust, which would undo edits
+var managedJavaKeyStoreDirs = []string{"/etc/ssl/certs/java/", "/etc/pki/ca-trust/extracted/"}
+
+// trustAnchorName is the file name stem, NSS nickname and Java alias used for
+// a certificate installed by this tool
+func trustAnchorName(commonName string) string {
+	return "selfsign-path-" + commonName
+}
+
+// userCertificateDirectory is the fallback directory used when no system
+// directory is writable
+func userCertificateDirectory() (string, error) {
+	homeDir, err := os.UserHomeDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(homeDir, ".local", "share", "ca-certificates"), nil
+}
+
+// detectLinuxTrustStores returns the trust stores found on this machine, and
+// the status of stores that were found but cannot be managed
+func detectLinuxTrustStores() ([]linuxTrustStore, []trustStoreStatus) {
+	var stores []linuxTrustStore
+	var unavailable []trustStoreStatus
+
+	if path, err := exec.LookPath(p11KitTrustCommand); err == nil && p11KitTrustCommand != "" {
+		stores = append(stores, &p11KitStore{command: path})
+	}
+	for _, store := range linuxCertificateDirs {
+		if _, err := os.Stat(store.dir); err == nil {
+			stores = append(stores, store)
+		}
+	}
+	if userDir, err := userCertificateDirectory(); err == nil {
+		if _, err := os.Stat(userDir); err == nil {
+			stores = append(stores, &caDirectoryStore{dir: userDir, user: true})
+		}
+	}
+
+	certutil, certutilErr := exec.LookPath(nssCertutilCommand)
+	for _, db := range findNSSDatabases() {
+		if certutilErr != nil || nssCertutilCommand == "" {
+			unavailable = append(unavailable, trustStoreStatus{Store: "NSS database", Location: db, Status: "unavailable: certutil (NSS tools) not found"})
+			continue
+		}
+		stores = append(stores, &nssStore{command: certutil, db: db})
+	}
+
+	for _, keyStore := range findJavaKeyStores() {
+		if managed := isManagedJavaKeyStore(keyStore); managed {
+			unavailable = append(unavailable, trustStoreStatus{Store: "Java keystore", Location: keyStore, Status: "follows the system trust store"})
+			continue
+		}
+		data, err := os.ReadFile(keyStore)
+		if err != nil {
+			unavailable = append(unavailable, trustStoreStatus{Store: "Java keystore", Location: keyStore, Status: fmt.Sprintf("unavailable: %v", err)})
+			continue
+		}
+		if bytes.HasPrefix(data, jksMagic) {
+			unavailable = append(unavailable, trustStoreStatus{Store: "Java keystore", Location: keyStore, Status: "unavailable: JKS format, only PKCS#12 is supported"})
+			continue
+		}
+		stores = append(stores, &javaKeyStore{path: keyStore})
+	}
+
+	return stores, unavailable
+}
+
+// findNSSDatabases returns the shared NSS database and the Firefox and
+// Thunderbird profile databases of the current user
+func findNSSDatabases() []string {
+	homeDir, err := os.UserHomeDir()
+	if err != nil {
+		return nil
+	}
+
+	candidates := []string{filepath.Join(homeDir, ".pki", "nssdb")}
+	for _, pattern := range []string{
+		".mozilla/firefox/*",
+		"snap/firefox/common/.mozilla/firefox/*",
+		".var/app/org.mozilla.firefox/.mozilla/firefox/*",
+		".thunderbird/*",
+	} {
+		matches, _ := filepath.Glob(filepath.Join(homeDir, pattern))
+		candidates = append(candidates, matches...)
+	}
+
+	// Only SQL databases are supported; the legacy cert8.db format is not
+	var dbs []string
+	for _, dir := range candidates {
+		if _, err := os.Stat(filepath.Join(dir, "cert9.db")); err == nil {
+			dbs = append(dbs, dir)
+		}
+	}
+	return dbs
+}
+
+// findJavaKeyStores returns the cacerts files of the installed JDKs, with
+// symbolic links resolved and duplicates removed
+func findJavaKeyStores() []string {
+	var javaHomes []string
+	if javaHome := os.Getenv("JAVA_HOME"); javaHome != "" {
+		javaHomes = append(javaHomes, javaHome)
+	}
+	globs := append([]string(nil), javaHomeGlobs...)
+	if homeDir, err := os.UserHomeDir(); err == nil {
+		globs = append(globs, filepath.Join(homeDir, ".sdkman", "candidates", "java", "*"), filepath.Join(homeDir, ".jdks", "*"))
+	}
+	for _, pattern := range globs {
+		matches, _ := filepath.Glob(pattern)
+		javaHomes = append(javaHomes, matches...)
+	}
+
+	candidates := append([]string(nil), javaSystemKeyStores...)
+	for _, javaHome := range javaHomes {
+		candidates = append(candidates,
+			filepath.Join(javaHome, "lib", "security", "cacerts"),
+			filepath.Join(javaHome, "jre", "lib", "security", "cacerts"))
+	}
+
+	seen := make(map[string]bool)
+	var keyStores []string
+	for _, candidate := range candidates {
+		resolved, err := filepath.EvalSymlinks(candidate)
+		if err != nil || seen[resolved] {
+			continue
+		}
+		if info, err := os.Stat(resolved); err != nil || !info.Mode().IsRegular() {
+			continue
+		}
+		seen[resolved] = true
+		keyStores = append(keyStores, resolved)
+	}
+	return keyStores
+}
+
+// isManagedJavaKeyStore reports whether a keystore is regenerated from the
+// system trust store
+func isManagedJavaKeyStore(keyStore string) bool {
+	for _, dir := range managedJavaKeyStoreDirs {
+		if strings.HasPrefix(keyStore, dir) {
+			return true
+		}
+	}
+	return false
+}
+
+// writeTempCertificatePEM writes cert to a temporary PEM file for external
+// tools, returning its path and a function removing it
+func writeTempCertificatePEM(cert *x509.Certificate) (string, func(), error) {
+	dir, err := os.MkdirTemp("", "selfsign-path-trust")
+	if err != nil {
+		return "", nil, fmt.Errorf("failed to create temporary directory: %w", err)
+	}
+	cleanup := func() { os.RemoveAll(dir) }
+
+	certPath := filepath.Join(dir, trustAnchorName(cert.Subject.CommonName)+".pem")
+	if err := os.WriteFile(certPath, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw}), 0644); err != nil {
+		cleanup()
+		return "", nil, fmt.Errorf("failed to write temporary certificate: %w", err)
+	}
+	return certPath, cleanup, nil
+}
+
+// runTrustTool runs an external trust store tool, including its output in
+// the error when it fails
+func runTrustTool(command string, args ...string) ([]byte, error) {
+	output, err := exec.Command(command, args...).CombinedOutput()
+	if err != nil {
+		name := filepath.Base(command)
+		if len(args) > 0 {
+			name += " " + args[0]
+		}
+		return output, fmt.Errorf("%s failed: %w: %s", name, err, strings.TrimSpace(string(output)))
+	}
+	return output, nil
+}
+
+// caDirectoryStore is a directory of CA certificates read by the system
+// certificate tools, or the user fallback directory
+type caDirectoryStore struct {
+	dir string
+	// refresh is the command compiling the directory into the system store
+	refresh []string
+	// bundle is the compiled PEM bundle; without one, the refresh must leave
+	// an OpenSSL hash link to the certificate
+	bundle string
+	user   bool
+}
+
+func (s *caDirectoryStore) Kind() string {
+	if s.user {
+		return "user directory"
+	}
+	return "system directory"
+}
+
+func (s *caDirectoryStore) Location() string { return s.dir }
+
+func (s *caDirectoryStore) certPath(commonName string) string {
+	return filepath.Join(s.dir, trustAnchorName(commonName)+".crt")
+}
+
+// Install writes cert as PEM, which update-ca-certificates requires and
+// update-ca-trust and OpenSSL accept, refreshes the system store and checks
+// that the certificate made it in, removing it again if not
+func (s *caDirectoryStore) Install(cert *x509.Certificate) error {
+	if s.user {
+		if err := os.MkdirAll(s.dir, 0755); err != nil {
+			return fmt.Errorf("failed to create %s: %w", s.dir, err)
+		}
+	}
+	certPath := s.certPath(cert.Subject.CommonName)
+	if err := os.WriteFile(certPath, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw}), 0644); err != nil {
+		return fmt.Errorf("failed to write certificate: %w", err)
+	}
+	if s.user {
+		return nil
+	}
+
+	err := s.refreshStore()
+	if err == nil {
+		err = s.verify(cert)
+	}
+	if err != nil {
+		os.Remove(certPath)
+		s.refreshStore()
+		return err
+	}
+	return nil
+}
+
+// refreshStore runs the refresh command of the directory
+func (s *caDirectoryStore) refreshStore() error {
+	if len(s.refresh) == 0 {
+		return nil
+	}
+	_, err := runTrustTool(s.refresh[0], s.refresh[1:]...)
+	return err
+}
+
+// verify checks that the refreshed system store holds cert
+func (s *caDirectoryStore) verify(cert *x509.Certificate) error {
+	if s.bundle != "" {
+		certs, err := readCertificateFile(s.bundle)
+		if err != nil {
+			return fmt.Errorf("failed to read %s: %w", s.bundle, err)
+		}
+		for _, bundled := range certs {
+			if bundled.Equal(cert) {
+				return nil
+			}
+		}
+		return fmt.Errorf("certificate missing from %s after refreshing the store", s.bundle)
+	}
+
+	certPath := s.certPath(cert.Subject.CommonName)
+	links, _ := filepath.Glob(filepath.Join(s.dir, "*.[0-9]*"))
+	for _, link := range links {
+		if target, err := filepath.EvalSymlinks(link); err == nil && target == certPath {
+			return nil
+		}
+	}
+	return fmt.Errorf("no hash link to %s after refreshing the store", certPath)
+}
+
+// trustedBy describes how the system store was checked to trust certificates
+// installed here
+func (s *caDirectoryStore) trustedBy() string {
+	switch {
+	case s.user:
+		return "not trusted system-wide"
+	case s.bundle != "":
+		return "verified in " + s.bundle
+	}
+	return "verified by hash link"
+}
+
+func (s *caDirectoryStore) Contains(cert *x509.Certificate) (bool, error) {
+	installed, err := readCertificateFile(s.certPath(cert.Subject.CommonName))
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return false, nil
+		}
+		return false, err
+	}
+	return installed[0].Equal(cert), nil
+}
+
+func (s *caDirectoryStore) Uninstall(names []string) ([]string, error) {
+	var candidates []string
+	if len(names) == 0 {
+		candidates, _ = filepath.Glob(filepath.Join(s.dir, trustAnchorName("*")+".crt"))
+	} else {
+		for _, name := range names {
+			candidates = append(candidates, s.certPath(name))
+		}
+	}
+
+	var removed []string
+	var errs []error
+	for _, certPath := range candidates {
+		if err := os.Remove(certPath); err != nil {
+			if !os.IsNotExist(err) {
+				errs = append(errs, fmt.Errorf("failed to remove %s: %w", certPath, err))
+			}
+			continue
+		}
+		removed = append(removed, certPath)
+	}
+
+	if len(removed) > 0 && !s.user {
+		if err := s.refreshStore(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return removed, errors.Join(errs...)
+}
+
+// p11KitStore manages anchors through the p11-kit "trust" tool, used by the
+// trust policy modules of Fedora, Arch and others
+type p11KitStore struct {
+	command string
+}
+
+func (s *p11KitStore) Kind() string { return "p11-kit" }
+
+func (s *p11KitStore) Location() string { return "trust anchor" }
+
+func (s *p11KitStore) Install(cert *x509.Certificate) error {
+	certPath, cleanup, err := writeTempCertificatePEM(cert)
+	if err != nil {
+		return err
+	}
+	defer cleanup()
+
+	if _, err := runTrustTool(s.command, "anchor", "--store", certPath); err != nil {
+		return err
+	}
+	if installed, err := s.Contains(cert); err != nil || !installed {
+		return fmt.Errorf("certificate missing from the p11-kit anchors after \"trust anchor --store\": %v", err)
+	}
+	return nil
+}
+
+// anchors extracts the certificates of the p11-kit anchors; an empty bundle
+// holds no certificates
+func (s *p11KitStore) anchors() ([]*x509.Certificate, error) {
+	dir, err := os.MkdirTemp("", "selfsign-path-trust")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+
+	bundle := filepath.Join(dir, "anchors.pem")
+	if _, err := runTrustTool(s.command, "extract", "--format=pem-bundle", "--filter=ca-anchors", "--overwrite", bundle); err != nil {
+		return nil, err
+	}
+	anchors, err := readCertificateFile(bundle)
+	if err != nil {
+		return nil, nil
+	}
+	return anchors, nil
+}
+
+func (s *p11KitStore) Contains(cert *x509.Certificate) (bool, error) {
+	anchors, err := s.anchors()
+	if err != nil {
+		return false, err
+	}
+	for _, anchor := range anchors {
+		if anchor.Equal(cert) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// Uninstall removes anchors by label; without names, the anchors that are
+// certificates of this tool, told by key rather than by a subject name that
+// any other certificate may share
+func (s *p11KitStore) Uninstall(names []string) ([]string, error) {
+	if len(names) > 0 {
+		return s.uninstallLabels(names)
+	}
+
+	anchors, err := s.anchors()
+	if err != nil {
+		return nil, err
+	}
+	ownCerts := loadOwnCertificates()
+
+	var removed []string
+	var errs []error
+	for _, anchor := range anchors {
+		if !isOwnCertificate(anchor, ownCerts) {
+			continue
+		}
+		// "trust anchor --remove" takes a certificate file as well as a URI
+		certPath, cleanup, err := writeTempCertificatePEM(anchor)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		_, err = runTrustTool(s.command, "anchor", "--remove", certPath)
+		cleanup()
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		removed = append(removed, fmt.Sprintf("p11-kit anchor %s", anchor.Subject.CommonName))
+	}
+	return removed, errors.Join(errs...)
+}
+
+// uninstallLabels removes the anchors with the given labels
+func (s *p11KitStore) uninstallLabels(names []string) ([]string, error) {
+	output, err := runTrustTool(s.command, "list", "--filter=ca-anchors")
+	if err != nil {
+		return nil, err
+	}
+
+	var removed []string
+	var errs []error
+	for _, anchor := range parseP11KitList(output) {
+		match := false
+		for _, name := range names {
+			match = match || anchor.label == name
+		}
+		if !match {
+			continue
+		}
+		if _, err := runTrustTool(s.command, "anchor", "--remove", anchor.uri); err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		removed = append(removed, fmt.Sprintf("p11-kit anchor %s", anchor.label))
+	}
+	return removed, errors.Join(errs...)
+}
+
+// p11KitAnchor is an entry of "trust list" output
+type p11KitAnchor struct {
+	uri   string
+	label string
+}
+
+// parseP11KitList parses "trust list" output, a pkcs11: URI line followed by
+// indented "key: value" lines for each object
+func parseP11KitList(output []byte) []p11KitAnchor {
+	var anchors []p11KitAnchor
+	scanner := bufio.NewScanner(bytes.NewReader(output))
+	for scanner.Scan() {
+		line := scanner.Text()
+		switch trimmed := strings.TrimSpace(line); {
+		case strings.HasPrefix(line, "pkcs11:"):
+			anchors = append(anchors, p11KitAnchor{uri: trimmed})
+		case strings.HasPrefix(trimmed, "label: ") && len(anchors) > 0:
+			anchors[len(anchors)-1].label = strings.TrimPrefix(trimmed, "label: ")
+		}
+	}
+	return anchors
+}
+
+// nssStore is an NSS certificate database, as used by Chrome and Firefox,
+// managed with the NSS certutil tool
+type nssStore struct {
+	command string
+	db      string
+}
+
+func (s *nssStore) Kind() string { return "NSS database" }
+
+func (s *nssStore) Location() string { return s.db }
+
+func (s *nssStore) Install(cert *x509.Certificate) error {
+	certPath, cleanup, err := writeTempCertificatePEM(cert)
+	if err != nil {
+		return err
+	}
+	defer cleanup()
+
+	// Trusted to issue server certificates, which is what browsers check
+	_, err = runTrustTool(s.command, "-A", "-d", "sql:"+s.db, "-n", trustAnchorName(cert.Subject.CommonName), "-t", "C,,", "-i", certPath)
+	return err
+}
+
+func (s *nssStore) Contains(cert *x509.Certificate) (bool, error) {
+	output, err := exec.Command(s.command, "-L", "-d", "sql:"+s.db, "-n", trustAnchorName(cert.Subject.CommonName), "-a").Output()
+	if err != nil {
+		// certutil fails when there is no certificate with the nickname
+		return false, nil
+	}
+	for rest := output; ; {
+		var block *pem.Block
+		if block, rest = pem.Decode(rest); block == nil {
+			return false, nil
+		}
+		if bytes.Equal(block.Bytes, cert.Raw) {
+			return true, nil
+		}
+	}
+}
+
+func (s *nssStore) Uninstall(names []string) ([]string, error) {
+	nicknames := make([]string, 0, len(names))
+	for _, name := range names {
+		nicknames = append(nicknames, trustAnchorName(name))
+	}
+	if len(names) == 0 {
+		output, err := runTrustTool(s.command, "-L", "-d", "sql:"+s.db)
+		if err != nil {
+			return nil, err
+		}
+		// Lines are "nickname   trust,flags", the nickname possibly with spaces
+		for _, line := range strings.Split(string(output), "\n") {
+			fields := strings.Fields(line)
+			if len(fields) < 2 || !strings.HasPrefix(line, trustAnchorName("")) {
+				continue
+			}
+			nicknames = append(nicknames, strings.TrimSpace(strings.TrimSuffix(strings.TrimSpace(line), fields[len(fields)-1])))
+		}
+	}
+
+	var removed []string
+	var errs []error
+	for _, nickname := range nicknames {
+		// A nickname can name several certificates; delete until none is left
+		for i := 0; i < 16; i++ {
+			if _, err := runTrustTool(s.command, "-D", "-d", "sql:"+s.db, "-n", nickname); err != nil {
+				// certutil also fails once the nickname is gone, which is success
+				if exec.Command(s.command, "-L", "-d", "sql:"+s.db, "-n", nickname).Run() == nil {
+					errs = append(errs, err)
+				}
+				break
+			}
+			removed = append(removed, fmt.Sprintf("%s in NSS database %s", nickname, s.db))
+		}
+	}
+	return removed, errors.Join(errs...)
+}
+
+// javaKeyStore is a PKCS#12 Java cacerts keystore, edited in place
+type javaKeyStore struct {
+	path string
+}
+
+func (s *javaKeyStore) Kind() string { return "Java keystore" }
+
+func (s *javaKeyStore) Location() string { return s.path }
+
+// alias returns the keystore alias for a subject name; Java treats aliases
+// case-insensitively and keytool writes them in lower case
+func (s *javaKeyStore) alias(commonName string) string {
+	return strings.ToLower(trustAnchorName(commonName))
+}
+
+func (s *javaKeyStore) read() ([]javaTrustedCert, bool, error) {
+	data, err := os.ReadFile(s.path)
+	if err != nil {
+		return nil, false, err
+	}
+	return decodeJavaTrustStore(data, javaTrustStorePassword)
+}
+
+// write replaces the keystore through a temporary file in the same
+// directory, keeping its permissions
+func (s *javaKeyStore) write(entries []javaTrustedCert, withMAC bool) error {
+	data, err := encodeJavaTrustStore(entries, javaTrustStorePassword, withMAC)
+	if err != nil {
+		return err
+	}
+	info, err := os.Stat(s.path)
+	if err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(s.path), ".cacerts-*")
+	if err != nil {
+		return fmt.Errorf("failed to write %s: %w", s.path, err)
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to write %s: %w", s.path, err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("failed to write %s: %w", s.path, err)
+	}
+	if err := os.Chmod(tmp.Name(), info.Mode().Perm()); err != nil {
+		return fmt.Errorf("failed to write %s: %w", s.path, err)
+	}
+	return os.Rename(tmp.Name(), s.path)
+}
+
+func (s *javaKeyStore) Install(cert *x509.Certificate) error {
+	entries, hasMAC, err := s.read()
+	if err != nil {
+		return err
+	}
+
+	alias := s.alias(cert.Subject.CommonName)
+	kept := entries[:0]
+	for _, entry := range entries {
+		if !strings.EqualFold(entry.Alias, alias) {
+			kept = append(kept, entry)
+		}
+	}
+	return s.write(append(kept, javaTrustedCert{Alias: alias, Cert: cert}), hasMAC)
+}
+
+func (s *javaKeyStore) Contains(cert *x509.Certificate) (bool, error) {
+	entries, _, err := s.read()
+	if err != nil {
+		return false, err
+	}
+	for _, entry := range entries {
+		if entry.Cert.Equal(cert) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func (s *javaKeyStore) Uninstall(names []string) ([]string, error) {
+	entries, hasMAC, err := s.read()
+	if err != nil {
+		return nil, err
+	}
+
+	var removed []string
+	kept := entries[:0]
+	for _, entry := range entries {
+		match := len(names) == 0 && strings.HasPrefix(strings.ToLower(entry.Alias), s.alias(""))
+		for _, name := range names {
+			match = match || strings.EqualFold(entry.Alias, s.alias(name))
+		}
+		if match {
+			removed = append(removed, fmt.Sprintf("%s in Java keystore %s", entry.Alias, s.path))
+			continue
+		}
+		kept = append(kept, entry)
+	}
+
+	if len(removed) == 0 {
+		return nil, nil
+	}
+	return removed, s.write(kept, hasMAC)
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"text/tabwriter"
+)
+
+// trustCommandUsage summarizes the "trust" subcommands
+const trustCommandUsage = `usage: selfsign-path trust install [-n CERT_NAME]
+       selfsign-path trust uninstall [-n CERT_NAME]
+       selfsign-path trust status [-n CERT_NAME]`
+
+// runTrustCommand handles the "trust" subcommand
+func runTrustCommand(args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf(trustCommandUsage)
+	}
+
+	switch args[0] {
+	case "install":
+		return runTrustInstallCommand(args[1:])
+	case "uninstall":
+		return runTrustUninstallCommand(args[1:])
+	case "status":
+		return runTrustStatusCommand(args[1:])
+	}
+	return fmt.Errorf("unknown trust command %q\n%s", args[0], trustCommandUsage)
+}
+
+// runTrustInstallCommand installs a stored certificate, by default the local
+// root CA, into the system trust store
+func runTrustInstallCommand(args []string) error {
+	fs := flag.NewFlagSet("trust install", flag.ContinueOnError)
+	name := fs.String("n", localRootCAName, "Subject name of the stored certificate to install")
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	}
+
+	id, err := findStoredIdentity(*name)
+	if err != nil {
+		return err
+	}
+	result, err := installCertificateToStore(id.Cert)
+	printTrustInstallResult(os.Stdout, result)
+	if err != nil {
+		return fmt.Errorf("failed to install %s: %w", id.Name, err)
+	}
+	if !result.SystemTrusted {
+		return fmt.Errorf("%s is not trusted system-wide; run as administrator to install it into the system trust store", id.Name)
+	}
+	return nil
+}
+
+// runTrustUninstallCommand removes certificates installed by this tool from
+// the system trust store
+func runTrustUninstallCommand(args []string) error {
+	fs := flag.NewFlagSet("trust uninstall", flag.ContinueOnError)
+	name := fs.String("n", "", "Only remove the certificate with this subject name (default: all of them)")
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	}
+
+	var names []string
+	if *name != "" {
+		names = []string{*name}
+	}
+	return uninstallCertificates(os.Stdout, names)
+}
+
+// uninstallCertificates removes this tool's certificates from the trust
+// store and reports what was removed
+func uninstallCertificates(w io.Writer, names []string) error {
+	removed, err := uninstallCertificatesFromStore(names)
+	for _, entry := range removed {
+		fmt.Fprintf(w, "Removed certificate: %s\n", entry)
+	}
+	if err != nil {
+		return err
+	}
+
+	if len(removed) == 0 {
+		fmt.Fprintf(w, "No installed certificates found.\n")
+	} else {
+		fmt.Fprintf(w, "Removed %d certificate(s) from the trust store.\n", len(removed))
+	}
+	return nil
+}
+
+// trustStoreStatus describes one trust store and whether a certificate is
+// installed in it
+type trustStoreStatus struct {
+	Store    string `json:"store"`
+	Location string `json:"location"`
+	Status   string `json:"status"`
+}
+
+// runTrustStatusCommand reports, for every trust store found, whether a
+// stored certificate, by default the local root CA, is installed in it
+func runTrustStatusCommand(args []string) error {
+	fs := flag.NewFlagSet("trust status", flag.ContinueOnError)
+	name := fs.String("n", localRootCAName, "Subject name of the stored certificate to look for")
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	}
+
+	id, err := findStoredIdentity(*name)
+	if err != nil {
+		return err
+	}
+
+	statuses := trustStoreStatusesPlatform(id.Cert)
+	if len(statuses) == 0 {
+		fmt.Printf("No trust stores found.\n")
+		return nil
+	}
+
+	fmt.Printf("Trust status of %s:\n", id.Name)
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "STORE\tLOCATION\tSTATUS")
+	for _, status := range statuses {
+		fmt.Fprintf(w, "%s\t%s\t%s\n", status.Store, status.Location, status.Status)
+	}
+	return w.Flush()
+}
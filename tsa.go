@@ -0,0 +1,173 @@
+package main
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/asn1"
+	"flag"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"os"
+	"time"
+)
+
+// oidLocalTSAPolicy is the policy reported by the built-in time-stamping
+// authority when the request does not ask for one
+var oidLocalTSAPolicy = asn1.ObjectIdentifier{1, 2, 3, 4, 1}
+
+// essCertIDv2 identifies the TSA certificate by hash (RFC 5035)
+type essCertIDv2 struct {
+	CertHash []byte
+}
+
+// signingCertificateV2 is the signed attribute binding a token to its TSA certificate
+type signingCertificateV2 struct {
+	Certs []essCertIDv2
+}
+
+// timestampAuthority issues RFC 3161 time-stamp tokens signed with a local certificate
+type timestampAuthority struct {
+	cert *Certificate
+}
+
+// tsaCommandUsage summarizes the "tsa" subcommand
+const tsaCommandUsage = `usage: selfsign-path tsa serve [--listen ADDR] [-n CERT_NAME] [--key-type TYPE]`
+
+// runTSACommand handles the "tsa" subcommand
+func runTSACommand(args []string) error {
+	if len(args) == 0 || args[0] != "serve" {
+		return fmt.Errorf(tsaCommandUsage)
+	}
+
+	fs := flag.NewFlagSet("tsa serve", flag.ContinueOnError)
+	listen := fs.String("listen", "127.0.0.1:3161", "Address to listen on for time-stamp requests")
+	name := fs.String("n", "LocalSign-TSA", "Subject name of the time-stamping certificate")
+	keyType := fs.String("key-type", "rsa2048", "Key type for a new time-stamping certificate (rsa2048, rsa4096, p256, p384, ed25519)")
+	if err := parseFlags(fs, args[1:]); err != nil {
+		return err
+	}
+
+	if !isValidKeyType(*keyType) {
+		return fmt.Errorf("unsupported key type %q", *keyType)
+	}
+	cert, err := getOrCreateTimestampCertificate(os.Stdout, *name, *keyType)
+	if err != nil {
+		return fmt.Errorf("failed to obtain time-stamping certificate: %w", err)
+	}
+
+	tsa := &timestampAuthority{cert: cert}
+	fmt.Printf("Time-stamping authority %s listening on http://%s/\n", cert.Subject, *listen)
+	return http.ListenAndServe(*listen, tsa)
+}
+
+// ServeHTTP answers RFC 3161 time-stamp queries
+func (tsa *timestampAuthority) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "time-stamp requests must use POST", http.StatusMethodNotAllowed)
+		return
+	}
+
+	reqDER, err := io.ReadAll(io.LimitReader(r.Body, 64*1024))
+	if err != nil {
+		http.Error(w, "failed to read request", http.StatusBadRequest)
+		return
+	}
+
+	respDER, err := tsa.respond(reqDER, time.Now())
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Warning: time-stamp request from %s failed: %v\n", r.RemoteAddr, err)
+		http.Error(w, "failed to create time-stamp response", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", timestampReplyContentType)
+	w.Write(respDER)
+}
+
+// respond builds the DER encoded TimeStampResp for a request
+func (tsa *timestampAuthority) respond(reqDER []byte, now time.Time) ([]byte, error) {
+	var req timeStampReq
+	if _, err := asn1.Unmarshal(reqDER, &req); err != nil {
+		return rejectTimestampRequest(fmt.Sprintf("malformed request: %v", err))
+	}
+	hash, err := hashFromAlgorithmID(req.MessageImprint.HashAlgorithm)
+	if err != nil || len(req.MessageImprint.HashedMessage) != hash.Size() {
+		return rejectTimestampRequest("unsupported message imprint")
+	}
+
+	token, err := tsa.createToken(&req, now)
+	if err != nil {
+		return nil, err
+	}
+
+	return asn1.Marshal(timeStampResp{
+		Status:         pkiStatusInfo{Status: 0},
+		TimeStampToken: asn1.RawValue{FullBytes: token},
+	})
+}
+
+// createToken signs a TSTInfo for the request
+func (tsa *timestampAuthority) createToken(req *timeStampReq, now time.Time) ([]byte, error) {
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate serial number: %w", err)
+	}
+
+	policy := oidLocalTSAPolicy
+	if len(req.ReqPolicy) > 0 {
+		policy = req.ReqPolicy
+	}
+
+	info, err := asn1.Marshal(tstInfo{
+		Version:        1,
+		Policy:         policy,
+		MessageImprint: req.MessageImprint,
+		SerialNumber:   serial,
+		GenTime:        now.UTC().Truncate(time.Second),
+		Nonce:          req.Nonce,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode TSTInfo: %w", err)
+	}
+	content, err := asn1.Marshal(info)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode TSTInfo content: %w", err)
+	}
+
+	certHash := sha256.Sum256(tsa.cert.Cert.Raw)
+	signingCert, err := newCMSAttribute(oidSigningCertificateV2, signingCertificateV2{
+		Certs: []essCertIDv2{{CertHash: certHash[:]}},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	hash := cmsDigestFor(tsa.cert.Cert.PublicKey, crypto.SHA256)
+	h := hash.New()
+	h.Write(info)
+	return createSignedData(tsa.cert, cmsSignOptions{
+		Version:          3,
+		ContentType:      oidTSTInfo,
+		Content:          content,
+		MessageDigest:    h.Sum(nil),
+		Hash:             hash,
+		SignedAttributes: []cmsAttribute{signingCert},
+	})
+}
+
+// rejectTimestampRequest builds a TimeStampResp with the rejection status
+func rejectTimestampRequest(reason string) ([]byte, error) {
+	text, err := asn1.MarshalWithParams(reason, "utf8")
+	if err != nil {
+		return nil, err
+	}
+	return asn1.Marshal(timeStampResp{
+		Status: pkiStatusInfo{
+			Status:       2, // rejection
+			StatusString: []asn1.RawValue{{FullBytes: text}},
+		},
+	})
+}
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/asn1"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// Signature status values reported by getFileSignatureStatus
+const (
+	StatusValid         = "Valid"
+	StatusNotSigned     = "NotSigned"
+	StatusHashMismatch  = "HashMismatch"
+	StatusBadSignature  = "BadSignature"
+	StatusUntrustedRoot = "UntrustedRoot"
+	StatusExpired       = "Expired"
+)
+
+// Errors returned by verifySignerInfo
+var (
+	errMessageDigestMismatch = errors.New("messageDigest attribute does not match content")
+	errBadSignature          = errors.New("signature verification failed")
+)
+
+// signatureVerifyRoots overrides the trust anchors used for chain
+// verification; nil means the system trust store
+var signatureVerifyRoots *x509.CertPool
+
+// parseAttributes decodes the attributes held in a signed or unsigned attribute field
+func parseAttributes(raw asn1.RawValue) ([]cmsAttribute, error) {
+	var attrs []cmsAttribute
+	rest := raw.Bytes
+	for len(rest) > 0 {
+		var attr cmsAttribute
+		var err error
+		if rest, err = asn1.Unmarshal(rest, &attr); err != nil {
+			return nil, fmt.Errorf("failed to decode attribute: %w", err)
+		}
+		attrs = append(attrs, attr)
+	}
+	return attrs, nil
+}
+
+// findAttribute returns the first value of the attribute with the given type
+func findAttribute(attrs []cmsAttribute, attrType asn1.ObjectIdentifier) (asn1.RawValue, bool) {
+	for _, attr := range attrs {
+		if attr.Type.Equal(attrType) {
+			var value asn1.RawValue
+			if _, err := asn1.Unmarshal(attr.Values.Bytes, &value); err != nil {
+				return asn1.RawValue{}, false
+			}
+			return value, true
+		}
+	}
+	return asn1.RawValue{}, false
+}
+
+// findSignerCertificate returns the certificate matching a signer's issuer and serial number
+func findSignerCertificate(certs []*x509.Certificate, id issuerAndSerial) (*x509.Certificate, error) {
+	for _, cert := range certs {
+		if bytes.Equal(cert.RawIssuer, id.Issuer.FullBytes) && cert.SerialNumber.Cmp(id.SerialNumber) == 0 {
+			return cert, nil
+		}
+	}
+	return nil, fmt.Errorf("signer certificate not included in signature")
+}
+
+// verifySignature checks a signature over a digest made by the given public key
+func verifySignature(pub crypto.PublicKey, hash crypto.Hash, digest, signature []byte) error {
+	switch key := pub.(type) {
+	case *rsa.PublicKey:
+		if err := rsa.VerifyPKCS1v15(key, hash, digest, signature); err != nil {
+			return errBadSignature
+		}
+		return nil
+	case *ecdsa.PublicKey:
+		if !ecdsa.VerifyASN1(key, digest, signature) {
+			return errBadSignature
+		}
+		return nil
+	case ed25519.PublicKey:
+		return fmt.Errorf("Ed25519 signatures require signed attributes")
+	}
+	return fmt.Errorf("unsupported public key type %T", pub)
+}
+
+// verifySignedBytes checks a signature over data, the counterpart of signBytes
+func verifySignedBytes(pub crypto.PublicKey, hash crypto.Hash, data, signature []byte) error {
+	if key, ok := pub.(ed25519.PublicKey); ok {
+		if !ed25519.Verify(key, data, signature) {
+			return errBadSignature
+		}
+		return nil
+	}
+	h := hash.New()
+	h.Write(data)
+	return verifySignature(pub, hash, h.Sum(nil), signature)
+}
+
+// verifySignerInfo checks that the signed attributes carry contentDigest and
+// that the signer certificate's key signed them; without signed attributes
+// the signature must be over contentDigest itself
+func verifySignerInfo(si *signerInfo, signer *x509.Certificate, contentDigest []byte) error {
+	hash, err := hashFromAlgorithmID(si.DigestAlgorithm)
+	if err != nil {
+		return err
+	}
+
+	if len(si.AuthenticatedAttributes.Bytes) == 0 {
+		if err := verifySignature(signer.PublicKey, hash, contentDigest, si.EncryptedDigest); err != nil {
+			if errors.Is(err, errBadSignature) {
+				// Without attributes a changed digest and a bad signature look the same
+				return errMessageDigestMismatch
+			}
+			return err
+		}
+		return nil
+	}
+
+	attrs, err := parseAttributes(si.AuthenticatedAttributes)
+	if err != nil {
+		return err
+	}
+	digestValue, ok := findAttribute(attrs, oidMessageDigest)
+	if !ok {
+		return fmt.Errorf("signature has no messageDigest attribute")
+	}
+	if !bytes.Equal(digestValue.Bytes, contentDigest) {
+		return errMessageDigestMismatch
+	}
+
+	// The signature covers the attributes re-tagged as a universal SET OF
+	signedBytes, err := asn1.Marshal(asn1.RawValue{Class: asn1.ClassUniversal, Tag: asn1.TagSet, IsCompound: true, Bytes: si.AuthenticatedAttributes.Bytes})
+	if err != nil {
+		return fmt.Errorf("failed to encode signed attributes: %w", err)
+	}
+	return verifySignedBytes(signer.PublicKey, hash, signedBytes, si.EncryptedDigest)
+}
+
+// verifyCertificateTrust maps the chain validation result for a signer to a status
+func verifyCertificateTrust(signer *x509.Certificate, certs []*x509.Certificate, at time.Time, usage x509.ExtKeyUsage) string {
+	if at.Before(signer.NotBefore) || at.After(signer.NotAfter) {
+		return StatusExpired
+	}
+
+	intermediates := x509.NewCertPool()
+	for _, cert := range certs {
+		if cert != signer {
+			intermediates.AddCert(cert)
+		}
+	}
+
+	_, err := signer.Verify(x509.VerifyOptions{
+		Roots:         signatureVerifyRoots,
+		Intermediates: intermediates,
+		CurrentTime:   at,
+		KeyUsages:     []x509.ExtKeyUsage{usage},
+	})
+	if err == nil {
+		return StatusValid
+	}
+
+	var invalidErr x509.CertificateInvalidError
+	if errors.As(err, &invalidErr) && invalidErr.Reason == x509.Expired {
+		return StatusExpired
+	}
+	return StatusUntrustedRoot
+}
+
+// isSelfSignedCertificate reports whether a certificate is signed by its own key
+func isSelfSignedCertificate(cert *x509.Certificate) bool {
+	return bytes.Equal(cert.RawIssuer, cert.RawSubject) &&
+		cert.CheckSignature(cert.SignatureAlgorithm, cert.RawTBSCertificate, cert.Signature) == nil
+}
+
+// applySignerTrust sets the time-stamp details and final status of a signer
+// whose signature has already been verified; a trusted time-stamp lets the
+// signature outlive the signing certificate
+func applySignerTrust(status *SignatureStatus, si *signerInfo, signer *x509.Certificate, certs []*x509.Certificate) {
+	signingTime := time.Now()
+	timestamp, err := verifySignerTimestamp(si)
+	if err != nil {
+		status.Status = StatusBadSignature
+		return
+	}
+	if timestamp != nil {
+		status.TimestampCertificate = timestamp.Signer.Subject.CommonName
+		status.TimestampTime = timestamp.Time
+		if timestamp.Status == StatusValid {
+			signingTime = timestamp.Time
+		}
+	}
+
+	status.Status = verifyCertificateTrust(signer, certs, signingTime, x509.ExtKeyUsageCodeSigning)
+}